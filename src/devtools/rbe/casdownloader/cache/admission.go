@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// admissionEntrySize is a rough estimate of the memory footprint of a single
+// digest->counter entry in admissionPolicy's sketch (hex digest string,
+// map/list bookkeeping overhead).
+const admissionEntrySize = 128
+
+// defaultAdmissionMaxEntries bounds the sketch when no -cache-admission-memory
+// budget is given.
+const defaultAdmissionMaxEntries = 100_000
+
+// admissionPolicy implements a "cache after N accesses" admission policy:
+// Push only actually materializes a blob into the cache once Pull has seen
+// its digest at least threshold times within this process.
+//
+// The access counts are kept in a small bounded in-memory LRU map rather
+// than growing without bound, so a long-running shared cache doesn't leak
+// memory tracking digests it will never see again. The counts are not
+// persisted: each process (each LocalCache) starts counting from zero.
+type admissionPolicy struct {
+	threshold  int
+	maxEntries int
+
+	mu     sync.Mutex
+	counts map[string]int
+	lru    *list.List
+	elems  map[string]*list.Element
+}
+
+// newAdmissionPolicy creates an admission policy that requires threshold
+// accesses (via recordAccess) before shouldAdmit returns true. threshold <= 1
+// disables the policy (every digest is admitted immediately, matching the
+// historical behavior). memoryBytes bounds the sketch's memory footprint; if
+// <= 0, a default cap is used.
+func newAdmissionPolicy(threshold int, memoryBytes int64) *admissionPolicy {
+	maxEntries := defaultAdmissionMaxEntries
+	if memoryBytes > 0 {
+		if n := int(memoryBytes / admissionEntrySize); n > 0 {
+			maxEntries = n
+		}
+	}
+	return &admissionPolicy{
+		threshold:  threshold,
+		maxEntries: maxEntries,
+		counts:     make(map[string]int),
+		lru:        list.New(),
+		elems:      make(map[string]*list.Element),
+	}
+}
+
+// recordAccess increments digest's access counter, evicting the
+// least-recently-touched digest from the sketch if it's at capacity.
+func (a *admissionPolicy) recordAccess(digest string) {
+	if a.threshold <= 1 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if elem, ok := a.elems[digest]; ok {
+		a.lru.MoveToFront(elem)
+		a.counts[digest]++
+		return
+	}
+
+	if a.lru.Len() >= a.maxEntries {
+		oldest := a.lru.Back()
+		if oldest != nil {
+			evictDigest := oldest.Value.(string)
+			a.lru.Remove(oldest)
+			delete(a.elems, evictDigest)
+			delete(a.counts, evictDigest)
+		}
+	}
+	a.elems[digest] = a.lru.PushFront(digest)
+	a.counts[digest] = 1
+}
+
+// shouldAdmit reports whether digest has been accessed enough times to be
+// materialized into the cache.
+func (a *admissionPolicy) shouldAdmit(digest string) bool {
+	if a.threshold <= 1 {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.counts[digest] >= a.threshold
+}
@@ -0,0 +1,30 @@
+//go:build darwin
+
+package cache
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fileAtime returns the last-access time and hard link count of fi.
+func fileAtime(fi os.FileInfo) (time.Time, uint64, error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("unsupported stat_t for %s", fi.Name())
+	}
+	return time.Unix(stat.Atimespec.Sec, stat.Atimespec.Nsec), uint64(stat.Nlink), nil
+}
+
+// availableBytes returns the free space, in bytes, available to an
+// unprivileged user on the filesystem containing path. It backs Prune's
+// MinFreeBytes policy.
+func availableBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to statfs %s: %v", path, err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// lruIndexFile is the name of the on-disk LRU index, relative to cacheDir.
+const lruIndexFile = "lru-index.json"
+
+// lruEntry records the last known access time and size of a single cached
+// blob, keyed by its hex digest.
+type lruEntry struct {
+	Atime time.Time `json:"atime"`
+	Size  int64     `json:"size"`
+}
+
+// lruIndex is a small on-disk index of cached blobs' last-access times, used
+// by the background tidy goroutine to pick eviction candidates without
+// having to stat every file in the cache directory on every run.
+type lruIndex struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*lruEntry
+}
+
+func loadLRUIndex(cacheDir string) *lruIndex {
+	idx := &lruIndex{
+		path:    filepath.Join(cacheDir, lruIndexFile),
+		entries: make(map[string]*lruEntry),
+	}
+	data, err := os.ReadFile(idx.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("failed to read LRU index %s: %v", idx.path, err)
+		}
+		return idx
+	}
+	if err := json.Unmarshal(data, &idx.entries); err != nil {
+		log.Warningf("failed to parse LRU index %s: %v", idx.path, err)
+		idx.entries = make(map[string]*lruEntry)
+	}
+	return idx
+}
+
+// touch records digest as accessed at time t with the given size.
+func (idx *lruIndex) touch(digest string, size int64, t time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.entries[digest] = &lruEntry{Atime: t, Size: size}
+}
+
+// remove drops digest from the index.
+func (idx *lruIndex) remove(digest string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	delete(idx.entries, digest)
+}
+
+// get returns the entry for digest, if known.
+func (idx *lruIndex) get(digest string) (*lruEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[digest]
+	return e, ok
+}
+
+// totalSize returns the sum of all known entry sizes.
+func (idx *lruIndex) totalSize() int64 {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var total int64
+	for _, e := range idx.entries {
+		total += e.Size
+	}
+	return total
+}
+
+// sortedByAtime returns all known digests ordered from least to most
+// recently accessed.
+func (idx *lruIndex) sortedByAtime() []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	digests := make([]string, 0, len(idx.entries))
+	for digest := range idx.entries {
+		digests = append(digests, digest)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return idx.entries[digests[i]].Atime.Before(idx.entries[digests[j]].Atime)
+	})
+	return digests
+}
+
+// save persists the index to disk.
+func (idx *lruIndex) save() error {
+	idx.mu.Lock()
+	data, err := json.Marshal(idx.entries)
+	idx.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal LRU index: %v", err)
+	}
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write LRU index %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, idx.path)
+}
+
+// evictionPolicy configures the background tidy goroutine.
+type evictionPolicy struct {
+	// lowWatermark is the footprint tidy() trims down to once triggered.
+	lowWatermark int64
+	// highWatermark is the footprint that triggers tidy(). 0 disables
+	// background eviction.
+	highWatermark int64
+	// tidyInterval is how often tidy() checks the footprint.
+	tidyInterval time.Duration
+}
+
+// evictor runs a background goroutine that reclaims space from a LocalCache's
+// directory once its footprint crosses highWatermark, by deleting entries in
+// least-recently-accessed order until it's back under lowWatermark.
+type evictor struct {
+	cacheDir string
+	lockPath string
+	policy   evictionPolicy
+	index    *lruIndex
+
+	evictions int64 // atomic
+}
+
+func newEvictor(cacheDir, lockPath string, policy evictionPolicy) *evictor {
+	return &evictor{
+		cacheDir: cacheDir,
+		lockPath: lockPath,
+		policy:   policy,
+		index:    loadLRUIndex(cacheDir),
+	}
+}
+
+// touch records digest (stored at path) as freshly accessed.
+func (e *evictor) touch(digest, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	e.index.touch(digest, info.Size(), time.Now())
+}
+
+// start runs the periodic tidy loop until ctx is done. It's meant to be
+// launched in its own goroutine.
+func (e *evictor) start(ctx context.Context) {
+	if e.policy.highWatermark <= 0 {
+		return
+	}
+	interval := e.policy.tidyInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.tidy(); err != nil {
+				log.Warningf("cache tidy failed: %v", err)
+			}
+		}
+	}
+}
+
+// tidy deletes cached blobs in atime order until the cache footprint is back
+// under lowWatermark, skipping any blob still hardlinked elsewhere (link
+// count > 1). It holds a short shared flock on lockPath so it never races
+// with a concurrent Push/Pull that holds the exclusive lock.
+func (e *evictor) tidy() error {
+	if e.index.totalSize() <= e.policy.highWatermark {
+		return nil
+	}
+
+	lockFile, err := os.OpenFile(e.lockPath, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to open cache lock file %s: %v", e.lockPath, err)
+	}
+	defer lockFile.Close()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_SH); err != nil {
+		return fmt.Errorf("failed to lock local cache %s: %v", e.cacheDir, err)
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	freed := int64(0)
+	removed := 0
+	for _, digest := range e.index.sortedByAtime() {
+		if e.index.totalSize() <= e.policy.lowWatermark {
+			break
+		}
+		path := filepath.Join(e.cacheDir, digest)
+		info, err := os.Stat(path)
+		if err != nil {
+			// Already gone; drop it from the index.
+			e.index.remove(digest)
+			continue
+		}
+		if _, nlink, err := fileAtime(info); err == nil && nlink > 1 {
+			// Still hardlinked into an active download directory; skip it.
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Warningf("failed to evict cached blob %s: %v", path, err)
+			continue
+		}
+		freed += info.Size()
+		removed++
+		e.index.remove(digest)
+		atomic.AddInt64(&e.evictions, 1)
+	}
+
+	if err := e.index.save(); err != nil {
+		log.Warningf("failed to persist LRU index: %v", err)
+	}
+	log.Infof("cache tidy: removed %d entries, freed %d bytes", removed, freed)
+	return nil
+}
+
+func (e *evictor) stats() (evictions int64) {
+	return atomic.LoadInt64(&e.evictions)
+}
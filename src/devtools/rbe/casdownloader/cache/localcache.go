@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -27,6 +28,53 @@ type LocalCache struct {
 	// If true, use hardlink to push/pull items to/from cache. Otherwise, use copy.
 	// When there are too many hard links, it may fall back to copy.
 	useHardlink bool
+
+	evictor     *evictor
+	stopEvictor context.CancelFunc
+	hits        int64 // atomic
+	misses      int64 // atomic
+
+	admission *admissionPolicy
+	verifier  *verifier
+}
+
+// Opts configures a LocalCache.
+type Opts struct {
+	// CacheDir is the directory to store downloaded files.
+	CacheDir string
+	// CacheMaxSize is the max size, in bytes, lucicache itself trims to.
+	CacheMaxSize int64
+	// EnableLock enables the cache flock so multiple downloader instances can
+	// share one cache directory safely.
+	EnableLock bool
+	// UseHardlink uses hardlinks (instead of copies) to push/pull cache items.
+	UseHardlink bool
+	// LowWatermark and HighWatermark configure the background tidy goroutine:
+	// once the cache footprint exceeds HighWatermark, tidy() evicts
+	// least-recently-accessed entries until it's back under LowWatermark. A
+	// HighWatermark of 0 disables background eviction.
+	LowWatermark, HighWatermark int64
+	// TidyInterval is how often the background tidy goroutine checks the
+	// cache footprint.
+	TidyInterval time.Duration
+	// AdmissionAfter is the number of times a digest must be seen by Pull
+	// (hit or miss) before Push will actually materialize it into the cache.
+	// <= 1 means every pushed blob is admitted immediately (the historical
+	// behavior).
+	AdmissionAfter int
+	// AdmissionMemory bounds, in bytes, the memory used to track per-digest
+	// access counts for the admission policy above. If <= 0, a default cap is
+	// used.
+	AdmissionMemory int64
+	// VerifyMode controls how aggressively Pull re-hashes cached blobs
+	// before trusting them. Defaults to VerifyOff.
+	VerifyMode VerifyMode
+	// VerifySampleRate is the fraction of pulls re-hashed in VerifySampled
+	// mode.
+	VerifySampleRate float64
+	// VerifyMtimeThreshold additionally triggers verification, in
+	// VerifySampled mode, for any cached blob whose mtime is older than this.
+	VerifyMtimeThreshold time.Duration
 }
 
 type cacheLock struct {
@@ -108,6 +156,9 @@ func (c *LocalCache) pushByHardlink(ctx context.Context, all map[digest.Digest]*
 	}
 
 	for _, item := range all {
+		if !c.admitted(item) {
+			continue
+		}
 		if err := c.cacheClient.AddFileWithoutValidation(
 			ctx, lucicache.HexDigest(item.Digest.Hash), item.Path); err != nil {
 			// Fall back to copy if hardlink fails. Do not log the link error as it can be spammy.
@@ -115,6 +166,7 @@ func (c *LocalCache) pushByHardlink(ctx context.Context, all map[digest.Digest]*
 				return err
 			}
 		}
+		c.touchEvictor(item)
 	}
 	return nil
 }
@@ -129,13 +181,46 @@ func (c *LocalCache) pushByCopy(ctx context.Context, all map[digest.Digest]*clie
 	}
 
 	for _, item := range all {
+		if !c.admitted(item) {
+			continue
+		}
 		if err := c.pushItemByCopy(ctx, item); err != nil {
 			return err
 		}
+		c.touchEvictor(item)
 	}
 	return nil
 }
 
+// touchEvictor records item as freshly cached with the evictor, if one is
+// configured.
+func (c *LocalCache) touchEvictor(item *client.TreeOutput) {
+	if c.evictor == nil {
+		return
+	}
+	c.evictor.touch(string(lucicache.HexDigest(item.Digest.Hash)), item.Path)
+}
+
+// admitted reports whether item should be materialized into the cache,
+// consulting the admission policy when one is configured. If the policy
+// declines, the file is simply left where the caller already placed it and
+// no cache state is recorded for it.
+func (c *LocalCache) admitted(item *client.TreeOutput) bool {
+	if c.admission == nil {
+		return true
+	}
+	return c.admission.shouldAdmit(string(lucicache.HexDigest(item.Digest.Hash)))
+}
+
+// recordAccess notes that item's digest was seen by Pull, whether it hit or
+// missed, for the admission policy.
+func (c *LocalCache) recordAccess(item *client.TreeOutput) {
+	if c.admission == nil {
+		return
+	}
+	c.admission.recordAccess(string(lucicache.HexDigest(item.Digest.Hash)))
+}
+
 func (c *LocalCache) pushItemByCopy(ctx context.Context, item *client.TreeOutput) error {
 	file, err := os.Open(item.Path)
 	if err != nil {
@@ -197,7 +282,12 @@ func (c *LocalCache) pullByHardlink(ctx context.Context, all []*client.TreeOutpu
 
 	// Hard link items from cache to the target location if the item is in cache.
 	for _, item := range all {
+		c.recordAccess(item)
 		if c.cacheClient.Touch(lucicache.HexDigest(item.Digest.Hash)) {
+			if !c.verifyCachedItem(ctx, item) {
+				missed = append(missed, item)
+				continue
+			}
 			if err := c.cacheClient.Hardlink(lucicache.HexDigest(item.Digest.Hash), item.Path, fileMode(item)); err != nil {
 				if !errors.Is(err, syscall.EMLINK) {
 					return nil, nil, fmt.Errorf("failed to hard link from cache to %s: %v", item.Path, err)
@@ -207,9 +297,12 @@ func (c *LocalCache) pullByHardlink(ctx context.Context, all []*client.TreeOutpu
 					return nil, nil, err
 				}
 			}
+			c.touchEvictor(item)
+			atomic.AddInt64(&c.hits, 1)
 			cached = append(cached, item)
 			continue
 		}
+		atomic.AddInt64(&c.misses, 1)
 		missed = append(missed, item)
 	}
 	return cached, missed, nil
@@ -230,18 +323,63 @@ func (c *LocalCache) pullByCopy(ctx context.Context, all []*client.TreeOutput) (
 
 	// Copy items from cache to the target location if the item is in cache.
 	for _, item := range all {
+		c.recordAccess(item)
 		if c.cacheClient.Touch(lucicache.HexDigest(item.Digest.Hash)) {
+			if !c.verifyCachedItem(ctx, item) {
+				missed = append(missed, item)
+				continue
+			}
 			if err := c.copyItemFromCache(ctx, item); err != nil {
 				return nil, nil, err
 			}
+			c.touchEvictor(item)
+			atomic.AddInt64(&c.hits, 1)
 			cached = append(cached, item)
 			continue
 		}
+		atomic.AddInt64(&c.misses, 1)
 		missed = append(missed, item)
 	}
 	return cached, missed, nil
 }
 
+// verifyCachedItem re-hashes item's cached blob if the verifier decides this
+// pull should be checked, evicting it and reporting corruption if the hash
+// doesn't match. It returns false if the item should be treated as missed.
+func (c *LocalCache) verifyCachedItem(ctx context.Context, item *client.TreeOutput) bool {
+	if c.verifier == nil {
+		return true
+	}
+	hexDigest := string(lucicache.HexDigest(item.Digest.Hash))
+	if !c.verifier.shouldVerify(hexDigest) {
+		return true
+	}
+	reader, err := c.cacheClient.Read(lucicache.HexDigest(item.Digest.Hash))
+	if err != nil {
+		log.Warningf("failed to open cached blob %s for verification: %v", hexDigest, err)
+		return true
+	}
+	ok, err := c.verifier.verify(reader, hexDigest)
+	reader.Close()
+	if err != nil {
+		log.Warningf("failed to verify cached blob %s: %v", hexDigest, err)
+		return true
+	}
+	if ok {
+		return true
+	}
+
+	log.Errorf("cached blob %s failed verification, evicting and re-fetching from CAS", hexDigest)
+	c.verifier.reportCorruption()
+	if err := os.Remove(filepath.Join(c.cacheDir, hexDigest)); err != nil && !os.IsNotExist(err) {
+		log.Warningf("failed to evict corrupted blob %s: %v", hexDigest, err)
+	}
+	if c.evictor != nil {
+		c.evictor.index.remove(hexDigest)
+	}
+	return false
+}
+
 func (c *LocalCache) copyItemFromCache(ctx context.Context, item *client.TreeOutput) error {
 	reader, err := c.cacheClient.Read(lucicache.HexDigest(item.Digest.Hash))
 	if err != nil {
@@ -264,36 +402,89 @@ func (c *LocalCache) copyItemFromCache(ctx context.Context, item *client.TreeOut
 
 // Close closes and cleans up the cache.
 func (c *LocalCache) Close() error {
+	if c.stopEvictor != nil {
+		c.stopEvictor()
+	}
 	return c.closeCache()
 }
 
+// Stats reports the current state of the cache for diagnostics (e.g.
+// -dump-json).
+type Stats struct {
+	BytesUsed   int64   `json:"bytes_used"`
+	Evictions   int64   `json:"evictions"`
+	Hits        int64   `json:"hits"`
+	Misses      int64   `json:"misses"`
+	HitRate     float64 `json:"hit_rate"`
+	Corruptions int64   `json:"corruptions"`
+}
+
+// Stats returns bytes used, evictions, and the hit rate observed so far.
+func (c *LocalCache) Stats() Stats {
+	hits := atomic.LoadInt64(&c.hits)
+	misses := atomic.LoadInt64(&c.misses)
+	stats := Stats{Hits: hits, Misses: misses}
+	if total := hits + misses; total > 0 {
+		stats.HitRate = float64(hits) / float64(total)
+	}
+	if c.evictor != nil {
+		stats.BytesUsed = c.evictor.index.totalSize()
+		stats.Evictions = c.evictor.stats()
+	}
+	if c.verifier != nil {
+		stats.Corruptions = c.verifier.stats()
+	}
+	return stats
+}
+
 // NewLocalCache creates a new LocalCache instance.
-func NewLocalCache(cacheDir string, cacheMaxSize int64, enableLock bool, useHardlink bool) (*LocalCache, error) {
-	os.MkdirAll(cacheDir, 0755)
+func NewLocalCache(opts Opts) (*LocalCache, error) {
+	os.MkdirAll(opts.CacheDir, 0755)
 	cachePolicies := lucicache.Policies{
-		MaxSize: units.Size(cacheMaxSize),
+		MaxSize: units.Size(opts.CacheMaxSize),
 	}
 
 	c := &LocalCache{
 		cacheClient:   nil,
 		cachePolicies: cachePolicies,
-		cacheDir:      cacheDir,
+		cacheDir:      opts.CacheDir,
 		cacheLock:     cacheLock{},
-		useHardlink:   useHardlink,
+		useHardlink:   opts.UseHardlink,
 	}
-	if enableLock {
-		c.cacheLock.lockPath = filepath.Join(cacheDir, "state.lock")
+	if opts.EnableLock {
+		c.cacheLock.lockPath = filepath.Join(opts.CacheDir, "state.lock")
 	}
 
 	// Only initialize the cache if enableLock is false. When enableLock is true, the cache will be
 	// initialized and closed inside push/pull operation.
-	if !enableLock {
+	if !opts.EnableLock {
 		var err error
-		c.cacheClient, err = lucicache.New(cachePolicies, cacheDir, crypto.SHA256)
+		c.cacheClient, err = lucicache.New(cachePolicies, opts.CacheDir, crypto.SHA256)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize local cache: %v", err)
 		}
 	}
 
+	lockPath := c.cacheLock.lockPath
+	if lockPath == "" {
+		lockPath = filepath.Join(opts.CacheDir, "state.lock")
+	}
+	c.evictor = newEvictor(opts.CacheDir, lockPath, evictionPolicy{
+		lowWatermark:  opts.LowWatermark,
+		highWatermark: opts.HighWatermark,
+		tidyInterval:  opts.TidyInterval,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopEvictor = cancel
+	go c.evictor.start(ctx)
+
+	c.admission = newAdmissionPolicy(opts.AdmissionAfter, opts.AdmissionMemory)
+
+	verifyMode := opts.VerifyMode
+	if verifyMode == "" {
+		verifyMode = VerifyOff
+	}
+	c.verifier = newVerifier(verifyMode, opts.VerifySampleRate, opts.VerifyMtimeThreshold, opts.CacheDir)
+
 	return c, nil
 }
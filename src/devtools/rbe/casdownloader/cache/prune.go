@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// PruneOpts configures a Prune run.
+type PruneOpts struct {
+	// MaxAge removes entries last accessed longer than this ago. 0 disables
+	// this check.
+	MaxAge time.Duration
+	// MaxSize trims the cache to at most this footprint, in atime order
+	// (oldest first), once MaxAge-based removal is done. 0 disables this
+	// check.
+	MaxSize int64
+	// KeepReferencedSince protects any entry accessed more recently than this
+	// ago from both of the checks above. 0 means no extra protection.
+	KeepReferencedSince time.Duration
+	// MinFreeBytes additionally trims the cache, in atime order, until at
+	// least this many bytes are free on the filesystem backing the cache
+	// directory. Unlike MaxSize (a cap on the cache's own footprint), this
+	// reacts to actual disk free space, so it still helps when something
+	// else on the same filesystem is eating into it. 0 disables this check.
+	// Not supported on Windows (see availableBytes); it's a no-op there.
+	MinFreeBytes int64
+}
+
+// PruneReport summarizes a completed Prune run.
+type PruneReport struct {
+	BytesFreed     int64 `json:"bytes_freed"`
+	EntriesRemoved int   `json:"entries_removed"`
+}
+
+// Prune runs an out-of-band garbage collection pass over the cache
+// directory, independent of any Push/Pull traffic: it removes entries older
+// than opts.MaxAge and/or trims to opts.MaxSize in atime order, skipping
+// anything protected by opts.KeepReferencedSince or still hardlinked
+// elsewhere (nlink > 1, i.e. still in use by an in-flight download).
+//
+// Prune takes an exclusive flock on the same cache lock file Push/Pull use,
+// so it never runs concurrently with (and never interrupts) an in-flight
+// hardlink; it simply waits its turn.
+func (c *LocalCache) Prune(ctx context.Context, opts PruneOpts) (PruneReport, error) {
+	lockPath := c.cacheLock.lockPath
+	if lockPath == "" {
+		lockPath = filepath.Join(c.cacheDir, "state.lock")
+	}
+	lockFile, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return PruneReport{}, fmt.Errorf("failed to open cache lock file %s: %v", lockPath, err)
+	}
+	defer lockFile.Close()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return PruneReport{}, fmt.Errorf("failed to lock local cache %s: %v", c.cacheDir, err)
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	index := c.evictor.index
+	now := time.Now()
+	protected := func(e *lruEntry) bool {
+		return opts.KeepReferencedSince > 0 && now.Sub(e.Atime) < opts.KeepReferencedSince
+	}
+
+	var report PruneReport
+	remove := func(digest string) {
+		path := filepath.Join(c.cacheDir, digest)
+		info, err := os.Stat(path)
+		if err != nil {
+			index.remove(digest)
+			return
+		}
+		if _, nlink, err := fileAtime(info); err == nil && nlink > 1 {
+			return // still hardlinked into an active download directory.
+		}
+		if err := os.Remove(path); err != nil {
+			log.Warningf("prune: failed to remove %s: %v", path, err)
+			return
+		}
+		report.BytesFreed += info.Size()
+		report.EntriesRemoved++
+		index.remove(digest)
+	}
+
+	if opts.MaxAge > 0 {
+		cutoff := now.Add(-opts.MaxAge)
+		for _, digest := range index.sortedByAtime() {
+			e, ok := index.get(digest)
+			if !ok {
+				continue
+			}
+			if e.Atime.After(cutoff) {
+				break // sortedByAtime is oldest-first: nothing older remains.
+			}
+			if protected(e) {
+				continue
+			}
+			remove(digest)
+		}
+	}
+
+	if opts.MaxSize > 0 {
+		for _, digest := range index.sortedByAtime() {
+			if index.totalSize() <= opts.MaxSize {
+				break
+			}
+			e, ok := index.get(digest)
+			if !ok || protected(e) {
+				continue
+			}
+			remove(digest)
+		}
+	}
+
+	if opts.MinFreeBytes > 0 {
+		for _, digest := range index.sortedByAtime() {
+			free, err := availableBytes(c.cacheDir)
+			if err != nil {
+				log.Warningf("prune: failed to check free disk space, skipping -min-free-bytes check: %v", err)
+				break
+			}
+			if free >= uint64(opts.MinFreeBytes) {
+				break
+			}
+			e, ok := index.get(digest)
+			if !ok || protected(e) {
+				continue
+			}
+			remove(digest)
+		}
+	}
+
+	if err := index.save(); err != nil {
+		log.Warningf("prune: failed to persist LRU index: %v", err)
+	}
+	log.Infof("prune: removed %d entries, freed %d bytes", report.EntriesRemoved, report.BytesFreed)
+	return report, nil
+}
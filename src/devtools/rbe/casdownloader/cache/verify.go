@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// VerifyMode controls how aggressively Pull re-hashes cached blobs before
+// trusting them.
+type VerifyMode string
+
+const (
+	// VerifyOff never re-verifies cached blobs (the historical behavior).
+	VerifyOff VerifyMode = "off"
+	// VerifySampled re-verifies a random sample of pulls, plus any pull of a
+	// blob whose mtime is older than the configured threshold.
+	VerifySampled VerifyMode = "sampled"
+	// VerifyAlways re-verifies every pull.
+	VerifyAlways VerifyMode = "always"
+)
+
+// ParseVerifyMode parses a -cache-verify flag value.
+func ParseVerifyMode(s string) (VerifyMode, error) {
+	switch VerifyMode(s) {
+	case VerifyOff, VerifySampled, VerifyAlways:
+		return VerifyMode(s), nil
+	default:
+		return "", fmt.Errorf("invalid cache verify mode %q, want one of off|sampled|always", s)
+	}
+}
+
+// verifier re-hashes cached blobs before they're trusted, evicting and
+// reporting corruption it finds so the caller can re-fetch from CAS.
+type verifier struct {
+	mode           VerifyMode
+	sampleRate     float64
+	mtimeThreshold time.Duration
+	cacheDir       string
+
+	corruptions int64 // atomic
+}
+
+func newVerifier(mode VerifyMode, sampleRate float64, mtimeThreshold time.Duration, cacheDir string) *verifier {
+	return &verifier{
+		mode:           mode,
+		sampleRate:     sampleRate,
+		mtimeThreshold: mtimeThreshold,
+		cacheDir:       cacheDir,
+	}
+}
+
+// shouldVerify decides whether digest's cached blob should be re-hashed
+// before this pull trusts it.
+func (v *verifier) shouldVerify(digest string) bool {
+	switch v.mode {
+	case VerifyAlways:
+		return true
+	case VerifySampled:
+		if rand.Float64() < v.sampleRate {
+			return true
+		}
+		if v.mtimeThreshold <= 0 {
+			return false
+		}
+		info, err := os.Stat(filepath.Join(v.cacheDir, digest))
+		if err != nil {
+			return false
+		}
+		return time.Since(info.ModTime()) > v.mtimeThreshold
+	default:
+		return false
+	}
+}
+
+// verify streams r through a SHA-256 hasher and reports whether the result
+// matches digest (the hex-encoded blob digest it's supposed to be).
+func (v *verifier) verify(r io.Reader, digest string) (bool, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return false, fmt.Errorf("failed to hash cached blob %s: %v", digest, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)) == digest, nil
+}
+
+// reportCorruption records that digest's cached blob failed verification.
+func (v *verifier) reportCorruption() {
+	atomic.AddInt64(&v.corruptions, 1)
+}
+
+// stats returns the number of corruptions found (and repaired, by eviction)
+// so far.
+func (v *verifier) stats() int64 {
+	return atomic.LoadInt64(&v.corruptions)
+}
@@ -0,0 +1,155 @@
+package download
+
+import (
+	"sort"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
+)
+
+// defaultMaxBatchBytes bounds how much data a single coalesced CAS batch
+// fetch is allowed to request when DownloadJob.MaxBatchBytes is unset, so
+// that merging thousands of small chunks doesn't produce one unbounded RPC.
+const defaultMaxBatchBytes = 4 * 1024 * 1024
+
+// region is a half-open byte range [start, end) within a single
+// reconstructed source file.
+type region struct {
+	start, end int64
+}
+
+// regionSet is a sorted set of disjoint, non-adjacent byte regions. add
+// merges any existing region that overlaps or touches the new one in O(n),
+// dropping the redundant entry, so the set stays small even as regions are
+// added one chunk at a time in arbitrary order.
+type regionSet struct {
+	regions []region
+}
+
+func (s *regionSet) add(r region) {
+	out := make([]region, 0, len(s.regions)+1)
+	inserted := false
+	for _, existing := range s.regions {
+		switch {
+		case existing.end < r.start:
+			// existing lies entirely before r, with a gap: keep it.
+			out = append(out, existing)
+		case existing.start > r.end:
+			// existing lies entirely after r, with a gap: place r first.
+			if !inserted {
+				out = append(out, r)
+				inserted = true
+			}
+			out = append(out, existing)
+		default:
+			// existing overlaps or is adjacent to r: fold it into r and keep
+			// scanning, since the widened r may now reach further regions too.
+			if existing.start < r.start {
+				r.start = existing.start
+			}
+			if existing.end > r.end {
+				r.end = existing.end
+			}
+		}
+	}
+	if !inserted {
+		out = append(out, r)
+	}
+	s.regions = out
+}
+
+// chunkRef is a single FastCDC chunk's expected output location together
+// with the byte offset it occupies in the source file it was cut from.
+type chunkRef struct {
+	output *client.TreeOutput
+	offset int64
+}
+
+// coalesceChunks groups offset-ordered chunks of one source file into
+// contiguous regions, then splits each region at maxBatchBytes boundaries so
+// that no single batch exceeds the cap. It returns the chunks that belong to
+// each resulting batch, in offset order.
+func coalesceChunks(chunks []chunkRef, maxBatchBytes int64) [][]chunkRef {
+	if len(chunks) == 0 {
+		return nil
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].offset < chunks[j].offset })
+
+	var set regionSet
+	for _, c := range chunks {
+		set.add(region{start: c.offset, end: c.offset + c.output.Digest.Size})
+	}
+
+	byRegion := make([][]chunkRef, len(set.regions))
+	for _, c := range chunks {
+		for i, r := range set.regions {
+			if c.offset >= r.start && c.offset < r.end {
+				byRegion[i] = append(byRegion[i], c)
+				break
+			}
+		}
+	}
+
+	var batches [][]chunkRef
+	for _, group := range byRegion {
+		batches = append(batches, splitByMaxBytes(group, maxBatchBytes)...)
+	}
+	return batches
+}
+
+// splitByMaxBytes splits an offset-ordered run of chunks into consecutive
+// batches whose total digest size stays within maxBatchBytes. A single chunk
+// larger than the cap still gets a batch of its own.
+func splitByMaxBytes(chunks []chunkRef, maxBatchBytes int64) [][]chunkRef {
+	if maxBatchBytes <= 0 {
+		maxBatchBytes = defaultMaxBatchBytes
+	}
+	var batches [][]chunkRef
+	var cur []chunkRef
+	var curSize int64
+	for _, c := range chunks {
+		if len(cur) > 0 && curSize+c.output.Digest.Size > maxBatchBytes {
+			batches = append(batches, cur)
+			cur = nil
+			curSize = 0
+		}
+		cur = append(cur, c)
+		curSize += c.output.Digest.Size
+	}
+	if len(cur) > 0 {
+		batches = append(batches, cur)
+	}
+	return batches
+}
+
+// splitChunkOutputs separates toDownload into chunk files that can be
+// grouped by chunksIndex (returned as per-batch chunkRef groups, ready for
+// coalesced fetching) and everything else (returned as rest, unchanged).
+func splitChunkOutputs(toDownload map[digest.Digest]*client.TreeOutput, chunksIndex []chunkerutil.ChunksIndex, maxBatchBytes int64) (batches [][]chunkRef, rest map[digest.Digest]*client.TreeOutput) {
+	byHash := make(map[string]*client.TreeOutput, len(toDownload))
+	for _, out := range toDownload {
+		byHash[out.Digest.Hash] = out
+	}
+	rest = make(map[digest.Digest]*client.TreeOutput, len(toDownload))
+
+	for _, file := range chunksIndex {
+		var chunks []chunkRef
+		for _, ci := range file.Chunks {
+			out, ok := byHash[ci.SHA256]
+			if !ok {
+				continue // already cached, or not part of this download.
+			}
+			chunks = append(chunks, chunkRef{output: out, offset: ci.Offset})
+			delete(byHash, ci.SHA256) // a chunk can be shared by several files.
+		}
+		batches = append(batches, coalesceChunks(chunks, maxBatchBytes)...)
+	}
+
+	// Anything left in byHash didn't map to an index entry; download it the
+	// ordinary way rather than silently dropping it.
+	for _, out := range byHash {
+		rest[out.Digest] = out
+	}
+	return batches, rest
+}
@@ -34,23 +34,68 @@ type DownloadJob struct {
 	// Filters applied to files to download
 	IncludeFilters []string
 	ExcludeFilters []string
-	downloadStats  *downloadStats
+	// FilterSyntax selects how IncludeFilters/ExcludeFilters are interpreted.
+	// The zero value is FilterSyntaxRegex.
+	FilterSyntax  FilterSyntax
+	downloadStats *downloadStats
 	KeepChunks     bool
 	ChunksOnly     bool
+	// MaxBatchBytes bounds the size of a single coalesced CAS batch fetch when
+	// restoring chunked artifacts (see downloadCoalescedChunks). 0 uses
+	// defaultMaxBatchBytes.
+	MaxBatchBytes int64
+	// SmallFileThreshold is the maximum digest size, in bytes, at which a
+	// missing file is fetched through a single batched BatchDownloadBlobs
+	// call instead of client.DownloadFiles's per-file streaming path (see
+	// downloadPartitioned). <= 0 uses defaultSmallFileThreshold.
+	SmallFileThreshold int64
+	// Resume skips re-downloading any file already present in Dir whose
+	// content hash-verifies against its expected digest, persisting verified
+	// digests to resumeStateFileName so a later run doesn't re-hash them.
+	// Takes priority over SkipExisting.
+	Resume bool
+	// SkipExisting skips re-downloading any file already present in Dir
+	// whose size matches its expected digest, trusting it without hashing.
+	// Ignored if Resume is set.
+	SkipExisting bool
+	// Lazy mounts Dir as a read-only FUSE view of the tree instead of
+	// downloading it, fetching each file's content on first read (see
+	// doLazyDownload). DoDownload blocks until the mount is torn down.
+	Lazy bool
+	// MountTimeout bounds how long Lazy waits for the initial mount (reading
+	// the directory tree and building the FUSE inode structure) before
+	// giving up. <= 0 uses defaultMountTimeout.
+	MountTimeout time.Duration
+	// Progress, if set, receives structured per-file/per-batch events as the
+	// download proceeds (see ProgressReporter). Checking it is cheap when
+	// nil (see DownloadJob.progress).
+	Progress ProgressReporter
 }
 
 type downloadStats struct {
-	SizeCold           int64  `json:"size_cold"`
-	SizeHot            int64  `json:"size_hot"`
-	CountCold          int    `json:"count_cold"`
-	CountHot           int    `json:"count_hot"`
-	E2eTimeMs          int64  `json:"e2e_time_ms"`
-	DirRetrieveTimeMs  int64  `json:"dir_retrieve_time_ms"`
-	DirPrepareTimeMs   int64  `json:"dir_prepare_time_ms"`
-	FileDownloadTimeMs int64  `json:"file_download_time_ms"`
-	ChunkRestoreTimeMs int64  `json:"chunk_restore_time_ms"`
-	DownloadError      string `json:"download_error"`
-	Notes              string `json:"notes"`
+	SizeCold           int64        `json:"size_cold"`
+	SizeHot            int64        `json:"size_hot"`
+	CountCold          int          `json:"count_cold"`
+	CountHot           int          `json:"count_hot"`
+	E2eTimeMs          int64        `json:"e2e_time_ms"`
+	DirRetrieveTimeMs  int64        `json:"dir_retrieve_time_ms"`
+	DirPrepareTimeMs   int64        `json:"dir_prepare_time_ms"`
+	FileDownloadTimeMs int64        `json:"file_download_time_ms"`
+	ChunkRestoreTimeMs int64        `json:"chunk_restore_time_ms"`
+	DownloadError      string       `json:"download_error"`
+	Notes              string       `json:"notes"`
+	CacheStats         *cache.Stats `json:"cache_stats,omitempty"`
+	// CountBatch, SizeBatch, and BatchTimeMs cover the files fetched through
+	// downloadBatchedSmallFiles, a subset of CountCold/SizeCold.
+	CountBatch  int   `json:"count_batch"`
+	SizeBatch   int64 `json:"size_batch"`
+	BatchTimeMs int64 `json:"batch_time_ms"`
+}
+
+// cacheStatser is implemented by cache.Cache implementations that can report
+// usage stats (currently just cache.LocalCache).
+type cacheStatser interface {
+	Stats() cache.Stats
 }
 
 // prepareSymLinksAndDirs creates directories and symbolic links. It is executed before checking
@@ -119,7 +164,7 @@ func copyFile(dstPath string, srcPath string, mode os.FileMode) error {
 	return err
 }
 
-func copyFiles(ctx context.Context, dsts []*client.TreeOutput, srcs map[digest.Digest]*client.TreeOutput) error {
+func (d *DownloadJob) copyFiles(ctx context.Context, dsts []*client.TreeOutput, srcs map[digest.Digest]*client.TreeOutput) error {
 	eg, _ := errgroup.WithContext(ctx)
 
 	// limit the number of concurrent I/O operations.
@@ -129,8 +174,10 @@ func copyFiles(ctx context.Context, dsts []*client.TreeOutput, srcs map[digest.D
 		dst := dst
 		src := srcs[dst.Digest]
 		ch <- struct{}{}
+		d.progress().OnFileStart(dst.Path, dst.Digest.Size)
 		eg.Go(func() (err error) {
 			defer func() { <-ch }()
+			defer func() { d.progress().OnFileDone(dst.Path, dst.Digest.Size, err) }()
 			if fileMode(dst) == fileMode(src) {
 				// Create a hard link if file mode matches.
 				if err := os.Link(src.Path, dst.Path); err == nil {
@@ -193,14 +240,14 @@ func (d *DownloadJob) filterFiles(fullSet map[string]*client.TreeOutput) (map[st
 	excludePatterns := []*regexp.Regexp{}
 
 	for _, filter := range d.IncludeFilters {
-		p, err := regexp.Compile(filter)
+		p, err := compileFilter(d.FilterSyntax, filter)
 		if err != nil {
 			return nil, fmt.Errorf("fail to compile filter %s: %v", filter, err)
 		}
 		includePatterns = append(includePatterns, p)
 	}
 	for _, filter := range d.ExcludeFilters {
-		p, err := regexp.Compile(filter)
+		p, err := compileFilter(d.FilterSyntax, filter)
 		if err != nil {
 			return nil, fmt.Errorf("fail to compile filter %s: %v", filter, err)
 		}
@@ -274,7 +321,11 @@ func removeLeftOverFiles(files []*client.TreeOutput) {
 // downloadFilesWithAbsolutePath takes a map of digests to TreeOutput with absolute paths,
 // converts these paths to be relative to d.Dir, and then calls d.Client.DownloadFiles.
 func (d *DownloadJob) downloadFilesWithAbsolutePath(ctx context.Context, toDownload map[digest.Digest]*client.TreeOutput) error {
+	if len(toDownload) == 0 {
+		return nil
+	}
 	toDownloadRelative := make(map[digest.Digest]*client.TreeOutput, len(toDownload))
+	var totalBytes int64
 	for dg, output := range toDownload {
 		// Convert absolute output.Path to be relative to d.Dir
 		relPath, err := filepath.Rel(d.Dir, output.Path)
@@ -285,11 +336,18 @@ func (d *DownloadJob) downloadFilesWithAbsolutePath(ctx context.Context, toDownl
 		relOutput := *output // Shallow copy
 		relOutput.Path = relPath
 		toDownloadRelative[dg] = &relOutput
+		totalBytes += output.Digest.Size
+		d.progress().OnFileStart(output.Path, output.Digest.Size)
 	}
 
 	// Call d.Client.DownloadFiles with d.Dir as destDir and relative paths.
 	// We ignore the returned map as it's not used by the callers.
+	start := time.Now()
 	_, err := d.Client.DownloadFiles(ctx, d.Dir, toDownloadRelative)
+	for _, output := range toDownload {
+		d.progress().OnFileDone(output.Path, output.Digest.Size, err)
+	}
+	d.progress().OnBatchDone(len(toDownload), totalBytes, time.Since(start))
 	return err
 }
 
@@ -299,7 +357,7 @@ func (d *DownloadJob) downloadWithoutLocalCache(ctx context.Context, outputs []*
 		toDownload[output.Digest] = output
 	}
 	start := time.Now()
-	if err := d.downloadFilesWithAbsolutePath(ctx, toDownload); err != nil {
+	if err := d.downloadFiles(ctx, toDownload); err != nil {
 		removeLeftOverFiles(outputs)
 		return fmt.Errorf("failed to download files: %v", err)
 	}
@@ -308,6 +366,101 @@ func (d *DownloadJob) downloadWithoutLocalCache(ctx context.Context, outputs []*
 	return nil
 }
 
+// downloadFiles downloads toDownload from CAS into d.Dir. When toDownload is
+// (or includes) part of a chunked artifact, the chunk files it contains are
+// additionally coalesced by source-file offset, so that runs of chunks that
+// are contiguous in the reconstructed file are fetched with a single batched
+// CAS read instead of one RPC per chunk; everything else downloads as usual.
+func (d *DownloadJob) downloadFiles(ctx context.Context, toDownload map[digest.Digest]*client.TreeOutput) error {
+	indexOutput, rest := extractChunksIndexOutput(d.Dir, toDownload)
+	if indexOutput != nil {
+		// The index file determines chunk offsets, so it must land on disk
+		// before the rest of the chunk files can be grouped.
+		if err := d.downloadFilesWithAbsolutePath(ctx, map[digest.Digest]*client.TreeOutput{indexOutput.Digest: indexOutput}); err != nil {
+			return err
+		}
+		toDownload = rest
+	}
+
+	chunksIndex, err := chunkerutil.LoadChunksIndex(d.Dir)
+	if err != nil {
+		// Not a chunked artifact, or the index is missing/corrupt: nothing to
+		// coalesce, download everything the ordinary way.
+		return d.downloadPartitioned(ctx, toDownload)
+	}
+
+	maxBatchBytes := d.MaxBatchBytes
+	if maxBatchBytes <= 0 {
+		maxBatchBytes = defaultMaxBatchBytes
+	}
+	batches, rest := splitChunkOutputs(toDownload, chunksIndex, maxBatchBytes)
+	if err := d.downloadPartitioned(ctx, rest); err != nil {
+		return err
+	}
+	if len(batches) == 0 {
+		return nil
+	}
+	return d.downloadCoalescedChunks(ctx, batches)
+}
+
+// extractChunksIndexOutput finds the chunks index file among toDownload, if
+// present, and returns it along with toDownload minus that entry.
+func extractChunksIndexOutput(dir string, toDownload map[digest.Digest]*client.TreeOutput) (*client.TreeOutput, map[digest.Digest]*client.TreeOutput) {
+	primary := filepath.Join(dir, chunkerutil.ChunksDirName, chunkerutil.ChunksIndexFileName)
+	secondary := filepath.Join(dir, chunkerutil.ChunksIndexFileName)
+
+	rest := make(map[digest.Digest]*client.TreeOutput, len(toDownload))
+	var indexOutput *client.TreeOutput
+	for dg, out := range toDownload {
+		if out.Path == primary || out.Path == secondary {
+			indexOutput = out
+			continue
+		}
+		rest[dg] = out
+	}
+	return indexOutput, rest
+}
+
+// downloadCoalescedChunks fetches each merged batch of chunk files with a
+// single BatchDownloadBlobs call and writes each returned blob straight to
+// its chunk file. Pushing the fetched files to the local cache, if any, is
+// left to the caller, same as for files downloaded individually.
+func (d *DownloadJob) downloadCoalescedChunks(ctx context.Context, batches [][]chunkRef) error {
+	var fetched int
+	for _, batch := range batches {
+		start := time.Now()
+		digests := make([]digest.Digest, 0, len(batch))
+		for _, c := range batch {
+			digests = append(digests, c.output.Digest)
+			d.progress().OnFileStart(c.output.Path, c.output.Digest.Size)
+		}
+		blobs, err := d.Client.BatchDownloadBlobs(ctx, digests)
+		if err != nil {
+			return fmt.Errorf("failed to batch-download %d coalesced chunks: %v", len(digests), err)
+		}
+		var batchBytes int64
+		for _, c := range batch {
+			data, ok := blobs[c.output.Digest]
+			if !ok {
+				err := fmt.Errorf("chunk %s missing from coalesced batch response", c.output.Digest)
+				d.progress().OnFileDone(c.output.Path, c.output.Digest.Size, err)
+				return err
+			}
+			if err := os.WriteFile(c.output.Path, data, fileMode(c.output)); err != nil {
+				err = fmt.Errorf("failed to write chunk file %s: %v", c.output.Path, err)
+				d.progress().OnFileDone(c.output.Path, c.output.Digest.Size, err)
+				return err
+			}
+			d.progress().OnFileDone(c.output.Path, c.output.Digest.Size, nil)
+			batchBytes += int64(len(data))
+			fetched++
+		}
+		d.progress().OnBatchDone(len(batch), batchBytes, time.Since(start))
+	}
+	log.Infof("fetched %d chunk files in %d coalesced batches", fetched, len(batches))
+	return nil
+}
+
 func (d *DownloadJob) downloadWithLocalCache(ctx context.Context, cache cache.Cache, outputs []*client.TreeOutput) error {
 	start := time.Now()
 	cached, missed, err := cache.Pull(ctx, outputs)
@@ -330,7 +483,7 @@ func (d *DownloadJob) downloadWithLocalCache(ctx context.Context, cache cache.Ca
 	log.Infof("start downloading %d files, estimated size %v", len(toDownload), units.Size(sumSize))
 
 	start = time.Now()
-	if err := d.downloadFilesWithAbsolutePath(ctx, toDownload); err != nil {
+	if err := d.downloadFiles(ctx, toDownload); err != nil {
 		removeLeftOverFiles(outputs)
 		return fmt.Errorf("failed to download files: %v", err)
 	}
@@ -347,7 +500,7 @@ func (d *DownloadJob) downloadWithLocalCache(ctx context.Context, cache cache.Ca
 	if len(dups) > 0 {
 		// Copy duplicates files to the target location
 		start = time.Now()
-		if err := copyFiles(ctx, dups, toDownload); err != nil {
+		if err := d.copyFiles(ctx, dups, toDownload); err != nil {
 			removeLeftOverFiles(outputs)
 			return err
 		}
@@ -371,15 +524,24 @@ func (d *DownloadJob) downloadWithLocalCache(ctx context.Context, cache cache.Ca
 //   - Copy duplicates files to target locations
 //   - Dump downloadStats
 func (d *DownloadJob) DoDownload(ctx context.Context) error {
+	if d.Lazy {
+		return d.doLazyDownload(ctx)
+	}
+
 	d.downloadStats = &downloadStats{}
 	start := time.Now()
 	err := d.doDownloadInternal(ctx)
 	d.downloadStats.E2eTimeMs = time.Since(start).Milliseconds()
 	if err != nil {
 		d.downloadStats.DownloadError = err.Error()
+		d.progress().OnError(err)
 	}
 
 	if d.DumpJSON != "" {
+		if statser, ok := d.Cache.(cacheStatser); ok {
+			stats := statser.Stats()
+			d.downloadStats.CacheStats = &stats
+		}
 		if dumpErr := dumpStats(d.DumpJSON, d.downloadStats); dumpErr != nil {
 			log.Errorf("failed to dump stats to file: %v", dumpErr)
 		}
@@ -445,6 +607,14 @@ func (d *DownloadJob) doDownloadInternal(ctx context.Context) error {
 	log.Infof("finished preparing directories, took %s", dirPrepareTime)
 	d.downloadStats.DirPrepareTimeMs = dirPrepareTime.Milliseconds()
 
+	outputs = d.filterAlreadyPresent(outputs)
+
+	var planBytes int64
+	for _, output := range outputs {
+		planBytes += output.Digest.Size
+	}
+	d.progress().OnPlan(len(outputs), planBytes)
+
 	start = time.Now()
 	if d.Cache == nil {
 		if err := d.downloadWithoutLocalCache(ctx, outputs); err != nil {
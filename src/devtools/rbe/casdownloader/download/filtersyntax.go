@@ -0,0 +1,68 @@
+package download
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FilterSyntax selects how DownloadJob.IncludeFilters/ExcludeFilters patterns
+// are interpreted by filterFiles.
+type FilterSyntax string
+
+const (
+	// FilterSyntaxRegex interprets filters as regular expressions (the
+	// historical behavior).
+	FilterSyntaxRegex FilterSyntax = "regex"
+	// FilterSyntaxGlob interprets filters as doublestar-style globs ("*"
+	// matches within a path segment, "**" matches zero or more segments, "?"
+	// matches a single character).
+	FilterSyntaxGlob FilterSyntax = "glob"
+)
+
+// ParseFilterSyntax parses a -filter-syntax flag value.
+func ParseFilterSyntax(s string) (FilterSyntax, error) {
+	switch FilterSyntax(s) {
+	case FilterSyntaxRegex, FilterSyntaxGlob:
+		return FilterSyntax(s), nil
+	default:
+		return "", fmt.Errorf("invalid filter syntax %q, want one of regex|glob", s)
+	}
+}
+
+// compileFilter compiles a single IncludeFilters/ExcludeFilters pattern
+// according to syntax. An empty syntax defaults to FilterSyntaxRegex.
+func compileFilter(syntax FilterSyntax, pattern string) (*regexp.Regexp, error) {
+	if syntax == FilterSyntaxGlob {
+		return globToRegexp(pattern)
+	}
+	return regexp.Compile(pattern)
+}
+
+// globToRegexp compiles a doublestar-style glob pattern into a regexp
+// anchored to the whole relative path filterFiles matches against.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteByte('^')
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString(`(?:.*/)?`)
+			i += 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(`.*`)
+			i += 2
+		case pattern[i] == '*':
+			b.WriteString(`[^/]*`)
+			i++
+		case pattern[i] == '?':
+			b.WriteString(`[^/]`)
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			i++
+		}
+	}
+	b.WriteByte('$')
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,28 @@
+package download
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/device-infra/src/devtools/rbe/casdownloader/cache"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore/health"
+)
+
+// HealthChecker returns a health.Checker reporting whether d.Cache (if it's
+// a *cache.LocalCache) has ever observed a corrupt cache entry (see
+// cache.Stats.Corruptions), for a long-running process (e.g. a build
+// coordinator issuing many DoDownload calls) to register alongside its own
+// checks. It's a no-op check, always healthy, if d.Cache is nil or isn't a
+// *cache.LocalCache.
+func (d *DownloadJob) HealthChecker() health.Checker {
+	lc, ok := d.Cache.(*cache.LocalCache)
+	if !ok {
+		return health.CheckerFunc(func(ctx context.Context) error { return nil })
+	}
+	return health.CheckerFunc(func(ctx context.Context) error {
+		if n := lc.Stats().Corruptions; n > 0 {
+			return fmt.Errorf("local cache has observed %d corrupt entries", n)
+		}
+		return nil
+	})
+}
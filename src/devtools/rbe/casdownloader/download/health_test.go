@@ -0,0 +1,80 @@
+package download
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/google/device-infra/src/devtools/rbe/casdownloader/cache"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore/health"
+)
+
+// TestHealthChecker_CorruptedCacheEntry pushes a blob into a real
+// *cache.LocalCache, corrupts it on disk, and pulls it back with
+// verification forced on, so Pull's own corruption bookkeeping (not a
+// fake) is what HealthChecker observes.
+func TestHealthChecker_CorruptedCacheEntry(t *testing.T) {
+	cacheDir := t.TempDir()
+	lc, err := cache.NewLocalCache(cache.Opts{CacheDir: cacheDir, VerifyMode: cache.VerifyAlways})
+	if err != nil {
+		t.Fatalf("NewLocalCache() failed: %v", err)
+	}
+	defer lc.Close()
+
+	d := DownloadJob{Cache: lc}
+	if err := d.HealthChecker().Check(context.Background()); err != nil {
+		t.Fatalf("HealthChecker() before any corruption = %v, want nil", err)
+	}
+
+	content := []byte("hello world")
+	dg := digest.NewFromBlob(content)
+	srcPath := filepath.Join(t.TempDir(), "src")
+	if err := os.WriteFile(srcPath, content, 0644); err != nil {
+		t.Fatalf("failed to write source file: %v", err)
+	}
+	pushed := &client.TreeOutput{Digest: dg, Path: srcPath}
+	if err := lc.Push(context.Background(), map[digest.Digest]*client.TreeOutput{dg: pushed}); err != nil {
+		t.Fatalf("Push() failed: %v", err)
+	}
+
+	// Corrupt the cached blob in place: LocalCache stores blobs under
+	// CacheDir/<hex digest>, see lucicache.Cache.itemPath.
+	if err := os.WriteFile(filepath.Join(cacheDir, dg.Hash), []byte("corrupted content"), 0644); err != nil {
+		t.Fatalf("failed to corrupt cached blob: %v", err)
+	}
+
+	destPath := filepath.Join(t.TempDir(), "dest")
+	pulled := &client.TreeOutput{Digest: dg, Path: destPath}
+	if _, missed, err := lc.Pull(context.Background(), []*client.TreeOutput{pulled}); err != nil {
+		t.Fatalf("Pull() failed: %v", err)
+	} else if len(missed) != 1 {
+		t.Fatalf("Pull() missed = %d items, want 1 (corrupted blob should miss)", len(missed))
+	}
+	if got := lc.Stats().Corruptions; got != 1 {
+		t.Fatalf("Stats().Corruptions = %d, want 1", got)
+	}
+
+	checker := d.HealthChecker()
+	if err := checker.Check(context.Background()); err == nil {
+		t.Fatal("HealthChecker() after corruption = nil, want an error")
+	}
+
+	// The checker must also flip a periodic Registry unhealthy within one
+	// check interval, not just report an error when called directly.
+	reg := health.NewRegistry()
+	reg.RegisterPeriodic("cache", 5*time.Millisecond, checker)
+	defer reg.Stop()
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if !reg.Results()["cache"].OK {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Registry never reported the cache checker unhealthy after corruption")
+}
@@ -0,0 +1,77 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+
+	"github.com/google/device-infra/src/devtools/rbe/casdownloader/cache"
+	"github.com/google/device-infra/src/devtools/rbe/casmount/casfs"
+)
+
+// defaultMountTimeout bounds DownloadJob.MountTimeout's default.
+const defaultMountTimeout = time.Minute
+
+// doLazyDownload mounts d.Digest at d.Dir as a lazily-fetched, read-only FUSE
+// filesystem instead of materializing every file up front, reusing the same
+// casfs library the standalone casmount binary is built on. Files are
+// fetched from CAS on first read and, when d.Cache is a *cache.LocalCache,
+// content-addressed into it like an ordinary download.
+//
+// It blocks until the mount is torn down, either by a SIGINT/SIGTERM (clean
+// unmount) or by ctx being canceled.
+//
+// doLazyDownload does not restore chunked artifacts: casfs serves each CAS
+// blob as-is, so a file uploaded via casuploader's -chunk mode surfaces as
+// its chunks index and loose chunk files rather than the reassembled
+// original.
+func (d *DownloadJob) doLazyDownload(ctx context.Context) error {
+	rootDigest, err := digest.NewFromString(d.Digest)
+	if err != nil {
+		return fmt.Errorf("failed to parse root digest %s: %v", d.Digest, err)
+	}
+
+	mountTimeout := d.MountTimeout
+	if mountTimeout <= 0 {
+		mountTimeout = defaultMountTimeout
+	}
+	mountCtx, cancel := context.WithTimeout(ctx, mountTimeout)
+	defer cancel()
+
+	localCache, _ := d.Cache.(*cache.LocalCache)
+	stageDir := d.Dir + ".stage"
+
+	fs := casfs.New(d.Client, localCache, stageDir)
+	server, err := fs.Mount(mountCtx, d.Dir, rootDigest)
+	if err != nil {
+		return fmt.Errorf("failed to lazily mount %s at %s: %v", d.Digest, d.Dir, err)
+	}
+	log.Infof("lazily mounted %s at %s", d.Digest, d.Dir)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigChan:
+			log.Infof("received signal, unmounting %s...", d.Dir)
+		case <-ctx.Done():
+		}
+		if err := server.Unmount(); err != nil {
+			log.Warningf("clean unmount of %s failed: %v, attempting lazy unmount", d.Dir, err)
+			if err := syscall.Unmount(d.Dir, syscall.MNT_DETACH); err != nil {
+				log.Errorf("forced unmount of %s failed: %v", d.Dir, err)
+			}
+		}
+	}()
+
+	server.Wait()
+	log.Infof("unmounted %s", d.Dir)
+	return nil
+}
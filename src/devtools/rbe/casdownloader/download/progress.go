@@ -0,0 +1,166 @@
+package download
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// ProgressReporter receives structured events as a download proceeds. All
+// methods may be called concurrently from multiple goroutines and must be
+// safe for that; implementations in this package serialize their own state
+// with a mutex.
+type ProgressReporter interface {
+	// OnPlan reports the total work a download is about to do, once the
+	// directory tree has been retrieved and filtered.
+	OnPlan(totalFiles int, totalBytes int64)
+	// OnFileStart reports that a single file's content is about to be
+	// fetched or copied.
+	OnFileStart(path string, size int64)
+	// OnFileDone reports that a single file finished, successfully or not.
+	OnFileDone(path string, size int64, err error)
+	// OnBatchDone reports that a batched operation (e.g. a single
+	// BatchDownloadBlobs or DownloadFiles call covering several files)
+	// finished.
+	OnBatchDone(count int, bytes int64, elapsed time.Duration)
+	// OnError reports a fatal error that aborted the download.
+	OnError(err error)
+}
+
+// progress returns d.Progress, or a no-op reporter if none is configured, so
+// call sites never need to nil-check.
+func (d *DownloadJob) progress() ProgressReporter {
+	if d.Progress == nil {
+		return noopProgressReporter{}
+	}
+	return d.Progress
+}
+
+type noopProgressReporter struct{}
+
+func (noopProgressReporter) OnPlan(int, int64) {}
+func (noopProgressReporter) OnFileStart(string, int64) {}
+func (noopProgressReporter) OnFileDone(string, int64, error) {}
+func (noopProgressReporter) OnBatchDone(int, int64, time.Duration) {}
+func (noopProgressReporter) OnError(error) {}
+
+// ttyProgressReporter renders a human-readable running total to an
+// io.Writer (typically os.Stderr), suitable for an interactive terminal.
+type ttyProgressReporter struct {
+	w io.Writer
+
+	mu          sync.Mutex
+	totalFiles  int
+	totalBytes  int64
+	doneFiles   int
+	doneBytes   int64
+}
+
+// NewTTYProgressReporter returns a ProgressReporter that prints a running
+// "done/total" line to w as files complete.
+func NewTTYProgressReporter(w io.Writer) ProgressReporter {
+	return &ttyProgressReporter{w: w}
+}
+
+func (r *ttyProgressReporter) OnPlan(totalFiles int, totalBytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.totalFiles, r.totalBytes = totalFiles, totalBytes
+	fmt.Fprintf(r.w, "downloading %d files, %d bytes\n", totalFiles, totalBytes)
+}
+
+func (r *ttyProgressReporter) OnFileStart(path string, size int64) {}
+
+func (r *ttyProgressReporter) OnFileDone(path string, size int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(r.w, "failed %s: %v\n", path, err)
+		return
+	}
+	r.doneFiles++
+	r.doneBytes += size
+	fmt.Fprintf(r.w, "[%d/%d] %s\n", r.doneFiles, r.totalFiles, path)
+}
+
+func (r *ttyProgressReporter) OnBatchDone(count int, bytes int64, elapsed time.Duration) {}
+
+func (r *ttyProgressReporter) OnError(err error) {
+	fmt.Fprintf(r.w, "download failed: %v\n", err)
+}
+
+// progressEvent is the JSON schema written, one per line, by a
+// jsonlProgressReporter.
+type progressEvent struct {
+	Type      string  `json:"type"` // "plan", "file_start", "file_done", "batch_done", "error"
+	Path      string  `json:"path,omitempty"`
+	Size      int64   `json:"size,omitempty"`
+	Count     int     `json:"count,omitempty"`
+	Bytes     int64   `json:"bytes,omitempty"`
+	ElapsedMs int64   `json:"elapsed_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// jsonlProgressReporter writes one JSON object per line to w, for
+// -progress-json. It's safe for concurrent use.
+type jsonlProgressReporter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+}
+
+// NewJSONLProgressReporter opens path (truncating it) and returns a
+// ProgressReporter that appends a JSON object per event, plus the file so
+// the caller can close it once the download finishes.
+func NewJSONLProgressReporter(path string) (ProgressReporter, io.Closer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create progress-json file %s: %v", path, err)
+	}
+	return &jsonlProgressReporter{w: f, start: time.Now()}, f, nil
+}
+
+func (r *jsonlProgressReporter) write(e progressEvent) {
+	e.Timestamp = time.Since(r.start).Seconds()
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Warningf("failed to marshal progress event: %v", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data = append(data, '\n')
+	if _, err := r.w.Write(data); err != nil {
+		log.Warningf("failed to write progress event: %v", err)
+	}
+}
+
+func (r *jsonlProgressReporter) OnPlan(totalFiles int, totalBytes int64) {
+	r.write(progressEvent{Type: "plan", Count: totalFiles, Bytes: totalBytes})
+}
+
+func (r *jsonlProgressReporter) OnFileStart(path string, size int64) {
+	r.write(progressEvent{Type: "file_start", Path: path, Size: size})
+}
+
+func (r *jsonlProgressReporter) OnFileDone(path string, size int64, err error) {
+	e := progressEvent{Type: "file_done", Path: path, Size: size}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.write(e)
+}
+
+func (r *jsonlProgressReporter) OnBatchDone(count int, bytes int64, elapsed time.Duration) {
+	r.write(progressEvent{Type: "batch_done", Count: count, Bytes: bytes, ElapsedMs: elapsed.Milliseconds()})
+}
+
+func (r *jsonlProgressReporter) OnError(err error) {
+	r.write(progressEvent{Type: "error", Error: err.Error()})
+}
@@ -3,17 +3,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/debug"
 	"syscall"
 	"time"
 
 	"flag"
-	
+
 	log "github.com/golang/glog"
 	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 	"github.com/google/device-infra/src/devtools/rbe/casdownloader/cache"
@@ -58,6 +61,17 @@ var (
 		"Enable cache lock. When using local cache (-cache-dir is set) and enable cache lock, the downloader will add lock when it changes cache, so you can safely run multiple downloader instances simultaneously.")
 	useHardlink = flag.Bool("use-hardlink", true, "By default local cache will use hardlink when push and pull files.")
 
+	cacheLowWatermark  = flag.Int64("cache-low-watermark", 0, "Background eviction trims the cache down to this size, in bytes, once -cache-high-watermark is crossed. If 0, background eviction is disabled.")
+	cacheHighWatermark = flag.Int64("cache-high-watermark", 0, "Background eviction triggers once the cache footprint exceeds this size, in bytes. If 0, background eviction is disabled.")
+	cacheTidyInterval  = flag.Duration("cache-tidy-interval", time.Minute, "How often the background eviction goroutine checks the cache footprint.")
+
+	cacheAfter           = flag.Int("cache-after", 1, "Number of times a digest must be seen by Pull (hit or miss) before Push will materialize it into the cache. 1 matches the historical behavior of caching on first push.")
+	cacheAdmissionMemory = flag.Int64("cache-admission-memory", 0, "Memory budget, in bytes, for the -cache-after admission sketch. If 0, a default cap is used.")
+
+	cacheVerify           = flag.String("cache-verify", "off", "Cached blob integrity checking mode: off|sampled|always.")
+	cacheVerifySample     = flag.Float64("cache-verify-sample", 0.05, "Fraction of pulls to re-verify in -cache-verify=sampled mode.")
+	cacheVerifyMtimeAfter = flag.Duration("cache-verify-mtime-after", 0, "In -cache-verify=sampled mode, also verify any cached blob whose mtime is older than this. 0 disables this extra check.")
+
 	// Flags for RBE CAS configurations
 	casInstance    = flag.String("cas-instance", "", "RBE instance")
 	casAddr        = flag.String("cas-addr", "remotebuildexecution.googleapis.com:443", "RBE server addr")
@@ -71,6 +85,28 @@ var (
 	keepChunks = flag.Bool("keep-chunks", false, "Keep chunk files and the index file around for chunked version of artifacts.")
 	chunksOnly = flag.Bool("chunks-only", false, "Only download chunk files and the index file (skip file restoration) for chunked version of artifacts.")
 
+	maxBatchBytes = flag.Int64("max-batch-bytes", 0, "Cap, in bytes, on a single coalesced CAS batch read when restoring chunked artifacts. If 0, a default cap is used.")
+
+	smallFileThreshold = flag.Int64("small-file-threshold", 0, "Maximum digest size, in bytes, at which a missing file is fetched through a single batched CAS read instead of downloading it individually. If 0, a default threshold is used.")
+
+	resume       = flag.Bool("resume", false, "Skip re-downloading any file already present in -dir whose content hash-verifies against its expected digest, persisting verified digests so a later run doesn't re-hash them. Takes priority over -skip-existing.")
+	skipExisting = flag.Bool("skip-existing", false, "Skip re-downloading any file already present in -dir whose size matches its expected digest, trusting it without hashing. Ignored if -resume is set.")
+
+	lazy         = flag.Bool("lazy", false, "Mount -dir as a read-only FUSE view of the tree instead of downloading it, fetching each file's content on first read. Blocks until the mount is torn down (SIGINT/SIGTERM).")
+	mountTimeout = flag.Duration("mount-timeout", 0, "In -lazy mode, how long to wait for the initial mount before giving up. If 0, a default timeout is used.")
+
+	progressJSON = flag.String("progress-json", "", "Append one JSON object per line to this file as the download proceeds (plan/file_start/file_done/batch_done/error events). If empty, no structured progress is recorded.")
+
+	// Flags for the out-of-band cache prune/GC daemon. These run independent
+	// of any download: -digest/-dir/-cas-instance are not required.
+	pruneMode                = flag.Bool("prune", false, "Run a one-off cache prune pass instead of a download, acting on -cache-dir.")
+	daemonMode               = flag.Bool("daemon", false, "Run a long-lived cache GC daemon instead of a download, periodically pruning -cache-dir.")
+	pruneMaxAge              = flag.Duration("max-age", 0, "In -prune/-daemon mode, remove cache entries last accessed longer than this ago. 0 disables this check.")
+	pruneMaxSize             = flag.Int64("max-size", 0, "In -prune/-daemon mode, trim the cache to at most this footprint, in atime order. 0 disables this check.")
+	pruneKeepReferencedSince = flag.Duration("keep-referenced-since", 0, "In -prune/-daemon mode, protect entries accessed more recently than this ago from removal. 0 disables this protection.")
+	pruneMinFreeBytes        = flag.Int64("min-free-bytes", 0, "In -prune/-daemon mode, also trim the cache, in atime order, until at least this many bytes are free on the cache directory's filesystem. 0 disables this check. Not supported on Windows.")
+	daemonInterval           = flag.Duration("daemon-interval", time.Minute, "In -daemon mode, how often to check the cache footprint and prune if needed.")
+
 	// Flags for concurrency (affects peak memory), specify 0 for default.
 	casConcurrency = flag.Int("cas-concurrency", RBECASConcurrency, "the maximum number of concurrent download operations.")
 
@@ -86,6 +122,7 @@ var (
 
 	excludeFilters common.MultiStringFlag
 	includeFilters common.MultiStringFlag
+	filterSyntax   = flag.String("filter-syntax", "regex", "Syntax of -include-filters/-exclude-filters patterns: regex|glob. glob supports doublestar-style \"**\".")
 )
 
 func fileInfo(path string) (os.FileInfo, error) {
@@ -119,6 +156,12 @@ func checkFlags() error {
 	if *disableCache == false && *cacheDir == "" {
 		return errors.New("-cache-dir must be specified")
 	}
+	if *pruneMode || *daemonMode {
+		if *disableCache {
+			return errors.New("-prune and -daemon require a local cache (-disable-cache must be false)")
+		}
+		return nil
+	}
 	if *rootDigest == "" {
 		return errors.New("-digest must be specified")
 	}
@@ -200,6 +243,11 @@ func main() {
 
 	setMemoryLimit(*memoryLimit)
 
+	if *pruneMode || *daemonMode {
+		runPruneOrDaemon(ctx)
+		return
+	}
+
 	rpcTimeouts := map[string]time.Duration{
 		"default":          *rpcTimeout,
 		"GetCapabilities":  *getCapabilitesTimeout,
@@ -217,21 +265,49 @@ func main() {
 	}
 	defer client.Close()
 
-	cache, err := createCache(*disableCache, *cacheDir, *cacheMaxSize, *enableCacheLock, *useHardlink)
+	verifyMode, err := cache.ParseVerifyMode(*cacheVerify)
 	if err != nil {
 		log.Exit(err)
 	}
 
+	filterSyntaxVal, err := download.ParseFilterSyntax(*filterSyntax)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	localCache, err := createCache(*disableCache, *cacheDir, *cacheMaxSize, *enableCacheLock, *useHardlink, *cacheLowWatermark, *cacheHighWatermark, *cacheTidyInterval, *cacheAfter, *cacheAdmissionMemory, verifyMode, *cacheVerifySample, *cacheVerifyMtimeAfter)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	var progress download.ProgressReporter
+	if *progressJSON != "" {
+		var progressCloser io.Closer
+		progress, progressCloser, err = download.NewJSONLProgressReporter(*progressJSON)
+		if err != nil {
+			log.Exit(err)
+		}
+		defer progressCloser.Close()
+	}
+
 	d := download.DownloadJob{
-		Client:         client,
-		Digest:         *rootDigest,
-		Dir:            *dir,
-		DumpJSON:       *dumpJSON,
-		Cache:          cache,
-		IncludeFilters: includeFilters,
-		ExcludeFilters: excludeFilters,
-		KeepChunks:     *keepChunks,
-		ChunksOnly:     *chunksOnly,
+		Client:             client,
+		Digest:             *rootDigest,
+		Dir:                *dir,
+		DumpJSON:           *dumpJSON,
+		Cache:              localCache,
+		IncludeFilters:     includeFilters,
+		ExcludeFilters:     excludeFilters,
+		FilterSyntax:       filterSyntaxVal,
+		KeepChunks:         *keepChunks,
+		ChunksOnly:         *chunksOnly,
+		MaxBatchBytes:      *maxBatchBytes,
+		SmallFileThreshold: *smallFileThreshold,
+		Resume:             *resume,
+		SkipExisting:       *skipExisting,
+		Lazy:               *lazy,
+		MountTimeout:       *mountTimeout,
+		Progress:           progress,
 	}
 	reportMemoryStats()
 	if err = d.DoDownload(ctx); err != nil {
@@ -240,19 +316,122 @@ func main() {
 	reportMemoryStats()
 }
 
-func createCache(disableCache bool, cacheDir string, cacheMaxSize int64, enableCacheLock bool, useHardlink bool) (cache.Cache, error) {
+func createCache(disableCache bool, cacheDir string, cacheMaxSize int64, enableCacheLock bool, useHardlink bool, cacheLowWatermark, cacheHighWatermark int64, cacheTidyInterval time.Duration, cacheAfter int, cacheAdmissionMemory int64, verifyMode cache.VerifyMode, verifySample float64, verifyMtimeAfter time.Duration) (cache.Cache, error) {
 	if disableCache {
 		return nil, nil
 	}
 	var localCache cache.Cache
 	var err error
-	localCache, err = cache.NewLocalCache(cacheDir, cacheMaxSize, enableCacheLock, useHardlink)
+	localCache, err = cache.NewLocalCache(cache.Opts{
+		CacheDir:             cacheDir,
+		CacheMaxSize:         cacheMaxSize,
+		EnableLock:           enableCacheLock,
+		UseHardlink:          useHardlink,
+		LowWatermark:         cacheLowWatermark,
+		HighWatermark:        cacheHighWatermark,
+		TidyInterval:         cacheTidyInterval,
+		AdmissionAfter:       cacheAfter,
+		AdmissionMemory:      cacheAdmissionMemory,
+		VerifyMode:           verifyMode,
+		VerifySampleRate:     verifySample,
+		VerifyMtimeThreshold: verifyMtimeAfter,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create local cache: %v", err)
 	}
 	return localCache, err
 }
 
+// runPruneOrDaemon runs a one-off cache prune (-prune) or a long-lived cache
+// GC daemon (-daemon), acting only on -cache-dir; it never talks to CAS.
+func runPruneOrDaemon(ctx context.Context) {
+	verifyMode, err := cache.ParseVerifyMode(*cacheVerify)
+	if err != nil {
+		log.Exit(err)
+	}
+	localCache, err := createCache(false, *cacheDir, *cacheMaxSize, *enableCacheLock, *useHardlink, *cacheLowWatermark, *cacheHighWatermark, *cacheTidyInterval, *cacheAfter, *cacheAdmissionMemory, verifyMode, *cacheVerifySample, *cacheVerifyMtimeAfter)
+	if err != nil {
+		log.Exit(err)
+	}
+	lc, ok := localCache.(*cache.LocalCache)
+	if !ok {
+		log.Exit("-prune and -daemon require the default local cache implementation")
+	}
+	defer lc.Close()
+
+	opts := cache.PruneOpts{
+		MaxAge:              *pruneMaxAge,
+		MaxSize:             *pruneMaxSize,
+		KeepReferencedSince: *pruneKeepReferencedSince,
+		MinFreeBytes:        *pruneMinFreeBytes,
+	}
+
+	if *daemonMode {
+		runPruneDaemon(ctx, lc, opts)
+		return
+	}
+
+	report, err := lc.Prune(ctx, opts)
+	if err != nil {
+		log.Exit(err)
+	}
+	log.Infof("prune: removed %d entries, freed %d bytes", report.EntriesRemoved, report.BytesFreed)
+	if *dumpJSON != "" {
+		if err := dumpPruneReport(*dumpJSON, report); err != nil {
+			log.Errorf("failed to dump prune report: %v", err)
+		}
+	}
+}
+
+// runPruneDaemon watches the cache footprint via periodic Stats and calls
+// Prune whenever -max-age or -max-size would have something to do, until
+// signaled to stop. Concurrent Push/Pull from other casdownloader instances
+// is safe: Prune takes the same cache-lock flock they do, so it waits its
+// turn rather than interrupting an in-flight hardlink.
+func runPruneDaemon(ctx context.Context, lc *cache.LocalCache, opts cache.PruneOpts) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(*daemonInterval)
+	defer ticker.Stop()
+
+	log.Infof("cache GC daemon: watching %s every %s", *cacheDir, *daemonInterval)
+	for {
+		select {
+		case <-sigChan:
+			log.Infof("cache GC daemon: received signal, exiting")
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if *pruneMaxSize > 0 && *pruneMaxAge <= 0 && *pruneMinFreeBytes <= 0 && lc.Stats().BytesUsed <= *pruneMaxSize {
+				continue
+			}
+			report, err := lc.Prune(ctx, opts)
+			if err != nil {
+				log.Warningf("cache GC daemon: prune failed: %v", err)
+				continue
+			}
+			if report.EntriesRemoved > 0 {
+				log.Infof("cache GC daemon: removed %d entries, freed %d bytes", report.EntriesRemoved, report.BytesFreed)
+			}
+		}
+	}
+}
+
+// dumpPruneReport writes report as JSON to path, matching the -dump-json
+// convention used for download stats.
+func dumpPruneReport(path string, report cache.PruneReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal prune report: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write prune report: %v", err)
+	}
+	return nil
+}
+
 func setMemoryLimit(limit int64) {
 	var limitInBytes int64 = math.MaxInt64
 	if limit > 0 {
@@ -0,0 +1,264 @@
+// Package casfs implements a read-only FUSE filesystem backed by RBE CAS.
+//
+// The directory tree is materialized once at mount time via GetDirectoryTree,
+// but file content is fetched lazily: a file's first Read triggers a
+// BatchReadBlobs/ByteStream fetch through the RBE client, which is then
+// served from cache.LocalCache (hardlinked into a per-inode staging area) so
+// repeated reads and repeated mounts of the same tree avoid re-fetching.
+package casfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/google/device-infra/src/devtools/rbe/casdownloader/cache"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// smallBlobPageCacheLimit is the largest blob size kept in the in-memory LRU
+// page cache, to serve small, frequently-read files without a round trip
+// through the on-disk stage.
+const smallBlobPageCacheLimit = 256 * 1024
+
+// CASFS is a read-only FUSE filesystem rooted at a single RBE CAS directory
+// digest.
+type CASFS struct {
+	fs.Inode
+
+	client     *client.Client
+	localCache *cache.LocalCache
+	stageDir   string
+	mountTime  time.Time
+	pages      *pageCache
+}
+
+var _ = (fs.NodeGetattrer)((*CASFS)(nil))
+
+// New creates a CASFS rooted at rootDigest, to be mounted read-only.
+// stageDir is a scratch directory (ideally on the same filesystem as the
+// cache directory, so hardlinks work) used to materialize files on demand.
+func New(c *client.Client, localCache *cache.LocalCache, stageDir string) *CASFS {
+	return &CASFS{
+		client:     c,
+		localCache: localCache,
+		stageDir:   stageDir,
+		mountTime:  time.Now(),
+		pages:      newPageCache(64 * 1024 * 1024), // 64MiB of small-blob pages.
+	}
+}
+
+// Getattr reports attributes for the filesystem root.
+func (f *CASFS) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0555
+	out.Nlink = 2
+	out.Uid = uint32(os.Getuid())
+	out.Gid = uint32(os.Getgid())
+	mt := uint64(f.mountTime.Unix())
+	out.Atime, out.Mtime, out.Ctime = mt, mt, mt
+	return 0
+}
+
+// Mount materializes rootDigest's directory tree in memory and mounts it
+// read-only at mountPoint.
+func (f *CASFS) Mount(ctx context.Context, mountPoint string, rootDigest digest.Digest) (*fuse.Server, error) {
+	if err := os.MkdirAll(f.stageDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create stage dir %s: %v", f.stageDir, err)
+	}
+
+	rootDir := &repb.Directory{}
+	if _, err := f.client.ReadProto(ctx, rootDigest, rootDir); err != nil {
+		return nil, fmt.Errorf("failed to read root directory proto: %v", err)
+	}
+	dirs, err := f.client.GetDirectoryTree(ctx, rootDigest.ToProto())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get directory tree from RBE: %v", err)
+	}
+	dirByDigest := make(map[string]*repb.Directory, len(dirs))
+	for _, d := range dirs {
+		dg, err := digest.NewFromMessage(d)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compute digest of directory: %v", err)
+		}
+		dirByDigest[dg.Hash] = d
+	}
+
+	if err := f.buildTree(ctx, &f.Inode, rootDir, dirByDigest); err != nil {
+		return nil, fmt.Errorf("failed to build filesystem tree: %v", err)
+	}
+
+	attrTimeout := time.Second
+	entryTimeout := time.Second
+	server, err := fs.Mount(mountPoint, f, &fs.Options{
+		AttrTimeout:  &attrTimeout,
+		EntryTimeout: &entryTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount FUSE filesystem at %s: %v", mountPoint, err)
+	}
+	return server, nil
+}
+
+// buildTree recursively populates parent's children from dir, resolving
+// nested directories via dirByDigest.
+func (f *CASFS) buildTree(ctx context.Context, parent *fs.Inode, dir *repb.Directory, dirByDigest map[string]*repb.Directory) error {
+	for _, sub := range dir.Directories {
+		child, ok := dirByDigest[sub.Digest.Hash]
+		if !ok {
+			return fmt.Errorf("missing directory %s (%s) in tree", sub.Name, sub.Digest.Hash)
+		}
+		childInode := parent.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: fuse.S_IFDIR})
+		parent.AddChild(sub.Name, childInode, false)
+		if err := f.buildTree(ctx, childInode, child, dirByDigest); err != nil {
+			return err
+		}
+	}
+	for _, file := range dir.Files {
+		node := &casFile{
+			fs:           f,
+			digest:       digest.NewFromProtoUnvalidated(file.Digest),
+			isExecutable: file.IsExecutable,
+		}
+		childInode := parent.NewPersistentInode(ctx, node, fs.StableAttr{Mode: fuse.S_IFREG})
+		parent.AddChild(file.Name, childInode, false)
+	}
+	for _, link := range dir.Symlinks {
+		target := link.Target
+		childInode := parent.NewPersistentInode(ctx, &fs.MemSymlink{Data: []byte(target)}, fs.StableAttr{Mode: fuse.S_IFLNK})
+		parent.AddChild(link.Name, childInode, false)
+	}
+	return nil
+}
+
+// casFile is a single regular file backed by an RBE CAS blob, fetched lazily
+// on first Open/Read.
+type casFile struct {
+	fs.Inode
+	fs           *CASFS
+	digest       digest.Digest
+	isExecutable bool
+
+	once     sync.Once
+	fetchErr error
+	stagedAt string // path materialized in fs.stageDir, once fetched.
+}
+
+var (
+	_ = (fs.NodeGetattrer)((*casFile)(nil))
+	_ = (fs.NodeOpener)((*casFile)(nil))
+	_ = (fs.NodeReader)((*casFile)(nil))
+)
+
+func (c *casFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = modeFor(c.isExecutable)
+	out.Size = uint64(c.digest.Size)
+	mt := uint64(c.fs.mountTime.Unix())
+	out.Atime, out.Mtime, out.Ctime = mt, mt, mt
+	out.Uid = uint32(os.Getuid())
+	out.Gid = uint32(os.Getgid())
+	return 0
+}
+
+func modeFor(executable bool) uint32 {
+	if executable {
+		return 0755
+	}
+	return 0644
+}
+
+// Open rejects any attempt to write, since the filesystem is read-only.
+func (c *casFile) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+// Read serves dest from the in-memory page cache for small files, or the
+// on-disk staging area (fetched on demand) otherwise.
+func (c *casFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if c.digest.Size <= smallBlobPageCacheLimit {
+		if data, ok := c.fs.pages.get(c.digest.Hash); ok {
+			return readFromBytes(data, dest, off), 0
+		}
+	}
+
+	c.once.Do(func() { c.fetchErr = c.fetch(ctx) })
+	if c.fetchErr != nil {
+		log.Errorf("failed to fetch CAS blob %s: %v", c.digest, c.fetchErr)
+		return nil, syscall.EIO
+	}
+
+	file, err := os.Open(c.stagedAt)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	defer file.Close()
+
+	n, err := file.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func readFromBytes(data, dest []byte, off int64) fuse.ReadResult {
+	if off >= int64(len(data)) {
+		return fuse.ReadResultData(nil)
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return fuse.ReadResultData(data[off:end])
+}
+
+// fetch materializes the blob for c.digest into c.fs.stageDir through the
+// shared LocalCache, so already-downloaded blobs are served from disk with
+// hardlinks into the per-inode staging area. Small blobs fetched from CAS
+// are additionally kept in the in-memory page cache.
+func (c *casFile) fetch(ctx context.Context) error {
+	staged := filepath.Join(c.fs.stageDir, strings.ReplaceAll(c.digest.String(), "/", "_"))
+
+	if c.fs.localCache != nil {
+		out := &client.TreeOutput{Digest: c.digest, Path: staged, IsExecutable: c.isExecutable}
+		cached, _, err := c.fs.localCache.Pull(ctx, []*client.TreeOutput{out})
+		if err == nil && len(cached) == 1 {
+			c.stagedAt = staged
+			return nil
+		}
+	}
+
+	data, _, err := c.fs.client.ReadBlob(ctx, c.digest)
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %v", c.digest, err)
+	}
+	if c.digest.Size <= smallBlobPageCacheLimit {
+		c.fs.pages.put(c.digest.Hash, data)
+	}
+
+	if err := os.WriteFile(staged, data, os.FileMode(modeFor(c.isExecutable))); err != nil {
+		return fmt.Errorf("failed to stage blob %s: %v", c.digest, err)
+	}
+	c.stagedAt = staged
+
+	if c.fs.localCache != nil {
+		if err := c.fs.localCache.Push(ctx, map[digest.Digest]*client.TreeOutput{
+			c.digest: {Digest: c.digest, Path: staged, IsExecutable: c.isExecutable},
+		}); err != nil {
+			log.Warningf("failed to push fetched blob %s to local cache: %v", c.digest, err)
+		}
+	}
+	return nil
+}
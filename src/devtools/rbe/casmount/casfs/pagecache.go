@@ -0,0 +1,68 @@
+package casfs
+
+import (
+	"container/list"
+	"sync"
+)
+
+// pageCache is a small in-memory LRU cache of whole small blobs, keyed by
+// hex digest, used to serve frequently-read small files without a round trip
+// through the on-disk stage.
+type pageCache struct {
+	maxBytes int64
+
+	mu       sync.Mutex
+	curBytes int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type pageEntry struct {
+	digest string
+	data   []byte
+}
+
+func newPageCache(maxBytes int64) *pageCache {
+	return &pageCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (p *pageCache) get(digest string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elem, ok := p.entries[digest]
+	if !ok {
+		return nil, false
+	}
+	p.order.MoveToFront(elem)
+	return elem.Value.(*pageEntry).data, true
+}
+
+func (p *pageCache) put(digest string, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if elem, ok := p.entries[digest]; ok {
+		p.order.MoveToFront(elem)
+		p.curBytes += int64(len(data)) - int64(len(elem.Value.(*pageEntry).data))
+		elem.Value.(*pageEntry).data = data
+	} else {
+		elem := p.order.PushFront(&pageEntry{digest: digest, data: data})
+		p.entries[digest] = elem
+		p.curBytes += int64(len(data))
+	}
+
+	for p.curBytes > p.maxBytes {
+		oldest := p.order.Back()
+		if oldest == nil {
+			break
+		}
+		entry := oldest.Value.(*pageEntry)
+		p.order.Remove(oldest)
+		delete(p.entries, entry.digest)
+		p.curBytes -= int64(len(entry.data))
+	}
+}
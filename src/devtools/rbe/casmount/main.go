@@ -0,0 +1,126 @@
+// Package main mounts an RBE CAS directory tree as a read-only, lazily
+// fetched FUSE filesystem.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"flag"
+
+	log "github.com/golang/glog"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/google/device-infra/src/devtools/rbe/casdownloader/cache"
+	"github.com/google/device-infra/src/devtools/rbe/casmount/casfs"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/mountpoint"
+	"github.com/google/device-infra/src/devtools/rbe/rbeclient"
+)
+
+const version = "0.1"
+
+var (
+	printVersion = flag.Bool("version", false, "Print version information")
+
+	rootDigest = flag.String("digest", "", `Digest of root directory proto "<digest hash>/<size bytes>".`)
+	mountPoint = flag.String("mount", "", "Empty directory to mount the CAS tree at.")
+
+	casInstance    = flag.String("cas-instance", "", "RBE instance")
+	casAddr        = flag.String("cas-addr", "remotebuildexecution.googleapis.com:443", "RBE server addr")
+	serviceAccount = flag.String("service-account-json", "", "Path to JSON file with service account credentials to use.")
+	useADC         = flag.Bool("use-adc", false, "True to use Application Default Credentials (ADC).")
+
+	cacheDir        = flag.String("cache-dir", "", "Cache directory backing this mount. If empty, fetched blobs aren't shared across mounts.")
+	cacheMaxSize    = flag.Int64("cache-max-size", 0, "Cache is trimmed if the cache gets larger than this value. If 0, the cache is effectively a leak.")
+	enableCacheLock = flag.Bool("cache-lock", false, "Enable cache lock, so casmount can safely share a cache directory with casdownloader/other casmount instances.")
+)
+
+func checkFlags() error {
+	if *rootDigest == "" {
+		return errors.New("-digest must be specified")
+	}
+	if *casInstance == "" {
+		return errors.New("-cas-instance must be specified")
+	}
+	if *serviceAccount == "" && !*useADC {
+		return errors.New("either -use-adc must be true or -service-account-json must be specified")
+	}
+	return mountpoint.ValidateMountPoint(*mountPoint)
+}
+
+func main() {
+	flag.Set("silent_init", "true")
+	flag.Set("logtostderr", "true")
+	flag.Set("stderrthreshold", "INFO")
+	flag.Parse()
+
+	if *printVersion {
+		fmt.Printf("version: %s\n", version)
+		os.Exit(0)
+	}
+
+	if err := checkFlags(); err != nil {
+		log.Exit(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dg, err := digest.NewFromString(*rootDigest)
+	if err != nil {
+		log.Exitf("failed to parse root digest %s: %v", *rootDigest, err)
+	}
+
+	client, err := rbeclient.New(ctx, rbeclient.Opts{
+		Instance:              *casInstance,
+		ServiceAddress:        *casAddr,
+		ServiceAccountJSON:    *serviceAccount,
+		UseApplicationDefault: *useADC,
+	})
+	if err != nil {
+		log.Exit(err)
+	}
+	defer client.Close()
+
+	var localCache *cache.LocalCache
+	stageDir := *mountPoint + ".stage"
+	if *cacheDir != "" {
+		localCache, err = cache.NewLocalCache(cache.Opts{
+			CacheDir:     *cacheDir,
+			CacheMaxSize: *cacheMaxSize,
+			EnableLock:   *enableCacheLock,
+			UseHardlink:  true,
+		})
+		if err != nil {
+			log.Exit(err)
+		}
+		defer localCache.Close()
+		stageDir = *cacheDir + "-staging"
+	}
+
+	fs := casfs.New(client, localCache, stageDir)
+	server, err := fs.Mount(ctx, *mountPoint, dg)
+	if err != nil {
+		log.Exit(err)
+	}
+	log.Infof("casmount: mounted %s at %s", *rootDigest, *mountPoint)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		log.Info("received signal, unmounting...")
+		if err := server.Unmount(); err != nil {
+			log.Warningf("clean unmount failed: %v, attempting lazy unmount", err)
+			if err := syscall.Unmount(*mountPoint, syscall.MNT_DETACH); err != nil {
+				log.Errorf("forced unmount failed: %v", err)
+			}
+		}
+	}()
+
+	server.Wait()
+	log.Infof("casmount: unmounted %s", *mountPoint)
+}
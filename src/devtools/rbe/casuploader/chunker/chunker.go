@@ -2,26 +2,208 @@
 package chunker
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/segmentstore"
 	"github.com/jotfs/fastcdc-go"
+	"github.com/klauspost/compress/zstd"
 )
 
-// ChunkInfo contains the sha256 and offset of a chunk in a file.
+const (
+	// CompressionNone stores each chunk file as raw, uncompressed bytes.
+	CompressionNone = "none"
+	// CompressionZstd individually zstd-compresses each chunk file. Chunks
+	// are still addressed and deduplicated by the SHA256 of their
+	// uncompressed content, so compression is purely an on-disk storage
+	// detail.
+	CompressionZstd = "zstd"
+	// CompressionGzip individually gzip-compresses each chunk file, like
+	// CompressionZstd but with wider decoder availability at the cost of a
+	// worse compression ratio and slower decode.
+	CompressionGzip = "gzip"
+)
+
+const (
+	// ChunkerFastCDC splits a file on content-defined boundaries (see
+	// github.com/jotfs/fastcdc-go), so inserting or removing bytes anywhere
+	// in the file only reshuffles the chunks adjacent to the edit instead of
+	// shifting every chunk boundary after it. This is what makes dedup
+	// effective across near-duplicate binaries (e.g. successive Android
+	// system images) and is the default.
+	ChunkerFastCDC = "fastcdc"
+	// ChunkerFixed splits a file into fixed-size windows regardless of
+	// content, trading FastCDC's dedup resilience to insertions/deletions
+	// for a cheaper, allocation-free splitter when the caller already knows
+	// a tree won't benefit from content-defined boundaries.
+	ChunkerFixed = "fixed"
+)
+
+// knownChunker reports whether chunkerKind is a value newSplitter knows how
+// to construct.
+func knownChunker(chunkerKind string) bool {
+	return chunkerKind == "" || chunkerKind == ChunkerFastCDC || chunkerKind == ChunkerFixed
+}
+
+// splitter yields a file's content as a sequence of chunks, terminating the
+// sequence by returning io.EOF. fastcdc.Chunker already satisfies this via
+// its own Next method; fixedSplitter is the ChunkerFixed implementation.
+type splitter interface {
+	Next() (fastcdc.Chunk, error)
+}
+
+// newSplitter returns the splitter for chunkerKind ("" behaves like
+// ChunkerFastCDC).
+func newSplitter(source io.Reader, avgChunkSizeKb int, chunkerKind string) (splitter, error) {
+	switch chunkerKind {
+	case "", ChunkerFastCDC:
+		return fastcdc.NewChunker(source, fastcdc.Options{AverageSize: 1024 * avgChunkSizeKb})
+	case ChunkerFixed:
+		return &fixedSplitter{source: source, size: 1024 * avgChunkSizeKb}, nil
+	default:
+		return nil, fmt.Errorf("unknown chunker %q", chunkerKind)
+	}
+}
+
+// fixedSplitter is the ChunkerFixed splitter: every chunk but the last is
+// exactly size bytes, regardless of content.
+type fixedSplitter struct {
+	source io.Reader
+	size   int
+	offset int
+}
+
+// Next returns the next fixed-size window of source, or io.EOF once source
+// is exhausted.
+func (s *fixedSplitter) Next() (fastcdc.Chunk, error) {
+	buf := make([]byte, s.size)
+	n, err := io.ReadFull(s.source, buf)
+	if n == 0 {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return fastcdc.Chunk{}, err
+	}
+	chunk := fastcdc.Chunk{Data: buf[:n], Offset: s.offset}
+	s.offset += n
+	// io.ReadFull returns io.ErrUnexpectedEOF for a final short read; that's
+	// not an error here, it's simply the file's last, shorter chunk. The
+	// next call correctly reports io.EOF since n will then be 0.
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return chunk, err
+}
+
+// knownCompression reports whether compression is a value ChunkFileWithCompression
+// and ChunkFileWithSegments know how to write.
+func knownCompression(compression string) bool {
+	return compression == CompressionNone || compression == CompressionZstd || compression == CompressionGzip
+}
+
+// ChunkInfo contains the sha256, offset, and on-disk storage details of a
+// chunk in a file. SHA256 and Offset always describe the chunk's
+// uncompressed content.
 type ChunkInfo struct {
 	SHA256 string `json:"sha256"`
 	Offset int64  `json:"offset"`
+	// Length is the chunk's uncompressed size. It's always populated so
+	// readers can learn a file's total size without needing to stat (and
+	// potentially decompress) its last chunk file on disk.
+	Length int64 `json:"length,omitempty"`
+	// Compression is CompressionNone, CompressionZstd, or CompressionGzip,
+	// naming how the chunk file under chunksDir is stored. The zero value
+	// (chunk index files written before this field existed) behaves like
+	// CompressionNone.
+	Compression string `json:"compression,omitempty"`
+	// CompressedSize is the on-disk size of the chunk's stored payload when
+	// Compression isn't CompressionNone.
+	CompressedSize int64 `json:"compressed_size,omitempty"`
+	// SegmentID is the 0-based id of the segment file (see segmentstore)
+	// that packs this chunk's payload alongside others, or nil if the
+	// chunk instead has its own file named by SHA256 under chunksDir.
+	SegmentID *int `json:"segment_id,omitempty"`
+	// SegmentOffset is the byte offset of this chunk's payload within its
+	// segment file. Only meaningful when SegmentID is set.
+	SegmentOffset int64 `json:"segment_offset,omitempty"`
 }
 
-// ChunkFile divides a file into chunks
-// and saves them in chunksDir, each named with its sha256.
-// It returns the list of the chunks with their SHA256 and offset in the source file.
+// ChunkFile divides a file into chunks and saves them uncompressed in
+// chunksDir, each named with its sha256. It returns the list of the chunks
+// with their SHA256, offset, and length in the source file. Equivalent to
+// ChunkFileWithCompression with CompressionNone.
 func ChunkFile(path string, chunksDir string, avgChunkSizeKb int) ([]ChunkInfo, error) {
+	return ChunkFileWithCompression(path, chunksDir, avgChunkSizeKb, CompressionNone)
+}
+
+// ChunkFileWithCompression is ChunkFileWithChunker with ChunkerFastCDC and no
+// cross-file dedup.
+func ChunkFileWithCompression(path string, chunksDir string, avgChunkSizeKb int, compression string) ([]ChunkInfo, error) {
+	return ChunkFileWithChunker(path, chunksDir, avgChunkSizeKb, compression, ChunkerFastCDC, nil)
+}
+
+// ChunkDedup tracks which chunk sha256s have already been written to a
+// chunksDir, so that chunking multiple files into the same chunksDir (see
+// DirUploader.chunkFiles) writes each unique chunk at most once even when
+// the files are chunked concurrently. The zero value is not usable; create
+// one with NewChunkDedup. Safe for concurrent use.
+type ChunkDedup struct {
+	mu   sync.Mutex
+	seen map[string]int64 // sha256 -> on-disk compressed size (0 for CompressionNone)
+}
+
+// NewChunkDedup returns a ChunkDedup ready to be shared across concurrent
+// ChunkFileWithChunker calls that write into the same chunksDir.
+func NewChunkDedup() *ChunkDedup {
+	return &ChunkDedup{seen: make(map[string]int64)}
+}
+
+// writeOnce writes chunk under chunksDir unless sha256 was already written
+// by a prior call on this ChunkDedup, returning the on-disk compressed size
+// either way.
+func (d *ChunkDedup) writeOnce(chunksDir, sha256 string, chunk fastcdc.Chunk, compression string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if size, ok := d.seen[sha256]; ok {
+		return size, nil
+	}
+	size, err := writeChunkToFile(chunksDir, sha256, chunk, compression)
+	if err != nil {
+		return 0, err
+	}
+	d.seen[sha256] = size
+	return size, nil
+}
+
+// ChunkFileWithChunker divides a file into chunks using chunkerKind
+// (ChunkerFastCDC or ChunkerFixed; "" behaves like ChunkerFastCDC) and saves
+// them in chunksDir, each named with its uncompressed sha256 (so dedup and
+// restores are unaffected by compression). When compression is
+// CompressionZstd or CompressionGzip, each chunk file on disk is an
+// individually compressed frame; otherwise chunks are stored raw. dedup, if
+// non-nil, is consulted and updated instead of chunking this file in
+// isolation, so identical chunks across multiple ChunkFileWithChunker calls
+// sharing dedup (and chunksDir) are only written once; a nil dedup only
+// dedups within this file. It returns the list of the chunks with their
+// SHA256, offset, and uncompressed length in the source file.
+func ChunkFileWithChunker(path string, chunksDir string, avgChunkSizeKb int, compression, chunkerKind string, dedup *ChunkDedup) ([]ChunkInfo, error) {
+	if compression == "" {
+		compression = CompressionNone
+	}
+	if !knownCompression(compression) {
+		return nil, fmt.Errorf("unknown chunk compression %q", compression)
+	}
+	if !knownChunker(chunkerKind) {
+		return nil, fmt.Errorf("unknown chunker %q", chunkerKind)
+	}
+
 	source, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open %s: %v", path, err)
@@ -33,16 +215,16 @@ func ChunkFile(path string, chunksDir string, avgChunkSizeKb int) ([]ChunkInfo,
 		return nil, fmt.Errorf("failed to get file info for %s: %v", path, err)
 	}
 
-	chunker, err := fastcdc.NewChunker(source, fastcdc.Options{
-		AverageSize: 1024 * avgChunkSizeKb,
-	})
+	chunker, err := newSplitter(source, avgChunkSizeKb, chunkerKind)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create chunker for %s: %v", path, err)
 	}
+	if dedup == nil {
+		dedup = NewChunkDedup()
+	}
 
 	// Add 5% to the estimated chunks to hopefully avoid in-loop reallocating of a large slice.
 	estimatedChunks := int(1.05*float64(fileInfo.Size())/float64(1024*avgChunkSizeKb)) + 1
-	seenChunks := make(map[string]struct{})	// Use the map as a set to deduplicate chunks.
 	chunkList := make([]ChunkInfo, 0, estimatedChunks)
 
 	for {
@@ -55,15 +237,16 @@ func ChunkFile(path string, chunksDir string, avgChunkSizeKb int) ([]ChunkInfo,
 		}
 
 		sha256 := chunkSHA256(chunk)
-		if _, ok := seenChunks[sha256]; !ok {
-			// To add the sha to the set, assign an empty struct value
-			seenChunks[sha256] = struct{}{}
+		compressedSize, err := dedup.writeOnce(chunksDir, sha256, chunk, compression)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write chunk %s: %w", sha256, err)
+		}
 
-			if err := writeChunkToFile(chunksDir, sha256, chunk); err != nil {
-				return nil, fmt.Errorf("failed to write chunk %s: %w", sha256, err)
-			}
+		info := ChunkInfo{SHA256: sha256, Offset: int64(chunk.Offset), Length: int64(len(chunk.Data)), Compression: compression}
+		if compression != CompressionNone {
+			info.CompressedSize = compressedSize
 		}
-		chunkList = append(chunkList, ChunkInfo{SHA256: sha256, Offset: int64(chunk.Offset)})
+		chunkList = append(chunkList, info)
 	}
 
 	return chunkList, nil
@@ -76,9 +259,121 @@ func chunkSHA256(chunk fastcdc.Chunk) string {
 	return hashCode
 }
 
-func writeChunkToFile(dir string, sha256 string, chunk fastcdc.Chunk) error {
+// writeChunkToFile writes chunk's data under dir named by its sha256,
+// compressing it first per compression, and returns the size written to
+// disk (0 for CompressionNone, since callers only care about the compressed
+// size).
+func writeChunkToFile(dir string, sha256 string, chunk fastcdc.Chunk, compression string) (int64, error) {
 	path := filepath.Join(dir, sha256)
-	return os.WriteFile(path, chunk.Data, 0644)
+	if compression == CompressionNone {
+		return 0, os.WriteFile(path, chunk.Data, 0644)
+	}
+
+	compressed, err := compressChunk(chunk.Data, compression)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(path, compressed, 0644); err != nil {
+		return 0, err
+	}
+	return int64(len(compressed)), nil
+}
+
+// compressChunk compresses data as a standalone zstd frame or gzip stream,
+// per compression (CompressionZstd or CompressionGzip).
+func compressChunk(data []byte, compression string) ([]byte, error) {
+	if compression == CompressionGzip {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("failed to gzip-compress chunk: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("failed to gzip-compress chunk: %v", err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %v", err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil), nil
+}
+
+// ChunkFileWithSegments is like ChunkFileWithCompression, but instead of
+// writing each unique chunk as its own file under chunksDir, it packs chunk
+// payloads into the segment files managed by segWriter (see segmentstore),
+// avoiding the inode overhead of one file per chunk on trees that produce
+// millions of small chunks.
+func ChunkFileWithSegments(path string, avgChunkSizeKb int, compression string, segWriter *segmentstore.Writer) ([]ChunkInfo, error) {
+	if compression == "" {
+		compression = CompressionNone
+	}
+	if !knownCompression(compression) {
+		return nil, fmt.Errorf("unknown chunk compression %q", compression)
+	}
+
+	source, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer source.Close()
+
+	fileInfo, err := source.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file info for %s: %v", path, err)
+	}
+
+	chunker, err := fastcdc.NewChunker(source, fastcdc.Options{
+		AverageSize: 1024 * avgChunkSizeKb,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chunker for %s: %v", path, err)
+	}
+
+	estimatedChunks := int(1.05*float64(fileInfo.Size())/float64(1024*avgChunkSizeKb)) + 1
+	chunkList := make([]ChunkInfo, 0, estimatedChunks)
+
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sha256 := chunkSHA256(chunk)
+		payload := chunk.Data
+		if compression != CompressionNone {
+			if payload, err = compressChunk(chunk.Data, compression); err != nil {
+				return nil, fmt.Errorf("failed to compress chunk %s: %w", sha256, err)
+			}
+		}
+
+		loc, err := segWriter.WriteChunk(sha256, payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write chunk %s to segment store: %w", sha256, err)
+		}
+
+		segmentID := loc.SegmentID
+		info := ChunkInfo{
+			SHA256:        sha256,
+			Offset:        int64(chunk.Offset),
+			Length:        int64(len(chunk.Data)),
+			Compression:   compression,
+			SegmentID:     &segmentID,
+			SegmentOffset: loc.Offset,
+		}
+		if compression != CompressionNone {
+			info.CompressedSize = int64(len(payload))
+		}
+		chunkList = append(chunkList, info)
+	}
+
+	return chunkList, nil
 }
 
 // RestoreFile restores a file from its chunks file in chunksDir using.
@@ -88,8 +383,10 @@ func RestoreFile(path string, chunksDir string, chunks []ChunkInfo) error {
 		return fmt.Errorf("error creating directories: %w", err)
 	}
 
-	if len(chunks) == 1 {
-		// Hard link the file if there is only one chunk.
+	if len(chunks) == 1 && (chunks[0].Compression == CompressionNone || chunks[0].Compression == "") {
+		// Hard link the file if there is only one, uncompressed chunk. A
+		// compressed chunk can't be hard-linked as-is since its on-disk
+		// content isn't the file's content.
 		chunk := chunks[0]
 		if err := os.Link(filepath.Join(chunksDir, chunk.SHA256), path); err == nil {
 			return nil
@@ -105,12 +402,77 @@ func RestoreFile(path string, chunksDir string, chunks []ChunkInfo) error {
 
 	// Restore the file by appending chunks.
 	for _, chunk := range chunks {
-		chunkFile, err := os.Open(filepath.Join(chunksDir, chunk.SHA256))
+		data, err := readChunkFile(chunksDir, chunk)
+		if err != nil {
+			return fmt.Errorf("failed to read chunk file: %v", err)
+		}
+		if _, err := file.Write(data); err != nil {
+			return fmt.Errorf("failed to append chunk to artifact: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// readChunkFile reads chunk's file under chunksDir, transparently
+// decompressing it per chunk.Compression.
+func readChunkFile(chunksDir string, chunk ChunkInfo) ([]byte, error) {
+	raw, err := os.ReadFile(filepath.Join(chunksDir, chunk.SHA256))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open chunk file: %v", err)
+	}
+	return decompressIfNeeded(raw, chunk.Compression)
+}
+
+func decompressIfNeeded(raw []byte, compression string) ([]byte, error) {
+	switch compression {
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %v", err)
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(raw, nil)
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip decoder: %v", err)
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return raw, nil
+	}
+}
+
+// RestoreFileWithSegments is like RestoreFile, but reads chunk payloads from
+// the segment files managed by segReader (see segmentstore) rather than
+// from individual chunk files under chunksDir, for chunks that carry a
+// SegmentID.
+func RestoreFileWithSegments(path string, chunks []ChunkInfo, segReader *segmentstore.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating directories: %w", err)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	defer file.Close()
+
+	for _, chunk := range chunks {
+		if chunk.SegmentID == nil {
+			return fmt.Errorf("chunk %s has no segment metadata", chunk.SHA256)
+		}
+		raw, err := segReader.ReadChunk(chunk.SHA256)
 		if err != nil {
-			return fmt.Errorf("failed to open chunk file: %v", err)
+			return fmt.Errorf("failed to read chunk %s from segment store: %w", chunk.SHA256, err)
 		}
-		_, err = io.Copy(file, chunkFile)
+		data, err := decompressIfNeeded(raw, chunk.Compression)
 		if err != nil {
+			return fmt.Errorf("failed to decompress chunk %s: %w", chunk.SHA256, err)
+		}
+		if _, err := file.Write(data); err != nil {
 			return fmt.Errorf("failed to append chunk to artifact: %v", err)
 		}
 	}
@@ -21,9 +21,14 @@ func TestChunkFile(t *testing.T) {
 	tests := []struct {
 		name             string
 		duplicateContent bool
+		compression      string
 	}{
-		{"regluar", false},
-		{"duplicateContent", true},
+		{"regluar", false, CompressionNone},
+		{"duplicateContent", true, CompressionNone},
+		{"zstdCompressed", false, CompressionZstd},
+		{"zstdCompressedDuplicateContent", true, CompressionZstd},
+		{"gzipCompressed", false, CompressionGzip},
+		{"gzipCompressedDuplicateContent", true, CompressionGzip},
 	}
 
 	for _, test := range tests {
@@ -47,7 +52,7 @@ func TestChunkFile(t *testing.T) {
 		}
 
 		avgChunkSizeKB := fileSizeKB / 10
-		chunks, err := ChunkFile(sourcePath, chunksDir, avgChunkSizeKB)
+		chunks, err := ChunkFileWithCompression(sourcePath, chunksDir, avgChunkSizeKB, test.compression)
 		if err != nil {
 			t.Fatalf("Failed to chunk file: %v", err)
 		}
@@ -66,6 +71,45 @@ func TestChunkFile(t *testing.T) {
 	}
 }
 
+func TestChunkFileWithChunker_Fixed(t *testing.T) {
+	const fileSizeKB = 2 * 1024
+	const avgChunkSizeKB = fileSizeKB / 10
+
+	targetDir := t.TempDir()
+	chunksDir := filepath.Join(targetDir, "chunks")
+	os.MkdirAll(chunksDir, 0755)
+
+	sourcePath := filepath.Join(targetDir, "source")
+	if err := createRandomFile(sourcePath, fileSizeKB*1024, time.Now().UnixNano(), false); err != nil {
+		t.Fatalf("Failed to create random file: %v", err)
+	}
+
+	chunks, err := ChunkFileWithChunker(sourcePath, chunksDir, avgChunkSizeKB, CompressionNone, ChunkerFixed, nil)
+	if err != nil {
+		t.Fatalf("ChunkFileWithChunker(ChunkerFixed) failed: %v", err)
+	}
+
+	want := int64(avgChunkSizeKB * 1024)
+	for i, chunk := range chunks[:len(chunks)-1] {
+		if chunk.Length != want {
+			t.Errorf("chunk %d Length = %d, want %d (only the last chunk may be shorter)", i, chunk.Length, want)
+		}
+	}
+	if last := chunks[len(chunks)-1]; last.Length <= 0 || last.Length > want {
+		t.Errorf("last chunk Length = %d, want in (0, %d]", last.Length, want)
+	}
+
+	restoredPath := filepath.Join(targetDir, "restored")
+	if err := RestoreFile(restoredPath, chunksDir, chunks); err != nil {
+		t.Fatalf("Failed to restore file: %v", err)
+	}
+	if matched, err := compareFilesByHash(sourcePath, restoredPath); err != nil {
+		t.Fatalf("Failed to compare files by hash: %v", err)
+	} else if !matched {
+		t.Fatalf("The hashes for the source and restored file do not match")
+	}
+}
+
 func createRandomFile(path string, size int, seed int64, duplicateContent bool) error {
 	fmt.Printf("Creating a random file %s of size %d using seed %d\n", path, size, seed)
 
@@ -0,0 +1,193 @@
+// Package chunkercache persists, across casuploader invocations, a mapping
+// from a file's on-disk identity to the ChunksIndex produced by chunking
+// it, plus a shared content-addressable pool of the chunk files themselves.
+// A second upload of a mostly-unchanged tree can then skip re-reading and
+// re-chunking unchanged files entirely, only re-materializing their chunk
+// files into the current invocation's (temporary) chunks dir from the pool.
+package chunkercache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// CacheFileName is the name of the cache's index file under its dir.
+	CacheFileName = "chunker_cache.json"
+	// PoolDirName is the name of the dir, under the cache's dir, that holds
+	// the shared content-addressable chunk pool.
+	PoolDirName = "pool"
+)
+
+// Key identifies a file's on-disk identity for cache lookups. Two files
+// with equal Keys are assumed to have identical content, so the second
+// one's ChunksIndex can be reused without re-reading or re-chunking it.
+//
+// ModTimeUnixNano is an int64, not a time.Time, because Key is used as a
+// map key: time.Time's == compares its monotonic reading and *Location
+// pointer, not just the instant, so a Time built fresh from os.FileInfo
+// wouldn't compare equal to one round-tripped through JSON, and every
+// reload of a persisted cache would silently miss on every entry.
+type Key struct {
+	Path            string      `json:"path"`
+	Size            int64       `json:"size"`
+	ModTimeUnixNano int64       `json:"mod_time_unix_nano"`
+	Mode            os.FileMode `json:"mode"`
+}
+
+// entry pairs a Key with its cached value. Cache persists as a flat JSON
+// list of entries rather than a JSON object keyed by Key, since Key isn't a
+// valid JSON object key.
+type entry struct {
+	Key   Key             `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Cache is a persistent (Key -> arbitrary JSON value) cache backed by a
+// single index file, plus a content-addressable chunk pool, under dir.
+type Cache struct {
+	dir     string
+	entries map[Key]json.RawMessage
+	dirty   bool
+}
+
+// DefaultDir returns the default chunker cache dir, under the user's cache
+// dir (respects $XDG_CACHE_HOME on Linux; see os.UserCacheDir).
+func DefaultDir() (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine user cache dir: %w", err)
+	}
+	return filepath.Join(base, "casuploader"), nil
+}
+
+// Open loads the cache's index file from dir, or returns an empty Cache if
+// dir has none yet.
+func Open(dir string) (*Cache, error) {
+	c := &Cache{dir: dir, entries: map[Key]json.RawMessage{}}
+
+	data, err := os.ReadFile(filepath.Join(dir, CacheFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("failed to read chunker cache: %w", err)
+	}
+
+	var entries []entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chunker cache: %w", err)
+	}
+	for _, e := range entries {
+		c.entries[e.Key] = e.Value
+	}
+	return c, nil
+}
+
+// Get looks up key and, on a hit, unmarshals its cached value into dest.
+func (c *Cache) Get(key Key, dest any) (bool, error) {
+	raw, ok := c.entries[key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, dest); err != nil {
+		return false, fmt.Errorf("failed to unmarshal cached entry for %s: %w", key.Path, err)
+	}
+	return true, nil
+}
+
+// Put stores value under key, to be persisted by the next Save.
+func (c *Cache) Put(key Key, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache entry for %s: %w", key.Path, err)
+	}
+	c.entries[key] = raw
+	c.dirty = true
+	return nil
+}
+
+// Save persists the cache's index file to disk, if it has unsaved changes.
+func (c *Cache) Save() error {
+	if !c.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create chunker cache dir: %w", err)
+	}
+
+	entries := make([]entry, 0, len(c.entries))
+	for k, v := range c.entries {
+		entries = append(entries, entry{Key: k, Value: v})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal chunker cache: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(c.dir, CacheFileName), data, 0644); err != nil {
+		return fmt.Errorf("failed to write chunker cache: %w", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// EnsureChunks materializes the chunk files named by shas into chunksDir
+// from the shared pool, for any that chunksDir (typically a fresh
+// per-invocation temp dir) doesn't already have. Chunks are hard-linked
+// from the pool when possible, falling back to a copy across filesystems.
+func (c *Cache) EnsureChunks(chunksDir string, shas []string) error {
+	poolDir := filepath.Join(c.dir, PoolDirName)
+	for _, sha := range shas {
+		dst := filepath.Join(chunksDir, sha)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := linkOrCopy(filepath.Join(poolDir, sha), dst); err != nil {
+			return fmt.Errorf("failed to materialize pooled chunk %s: %w", sha, err)
+		}
+	}
+	return nil
+}
+
+// AddChunks adds the chunk files named by shas, found under chunksDir, to
+// the shared pool, so a future cache hit can restore them via EnsureChunks
+// without re-chunking their source file.
+func (c *Cache) AddChunks(chunksDir string, shas []string) error {
+	poolDir := filepath.Join(c.dir, PoolDirName)
+	if err := os.MkdirAll(poolDir, 0755); err != nil {
+		return fmt.Errorf("failed to create chunk pool dir: %w", err)
+	}
+	for _, sha := range shas {
+		dst := filepath.Join(poolDir, sha)
+		if _, err := os.Stat(dst); err == nil {
+			continue // Already pooled, e.g. by another chunk with the same content.
+		}
+		if err := linkOrCopy(filepath.Join(chunksDir, sha), dst); err != nil {
+			return fmt.Errorf("failed to add chunk %s to pool: %w", sha, err)
+		}
+	}
+	return nil
+}
+
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,83 @@
+package chunkercache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutGetSave(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	key := Key{Path: "/src/foo", Size: 123, ModTimeUnixNano: 1000, Mode: 0644}
+	if ok, err := c.Get(key, new(string)); err != nil || ok {
+		t.Errorf("Get() on empty cache = %v, %v, want false, nil", ok, err)
+	}
+
+	if err := c.Put(key, "chunked"); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+
+	var got string
+	if ok, err := c.Get(key, &got); err != nil || !ok || got != "chunked" {
+		t.Errorf("Get() after Put() = %q, %v, %v, want %q, true, nil", got, ok, err, "chunked")
+	}
+
+	if err := c.Save(); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() after Save() failed: %v", err)
+	}
+	got = ""
+	if ok, err := reopened.Get(key, &got); err != nil || !ok || got != "chunked" {
+		t.Errorf("Get() on reopened cache = %q, %v, %v, want %q, true, nil", got, ok, err, "chunked")
+	}
+}
+
+func TestOpenMissing(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "does-not-exist"))
+	if err != nil {
+		t.Fatalf("Open() on missing dir failed: %v", err)
+	}
+	if len(c.entries) != 0 {
+		t.Errorf("Open() on missing dir = %d entries, want 0", len(c.entries))
+	}
+}
+
+func TestEnsureAndAddChunks(t *testing.T) {
+	dir := t.TempDir()
+	c, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "sha-a"), []byte("chunk-a-content"), 0644); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	if err := c.AddChunks(srcDir, []string{"sha-a"}); err != nil {
+		t.Fatalf("AddChunks() failed: %v", err)
+	}
+
+	dstDir := t.TempDir()
+	if err := c.EnsureChunks(dstDir, []string{"sha-a"}); err != nil {
+		t.Fatalf("EnsureChunks() failed: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dstDir, "sha-a"))
+	if err != nil {
+		t.Fatalf("ReadFile() on restored chunk failed: %v", err)
+	}
+	if string(got) != "chunk-a-content" {
+		t.Errorf("restored chunk content = %q, want %q", got, "chunk-a-content")
+	}
+}
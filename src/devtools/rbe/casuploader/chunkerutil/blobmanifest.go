@@ -0,0 +1,59 @@
+package chunkerutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+)
+
+// BlobManifestMagic is prepended to a BlobManifest's JSON encoding when it's
+// uploaded to CAS in place of a file's own content (see EncodeBlobManifest).
+// It lets a reader distinguish a manifest blob from a file's literal content
+// without any side channel: any blob starting with this prefix is a
+// BlobManifest, and any blob that isn't is ordinary content, exactly as it
+// would have been without this feature.
+var BlobManifestMagic = []byte("casuploader-blob-manifest-v1\n")
+
+// BlobManifest is a CAS-embeddable index of the chunks whose concatenation
+// reconstructs a single file's content, for a file that DirUploader chose
+// to upload as chunks instead of as one blob (see DoUpload's
+// partialBlobThreshold). It's the analogue of ChunksIndex, but describes
+// one file as a blob in its own right rather than as a sidecar index
+// alongside a whole chunked directory tree.
+type BlobManifest struct {
+	// Chunks lists, in order, the digest of every chunk whose concatenation
+	// reconstructs the original file's content.
+	Chunks []digest.Digest `json:"chunks"`
+}
+
+// EncodeBlobManifest returns m's magic-prefixed wire encoding, suitable for
+// upload as a CAS blob in place of a file's literal content.
+func EncodeBlobManifest(m BlobManifest) ([]byte, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal blob manifest: %v", err)
+	}
+	return append(append([]byte{}, BlobManifestMagic...), body...), nil
+}
+
+// IsBlobManifest reports whether data is a BlobManifest's encoding, i.e.
+// starts with BlobManifestMagic.
+func IsBlobManifest(data []byte) bool {
+	return bytes.HasPrefix(data, BlobManifestMagic)
+}
+
+// DecodeBlobManifest decodes data as a BlobManifest. Callers should check
+// IsBlobManifest first; DecodeBlobManifest returns an error if data doesn't
+// start with BlobManifestMagic.
+func DecodeBlobManifest(data []byte) (BlobManifest, error) {
+	if !IsBlobManifest(data) {
+		return BlobManifest{}, fmt.Errorf("data is not a blob manifest (missing magic prefix)")
+	}
+	var m BlobManifest
+	if err := json.Unmarshal(data[len(BlobManifestMagic):], &m); err != nil {
+		return BlobManifest{}, fmt.Errorf("failed to unmarshal blob manifest: %v", err)
+	}
+	return m, nil
+}
@@ -13,6 +13,9 @@ import (
 
 	log "github.com/golang/glog"
 	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkercache"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/metrics"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/segmentstore"
 )
 
 const (
@@ -24,6 +27,31 @@ const (
 	snippetSize = 1024
 )
 
+// Limits bounds the resources ChunkFile and CreateIndexFile are willing to
+// process, mirroring the safety limits uploader.zipUnarchiver applies when
+// extracting an archive: a cap on a single file's size, and on the number of
+// files one index describes, so a crafted or unexpectedly huge input tree
+// can't exhaust disk space or inodes.
+type Limits struct {
+	MaxFileSize int64
+	MaxFiles    int
+}
+
+// DefaultLimits are the limits ChunkFile and CreateIndexFile enforce.
+var DefaultLimits = Limits{
+	MaxFileSize: 512 << 20, // 512 MiB per file
+	MaxFiles:    1 << 17,   // 131072 files per index
+}
+
+var (
+	// ErrTooLarge is returned, wrapped, by ChunkFile (and its variants) when
+	// srcPath is larger than DefaultLimits.MaxFileSize.
+	ErrTooLarge = errors.New("file exceeds the configured size limit")
+	// ErrTooManyFiles is returned, wrapped, by CreateIndexFile when
+	// chunksIndex describes more files than DefaultLimits.MaxFiles.
+	ErrTooManyFiles = errors.New("too many files for one chunks index")
+)
+
 // ChunksIndex is the index of all chunks for a file.
 // A chunks index file contains a list of chunks index entries, one for each file for the upload.
 type ChunksIndex struct {
@@ -32,23 +60,178 @@ type ChunksIndex struct {
 	ModTime time.Time           `json:"mod_time"`
 	Mode    os.FileMode         `json:"mode"`
 	Chunks  []chunker.ChunkInfo `json:"chunks"`
+	// Format is FormatLegacy (or "", for backward compatibility) when Chunks
+	// is a list of standalone chunk files, or FormatZstdChunked when the
+	// file was instead stored as a single stream described by ZstdChunks.
+	Format string `json:"format,omitempty"`
+	// ZstdChunks is set instead of Chunks when Format is FormatZstdChunked.
+	ZstdChunks []ZstdChunkEntry `json:"zstd_chunks,omitempty"`
 }
 
-// ChunkFile chunks the file and returns ChunksIndex for restoration.
+// ChunkFile chunks the file, storing chunks uncompressed, and returns
+// ChunksIndex for restoration. Equivalent to ChunkFileWithFormat with
+// FormatLegacy and chunker.CompressionNone. Equivalent to ChunkFileCached
+// with a nil cache.
 func ChunkFile(srcPath string, dstPath, chunksDir string, avgChunkSize int) (ChunksIndex, error) {
-	chunks, err := chunker.ChunkFile(srcPath, chunksDir, avgChunkSize)
+	return ChunkFileCached(srcPath, dstPath, chunksDir, avgChunkSize, chunker.ChunkerFastCDC, nil, nil, nil)
+}
+
+// ChunkFileCached is like ChunkFile, but first consults cache for an entry
+// keyed by srcPath's (absolute path, size, mtime, mode). On a hit, it skips
+// re-reading and re-chunking srcPath, only re-materializing its chunk
+// files into chunksDir from the cache's shared pool (see
+// chunkercache.Cache.EnsureChunks) — this turns uploading a second,
+// mostly-unchanged tree into a near-zero-cost operation. A miss chunks the
+// file with chunkerKind (chunker.ChunkerFastCDC or chunker.ChunkerFixed) and
+// adds its ChunksIndex and chunk files to the cache for future invocations;
+// the cache key doesn't account for chunkerKind, so switching it between
+// invocations of an otherwise-unchanged tree still serves stale, previously
+// cached chunk boundaries. dedup, if non-nil, is shared with other
+// concurrent ChunkFileCached/ChunkFileWithFormat calls targeting the same
+// chunksDir so identical chunks across files are only written once (see
+// chunker.ChunkDedup). cacheMetrics, if non-nil, has its cache hit/miss
+// counters updated via RecordCacheResult. A nil cache disables caching
+// entirely.
+func ChunkFileCached(srcPath string, dstPath, chunksDir string, avgChunkSize int, chunkerKind string, dedup *chunker.ChunkDedup, cache *chunkercache.Cache, cacheMetrics *metrics.Metrics) (ChunksIndex, error) {
+	if cache == nil {
+		return chunkFileLegacy(srcPath, dstPath, chunksDir, avgChunkSize, chunkerKind, dedup, chunker.CompressionNone)
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return ChunksIndex{}, err
+	}
+	if info.Size() > DefaultLimits.MaxFileSize {
+		return ChunksIndex{}, fmt.Errorf("file %s is %d bytes, exceeding the per-file limit of %d: %w", srcPath, info.Size(), DefaultLimits.MaxFileSize, ErrTooLarge)
+	}
+	absPath, err := filepath.Abs(srcPath)
+	if err != nil {
+		return ChunksIndex{}, err
+	}
+	key := chunkercache.Key{Path: absPath, Size: info.Size(), ModTimeUnixNano: info.ModTime().UnixNano(), Mode: info.Mode()}
+
+	var cached ChunksIndex
+	if ok, err := cache.Get(key, &cached); err != nil {
+		log.Warningf("chunker cache lookup failed for %s, re-chunking: %v", srcPath, err)
+	} else if ok {
+		if err := cache.EnsureChunks(chunksDir, chunkSHAs(cached)); err != nil {
+			log.Warningf("failed to restore pooled chunks for %s, re-chunking: %v", srcPath, err)
+		} else {
+			if cacheMetrics != nil {
+				cacheMetrics.RecordCacheResult(true)
+			}
+			cached.Path = dstPath
+			return cached, nil
+		}
+	}
+
+	if cacheMetrics != nil {
+		cacheMetrics.RecordCacheResult(false)
+	}
+	chunksIndex, err := chunkFileLegacy(srcPath, dstPath, chunksDir, avgChunkSize, chunkerKind, dedup, chunker.CompressionNone)
+	if err != nil {
+		return ChunksIndex{}, err
+	}
+
+	if err := cache.AddChunks(chunksDir, chunkSHAs(chunksIndex)); err != nil {
+		log.Warningf("failed to add chunks for %s to the chunker cache pool: %v", srcPath, err)
+	} else if err := cache.Put(key, chunksIndex); err != nil {
+		log.Warningf("failed to update chunker cache for %s: %v", srcPath, err)
+	}
+
+	return chunksIndex, nil
+}
+
+func chunkSHAs(index ChunksIndex) []string {
+	shas := make([]string, len(index.Chunks))
+	for i, chunk := range index.Chunks {
+		shas[i] = chunk.SHA256
+	}
+	return shas
+}
+
+func chunkFileLegacy(srcPath string, dstPath, chunksDir string, avgChunkSize int, chunkerKind string, dedup *chunker.ChunkDedup, compression string) (ChunksIndex, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return ChunksIndex{}, err
+	}
+	if info.Size() > DefaultLimits.MaxFileSize {
+		return ChunksIndex{}, fmt.Errorf("file %s is %d bytes, exceeding the per-file limit of %d: %w", srcPath, info.Size(), DefaultLimits.MaxFileSize, ErrTooLarge)
+	}
+	chunks, err := chunker.ChunkFileWithChunker(srcPath, chunksDir, avgChunkSize, compression, chunkerKind, dedup)
 	if err != nil {
 		return ChunksIndex{}, fmt.Errorf("failed to chunk the file %s: %v", srcPath, err)
 	}
+	return ChunksIndex{Path: dstPath, ModTime: info.ModTime(), Mode: info.Mode(), Format: FormatLegacy, Chunks: chunks}, nil
+}
+
+// ChunkFileWithSegments is like ChunkFileWithFormat for FormatLegacy, but
+// packs chunk payloads into the segment files managed by segWriter (see
+// segmentstore) instead of writing each chunk as its own file under
+// chunksDir, to avoid the inode overhead of one file per chunk on trees
+// that produce millions of small chunks. The returned ChunksIndex still
+// uses Format FormatLegacy: restoration only depends on each ChunkInfo's
+// own SegmentID, not on ChunksIndex.Format.
+func ChunkFileWithSegments(srcPath string, dstPath, chunksDir string, avgChunkSize int, compression string, segWriter *segmentstore.Writer) (ChunksIndex, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return ChunksIndex{}, err
+	}
+	if info.Size() > DefaultLimits.MaxFileSize {
+		return ChunksIndex{}, fmt.Errorf("file %s is %d bytes, exceeding the per-file limit of %d: %w", srcPath, info.Size(), DefaultLimits.MaxFileSize, ErrTooLarge)
+	}
+	chunks, err := chunker.ChunkFileWithSegments(srcPath, avgChunkSize, compression, segWriter)
+	if err != nil {
+		return ChunksIndex{}, fmt.Errorf("failed to chunk the file %s: %v", srcPath, err)
+	}
+	return ChunksIndex{Path: dstPath, ModTime: info.ModTime(), Mode: info.Mode(), Format: FormatLegacy, Chunks: chunks}, nil
+}
+
+// ChunkFileWithFormat chunks the file using the given format: FormatLegacy
+// (or "") for the original many-small-files layout, or FormatZstdChunked to
+// store it as a single zstd-compressed stream with a seekable TOC under
+// chunksDir (see ChunkFileZstdChunked). compression selects the per-chunk
+// on-disk compression to use for FormatLegacy (see
+// chunker.ChunkFileWithChunker); it's ignored for FormatZstdChunked, which
+// is already compressed as a whole stream. chunkerKind (chunker.ChunkerFastCDC
+// or chunker.ChunkerFixed) selects FormatLegacy's splitting algorithm; it's
+// likewise ignored for FormatZstdChunked, which always splits on its own
+// content-defined rolling checksum (see ChunkFileZstdChunked). dedup is
+// forwarded to chunkFileLegacy for FormatLegacy (see chunker.ChunkDedup);
+// FormatZstdChunked has no equivalent cross-file dedup. It returns the
+// ChunksIndex entry for restoration.
+func ChunkFileWithFormat(srcPath string, dstPath, chunksDir string, avgChunkSize int, chunkerKind string, dedup *chunker.ChunkDedup, format, compression string) (ChunksIndex, error) {
+	if format == "" || format == FormatLegacy {
+		return chunkFileLegacy(srcPath, dstPath, chunksDir, avgChunkSize, chunkerKind, dedup, compression)
+	}
+	if format != FormatZstdChunked {
+		return ChunksIndex{}, fmt.Errorf("unknown chunk format %q", format)
+	}
+
 	info, err := os.Stat(srcPath)
 	if err != nil {
 		return ChunksIndex{}, err
 	}
-	return ChunksIndex{Path: dstPath, ModTime: info.ModTime(), Mode: info.Mode(), Chunks: chunks}, nil
+	if info.Size() > DefaultLimits.MaxFileSize {
+		return ChunksIndex{}, fmt.Errorf("file %s is %d bytes, exceeding the per-file limit of %d: %w", srcPath, info.Size(), DefaultLimits.MaxFileSize, ErrTooLarge)
+	}
+	toc, err := ChunkFileZstdChunked(srcPath, zstdChunkedBlobPath(chunksDir, dstPath), avgChunkSize)
+	if err != nil {
+		return ChunksIndex{}, fmt.Errorf("failed to chunk the file %s: %v", srcPath, err)
+	}
+	return ChunksIndex{Path: dstPath, ModTime: info.ModTime(), Mode: info.Mode(), Format: FormatZstdChunked, ZstdChunks: toc}, nil
 }
 
-// CreateIndexFile creates the index file for the collection of ChunksIndex and chunks.
-func CreateIndexFile(inDir string, chunksIndex []ChunksIndex) error {
+// CreateIndexFile creates the index file for the collection of ChunksIndex
+// and chunks, along with a sidecar Manifest recording avgChunkSizeKB and a
+// digest of the index contents (see WriteManifest) so a reader like
+// chunkstore.NewChunkStoreWithOptions can detect a truncated or
+// tampered-with index before trusting any of its chunk digests.
+func CreateIndexFile(inDir string, chunksIndex []ChunksIndex, avgChunkSizeKB int) error {
+	if len(chunksIndex) > DefaultLimits.MaxFiles {
+		return fmt.Errorf("chunks index for %s has %d files, exceeding the limit of %d: %w", inDir, len(chunksIndex), DefaultLimits.MaxFiles, ErrTooManyFiles)
+	}
+
 	outputContent, err := json.MarshalIndent(chunksIndex, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshall chunk index: %v", err)
@@ -68,6 +251,14 @@ func CreateIndexFile(inDir string, chunksIndex []ChunksIndex) error {
 	hash := sha256.Sum256(outputContent)
 	log.Infof("hash of index file: %s", hex.EncodeToString(hash[:]))
 
+	params := ChunkerParams{AvgChunkSizeKB: avgChunkSizeKB, Hash: "sha256"}
+	if err := WriteManifest(inDir, outputContent, params); err != nil {
+		// The manifest only adds optional tamper/truncation detection; a
+		// reader with no manifest just skips verification, so don't fail
+		// the upload over it.
+		log.Errorf("failed to write chunks manifest: %v", err)
+	}
+
 	return nil
 }
 
@@ -87,17 +278,17 @@ func logFileSnippets(filepath string, content []byte) {
 	log.Infof("File content snippet (last %d bytes):\n%s", snippetSize, string(content[len(content)-snippetSize:]))
 }
 
-// RestoreFiles restores files to dstDir with chunks index file and chunks file in srcDir.
-func RestoreFiles(srcDir string, dstDir string, keepChunks bool) error {
-	indexPath, err := FindChunksIndex(srcDir)
+// LoadChunksIndex reads and parses the chunks index file in dir, checking
+// both the chunks-dir and legacy root locations (see FindChunksIndex).
+func LoadChunksIndex(dir string) ([]ChunksIndex, error) {
+	indexPath, err := FindChunksIndex(dir)
 	if err != nil {
-		log.Infof("no chunk index file found, skip restoring chunked files")
-		return nil
+		return nil, err
 	}
 
 	index, err := os.ReadFile(indexPath)
 	if err != nil {
-		return fmt.Errorf("can't read chunk index file: %v", err)
+		return nil, fmt.Errorf("can't read chunk index file: %v", err)
 	}
 
 	hash := sha256.Sum256(index)
@@ -106,14 +297,48 @@ func RestoreFiles(srcDir string, dstDir string, keepChunks bool) error {
 	var chunksIndexEntries []ChunksIndex
 	if err := json.Unmarshal(index, &chunksIndexEntries); err != nil {
 		logFileSnippets(indexPath, index)
-		return fmt.Errorf("can't unmarshal chunk index file: %v", err)
+		return nil, fmt.Errorf("can't unmarshal chunk index file: %v", err)
+	}
+	return chunksIndexEntries, nil
+}
+
+// RestoreFiles restores files to dstDir with chunks index file and chunks file in srcDir.
+func RestoreFiles(srcDir string, dstDir string, keepChunks bool) error {
+	chunksIndexEntries, err := LoadChunksIndex(srcDir)
+	if err != nil {
+		log.Infof("no chunk index file found, skip restoring chunked files")
+		return nil
 	}
 
 	chunksDir := filepath.Join(srcDir, ChunksDirName)
+
+	// Segment metadata, if present, means chunk payloads for this upload
+	// were packed into segment files rather than written one-per-chunk;
+	// see segmentstore.
+	segIndex, err := segmentstore.LoadIndex(chunksDir)
+	if err != nil {
+		return fmt.Errorf("failed to load segment index: %w", err)
+	}
+	var segReader *segmentstore.Reader
+	if segIndex != nil {
+		segReader = segmentstore.NewReader(chunksDir, segIndex)
+	}
+
 	for _, chunksIndex := range chunksIndexEntries {
 		dstPath := filepath.Join(dstDir, chunksIndex.Path)
-		if err := chunker.RestoreFile(dstPath, chunksDir, chunksIndex.Chunks); err != nil {
-			return err
+		switch {
+		case chunksIndex.Format == FormatZstdChunked:
+			if err := RestoreZstdChunkedFile(dstPath, zstdChunkedBlobPath(chunksDir, chunksIndex.Path), chunksIndex.ZstdChunks); err != nil {
+				return err
+			}
+		case segReader != nil && len(chunksIndex.Chunks) > 0 && chunksIndex.Chunks[0].SegmentID != nil:
+			if err := chunker.RestoreFileWithSegments(dstPath, chunksIndex.Chunks, segReader); err != nil {
+				return err
+			}
+		default:
+			if err := chunker.RestoreFile(dstPath, chunksDir, chunksIndex.Chunks); err != nil {
+				return err
+			}
 		}
 		if !chunksIndex.ModTime.IsZero() { // for backward compatibility
 			os.Chtimes(dstPath, chunksIndex.ModTime, chunksIndex.ModTime)
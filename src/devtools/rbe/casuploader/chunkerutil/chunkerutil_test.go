@@ -1,9 +1,14 @@
 package chunkerutil
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkercache"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/metrics"
 )
 
 func TestFindChunksIndex(t *testing.T) {
@@ -97,3 +102,82 @@ func TestFindChunksIndex(t *testing.T) {
 		}
 	})
 }
+
+func TestChunkFile_TooLarge(t *testing.T) {
+	orig := DefaultLimits
+	defer func() { DefaultLimits = orig }()
+	DefaultLimits.MaxFileSize = 4
+
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "src.txt")
+	if err := os.WriteFile(srcPath, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	_, err := ChunkFile(srcPath, "src.txt", t.TempDir(), 1024)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("ChunkFile() error = %v, want wrapping ErrTooLarge", err)
+	}
+}
+
+func TestCreateIndexFile_TooManyFiles(t *testing.T) {
+	orig := DefaultLimits
+	defer func() { DefaultLimits = orig }()
+	DefaultLimits.MaxFiles = 1
+
+	err := CreateIndexFile(t.TempDir(), []ChunksIndex{{Path: "a"}, {Path: "b"}}, 1024)
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Errorf("CreateIndexFile() error = %v, want wrapping ErrTooManyFiles", err)
+	}
+}
+
+func TestChunkFileCached(t *testing.T) {
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "src.txt")
+	if err := os.WriteFile(srcPath, []byte("hello cached world"), 0644); err != nil {
+		t.Fatalf("Failed to write source file: %v", err)
+	}
+
+	cache, err := chunkercache.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("chunkercache.Open() failed: %v", err)
+	}
+	m := &metrics.Metrics{}
+
+	chunksDir1 := t.TempDir()
+	index1, err := ChunkFileCached(srcPath, "src.txt", chunksDir1, 1024, chunker.ChunkerFastCDC, nil, cache, m)
+	if err != nil {
+		t.Fatalf("ChunkFileCached() first call failed: %v", err)
+	}
+	if m.CacheMisses != 1 || m.CacheHits != 0 {
+		t.Errorf("after first call: CacheHits=%d, CacheMisses=%d, want 0, 1", m.CacheHits, m.CacheMisses)
+	}
+
+	// A second chunking of the same unchanged file should hit the cache and
+	// restore identical chunk files from the shared pool, without re-reading
+	// or re-chunking the source.
+	chunksDir2 := t.TempDir()
+	index2, err := ChunkFileCached(srcPath, "src.txt", chunksDir2, 1024, chunker.ChunkerFastCDC, nil, cache, m)
+	if err != nil {
+		t.Fatalf("ChunkFileCached() second call failed: %v", err)
+	}
+	if m.CacheHits != 1 || m.CacheMisses != 1 {
+		t.Errorf("after second call: CacheHits=%d, CacheMisses=%d, want 1, 1", m.CacheHits, m.CacheMisses)
+	}
+	if len(index1.Chunks) != len(index2.Chunks) {
+		t.Fatalf("chunk count mismatch: %d vs %d", len(index1.Chunks), len(index2.Chunks))
+	}
+	for i, chunk := range index1.Chunks {
+		original, err := os.ReadFile(filepath.Join(chunksDir1, chunk.SHA256))
+		if err != nil {
+			t.Fatalf("Failed to read original chunk %s: %v", chunk.SHA256, err)
+		}
+		restored, err := os.ReadFile(filepath.Join(chunksDir2, index2.Chunks[i].SHA256))
+		if err != nil {
+			t.Fatalf("Failed to read restored chunk %s: %v", chunk.SHA256, err)
+		}
+		if string(restored) != string(original) {
+			t.Errorf("restored chunk %s content mismatch", chunk.SHA256)
+		}
+	}
+}
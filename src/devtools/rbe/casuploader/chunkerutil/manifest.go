@@ -0,0 +1,88 @@
+package chunkerutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ManifestFileName is the sidecar file written alongside ChunksIndexFileName
+// by CreateIndexFile (see Manifest). It's optional: an index written before
+// this feature existed, or by a caller that doesn't call CreateIndexFile,
+// simply has no manifest, and LoadManifest reports that rather than erroring.
+const ManifestFileName = "_chunks_manifest.json"
+
+// manifestVersion is bumped whenever Manifest's shape changes incompatibly.
+const manifestVersion = 1
+
+// ChunkerParams records the chunking parameters used to produce an index,
+// for diagnostics; unlike EntriesDigest, it isn't itself verified.
+type ChunkerParams struct {
+	AvgChunkSizeKB int    `json:"avg_chunk_size_kb,omitempty"`
+	Hash           string `json:"hash,omitempty"`
+}
+
+// Manifest is a sidecar record of the chunks index's format version,
+// chunking parameters, and a digest of the index file's contents, in the
+// spirit of the TOC header used by eStargz/zstd:chunked images: it lets a
+// reader detect a truncated or tampered-with index before trusting any of
+// the chunk digests it names.
+type Manifest struct {
+	Version int           `json:"version"`
+	Chunker ChunkerParams `json:"chunker"`
+	// EntriesDigest is the hex SHA256 of ChunksIndexFileName's raw bytes at
+	// the time this manifest was written.
+	EntriesDigest string `json:"entries_digest"`
+}
+
+// WriteManifest writes a Manifest describing indexJSON (the raw bytes
+// already written to dir as ChunksIndexFileName) alongside it as
+// ManifestFileName.
+func WriteManifest(dir string, indexJSON []byte, params ChunkerParams) error {
+	hash := sha256.Sum256(indexJSON)
+	manifest := Manifest{
+		Version:       manifestVersion,
+		Chunker:       params,
+		EntriesDigest: hex.EncodeToString(hash[:]),
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFileName), data, 0644)
+}
+
+// LoadManifest reads the sidecar manifest under dir, or returns nil, nil if
+// none exists (e.g. the index predates this feature, or was produced by a
+// caller that skips CreateIndexFile).
+func LoadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// VerifyManifest checks indexJSON's SHA256 against manifest's recorded
+// EntriesDigest. A nil manifest always verifies successfully, since there's
+// nothing recorded to check against.
+func VerifyManifest(manifest *Manifest, indexJSON []byte) error {
+	if manifest == nil {
+		return nil
+	}
+	hash := sha256.Sum256(indexJSON)
+	if got := hex.EncodeToString(hash[:]); got != manifest.EntriesDigest {
+		return fmt.Errorf("chunks index digest mismatch: manifest recorded %s, index is %s", manifest.EntriesDigest, got)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package chunkerutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteLoadManifest_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	indexJSON := []byte(`[{"path":"a"}]`)
+
+	if err := WriteManifest(dir, indexJSON, ChunkerParams{AvgChunkSizeKB: 1024, Hash: "sha256"}); err != nil {
+		t.Fatalf("WriteManifest() failed: %v", err)
+	}
+
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatalf("LoadManifest() failed: %v", err)
+	}
+	if manifest == nil {
+		t.Fatal("LoadManifest() = nil, want a manifest")
+	}
+	if manifest.Chunker.AvgChunkSizeKB != 1024 {
+		t.Errorf("manifest.Chunker.AvgChunkSizeKB = %d, want 1024", manifest.Chunker.AvgChunkSizeKB)
+	}
+	if err := VerifyManifest(manifest, indexJSON); err != nil {
+		t.Errorf("VerifyManifest() on unmodified index = %v, want nil", err)
+	}
+	if err := VerifyManifest(manifest, []byte(`[{"path":"tampered"}]`)); err == nil {
+		t.Error("VerifyManifest() on tampered index = nil, want an error")
+	}
+}
+
+func TestLoadManifest_Missing(t *testing.T) {
+	manifest, err := LoadManifest(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadManifest() on dir with no manifest failed: %v", err)
+	}
+	if manifest != nil {
+		t.Errorf("LoadManifest() = %+v, want nil", manifest)
+	}
+	if err := VerifyManifest(manifest, []byte("anything")); err != nil {
+		t.Errorf("VerifyManifest() with nil manifest = %v, want nil", err)
+	}
+}
+
+func TestCreateIndexFile_WritesManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, ChunksDirName), 0755); err != nil {
+		t.Fatalf("Failed to create chunks dir: %v", err)
+	}
+
+	if err := CreateIndexFile(dir, []ChunksIndex{{Path: "f"}}, 512); err != nil {
+		t.Fatalf("CreateIndexFile() failed: %v", err)
+	}
+
+	indexJSON, err := os.ReadFile(filepath.Join(dir, ChunksIndexFileName))
+	if err != nil {
+		t.Fatalf("Failed to read index file: %v", err)
+	}
+	manifest, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatalf("LoadManifest() failed: %v", err)
+	}
+	if manifest == nil {
+		t.Fatal("CreateIndexFile() did not write a manifest")
+	}
+	if manifest.Chunker.AvgChunkSizeKB != 512 {
+		t.Errorf("manifest.Chunker.AvgChunkSizeKB = %d, want 512", manifest.Chunker.AvgChunkSizeKB)
+	}
+	if err := VerifyManifest(manifest, indexJSON); err != nil {
+		t.Errorf("VerifyManifest() against CreateIndexFile's own output = %v, want nil", err)
+	}
+}
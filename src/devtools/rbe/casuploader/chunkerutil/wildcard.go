@@ -0,0 +1,139 @@
+package chunkerutil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+)
+
+// ChunksIndexReader answers read-only queries over a chunk index that's
+// already been written to disk, such as ChecksumWildcard.
+type ChunksIndexReader struct {
+	entries   []ChunksIndex
+	chunksDir string
+}
+
+// NewChunksIndexReader loads the chunk index in dir (see LoadChunksIndex)
+// into a ChunksIndexReader.
+func NewChunksIndexReader(dir string) (*ChunksIndexReader, error) {
+	entries, err := LoadChunksIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunksIndexReader{entries: entries, chunksDir: filepath.Join(dir, ChunksDirName)}, nil
+}
+
+// ChecksumWildcard returns a single stable digest covering every index entry
+// whose logical path matches the doublestar-style glob pattern (e.g.
+// "**/*.so"). Entries are visited in sorted path order and fed into the
+// digest as "path\x00mode\x00size\x00chunkDigest\n", so the result is
+// deterministic across runs and independent of how chunk files happen to be
+// laid out on disk.
+//
+// followLinks is accepted for parity with the FUSE-side
+// chunkstore.ChunkStore.ChecksumWildcard, but has no effect here: the
+// casuploader chunking pipeline always chunks the content a path resolves
+// to (see chunker.ChunkFile, which opens the source with os.Open) rather
+// than recording a symlink entry, so the index never contains symlinks to
+// follow or not.
+func (r *ChunksIndexReader) ChecksumWildcard(pattern string, followLinks bool) (digest.Digest, error) {
+	matcher, err := globToRegexp(pattern)
+	if err != nil {
+		return digest.Digest{}, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+
+	var matched []ChunksIndex
+	for _, e := range r.entries {
+		if matcher.MatchString(e.Path) {
+			matched = append(matched, e)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Path < matched[j].Path })
+
+	var buf bytes.Buffer
+	for _, e := range matched {
+		size, err := e.size(r.chunksDir)
+		if err != nil {
+			return digest.Digest{}, fmt.Errorf("failed to get size of %s: %v", e.Path, err)
+		}
+		fmt.Fprintf(&buf, "%s\x00%d\x00%d\x00%s\n", e.Path, uint32(e.Mode), size, e.chunkDigest())
+	}
+	return digest.NewFromBlob(buf.Bytes()), nil
+}
+
+// chunkDigest returns a string that changes iff the chunks backing e change,
+// regardless of where those chunks happen to live on disk.
+func (e *ChunksIndex) chunkDigest() string {
+	if e.Format == FormatZstdChunked {
+		parts := make([]string, len(e.ZstdChunks))
+		for i, c := range e.ZstdChunks {
+			parts[i] = c.Checksum
+		}
+		return strings.Join(parts, ",")
+	}
+	parts := make([]string, len(e.Chunks))
+	for i, c := range e.Chunks {
+		parts[i] = c.SHA256
+	}
+	return strings.Join(parts, ",")
+}
+
+// size returns the logical size of the file e describes: the last chunk's
+// Offset plus its uncompressed Length. For an index written before
+// ChunkInfo.Length existed, it falls back to the size of the last chunk
+// file under chunksDir (mirrors chunkstore's getFileSize, since a legacy
+// ChunksIndex doesn't store the file's overall size directly).
+func (e *ChunksIndex) size(chunksDir string) (int64, error) {
+	if e.Format == FormatZstdChunked {
+		return tocTotalSize(e.ZstdChunks), nil
+	}
+	if len(e.Chunks) == 0 {
+		return 0, nil
+	}
+	last := e.Chunks[len(e.Chunks)-1]
+	if last.Length > 0 {
+		return last.Offset + last.Length, nil
+	}
+	info, err := os.Stat(filepath.Join(chunksDir, last.SHA256))
+	if err != nil {
+		return 0, err
+	}
+	return last.Offset + info.Size(), nil
+}
+
+// globToRegexp compiles a doublestar-style glob pattern ("*" matches within a
+// path segment, "**" matches zero or more segments, "?" matches a single
+// character) into a regexp anchored to the whole string. This is a minimal
+// subset sufficient for ChecksumWildcard; see the uploader's own
+// glob/doublestar exclude-filter support for the general-purpose matcher.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteByte('^')
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString(`(?:.*/)?`)
+			i += 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(`.*`)
+			i += 2
+		case pattern[i] == '*':
+			b.WriteString(`[^/]*`)
+			i++
+		case pattern[i] == '?':
+			b.WriteString(`[^/]`)
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			i++
+		}
+	}
+	b.WriteByte('$')
+	return regexp.Compile(b.String())
+}
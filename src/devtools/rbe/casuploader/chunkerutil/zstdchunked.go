@@ -0,0 +1,251 @@
+package chunkerutil
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jotfs/fastcdc-go"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Chunk format identifiers, stored in ChunksIndex.Format. The zero value
+// ("") is treated as FormatLegacy, so index files written before this field
+// existed keep restoring the same way.
+const (
+	FormatLegacy      = "legacy"
+	FormatZstdChunked = "zstd-chunked"
+
+	// zstdChunkedBlobSuffix is appended to a file's relative path to name the
+	// single zstd-chunked blob it's stored as under the chunks dir.
+	zstdChunkedBlobSuffix = ".zst-chunked"
+
+	// zstdChunkedMagic identifies a zstd-chunked stream's trailer, so the
+	// format can be recognized by seeking to the end of the blob.
+	zstdChunkedMagic uint32 = 0x7a636b31 // "zck1"
+	// trailerSize is the fixed size, in bytes, of the trailer: an 8-byte TOC
+	// offset, an 8-byte TOC length, and a 4-byte magic number.
+	trailerSize = 8 + 8 + 4
+)
+
+// ZstdChunkEntry describes one content-defined chunk within a zstd-chunked
+// stream: its logical (uncompressed) offset in the reconstructed file, its
+// byte range within the compressed stream, and the checksum of its
+// uncompressed content.
+type ZstdChunkEntry struct {
+	Offset      int64  `json:"offset"`
+	StartOffset int64  `json:"start_offset"`
+	EndOffset   int64  `json:"end_offset"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+}
+
+// zstdChunkedBlobPath returns the path a file's zstd-chunked blob is stored
+// at under chunksDir, given the file's relative path (ChunksIndex.Path).
+func zstdChunkedBlobPath(chunksDir, relPath string) string {
+	return filepath.Join(chunksDir, relPath+zstdChunkedBlobSuffix)
+}
+
+// ChunkFileZstdChunked splits srcPath into content-defined chunks, individually
+// zstd-compresses them, and concatenates them into a single stream at
+// dstPath, followed by a JSON table of contents and a fixed trailer
+// recording the TOC's location. It returns the TOC, which callers use both
+// to populate a ChunksIndex entry and to resolve byte-range reads without
+// decompressing the whole stream.
+func ChunkFileZstdChunked(srcPath, dstPath string, avgChunkSizeKb int) ([]ZstdChunkEntry, error) {
+	source, err := os.Open(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", srcPath, err)
+	}
+	defer source.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dir for %s: %v", dstPath, err)
+	}
+	out, err := os.Create(dstPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dstPath, err)
+	}
+	defer out.Close()
+
+	chnkr, err := fastcdc.NewChunker(source, fastcdc.Options{AverageSize: 1024 * avgChunkSizeKb})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create chunker for %s: %v", srcPath, err)
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %v", err)
+	}
+	defer enc.Close()
+
+	var toc []ZstdChunkEntry
+	var compressedPos, logicalPos int64
+	for {
+		chunk, err := chnkr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		compressed := enc.EncodeAll(chunk.Data, nil)
+		if _, err := out.Write(compressed); err != nil {
+			return nil, fmt.Errorf("failed to write compressed chunk: %v", err)
+		}
+
+		sum := sha256.Sum256(chunk.Data)
+		toc = append(toc, ZstdChunkEntry{
+			Offset:      logicalPos,
+			StartOffset: compressedPos,
+			EndOffset:   compressedPos + int64(len(compressed)),
+			Size:        int64(len(chunk.Data)),
+			Checksum:    hex.EncodeToString(sum[:]),
+		})
+		compressedPos += int64(len(compressed))
+		logicalPos += int64(len(chunk.Data))
+	}
+
+	tocBytes, err := json.Marshal(toc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal zstd-chunked TOC: %v", err)
+	}
+	tocOffset := compressedPos
+	if _, err := out.Write(tocBytes); err != nil {
+		return nil, fmt.Errorf("failed to write zstd-chunked TOC: %v", err)
+	}
+
+	trailer := make([]byte, trailerSize)
+	binary.BigEndian.PutUint64(trailer[0:8], uint64(tocOffset))
+	binary.BigEndian.PutUint64(trailer[8:16], uint64(len(tocBytes)))
+	binary.BigEndian.PutUint32(trailer[16:20], zstdChunkedMagic)
+	if _, err := out.Write(trailer); err != nil {
+		return nil, fmt.Errorf("failed to write zstd-chunked trailer: %v", err)
+	}
+
+	return toc, nil
+}
+
+// ReadZstdChunkedTOC reads the table of contents of a zstd-chunked stream at
+// path by seeking to its trailer, without decompressing any chunk data.
+func ReadZstdChunkedTOC(path string) ([]ZstdChunkEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if size < trailerSize {
+		return nil, fmt.Errorf("%s is too small to contain a zstd-chunked trailer", path)
+	}
+
+	trailer := make([]byte, trailerSize)
+	if _, err := f.ReadAt(trailer, size-trailerSize); err != nil {
+		return nil, fmt.Errorf("failed to read zstd-chunked trailer of %s: %v", path, err)
+	}
+	if magic := binary.BigEndian.Uint32(trailer[16:20]); magic != zstdChunkedMagic {
+		return nil, fmt.Errorf("%s is not a zstd-chunked stream (bad magic)", path)
+	}
+	tocOffset := int64(binary.BigEndian.Uint64(trailer[0:8]))
+	tocLength := int64(binary.BigEndian.Uint64(trailer[8:16]))
+
+	tocBytes := make([]byte, tocLength)
+	if _, err := f.ReadAt(tocBytes, tocOffset); err != nil {
+		return nil, fmt.Errorf("failed to read zstd-chunked TOC of %s: %v", path, err)
+	}
+
+	var toc []ZstdChunkEntry
+	if err := json.Unmarshal(tocBytes, &toc); err != nil {
+		return nil, fmt.Errorf("can't unmarshal zstd-chunked TOC of %s: %v", path, err)
+	}
+	return toc, nil
+}
+
+// ReadZstdChunkedRange returns the decompressed bytes covering the logical
+// range [start, end) of the zstd-chunked stream at path, resolving it to the
+// minimal set of chunks via toc and decompressing only those. This is the
+// primitive a FUSE read handler uses to serve a partial read without
+// materializing the whole file.
+func ReadZstdChunkedRange(path string, toc []ZstdChunkEntry, start, end int64) ([]byte, error) {
+	if end <= start {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %v", err)
+	}
+	defer dec.Close()
+
+	out := make([]byte, 0, end-start)
+	for _, c := range toc {
+		chunkEnd := c.Offset + c.Size
+		if chunkEnd <= start || c.Offset >= end {
+			continue
+		}
+
+		compressed := make([]byte, c.EndOffset-c.StartOffset)
+		if _, err := f.ReadAt(compressed, c.StartOffset); err != nil {
+			return nil, fmt.Errorf("failed to read compressed chunk at %d: %v", c.StartOffset, err)
+		}
+		data, err := dec.DecodeAll(compressed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress chunk at offset %d: %v", c.Offset, err)
+		}
+
+		overlapStart := max64(start, c.Offset)
+		overlapEnd := min64(end, chunkEnd)
+		out = append(out, data[overlapStart-c.Offset:overlapEnd-c.Offset]...)
+	}
+	return out, nil
+}
+
+// RestoreZstdChunkedFile decompresses every chunk of the zstd-chunked stream
+// at srcPath, in order, and writes the reconstructed file to dstPath.
+func RestoreZstdChunkedFile(dstPath, srcPath string, toc []ZstdChunkEntry) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("error creating directories: %w", err)
+	}
+	data, err := ReadZstdChunkedRange(srcPath, toc, 0, tocTotalSize(toc))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dstPath, data, 0644)
+}
+
+func tocTotalSize(toc []ZstdChunkEntry) int64 {
+	if len(toc) == 0 {
+		return 0
+	}
+	last := toc[len(toc)-1]
+	return last.Offset + last.Size
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -7,13 +7,21 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"flag"
-	
+
 	log "github.com/golang/glog"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkercache"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/metadatacache"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/metrics"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/resumejournal"
 	"github.com/google/device-infra/src/devtools/rbe/casuploader/uploader"
 	"github.com/google/device-infra/src/devtools/rbe/rbeclient"
 )
@@ -39,19 +47,36 @@ func (f *multiStringFlag) Get() any {
 var (
 	printVersion = flag.Bool("version", false, "Print version information")
 
-	zipPath         = flag.String("zip-path", "", "Path to a .zip file to upload")
-	dirPath         = flag.String("dir-path", "", "Path to a directory to upload")
-	filelistPath    = flag.String("filelist-path", "", "Path to a file containing a list of files to upload")
-	filePath        = flag.String("file-path", "", "Path to a single file to upload")
-	chunk           = flag.Bool("chunk", false, "Chunk files when applicable")
-	avgChunkSizeKb  = flag.Int("avg-chunk-size", 1024, "Average chunk size in KiB")
-	casInstance     = flag.String("cas-instance", "", "RBE instance")
-	casAddr         = flag.String("cas-addr", "remotebuildexecution.googleapis.com:443", "RBE server addr")
-	serviceAccount  = flag.String("service-account-json", "", "Path to JSON file with service account credentials to use.")
-	useADC          = flag.Bool("use-adc", false, "True to use Application Default Credentials (ADC).")
-	dumpDigest      = flag.String("dump-digest", "", "Output the digest to file")
-	dumpFileDetails = flag.String("dump-file-details", "", "Export information of all uploaded files to a file")
-	excludeFilters  multiStringFlag
+	zipPath                 = flag.String("zip-path", "", "Path to a .zip file to upload")
+	dirPath                 = flag.String("dir-path", "", "Path to a directory to upload")
+	filelistPath            = flag.String("filelist-path", "", "Path to a file containing a list of files to upload")
+	filePath                = flag.String("file-path", "", "Path to a single file to upload, or an http(s):// URL to fetch it from")
+	tarPath                 = flag.String("tar-path", "", "Path to a .tar or .tar.zst file to upload")
+	chunk                   = flag.Bool("chunk", false, "Chunk files when applicable")
+	avgChunkSizeKb          = flag.Int("avg-chunk-size", 1024, "Average chunk size in KiB")
+	chunkFormat             = flag.String("chunk-format", chunkerutil.FormatLegacy, "Chunk storage format when -chunk is set: \"legacy\" (many small chunk files) or \"zstd-chunked\" (a single zstd-compressed stream with a seekable TOC, for partial FUSE fetches)")
+	chunkerKind             = flag.String("chunker", chunker.ChunkerFastCDC, "Chunk splitting algorithm when -chunk-format=legacy: \"fastcdc\" (content-defined, dedup-friendly) or \"fixed\" (fixed-size windows); ignored (always \"fastcdc\") when -chunk-segment-size > 0")
+	chunkCompression        = flag.String("chunk-compression", chunker.CompressionNone, "Per-chunk on-disk compression when -chunk-format=legacy: \"none\", \"zstd\", or \"gzip\"; ignored (chunks are stored uncompressed) when -chunk-cache is set")
+	chunkSegmentSize        = flag.Int64("chunk-segment-size", 0, "When > 0 and -chunk-format=legacy, pack chunk payloads into segment files of roughly this many bytes instead of one file per chunk, to avoid inode exhaustion on large trees")
+	chunkCache              = flag.Bool("chunk-cache", false, "When -chunk-format=legacy, persist a dedup cache across invocations so re-uploading an unchanged tree skips re-chunking (see chunkercache)")
+	chunkCacheDir           = flag.String("chunk-cache-dir", "", "Dir for the chunker dedup cache when -chunk-cache is set; defaults to chunkercache.DefaultDir()")
+	metadataCacheDir        = flag.String("metadata-cache-dir", "", "Dir for a persistent file-metadata cache (see metadatacache); when non-empty, re-uploading an unchanged tree skips restating and rehashing files unchanged since the last invocation")
+	metadataCacheMaxEntries = flag.Int("metadata-cache-max-entries", 0, "Max entries the file-metadata cache keeps before evicting the least-recently-used ones; <= 0 uses metadatacache.DefaultMaxEntries")
+	partialBlobThreshold    = flag.Int64("partial-blob-threshold", 0, "Minimum file size, in bytes, at which a file in a non-chunked upload is instead chunked on the fly and uploaded as a chunkerutil.BlobManifest blob, so a large, mostly-unchanged file only re-transmits the chunks CAS doesn't already have; every file at least this size is replaced this way, whether or not CAS already has its whole content; <= 0 disables this")
+	uploadCompression       = flag.String("upload-compression", uploader.CompressionNone, "Compression to estimate/advertise for CAS uploads above -upload-compression-threshold: \"none\" or \"zstd\" (see uploader.Compressor)")
+	compressionThreshold    = flag.Int64("upload-compression-threshold", 1<<20, "Minimum blob size, in bytes, -upload-compression applies to; has no effect when -upload-compression=none")
+	resumeDir               = flag.String("resume-dir", "", "Dir for resumable-upload journals; when non-empty, retries a failed upload with exponential backoff and persists progress so a later \"casuploader resume <id>\" can continue without re-uploading already-confirmed blobs (see resumejournal)")
+	resumeID                = flag.String("resume-id", "", "Identifier for this resumable upload's journal under -resume-dir; required when -resume-dir is set")
+	resumeMaxRetries        = flag.Int("resume-max-retries", 5, "Max retry attempts for a resumable upload before giving up")
+	casInstance             = flag.String("cas-instance", "", "RBE instance")
+	casAddr                 = flag.String("cas-addr", "remotebuildexecution.googleapis.com:443", "RBE server addr")
+	serviceAccount          = flag.String("service-account-json", "", "Path to JSON file with service account credentials to use.")
+	useADC                  = flag.Bool("use-adc", false, "True to use Application Default Credentials (ADC).")
+	dumpDigest              = flag.String("dump-digest", "", "Output the digest to file")
+	dumpFileDetails         = flag.String("dump-file-details", "", "Export information of all uploaded files to a file")
+	dumpMetrics             = flag.String("dump-metrics", "", "Export metrics about the upload to a file")
+	excludeFrom             = flag.String("exclude-from", "", "Path to a file of newline-separated -exclude-filters patterns (blank lines and \"#\"-prefixed comments are skipped), so a large exclude list doesn't have to be repeated on the command line")
+	excludeFilters   multiStringFlag
 )
 
 func checkFlags() error {
@@ -61,8 +86,8 @@ func checkFlags() error {
 	if *casAddr == "" {
 		return errors.New("-cas-addr must be specified")
 	}
-	if countPaths(*dirPath, *zipPath, *filePath, *filelistPath) != 1 {
-		return errors.New("One and only one of -zip-path, -dir-path or -file-path must be specified")
+	if countPaths(*dirPath, *zipPath, *filePath, *filelistPath, *tarPath) != 1 {
+		return errors.New("One and only one of -zip-path, -dir-path, -file-path or -tar-path must be specified")
 	}
 	if *serviceAccount == "" && *useADC == false {
 		return errors.New("Either -use-adc must be true or -service-account-json must be specified")
@@ -70,9 +95,110 @@ func checkFlags() error {
 	if *serviceAccount != "" && *useADC == true {
 		return errors.New("-use-adc and -service-account-json must not be set together")
 	}
+	if *chunkFormat != chunkerutil.FormatLegacy && *chunkFormat != chunkerutil.FormatZstdChunked {
+		return fmt.Errorf("-chunk-format must be %q or %q", chunkerutil.FormatLegacy, chunkerutil.FormatZstdChunked)
+	}
+	if *chunkerKind != chunker.ChunkerFastCDC && *chunkerKind != chunker.ChunkerFixed {
+		return fmt.Errorf("-chunker must be %q or %q", chunker.ChunkerFastCDC, chunker.ChunkerFixed)
+	}
+	if *chunkCompression != chunker.CompressionNone && *chunkCompression != chunker.CompressionZstd && *chunkCompression != chunker.CompressionGzip {
+		return fmt.Errorf("-chunk-compression must be %q, %q, or %q", chunker.CompressionNone, chunker.CompressionZstd, chunker.CompressionGzip)
+	}
+	if *chunkSegmentSize < 0 {
+		return errors.New("-chunk-segment-size must not be negative")
+	}
+	if *chunkCache && *chunkSegmentSize > 0 {
+		return errors.New("-chunk-cache and -chunk-segment-size must not be set together")
+	}
+	if *uploadCompression != uploader.CompressionNone && *uploadCompression != uploader.CompressionZstd {
+		return fmt.Errorf("-upload-compression must be %q or %q", uploader.CompressionNone, uploader.CompressionZstd)
+	}
+	if *resumeDir != "" && *resumeID == "" {
+		return errors.New("-resume-id must be specified when -resume-dir is set")
+	}
+	if *resumeMaxRetries < 0 {
+		return errors.New("-resume-max-retries must not be negative")
+	}
+	if *metadataCacheMaxEntries < 0 {
+		return errors.New("-metadata-cache-max-entries must not be negative")
+	}
+	if *partialBlobThreshold < 0 {
+		return errors.New("-partial-blob-threshold must not be negative")
+	}
 	return nil
 }
 
+// resumeCommandArgs checks whether args invokes the "resume <id>" subcommand
+// and, if so, returns the replayed flag args: the original invocation's args
+// from its journal, followed by any flags given after <id> so they can
+// override, e.g. a new -resume-dir. It returns nil, nil for a normal
+// (non-resume) invocation.
+func resumeCommandArgs(args []string) ([]string, error) {
+	if len(args) == 0 || args[0] != "resume" {
+		return nil, nil
+	}
+	if len(args) < 2 {
+		return nil, errors.New("usage: casuploader resume <id> [flags...]")
+	}
+	id, extra := args[1], args[2:]
+
+	dir := ""
+	for i, a := range extra {
+		switch {
+		case strings.HasPrefix(a, "-resume-dir="):
+			dir = strings.TrimPrefix(a, "-resume-dir=")
+		case a == "-resume-dir" && i+1 < len(extra):
+			dir = extra[i+1]
+		}
+	}
+	if dir == "" {
+		return nil, errors.New("-resume-dir must be specified to locate the journal for \"casuploader resume\"")
+	}
+
+	j, err := resumejournal.Load(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	if j.Done {
+		return nil, fmt.Errorf("resume %s: upload already completed", id)
+	}
+	if len(j.Args) == 0 {
+		return nil, fmt.Errorf("resume %s: no journal found under %s", id, dir)
+	}
+	return append(append([]string{}, j.Args...), extra...), nil
+}
+
+// uploadWithResume calls upload, retrying with exponential backoff on
+// failure when journal is non-nil; each attempt's error is recorded to
+// journal so a later "casuploader resume" can pick up where this one left
+// off, should every retry here be exhausted. A nil journal disables
+// retrying entirely, matching upload()'s own behavior.
+func uploadWithResume(upload func() (digest.Digest, error), journal *resumejournal.Journal, maxRetries int) (digest.Digest, error) {
+	if journal == nil {
+		return upload()
+	}
+
+	backoff := time.Second
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		rootDigest, err := upload()
+		if err == nil {
+			return rootDigest, nil
+		}
+		lastErr = err
+		if recordErr := journal.RecordAttempt(err); recordErr != nil {
+			log.Warningf("failed to record resume journal attempt: %v", recordErr)
+		}
+		if attempt == maxRetries {
+			break
+		}
+		log.Warningf("upload attempt %d failed, retrying in %v: %v", attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return digest.Digest{}, fmt.Errorf("giving up after %d attempts: %w", maxRetries+1, lastErr)
+}
+
 func countPaths(paths ...string) int {
 	count := 0
 	for _, path := range paths {
@@ -85,12 +211,24 @@ func countPaths(paths ...string) int {
 
 func main() {
 	flag.Var(&excludeFilters, "exclude-filters",
-		"Regular expression of paths to be excluded from uploading. The regex will implicitly "+
-			"append the root directory path to the beginning, so DO NOT use \"^\" in the regex.")
+		"Regular expression, or gitignore/buildkit-style glob (\"**/*.img\", \"out/host/**\"), of "+
+			"paths to be excluded from uploading. The pattern will implicitly append the root "+
+			"directory path to the beginning, so DO NOT use \"^\" in a regex pattern.")
 	flag.Set("silent_init", "true")
 	flag.Set("logtostderr", "true")
 	flag.Set("stderrthreshold", "INFO")
-	flag.Parse()
+
+	replayArgs, err := resumeCommandArgs(os.Args[1:])
+	if err != nil {
+		log.Exit(err)
+	}
+	effectiveArgs := os.Args[1:]
+	if replayArgs != nil {
+		effectiveArgs = replayArgs
+		flag.CommandLine.Parse(replayArgs)
+	} else {
+		flag.Parse()
+	}
 
 	if *printVersion == true {
 		fmt.Printf("version: %s\n", version)
@@ -124,11 +262,77 @@ func main() {
 	}
 	defer client.Close()
 
+	var cache *chunkercache.Cache
+	if *chunkCache {
+		dir := *chunkCacheDir
+		if dir == "" {
+			var err error
+			dir, err = chunkercache.DefaultDir()
+			if err != nil {
+				log.Exitf("Failed to determine chunker cache dir: %v", err)
+			}
+		}
+		cache, err = chunkercache.Open(dir)
+		if err != nil {
+			log.Exitf("Failed to open chunker cache: %v", err)
+		}
+	}
+
+	var metadataCache *metadatacache.Cache
+	if *metadataCacheDir != "" {
+		maxEntries := *metadataCacheMaxEntries
+		if maxEntries <= 0 {
+			maxEntries = metadatacache.DefaultMaxEntries
+		}
+		metadataCache, err = metadatacache.NewCache(*metadataCacheDir, filemetadata.NewNoopCache(), maxEntries)
+		if err != nil {
+			log.Exitf("Failed to open metadata cache: %v", err)
+		}
+	}
+
+	var journal *resumejournal.Journal
+	if *resumeDir != "" {
+		journal, err = resumejournal.Start(*resumeDir, *resumeID, effectiveArgs)
+		if err != nil {
+			log.Exitf("Failed to open resume journal: %v", err)
+		}
+	}
+
+	compressor, err := uploader.NewCompressor(*uploadCompression)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	allExcludeFilters := []string(excludeFilters)
+	if *excludeFrom != "" {
+		fromFile, err := uploader.ReadExcludeFiltersFile(*excludeFrom)
+		if err != nil {
+			log.Exitf("Failed to read -exclude-from %s: %v", *excludeFrom, err)
+		}
+		allExcludeFilters = append(allExcludeFilters, fromFile...)
+	}
+	normalizedExcludeFilters, err := uploader.NormalizeExcludeFilters(allExcludeFilters)
+	if err != nil {
+		log.Exit(err)
+	}
+
+	// metadataCache is typed nil when -metadata-cache-dir is unset; pass it
+	// through a filemetadata.Cache-typed variable only when it's actually
+	// set, so NewCommonConfig's nil check doesn't see a non-nil interface
+	// wrapping a nil *metadatacache.Cache.
+	var metadataCacheArg filemetadata.Cache
+	if metadataCache != nil {
+		metadataCacheArg = metadataCache
+	}
+
 	var rootDigest digest.Digest
-	uploaderConfig := uploader.NewCommonConfig(ctx, client, excludeFilters, *dumpFileDetails, *chunk, *avgChunkSizeKb)
+	m := &metrics.Metrics{}
+	// digestSource is nil: no flag exposes a DigestSource implementation yet,
+	// so -tar-path uploads always hash entries themselves (see DigestSource).
+	uploaderConfig := uploader.NewCommonConfig(ctx, client, normalizedExcludeFilters, *dumpFileDetails, *chunk, *avgChunkSizeKb, *chunkFormat, *chunkCompression, *chunkSegmentSize, *chunkerKind, cache, journal, m, compressor, *compressionThreshold, metadataCacheArg, *partialBlobThreshold, nil)
 	if *zipPath != "" {
 		zipUploader := uploader.NewZipUploader(uploaderConfig, *zipPath)
-		rootDigest, err = zipUploader.DoUpload()
+		rootDigest, err = uploadWithResume(zipUploader.DoUpload, journal, *resumeMaxRetries)
 		if err != nil {
 			log.Exitf("Failed to upload the zip archive to CAS: %v", err)
 		}
@@ -139,27 +343,57 @@ func main() {
 		}
 		log.Infof("Current working directory: %s", dir)
 		flUploader := uploader.NewFilelistUploader(uploaderConfig, *filelistPath, dir)
-		rootDigest, err = flUploader.DoUpload()
+		rootDigest, err = uploadWithResume(flUploader.DoUpload, journal, *resumeMaxRetries)
 		if err != nil {
 			log.Exitf("Failed to upload the files listed in %s to CAS: %v", *filelistPath, err)
 		}
 	} else if *dirPath != "" {
 		dirUploader := uploader.NewDirUploader(uploaderConfig, *dirPath, nil)
-		rootDigest, err = dirUploader.DoUpload()
+		rootDigest, err = uploadWithResume(dirUploader.DoUpload, journal, *resumeMaxRetries)
 		if err != nil {
 			log.Exitf("Failed to upload the directory to CAS: %v", err)
 		}
 	} else if *filePath != "" {
 		fileUploader := uploader.NewFileUploader(uploaderConfig, *filePath)
-		rootDigest, err = fileUploader.DoUpload()
+		rootDigest, err = uploadWithResume(fileUploader.DoUpload, journal, *resumeMaxRetries)
 		if err != nil {
 			log.Exitf("Failed to upload the file to CAS: %v", err)
 		}
+	} else if *tarPath != "" {
+		tarUploader := uploader.NewTarUploader(uploaderConfig, *tarPath)
+		rootDigest, err = uploadWithResume(tarUploader.DoUpload, journal, *resumeMaxRetries)
+		if err != nil {
+			log.Exitf("Failed to upload the tar archive to CAS: %v", err)
+		}
+	}
+
+	if metadataCache != nil {
+		if err := metadataCache.Save(); err != nil {
+			log.Errorf("Failed to save metadata cache: %v", err)
+		}
+	}
+
+	if cache != nil {
+		if err := cache.Save(); err != nil {
+			log.Errorf("Failed to save chunker cache: %v", err)
+		}
+		log.Infof("Chunker cache hits: %d, misses: %d", m.CacheHits, m.CacheMisses)
+	}
+
+	if journal != nil {
+		if err := journal.Remove(); err != nil {
+			log.Errorf("Failed to remove completed resume journal: %v", err)
+		}
 	}
 
 	output := fmt.Sprintf("%s/%d", rootDigest.Hash, rootDigest.Size)
 	if *dumpDigest != "" {
 		os.WriteFile(*dumpDigest, []byte(output), 0644)
 	}
+	if *dumpMetrics != "" {
+		if err := m.Dump(*dumpMetrics); err != nil {
+			log.Errorf("Failed to dump metrics: %v", err)
+		}
+	}
 	log.Infof("Uploaded %s to RBE instance %s, root digest: %s. E2E time: %v\n", *zipPath, *casInstance, output, time.Since(start))
 }
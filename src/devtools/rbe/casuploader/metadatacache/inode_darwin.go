@@ -0,0 +1,18 @@
+//go:build darwin
+
+package metadatacache
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fileInode returns fi's inode number.
+func fileInode(fi os.FileInfo) (uint64, error) {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("unsupported stat_t for %s", fi.Name())
+	}
+	return stat.Ino, nil
+}
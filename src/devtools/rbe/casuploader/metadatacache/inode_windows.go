@@ -0,0 +1,16 @@
+//go:build windows
+
+package metadatacache
+
+import "os"
+
+// fileInode returns 0: Windows' os.FileInfo does not expose a file index
+// the way POSIX stat does (that requires an open handle and
+// GetFileInformationByHandle), so every file on Windows shares the same
+// Inode value. Path, Size, and ModTime still distinguish distinct files in
+// Key, so this only weakens detection of a file replaced in place with
+// identical size and mtime but a different underlying inode, a case
+// Windows' own filesystem APIs make costly to detect anyway.
+func fileInode(fi os.FileInfo) (uint64, error) {
+	return 0, nil
+}
@@ -0,0 +1,306 @@
+// Package metadatacache persists, across casuploader invocations, a mapping
+// from a file's on-disk identity (absolute path, size, mtime, and inode) to
+// its previously computed CAS digest. Cache implements filemetadata.Cache,
+// so wiring it into client.ComputeMerkleTree lets a warm run of
+// DirUploader.DoUpload skip restating and rehashing files that haven't
+// changed since the last invocation.
+package metadatacache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
+)
+
+const (
+	// CacheFileName is the name of the cache's index file under its dir.
+	CacheFileName = "metadata_cache.json"
+	// DefaultMaxEntries is the entry count NewCache enforces when given
+	// maxEntries <= 0.
+	DefaultMaxEntries = 1_000_000
+)
+
+// Key identifies a file's on-disk identity for cache lookups. Two files
+// with equal Keys are assumed to have identical content, so the second
+// one's digest can be reused without rereading or rehashing it.
+//
+// ModTimeUnixNano is an int64, not a time.Time, because Key is used as a
+// map key: time.Time's == compares its monotonic reading and *Location
+// pointer, not just the instant, so a Key built fresh from os.Stat
+// wouldn't compare equal to one round-tripped through JSON, and every
+// reload of a persisted cache would silently miss on every entry.
+type Key struct {
+	Path            string `json:"path"` // Absolute.
+	Size            int64  `json:"size"`
+	ModTimeUnixNano int64  `json:"mod_time_unix_nano"`
+	Inode           uint64 `json:"inode"`
+}
+
+// entry pairs a Key with its cached filemetadata.Metadata fields and a
+// recency counter used for LRU eviction.
+type entry struct {
+	Key          Key    `json:"key"`
+	DigestHash   string `json:"digest_hash"`
+	DigestSize   int64  `json:"digest_size"`
+	IsExecutable bool   `json:"is_executable"`
+	LastUsed     int64  `json:"last_used"` // Higher is more recently used.
+}
+
+// Cache is a persistent filemetadata.Cache backed by a single index file
+// under dir, wrapping inner to compute a file's actual metadata on a cache
+// miss. It's safe for concurrent use.
+type Cache struct {
+	mu         sync.Mutex
+	dir        string
+	inner      filemetadata.Cache
+	maxEntries int
+	entries    map[Key]*entry
+	byPath     map[string]Key
+	seq        int64
+	dirty      bool
+	hits       uint64
+	misses     uint64
+}
+
+// NewCache loads the cache's index file from dir, or starts an empty cache
+// if dir has none yet. inner (typically filemetadata.NewNoopCache()) is
+// consulted, and its result cached, on every miss. maxEntries bounds the
+// cache via LRU eviction; <= 0 uses DefaultMaxEntries.
+func NewCache(dir string, inner filemetadata.Cache, maxEntries int) (*Cache, error) {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	c := &Cache{
+		dir:        dir,
+		inner:      inner,
+		maxEntries: maxEntries,
+		entries:    map[Key]*entry{},
+		byPath:     map[string]Key{},
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, CacheFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, fmt.Errorf("failed to read metadata cache: %w", err)
+	}
+
+	var entries []entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata cache: %w", err)
+	}
+	for i := range entries {
+		e := entries[i]
+		c.entries[e.Key] = &e
+		c.byPath[e.Key.Path] = e.Key
+		if e.LastUsed > c.seq {
+			c.seq = e.LastUsed
+		}
+	}
+	return c, nil
+}
+
+// Get implements filemetadata.Cache.
+func (c *Cache) Get(path string) *filemetadata.Metadata {
+	key, ok := c.statKey(path)
+	if !ok {
+		return c.inner.Get(path)
+	}
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.seq++
+		e.LastUsed = c.seq
+		c.dirty = true
+		c.hits++
+		c.mu.Unlock()
+		return entryMetadata(e)
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	md := c.inner.Get(path)
+	if md == nil || md.Err != nil {
+		return md
+	}
+	c.mu.Lock()
+	c.put(key, md)
+	c.mu.Unlock()
+	return md
+}
+
+// Update implements filemetadata.Cache: it persists cacheEntry, already
+// computed by the caller (e.g. after downloading path's content), as
+// path's current cached entry, without rereading or rehashing path itself.
+func (c *Cache) Update(path string, cacheEntry *filemetadata.Metadata) error {
+	if err := c.inner.Update(path, cacheEntry); err != nil {
+		return err
+	}
+	if cacheEntry == nil || cacheEntry.Err != nil {
+		return nil
+	}
+	if key, ok := c.statKey(path); ok {
+		c.mu.Lock()
+		c.put(key, cacheEntry)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// GetCacheHits implements filemetadata.Cache: the number of Get calls
+// served from this cache's own persisted entries, not counting hits inner
+// may have served on a miss here.
+func (c *Cache) GetCacheHits() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits
+}
+
+// GetCacheMisses implements filemetadata.Cache: the number of Get calls
+// that fell through to inner because this cache had no entry for path yet.
+func (c *Cache) GetCacheMisses() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.misses
+}
+
+// Delete implements filemetadata.Cache: it drops path's cached entry, if
+// any, in addition to forwarding to inner.
+func (c *Cache) Delete(path string) error {
+	if err := c.inner.Delete(path); err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.byPath[abs]; ok {
+		delete(c.entries, key)
+		delete(c.byPath, abs)
+		c.dirty = true
+	}
+	return nil
+}
+
+// Save persists the cache's index file to dir, if it has unsaved changes,
+// via a temp file plus rename so a crash (or another casuploader process
+// writing the same cache dir concurrently) never leaves a partially written
+// index file for the next invocation to load.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create metadata cache dir: %w", err)
+	}
+
+	entries := make([]entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, *e)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata cache: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(c.dir, CacheFileName+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp metadata cache file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write temp metadata cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close temp metadata cache file: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(c.dir, CacheFileName)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename temp metadata cache file into place: %w", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// statKey stats path and returns its cache Key, or false if path can't be
+// stat'd or its inode can't be determined.
+func (c *Cache) statKey(path string) (Key, bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Key{}, false
+	}
+	return c.keyFor(path, fi)
+}
+
+func (c *Cache) keyFor(path string, fi os.FileInfo) (Key, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return Key{}, false
+	}
+	inode, err := fileInode(fi)
+	if err != nil {
+		return Key{}, false
+	}
+	return Key{Path: abs, Size: fi.Size(), ModTimeUnixNano: fi.ModTime().UnixNano(), Inode: inode}, true
+}
+
+// put stores md under key, evicting the least-recently-used entry first if
+// the cache is at maxEntries. c.mu must be held.
+func (c *Cache) put(key Key, md *filemetadata.Metadata) {
+	if old, ok := c.byPath[key.Path]; ok && old != key {
+		delete(c.entries, old)
+	}
+	c.seq++
+	c.entries[key] = &entry{
+		Key:          key,
+		DigestHash:   md.Digest.Hash,
+		DigestSize:   md.Digest.Size,
+		IsExecutable: md.IsExecutable,
+		LastUsed:     c.seq,
+	}
+	c.byPath[key.Path] = key
+	c.dirty = true
+
+	for len(c.entries) > c.maxEntries {
+		c.evictOldest()
+	}
+}
+
+// evictOldest removes the entry with the smallest LastUsed. c.mu must be
+// held. Eviction scans every entry; that's fine at the entry counts this
+// cache is meant for (bounded by maxEntries), and keeps the implementation
+// simple.
+func (c *Cache) evictOldest() {
+	var oldestKey Key
+	first := true
+	var oldest int64
+	for k, e := range c.entries {
+		if first || e.LastUsed < oldest {
+			oldest, oldestKey, first = e.LastUsed, k, false
+		}
+	}
+	delete(c.entries, oldestKey)
+	delete(c.byPath, oldestKey.Path)
+}
+
+func entryMetadata(e *entry) *filemetadata.Metadata {
+	return &filemetadata.Metadata{
+		Digest:       digest.Digest{Hash: e.DigestHash, Size: e.DigestSize},
+		IsExecutable: e.IsExecutable,
+		MTime:        time.Unix(0, e.Key.ModTimeUnixNano),
+	}
+}
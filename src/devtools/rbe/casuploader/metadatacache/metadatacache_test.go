@@ -0,0 +1,134 @@
+package metadatacache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
+)
+
+func TestUpdateThenGet(t *testing.T) {
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "file.txt")
+	if err := os.WriteFile(srcPath, []byte("hello"), 0644); err != nil {
+		t.Fatalf("os.WriteFile() failed: %v", err)
+	}
+
+	cache, err := NewCache(t.TempDir(), filemetadata.NewNoopCache(), 0)
+	if err != nil {
+		t.Fatalf("NewCache() failed: %v", err)
+	}
+
+	// A Get before Update falls through to inner (a miss), since this cache
+	// has no entry yet.
+	if md := cache.Get(srcPath); md == nil || md.Err != nil {
+		t.Fatalf("Get() before Update = %+v, want a successfully computed Metadata", md)
+	}
+	if got, want := cache.GetCacheMisses(), uint64(1); got != want {
+		t.Errorf("GetCacheMisses() after first Get = %d, want %d", got, want)
+	}
+
+	// Update persists the caller-supplied entry without recomputing it.
+	want := &filemetadata.Metadata{Digest: digest.Digest{Hash: "deadbeef", Size: 5}, IsExecutable: true}
+	if err := cache.Update(srcPath, want); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+
+	got := cache.Get(srcPath)
+	if got == nil || got.Digest != want.Digest || got.IsExecutable != want.IsExecutable {
+		t.Errorf("Get() after Update = %+v, want digest/executable matching %+v", got, want)
+	}
+	if hits := cache.GetCacheHits(); hits != 1 {
+		t.Errorf("GetCacheHits() after Get following Update = %d, want 1", hits)
+	}
+}
+
+func TestUpdateThenSaveThenReload(t *testing.T) {
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "file.txt")
+	if err := os.WriteFile(srcPath, []byte("hello"), 0644); err != nil {
+		t.Fatalf("os.WriteFile() failed: %v", err)
+	}
+
+	cacheDir := t.TempDir()
+	cache, err := NewCache(cacheDir, filemetadata.NewNoopCache(), 0)
+	if err != nil {
+		t.Fatalf("NewCache() failed: %v", err)
+	}
+
+	want := &filemetadata.Metadata{Digest: digest.Digest{Hash: "deadbeef", Size: 5}, IsExecutable: true}
+	if err := cache.Update(srcPath, want); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+
+	// A cache reloaded from dir, as the next casuploader invocation would do,
+	// must still hit on srcPath without calling inner.
+	reopened, err := NewCache(cacheDir, filemetadata.NewNoopCache(), 0)
+	if err != nil {
+		t.Fatalf("NewCache() after Save() failed: %v", err)
+	}
+	got := reopened.Get(srcPath)
+	if got == nil || got.Digest != want.Digest || got.IsExecutable != want.IsExecutable {
+		t.Errorf("Get() on reopened cache = %+v, want digest/executable matching %+v", got, want)
+	}
+	if hits := reopened.GetCacheHits(); hits != 1 {
+		t.Errorf("GetCacheHits() on reopened cache after Get = %d, want 1", hits)
+	}
+}
+
+func TestUpdateWithErrIsNotCached(t *testing.T) {
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "file.txt")
+	if err := os.WriteFile(srcPath, []byte("hello"), 0644); err != nil {
+		t.Fatalf("os.WriteFile() failed: %v", err)
+	}
+
+	cache, err := NewCache(t.TempDir(), filemetadata.NewNoopCache(), 0)
+	if err != nil {
+		t.Fatalf("NewCache() failed: %v", err)
+	}
+
+	if err := cache.Update(srcPath, &filemetadata.Metadata{Err: &filemetadata.FileError{}}); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	if _, ok := cache.statKey(srcPath); !ok {
+		t.Fatalf("statKey(%s) failed unexpectedly", srcPath)
+	} else if key, _ := cache.statKey(srcPath); len(cache.entries) != 0 {
+		t.Errorf("entries after Update with an errored Metadata = %v, want none cached for key %v", cache.entries, key)
+	}
+}
+
+func TestUpdateThenDelete(t *testing.T) {
+	srcDir := t.TempDir()
+	srcPath := filepath.Join(srcDir, "file.txt")
+	if err := os.WriteFile(srcPath, []byte("hello"), 0644); err != nil {
+		t.Fatalf("os.WriteFile() failed: %v", err)
+	}
+
+	cache, err := NewCache(t.TempDir(), filemetadata.NewNoopCache(), 0)
+	if err != nil {
+		t.Fatalf("NewCache() failed: %v", err)
+	}
+	if err := cache.Update(srcPath, &filemetadata.Metadata{Digest: digest.Digest{Hash: "abc123", Size: 5}}); err != nil {
+		t.Fatalf("Update() failed: %v", err)
+	}
+	if err := cache.Delete(srcPath); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+
+	// Delete drops the cached entry, so the next Get falls through to inner
+	// (a miss) rather than returning the deleted digest.
+	before := cache.GetCacheMisses()
+	if got := cache.Get(srcPath); got == nil || got.Digest.Hash == "abc123" {
+		t.Errorf("Get() after Delete = %+v, want inner's recomputed Metadata, not the deleted entry", got)
+	}
+	if got, want := cache.GetCacheMisses(), before+1; got != want {
+		t.Errorf("GetCacheMisses() after Get following Delete = %d, want %d", got, want)
+	}
+}
+
@@ -5,10 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
 )
 
 // Metrics contains the metrics for the uploader.
 type Metrics struct {
+	// mu guards CacheHits and CacheMisses, which RecordCacheResult updates
+	// from possibly-concurrent chunking goroutines (see
+	// DirUploader.chunkFiles); every other field is only ever touched from a
+	// single goroutine at a time.
+	mu sync.Mutex
+
 	TimeMs            int64 `json:"time_ms"`             // End to end time to upload the artifact.
 	UnzipTimeMs       int64 `json:"unzip_time_ms"`       // Time to unzip the artifact if it is a zip file.
 	ChunkTimeMs       int64 `json:"chunk_time_ms"`       // Time to chunk files if chunking is enabled.
@@ -17,6 +24,26 @@ type Metrics struct {
 	UploadedSizeBytes int64 `json:"uploaded_size_bytes"` // Size of uploaded entries in bytes.
 	Entries           int   `json:"entries"`             // Number of entries.
 	UploadedEntries   int   `json:"uploaded_entries"`    // Number of uploaded entries.
+	CacheHits         int   `json:"cache_hits"`          // Number of files skipped via the chunker dedup cache.
+	CacheMisses       int   `json:"cache_misses"`        // Number of files chunked due to a chunker dedup cache miss.
+	EvictedEntries    int   `json:"evicted_entries"`     // Number of unreferenced chunks removed by chunkstore.GC.
+	EvictedBytes      int64 `json:"evicted_bytes"`       // Total size of EvictedEntries.
+
+	CompressedEntries        int   `json:"compressed_entries"`          // Number of blobs at or above the upload compression threshold.
+	PreCompressionSizeBytes  int64 `json:"pre_compression_size_bytes"`  // Total size of CompressedEntries before compression.
+	PostCompressionSizeBytes int64 `json:"post_compression_size_bytes"` // Total size of CompressedEntries after compression.
+}
+
+// RecordCacheResult increments CacheHits or CacheMisses. Unlike direct field
+// access, it's safe to call concurrently.
+func (m *Metrics) RecordCacheResult(hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.CacheHits++
+	} else {
+		m.CacheMisses++
+	}
 }
 
 // Dump dumps the metrics to a file.
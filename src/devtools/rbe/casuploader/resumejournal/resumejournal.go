@@ -0,0 +1,134 @@
+// Package resumejournal persists enough state about an in-progress
+// casuploader invocation to retry it after a crash or network failure
+// without redoing work CAS already has. The remote-apis-sdks Client used by
+// this tool only exposes whole-blob MissingBlobs/UploadIfMissing, not
+// ByteStream write-offset resumption, so a Journal operates at whole-blob
+// granularity: it tracks which digests from the current Merkle tree are
+// already confirmed uploaded, and the original command-line args needed to
+// replay the rest of the invocation (see the `casuploader resume` command).
+package resumejournal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+)
+
+// Journal records the state of a resumable casuploader invocation, keyed by
+// a user-supplied ID under its --resume-dir.
+type Journal struct {
+	dir string
+
+	ID         string          `json:"id"`
+	Args       []string        `json:"args"`
+	Confirmed  map[string]bool `json:"confirmed"`
+	RootDigest string          `json:"root_digest,omitempty"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error,omitempty"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	Done       bool            `json:"done"`
+}
+
+// digestKey returns the string used to key d in Confirmed, matching the
+// "<hash>/<size>" format casuploader already uses for -dump-digest output.
+func digestKey(d digest.Digest) string {
+	return fmt.Sprintf("%s/%d", d.Hash, d.Size)
+}
+
+func fileName(id string) string {
+	return fmt.Sprintf("resume_%s.json", id)
+}
+
+// Start loads the existing journal for id under dir, if any, or creates a
+// fresh one recording args as the command line to replay on resume.
+func Start(dir, id string, args []string) (*Journal, error) {
+	j, err := Load(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	if j.Args == nil {
+		j.Args = args
+	}
+	return j, nil
+}
+
+// Load reads the journal for id from dir, or returns a fresh, unsaved
+// Journal if none exists yet.
+func Load(dir, id string) (*Journal, error) {
+	j := &Journal{dir: dir, ID: id, Confirmed: map[string]bool{}}
+
+	data, err := os.ReadFile(filepath.Join(dir, fileName(id)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, nil
+		}
+		return nil, fmt.Errorf("failed to read resume journal %q: %w", id, err)
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal resume journal %q: %w", id, err)
+	}
+	if j.Confirmed == nil {
+		j.Confirmed = map[string]bool{}
+	}
+	return j, nil
+}
+
+// IsConfirmed reports whether d was recorded as successfully uploaded by a
+// prior attempt.
+func (j *Journal) IsConfirmed(d digest.Digest) bool {
+	return j.Confirmed[digestKey(d)]
+}
+
+// MarkConfirmed records digests as successfully uploaded and persists the
+// journal.
+func (j *Journal) MarkConfirmed(digests []digest.Digest) error {
+	for _, d := range digests {
+		j.Confirmed[digestKey(d)] = true
+	}
+	return j.save()
+}
+
+// RecordAttempt records a failed attempt and persists the journal.
+func (j *Journal) RecordAttempt(attemptErr error) error {
+	j.Attempts++
+	j.LastError = attemptErr.Error()
+	j.UpdatedAt = time.Now()
+	return j.save()
+}
+
+// MarkDone records that rootDigest was fully uploaded and persists the
+// journal; a subsequent Load for the same ID reports Done.
+func (j *Journal) MarkDone(rootDigest digest.Digest) error {
+	j.Done = true
+	j.RootDigest = digestKey(rootDigest)
+	j.LastError = ""
+	j.UpdatedAt = time.Now()
+	return j.save()
+}
+
+// Remove deletes the journal file once its upload is confirmed done and the
+// caller no longer needs to retry it.
+func (j *Journal) Remove() error {
+	if err := os.Remove(filepath.Join(j.dir, fileName(j.ID))); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove resume journal %q: %w", j.ID, err)
+	}
+	return nil
+}
+
+func (j *Journal) save() error {
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create resume dir: %w", err)
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal resume journal: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(j.dir, fileName(j.ID)), data, 0644); err != nil {
+		return fmt.Errorf("failed to write resume journal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package resumejournal
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+)
+
+func TestStartPersistsArgs(t *testing.T) {
+	dir := t.TempDir()
+	args := []string{"-dir-path=/tmp/foo", "-cas-instance=x"}
+
+	j, err := Start(dir, "job1", args)
+	if err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	if err := j.RecordAttempt(errors.New("boom")); err != nil {
+		t.Fatalf("RecordAttempt() failed: %v", err)
+	}
+
+	reloaded, err := Load(dir, "job1")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if len(reloaded.Args) != len(args) || reloaded.Args[0] != args[0] || reloaded.Args[1] != args[1] {
+		t.Errorf("Load().Args = %v, want %v", reloaded.Args, args)
+	}
+	if reloaded.Attempts != 1 {
+		t.Errorf("Load().Attempts = %d, want 1", reloaded.Attempts)
+	}
+	if reloaded.LastError != "boom" {
+		t.Errorf("Load().LastError = %q, want %q", reloaded.LastError, "boom")
+	}
+}
+
+func TestMarkConfirmedAndIsConfirmed(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Start(dir, "job2", nil)
+	if err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	d := digest.Digest{Hash: "abc123", Size: 42}
+	if j.IsConfirmed(d) {
+		t.Error("IsConfirmed() = true before MarkConfirmed, want false")
+	}
+
+	if err := j.MarkConfirmed([]digest.Digest{d}); err != nil {
+		t.Fatalf("MarkConfirmed() failed: %v", err)
+	}
+	if !j.IsConfirmed(d) {
+		t.Error("IsConfirmed() = false after MarkConfirmed, want true")
+	}
+
+	reloaded, err := Load(dir, "job2")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if !reloaded.IsConfirmed(d) {
+		t.Error("reloaded IsConfirmed() = false, want true")
+	}
+}
+
+func TestMarkDoneAndRemove(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Start(dir, "job3", []string{"-dir-path=/tmp/foo"})
+	if err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	rootDigest := digest.Digest{Hash: "root", Size: 7}
+	if err := j.MarkDone(rootDigest); err != nil {
+		t.Fatalf("MarkDone() failed: %v", err)
+	}
+
+	reloaded, err := Load(dir, "job3")
+	if err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if !reloaded.Done {
+		t.Error("reloaded.Done = false, want true")
+	}
+	if reloaded.RootDigest != digestKey(rootDigest) {
+		t.Errorf("reloaded.RootDigest = %q, want %q", reloaded.RootDigest, digestKey(rootDigest))
+	}
+
+	if err := j.Remove(); err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	fresh, err := Load(dir, "job3")
+	if err != nil {
+		t.Fatalf("Load() after Remove() failed: %v", err)
+	}
+	if fresh.Done || len(fresh.Args) != 0 {
+		t.Errorf("Load() after Remove() = %+v, want a fresh journal", fresh)
+	}
+}
@@ -0,0 +1,212 @@
+// Package segmentstore packs many small chunk payloads into a small number
+// of segment files instead of writing one file per chunk. Segment files are
+// not pre-allocated: each is created empty and grows as records are appended.
+// Trees that FastCDC-chunk into millions of small pieces (e.g. a large
+// Android build) otherwise hammer the filesystem with inode allocation and
+// blow up os.Link-based restores.
+//
+// Each segment file is an append-only sequence of [length][sha256][payload]
+// records. A companion segments_index.json maps each chunk's sha256 to the
+// (segment id, offset, length) of its payload, so readers can pread the
+// payload directly without re-parsing record headers.
+package segmentstore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DefaultMaxSegmentSize is the size a segment file rolls over at when no
+	// explicit size is requested.
+	DefaultMaxSegmentSize = 512 * 1024 * 1024
+
+	// IndexFileName is the name of the segment index file under a segments dir.
+	IndexFileName = "segments_index.json"
+
+	segmentFilePattern = "segment-%06d.dat"
+
+	// recordHeaderSize is the size of the [length][sha256] header that
+	// precedes each chunk's payload in a segment file: an 8-byte big-endian
+	// payload length, followed by the chunk's sha256 as a 64-character hex
+	// string.
+	recordHeaderSize = 8 + 64
+)
+
+// Location describes where a chunk's payload lives within a segment store:
+// which segment file it's in, and the byte offset and length of the
+// payload (not including the record header) within that file.
+type Location struct {
+	SegmentID int   `json:"segment_id"`
+	Offset    int64 `json:"offset"`
+	Length    int64 `json:"length"`
+}
+
+// Index maps a chunk's sha256 to the Location of its payload.
+type Index map[string]Location
+
+// WriteIndex persists index as dir/IndexFileName.
+func WriteIndex(dir string, index Index) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal segment index: %w", err)
+	}
+	return os.WriteFile(filepath.Join(dir, IndexFileName), data, 0644)
+}
+
+// LoadIndex reads the segment index from dir. It returns (nil, nil) if dir
+// has no segment index file, so callers can fall back to the legacy
+// one-file-per-chunk layout.
+func LoadIndex(dir string) (Index, error) {
+	data, err := os.ReadFile(filepath.Join(dir, IndexFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read segment index: %w", err)
+	}
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal segment index: %w", err)
+	}
+	return index, nil
+}
+
+// Writer appends chunk payloads to segment files under dir, rolling over to
+// a new segment once the current one would exceed maxSegmentSize.
+type Writer struct {
+	dir            string
+	maxSegmentSize int64
+	index          Index
+
+	segmentID   int
+	segmentSize int64
+	file        *os.File
+}
+
+// NewWriter creates a Writer that packs chunk payloads into segment files
+// under dir. A maxSegmentSize <= 0 uses DefaultMaxSegmentSize.
+func NewWriter(dir string, maxSegmentSize int64) (*Writer, error) {
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultMaxSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create segment dir %s: %w", dir, err)
+	}
+	return &Writer{dir: dir, maxSegmentSize: maxSegmentSize, index: Index{}, segmentID: -1}, nil
+}
+
+// WriteChunk appends data (identified by its sha256) to the current segment
+// file, rolling over to a new segment first if data wouldn't fit within
+// maxSegmentSize. If sha256 was already written, its existing Location is
+// returned and data is not written again.
+func (w *Writer) WriteChunk(sha256 string, data []byte) (Location, error) {
+	if loc, ok := w.index[sha256]; ok {
+		return loc, nil
+	}
+
+	size := int64(recordHeaderSize) + int64(len(data))
+	if w.file == nil || w.segmentSize+size > w.maxSegmentSize {
+		if err := w.rollSegment(); err != nil {
+			return Location{}, err
+		}
+	}
+
+	if err := writeRecord(w.file, sha256, data); err != nil {
+		return Location{}, fmt.Errorf("failed to append chunk %s to segment %d: %w", sha256, w.segmentID, err)
+	}
+
+	loc := Location{SegmentID: w.segmentID, Offset: w.segmentSize + recordHeaderSize, Length: int64(len(data))}
+	w.index[sha256] = loc
+	w.segmentSize += size
+	return loc, nil
+}
+
+// Index returns the Location index built so far. Callers should call
+// WriteIndex with it once all chunks have been written.
+func (w *Writer) Index() Index {
+	return w.index
+}
+
+// Close closes the currently open segment file, if any.
+func (w *Writer) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *Writer) rollSegment() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return fmt.Errorf("failed to close segment %d: %w", w.segmentID, err)
+		}
+	}
+	w.segmentID++
+	path := filepath.Join(w.dir, fmt.Sprintf(segmentFilePattern, w.segmentID))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment file %s: %w", path, err)
+	}
+	w.file = f
+	w.segmentSize = 0
+	return nil
+}
+
+func writeRecord(f *os.File, sha256 string, data []byte) error {
+	header := make([]byte, recordHeaderSize)
+	binary.BigEndian.PutUint64(header[:8], uint64(len(data)))
+	copy(header[8:], sha256)
+	if _, err := f.Write(header); err != nil {
+		return err
+	}
+	_, err := f.Write(data)
+	return err
+}
+
+// Reader performs pread-style reads of chunk payloads from segment files
+// under dir, using a loaded Index (see LoadIndex).
+type Reader struct {
+	dir   string
+	index Index
+}
+
+// NewReader creates a Reader over the segment files in dir, resolving
+// chunks via index.
+func NewReader(dir string, index Index) *Reader {
+	return &Reader{dir: dir, index: index}
+}
+
+// ReadChunk reads and returns the full payload for sha256.
+func (r *Reader) ReadChunk(sha256 string) ([]byte, error) {
+	loc, ok := r.index[sha256]
+	if !ok {
+		return nil, fmt.Errorf("chunk %s not found in segment index", sha256)
+	}
+	buf := make([]byte, loc.Length)
+	if _, err := r.ReadRange(sha256, 0, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// ReadRange reads len(dest) bytes of chunk sha256's payload starting at
+// pos, via a pread (os.File.ReadAt) on its segment file.
+func (r *Reader) ReadRange(sha256 string, pos int64, dest []byte) (int, error) {
+	loc, ok := r.index[sha256]
+	if !ok {
+		return 0, fmt.Errorf("chunk %s not found in segment index", sha256)
+	}
+	path := filepath.Join(r.dir, fmt.Sprintf(segmentFilePattern, loc.SegmentID))
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment file %s: %w", path, err)
+	}
+	defer f.Close()
+	return f.ReadAt(dest, loc.Offset+pos)
+}
@@ -0,0 +1,78 @@
+package segmentstore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteAndReadChunk(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := NewWriter(dir, 64) // Tiny segment size to force rollover.
+	if err != nil {
+		t.Fatalf("NewWriter() failed: %v", err)
+	}
+
+	chunks := map[string][]byte{
+		"a": bytes.Repeat([]byte("a"), 40),
+		"b": bytes.Repeat([]byte("b"), 40),
+		"c": bytes.Repeat([]byte("c"), 40),
+	}
+
+	locs := map[string]Location{}
+	for _, sha256 := range []string{"a", "b", "c"} {
+		loc, err := w.WriteChunk(sha256, chunks[sha256])
+		if err != nil {
+			t.Fatalf("WriteChunk(%q) failed: %v", sha256, err)
+		}
+		locs[sha256] = loc
+	}
+
+	// Writing the same chunk again should be a no-op that returns the same Location.
+	if loc, err := w.WriteChunk("a", chunks["a"]); err != nil || loc != locs["a"] {
+		t.Errorf("WriteChunk(\"a\") again = %v, %v, want %v, nil", loc, err, locs["a"])
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if err := WriteIndex(dir, w.Index()); err != nil {
+		t.Fatalf("WriteIndex() failed: %v", err)
+	}
+
+	// Tiny segment size should have forced at least one rollover.
+	if locs["a"].SegmentID == locs["c"].SegmentID {
+		t.Errorf("expected chunks to span multiple segments, got segment %d for both", locs["a"].SegmentID)
+	}
+
+	index, err := LoadIndex(dir)
+	if err != nil {
+		t.Fatalf("LoadIndex() failed: %v", err)
+	}
+
+	r := NewReader(dir, index)
+	for sha256, want := range chunks {
+		got, err := r.ReadChunk(sha256)
+		if err != nil {
+			t.Fatalf("ReadChunk(%q) failed: %v", sha256, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("ReadChunk(%q) = %q, want %q", sha256, got, want)
+		}
+	}
+
+	var partial [10]byte
+	if n, err := r.ReadRange("b", 5, partial[:]); err != nil || n != 10 || !bytes.Equal(partial[:], chunks["b"][5:15]) {
+		t.Errorf("ReadRange(\"b\", 5, ...) = %d, %v, %q, want 10, nil, %q", n, err, partial[:], chunks["b"][5:15])
+	}
+}
+
+func TestLoadIndexMissing(t *testing.T) {
+	index, err := LoadIndex(t.TempDir())
+	if err != nil {
+		t.Fatalf("LoadIndex() on dir with no segment index failed: %v", err)
+	}
+	if index != nil {
+		t.Errorf("LoadIndex() = %v, want nil", index)
+	}
+}
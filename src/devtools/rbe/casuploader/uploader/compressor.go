@@ -0,0 +1,78 @@
+package uploader
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// CompressionNone estimates no compression savings.
+	CompressionNone = "none"
+	// CompressionZstd estimates the zstd compression savings of blobs above
+	// CommonConfig's compression threshold. Blobs are still uploaded as-is;
+	// this package doesn't compress what UploadIfMissing sends.
+	CompressionZstd = "zstd"
+)
+
+// Compressor estimates the wire-protocol savings of compressing a blob's
+// contents before upload. Name is the RE API v2 bytestream Compressor value
+// ("identity" or "zstd") the caller should advertise for entries it
+// compresses this way.
+type Compressor interface {
+	// Name is the RE API v2 bytestream Compressor value this Compressor
+	// corresponds to ("identity" or "zstd").
+	Name() string
+	// Compress returns data's compressed form.
+	Compress(data []byte) ([]byte, error)
+}
+
+// NewCompressor returns the Compressor for kind (CompressionNone or
+// CompressionZstd), or an error if kind isn't recognized.
+func NewCompressor(kind string) (Compressor, error) {
+	switch kind {
+	case "", CompressionNone:
+		return noopCompressor{}, nil
+	case CompressionZstd:
+		return zstdCompressor{}, nil
+	default:
+		return nil, fmt.Errorf("unknown upload compression %q", kind)
+	}
+}
+
+// noopCompressor is the identity Compressor, which NewCompressor returns for
+// CompressionNone (or ""): its estimate is always the blob's own size.
+type noopCompressor struct{}
+
+func (noopCompressor) Name() string { return "identity" }
+
+func (noopCompressor) Compress(data []byte) ([]byte, error) { return data, nil }
+
+// zstdEncoderPool holds reusable *zstd.Encoder instances, so compressing
+// many blobs doesn't allocate a fresh encoder (and its internal buffers)
+// per call. A *zstd.Encoder is safe to reuse across EncodeAll calls once
+// its previous result is no longer needed, mirroring remote-apis-sdks'
+// own pooling of its bytestream compressors.
+var zstdEncoderPool = sync.Pool{
+	New: func() any {
+		e, err := zstd.NewWriter(nil)
+		if err != nil {
+			// zstd.NewWriter(nil) only fails on invalid options, which this
+			// call site never passes, so this is unreachable in practice.
+			panic(fmt.Sprintf("failed to create zstd encoder: %v", err))
+		}
+		return e
+	},
+}
+
+// zstdCompressor advertises the RE API v2 "zstd" bytestream Compressor.
+type zstdCompressor struct{}
+
+func (zstdCompressor) Name() string { return "zstd" }
+
+func (zstdCompressor) Compress(data []byte) ([]byte, error) {
+	encoder := zstdEncoderPool.Get().(*zstd.Encoder)
+	defer zstdEncoderPool.Put(encoder)
+	return encoder.EncodeAll(data, nil), nil
+}
@@ -2,21 +2,25 @@ package uploader
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/command"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
-	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/uploadinfo"
 	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
 	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
 	"github.com/google/device-infra/src/devtools/rbe/casuploader/metrics"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/segmentstore"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -69,9 +73,19 @@ func (du *DirUploader) DoUpload() (digest.Digest, error) {
 		}
 	}
 
+	if du.CommonConfig.partialBlobThreshold > 0 && !du.CommonConfig.chunk {
+		hasLarge, err := du.hasFileAtLeast(du.CommonConfig.partialBlobThreshold)
+		if err != nil {
+			return digest.Digest{}, fmt.Errorf("failed to scan %q for large files: %w", du.dirPath, err)
+		}
+		if hasLarge {
+			return du.partialBlobUpload()
+		}
+	}
+
 	inputSpec := du.inputSpec()
 	rootDigest, uploadEntries, _, err := du.client.ComputeMerkleTree(
-		du.ctx, du.dirPath, "", "", &inputSpec, filemetadata.NewNoopCache())
+		du.ctx, du.dirPath, "", "", &inputSpec, du.CommonConfig.metadataCache)
 	if err != nil {
 		return digest.Digest{}, fmt.Errorf("failed to compute merkle tree: %w", err)
 	}
@@ -102,6 +116,12 @@ func (du *DirUploader) DoUpload() (digest.Digest, error) {
 		return digest.Digest{}, fmt.Errorf("failed to upload blobs: %w", err)
 	}
 
+	if du.CommonConfig.journal != nil {
+		if err := du.CommonConfig.journal.MarkDone(rootDigest); err != nil {
+			log.Warningf("failed to mark resume journal done: %v", err)
+		}
+	}
+
 	return rootDigest, nil
 }
 
@@ -121,15 +141,25 @@ func (du *DirUploader) chunkAndUpload() (digest.Digest, error) {
 		return digest.Digest{}, fmt.Errorf("failed to create chunks dir: %w", err)
 	}
 
+	matcher, err := newExcludeMatcher(du.dirPath, du.CommonConfig.excludeFilters)
+	if err != nil {
+		return digest.Digest{}, err
+	}
+
 	// Compile the list of files to chunk and upload.
 	var paths []string
 	err = fs.WalkDir(os.DirFS(du.dirPath), ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		// TODO: apply excludeFilter
+		filePath := filepath.Join(du.dirPath, path)
+		if matcher.Match(filePath) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
 		if !d.IsDir() {
-			filePath := filepath.Join(du.dirPath, path)
 			paths = append(paths, filePath)
 		}
 		return nil
@@ -143,7 +173,7 @@ func (du *DirUploader) chunkAndUpload() (digest.Digest, error) {
 		return digest.Digest{}, err
 	}
 
-	if err := chunkerutil.CreateIndexFile(targetDir, chunksIndexEntries); err != nil {
+	if err := chunkerutil.CreateIndexFile(targetDir, chunksIndexEntries, du.CommonConfig.avgChunkSize); err != nil {
 		return digest.Digest{}, err
 	}
 
@@ -155,27 +185,256 @@ func (du *DirUploader) chunkAndUpload() (digest.Digest, error) {
 	return rootDigest, nil
 }
 
+// errFoundLargeFile is hasFileAtLeast's sentinel for WalkDir's early exit.
+var errFoundLargeFile = errors.New("found large file")
+
+// hasFileAtLeast reports whether any regular file under du.dirPath is at
+// least size bytes, stopping at the first match instead of walking the
+// whole tree.
+func (du *DirUploader) hasFileAtLeast(size int64) (bool, error) {
+	err := fs.WalkDir(os.DirFS(du.dirPath), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() >= size {
+			return errFoundLargeFile
+		}
+		return nil
+	})
+	if err == errFoundLargeFile {
+		return true, nil
+	}
+	return false, err
+}
+
+// partialBlobUpload materializes a copy of du.dirPath with every file at
+// least partialBlobThreshold bytes replaced by a chunkerutil.BlobManifest
+// blob (see writeBlobManifest), then uploads that copy like an ordinary,
+// non-chunked directory. The copy's Merkle tree therefore has a manifest
+// blob's own digest in place of such a file's real content digest: a
+// consumer that doesn't check for chunkerutil.BlobManifestMagic (see
+// chunkstore.ExpandBlobManifest) would read back the wrong bytes for that
+// file, which is the tradeoff this opt-in feature makes to avoid
+// re-transmitting the unchanged regions of a large, mostly-unchanged file.
+// Smaller files are hardlinked into the copy unchanged, and directories are
+// recreated in it.
+func (du *DirUploader) partialBlobUpload() (digest.Digest, error) {
+	targetDir, err := os.MkdirTemp("", "casuploader-partial-*")
+	if err != nil {
+		return digest.Digest{}, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(targetDir); err != nil {
+			log.Errorf("Failed to remove tmp dir %q: %v", targetDir, err)
+		}
+	}()
+
+	err = fs.WalkDir(os.DirFS(du.dirPath), ".", func(relPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		srcPath := filepath.Join(du.dirPath, relPath)
+		dstPath := filepath.Join(targetDir, relPath)
+		if d.IsDir() {
+			return os.MkdirAll(dstPath, 0755)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() < du.CommonConfig.partialBlobThreshold {
+			return os.Link(srcPath, dstPath)
+		}
+		return du.writeBlobManifest(srcPath, dstPath)
+	})
+	if err != nil {
+		return digest.Digest{}, fmt.Errorf("failed to materialize partial-blob copy of %q: %w", du.dirPath, err)
+	}
+
+	// The copy's large files are now manifest blobs, not the originals, so
+	// re-running this same threshold scan over it would both be pointless
+	// and misinterpret those manifests as more large files to split.
+	config := du.CommonConfig
+	config.partialBlobThreshold = 0
+	newDu := NewDirUploader(&config, targetDir, nil)
+	rootDigest, err := newDu.DoUpload()
+	if err != nil {
+		return rootDigest, fmt.Errorf("failed to upload partial-blob copy %q for source %q: %w", targetDir, du.dirPath, err)
+	}
+	return rootDigest, nil
+}
+
+// writeBlobManifest chunks srcPath on the fly, uploads whichever chunks CAS
+// doesn't already have, and writes the resulting chunkerutil.BlobManifest
+// to dstPath in place of srcPath's own content.
+func (du *DirUploader) writeBlobManifest(srcPath, dstPath string) error {
+	chunksDir, err := os.MkdirTemp("", "casuploader-partial-chunks-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(chunksDir); err != nil {
+			log.Errorf("Failed to remove tmp dir %q: %v", chunksDir, err)
+		}
+	}()
+
+	chunks, err := chunker.ChunkFileWithChunker(srcPath, chunksDir, du.CommonConfig.avgChunkSize, chunker.CompressionNone, du.CommonConfig.chunkerKind, nil)
+	if err != nil {
+		return fmt.Errorf("failed to chunk %s: %w", srcPath, err)
+	}
+
+	manifest := chunkerutil.BlobManifest{Chunks: make([]digest.Digest, len(chunks))}
+	chunkEntries := make([]*uploadinfo.Entry, len(chunks))
+	for i, c := range chunks {
+		dg := digest.Digest{Hash: c.SHA256, Size: c.Length}
+		manifest.Chunks[i] = dg
+		chunkEntries[i] = &uploadinfo.Entry{Digest: dg, Path: filepath.Join(chunksDir, c.SHA256)}
+	}
+
+	missing, err := du.client.MissingBlobs(du.ctx, manifest.Chunks)
+	if err != nil {
+		return fmt.Errorf("MissingBlobs RPC failed for %s's chunks: %w", srcPath, err)
+	}
+	if len(missing) > 0 {
+		missingSet := make(map[digest.Digest]struct{}, len(missing))
+		for _, dg := range missing {
+			missingSet[dg] = struct{}{}
+		}
+		var missingEntries []*uploadinfo.Entry
+		for _, entry := range chunkEntries {
+			if _, ok := missingSet[entry.Digest]; ok {
+				missingEntries = append(missingEntries, entry)
+			}
+		}
+		if _, _, err := du.client.UploadIfMissing(du.ctx, missingEntries...); err != nil {
+			return fmt.Errorf("failed to upload %s's missing chunks: %w", srcPath, err)
+		}
+	}
+
+	data, err := chunkerutil.EncodeBlobManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode blob manifest for %s: %w", srcPath, err)
+	}
+	return os.WriteFile(dstPath, data, 0644)
+}
+
 func (du *DirUploader) chunkFiles(chunksDir string, paths []string) ([]chunkerutil.ChunksIndex, error) {
 	start := time.Now()
-	chunksIndexEntries := make([]chunkerutil.ChunksIndex, 0, len(paths))
-	for _, path := range paths {
-		relPath, err := filepath.Rel(du.dirPath, path)
+
+	// Packing chunk payloads into segment files only applies to the legacy
+	// format: zstd-chunked already stores a whole file as a single blob.
+	var segWriter *segmentstore.Writer
+	if du.CommonConfig.chunkSegmentSize > 0 && du.CommonConfig.chunkFormat == chunkerutil.FormatLegacy {
+		var err error
+		segWriter, err = segmentstore.NewWriter(chunksDir, du.CommonConfig.chunkSegmentSize)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get relative path of file %q: %w", path, err)
+			return nil, fmt.Errorf("failed to create segment writer: %w", err)
 		}
-		chunksIndex, err := chunkerutil.ChunkFile(path, relPath, chunksDir, du.CommonConfig.avgChunkSize)
-		if err != nil {
-			return nil, err
+		defer segWriter.Close()
+	}
+
+	chunksIndexEntries := make([]chunkerutil.ChunksIndex, len(paths))
+	if segWriter != nil {
+		// segmentstore.Writer packs every chunk payload into the same
+		// segment file(s), so it isn't safe for concurrent writers; this
+		// format chunks sequentially.
+		for i, path := range paths {
+			relPath, err := filepath.Rel(du.dirPath, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get relative path of file %q: %w", path, err)
+			}
+			chunksIndex, err := chunkerutil.ChunkFileWithSegments(path, relPath, chunksDir, du.CommonConfig.avgChunkSize, du.CommonConfig.chunkCompression, segWriter)
+			if err != nil {
+				return nil, err
+			}
+			chunksIndexEntries[i] = chunksIndex
+		}
+		if err := segWriter.Close(); err != nil {
+			return nil, fmt.Errorf("failed to close segment writer: %w", err)
 		}
-		chunksIndexEntries = append(chunksIndexEntries, chunksIndex)
+		if err := segmentstore.WriteIndex(chunksDir, segWriter.Index()); err != nil {
+			return nil, fmt.Errorf("failed to write segment index: %w", err)
+		}
+	} else if err := du.chunkFilesConcurrently(chunksDir, paths, chunksIndexEntries); err != nil {
+		return nil, err
 	}
+
 	elapsedTime := time.Since(start)
 	du.CommonConfig.metrics.ChunkTimeMs = elapsedTime.Milliseconds()
 	log.Infof("Chunked %d files. Elapsed time: %v", len(paths), elapsedTime)
 	return chunksIndexEntries, nil
 }
 
+// chunkFilesConcurrently chunks paths into chunksDir, bounded by
+// runtime.GOMAXPROCS(0) concurrent files, writing each file's ChunksIndex
+// into results at its original index. All paths share chunksDir and a
+// single chunker.ChunkDedup, so identical chunks across different files are
+// only written once.
+func (du *DirUploader) chunkFilesConcurrently(chunksDir string, paths []string, results []chunkerutil.ChunksIndex) error {
+	dedup := chunker.NewChunkDedup()
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	errs := make([]error, len(paths))
+
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		relPath, err := filepath.Rel(du.dirPath, path)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path of file %q: %w", path, err)
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, path, relPath string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var chunksIndex chunkerutil.ChunksIndex
+			var err error
+			if du.CommonConfig.chunkCache != nil && du.CommonConfig.chunkFormat == chunkerutil.FormatLegacy {
+				chunksIndex, err = chunkerutil.ChunkFileCached(path, relPath, chunksDir, du.CommonConfig.avgChunkSize, du.CommonConfig.chunkerKind, dedup, du.CommonConfig.chunkCache, du.CommonConfig.metrics)
+			} else {
+				chunksIndex, err = chunkerutil.ChunkFileWithFormat(path, relPath, chunksDir, du.CommonConfig.avgChunkSize, du.CommonConfig.chunkerKind, dedup, du.CommonConfig.chunkFormat, du.CommonConfig.chunkCompression)
+			}
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i] = chunksIndex
+		}(i, path, relPath)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (du *DirUploader) findMissing(uploadInfos []*uploadinfo.Entry) ([]*uploadinfo.Entry, error) {
+	if du.CommonConfig.journal != nil {
+		// Entries a prior attempt already confirmed uploaded don't need to
+		// round-trip through MissingBlobs again.
+		remaining := uploadInfos[:0:0]
+		for _, entry := range uploadInfos {
+			if !du.CommonConfig.journal.IsConfirmed(entry.Digest) {
+				remaining = append(remaining, entry)
+			}
+		}
+		uploadInfos = remaining
+	}
+
 	if len(uploadInfos) == 0 {
 		return nil, nil
 	}
@@ -213,17 +472,59 @@ func (du *DirUploader) findMissing(uploadInfos []*uploadinfo.Entry) ([]*uploadin
 
 func (du *DirUploader) upload(uploadInfos []*uploadinfo.Entry) error {
 	start := time.Now()
+	du.recordCompressionSavings(uploadInfos)
 	digests, size, err := du.client.UploadIfMissing(du.ctx, uploadInfos...)
 	if err != nil {
 		return fmt.Errorf("UploadIfMissing failed: %w", err)
 	}
 
+	if du.CommonConfig.journal != nil {
+		if err := du.CommonConfig.journal.MarkConfirmed(digests); err != nil {
+			log.Warningf("failed to update resume journal with confirmed blobs: %v", err)
+		}
+	}
+
 	du.CommonConfig.metrics.UploadedSizeBytes = size
 	du.CommonConfig.metrics.UploadedEntries = len(digests)
 	log.Infof("Uploaded %d blobs, %d bytes. Elapsed time: %v", len(digests), size, time.Since(start))
 	return nil
 }
 
+// recordCompressionSavings estimates, for every blob in uploadInfos at
+// least compressionThreshold bytes, what CommonConfig.compressor would have
+// saved on the wire, and folds the result into metrics. It's an estimate
+// rather than what UploadIfMissing actually sends: the RE API v2
+// bytestream Compressor negotiation (and its fallback to uncompressed
+// uploads when the server's capabilities probe rejects compression) happens
+// inside the remote-apis-sdks client, below this package.
+func (du *DirUploader) recordCompressionSavings(uploadInfos []*uploadinfo.Entry) {
+	if du.CommonConfig.compressionThreshold <= 0 {
+		return
+	}
+	for _, entry := range uploadInfos {
+		if (!entry.IsBlob() && !entry.IsFile()) || entry.Digest.Size < du.CommonConfig.compressionThreshold {
+			continue
+		}
+		contents := entry.Contents
+		if len(contents) == 0 && entry.Path != "" {
+			data, err := os.ReadFile(entry.Path)
+			if err != nil {
+				log.Warningf("failed to read %q to estimate compression savings: %v", entry.Path, err)
+				continue
+			}
+			contents = data
+		}
+		compressed, err := du.CommonConfig.compressor.Compress(contents)
+		if err != nil {
+			log.Warningf("failed to estimate %s compression for blob %s: %v", du.CommonConfig.compressor.Name(), entry.Digest, err)
+			continue
+		}
+		du.CommonConfig.metrics.CompressedEntries++
+		du.CommonConfig.metrics.PreCompressionSizeBytes += entry.Digest.Size
+		du.CommonConfig.metrics.PostCompressionSizeBytes += int64(len(compressed))
+	}
+}
+
 func printEntriesStats(entries []*uploadinfo.Entry, message string, metrics *metrics.Metrics) {
 	var size int64
 	var numFiles, numBlobs int
@@ -0,0 +1,133 @@
+package uploader
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// NormalizeExcludeFilters validates and normalizes the raw -exclude-filters
+// values so CommonConfig only ever has to deal with plain regex source:
+// a pattern that's already a valid Go regular expression is returned
+// unchanged (so every existing -exclude-filters invocation keeps behaving
+// exactly as before); a pattern that isn't (e.g. "**/*.img" or
+// "out/host/**", which regexp.Compile rejects because "**" repeats a
+// repetition operator) is translated from gitignore/buildkit-style glob
+// syntax into equivalent regex source instead. The result is still meant to
+// be used the way DirUploader.inputSpec always has: with the root
+// directory path implicitly prepended, so callers must not anchor a
+// pattern with "^".
+func NormalizeExcludeFilters(filters []string) ([]string, error) {
+	normalized := make([]string, len(filters))
+	for i, f := range filters {
+		n, err := normalizeExcludeFilter(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -exclude-filters pattern %q: %v", f, err)
+		}
+		normalized[i] = n
+	}
+	return normalized, nil
+}
+
+func normalizeExcludeFilter(pattern string) (string, error) {
+	if _, err := regexp.Compile(pattern); err == nil {
+		return pattern, nil
+	}
+	return globToRegexSource(pattern)
+}
+
+// globToRegexSource translates a doublestar-style glob ("*" matches within
+// a path segment, "**" matches zero or more whole segments, "?" matches a
+// single character) into equivalent regex source text, anchored at the end
+// (so "*.img" can't match a path like "foo.imgbak") but not at the start,
+// matching how the unanchored raw-regex patterns above are used: prepended
+// with the root directory path and matched unanchored on the left.
+func globToRegexSource(pattern string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString(`(?:.*/)?`)
+			i += 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(`.*`)
+			i += 2
+		case pattern[i] == '*':
+			b.WriteString(`[^/]*`)
+			i++
+		case pattern[i] == '?':
+			b.WriteString(`[^/]`)
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			i++
+		}
+	}
+	b.WriteByte('$')
+	source := b.String()
+	if _, err := regexp.Compile(source); err != nil {
+		return "", err
+	}
+	return source, nil
+}
+
+// excludeMatcher applies CommonConfig's (already-normalized) exclude
+// filters directly against a walked path, for chunkAndUpload, which has no
+// equivalent of client.ComputeMerkleTree's own InputExclusion mechanism
+// (see DirUploader.inputSpec).
+type excludeMatcher struct {
+	patterns []*regexp.Regexp
+}
+
+// newExcludeMatcher compiles filters the same way DirUploader.inputSpec
+// turns them into command.InputExclusion.Regex values: each pattern is
+// prepended with root and matched unanchored on the left.
+func newExcludeMatcher(root string, filters []string) (*excludeMatcher, error) {
+	m := &excludeMatcher{patterns: make([]*regexp.Regexp, 0, len(filters))}
+	for _, f := range filters {
+		re, err := regexp.Compile(fmt.Sprintf("%s/%s", root, f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude filter %q: %v", f, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+// Match reports whether path matches any of m's patterns.
+func (m *excludeMatcher) Match(path string) bool {
+	for _, re := range m.patterns {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadExcludeFiltersFile reads newline-separated exclude patterns (regex or
+// glob, see NormalizeExcludeFilters) from path for the --exclude-from flag,
+// skipping blank lines and "#"-prefixed comments so a large exclude list
+// doesn't have to be repeated on the command line.
+func ReadExcludeFiltersFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read exclude filters from %s: %v", path, err)
+	}
+	return patterns, nil
+}
@@ -0,0 +1,82 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// SourceFetcher resolves a source (a local path or a URL) to a local file
+// FileUploader can chunk and upload, fetching it into dir first if it isn't
+// already local. The returned cleanup func removes any temporary file the
+// fetcher created; it is always non-nil and safe to call even on error.
+type SourceFetcher interface {
+	Fetch(ctx context.Context, source, dir string) (path string, cleanup func(), err error)
+}
+
+// sourceFetchers maps a URL scheme to the SourceFetcher that handles it.
+// Sources with no scheme, or an unrecognized one, fall back to localFetcher.
+var sourceFetchers = map[string]SourceFetcher{
+	"http":  httpFetcher{},
+	"https": httpFetcher{},
+}
+
+// resolveSourceFetcher returns the SourceFetcher registered for source's URL
+// scheme, or localFetcher if source has no scheme or an unregistered one.
+func resolveSourceFetcher(source string) SourceFetcher {
+	u, err := url.Parse(source)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return localFetcher{}
+	}
+	if f, ok := sourceFetchers[u.Scheme]; ok {
+		return f
+	}
+	return localFetcher{}
+}
+
+// localFetcher treats source as a path already on the local filesystem.
+type localFetcher struct{}
+
+func (localFetcher) Fetch(ctx context.Context, source, dir string) (string, func(), error) {
+	return source, func() {}, nil
+}
+
+// httpFetcher downloads source over HTTP(S) into a temporary file under dir.
+type httpFetcher struct{}
+
+func (httpFetcher) Fetch(ctx context.Context, source, dir string) (string, func(), error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return "", func() {}, fmt.Errorf("failed to build request for %s: %v", source, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", func() {}, fmt.Errorf("failed to fetch %s: %v", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", func() {}, fmt.Errorf("failed to fetch %s: status %s", source, resp.Status)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", func() {}, fmt.Errorf("failed to create dir %s: %v", dir, err)
+	}
+	path := filepath.Join(dir, uuid.New().String())
+	out, err := os.Create(path)
+	if err != nil {
+		return "", func() {}, fmt.Errorf("failed to create %s: %v", path, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		os.Remove(path)
+		return "", func() {}, fmt.Errorf("failed to download %s: %v", source, err)
+	}
+	return path, func() { os.Remove(path) }, nil
+}
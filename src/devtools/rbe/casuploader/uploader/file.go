@@ -12,6 +12,7 @@ import (
 	log "github.com/golang/glog"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
 	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/segmentstore"
 )
 
 // FileUploader is the uploader for uploading a file to CAS.
@@ -45,7 +46,9 @@ func copyFile(dstPath string, srcPath string, mode os.FileMode) error {
 	return err
 }
 
-// DoUpload uploads the file to CAS, and returns the digest of the root.
+// DoUpload uploads the file to CAS, and returns the digest of the root. fu.path
+// may be a local path or a URL recognized by a registered SourceFetcher (see
+// resolveSourceFetcher), in which case it's fetched to a local file first.
 func (fu *FileUploader) DoUpload() (digest.Digest, error) {
 	targetDir := createTmpDir()
 	defer func() {
@@ -54,30 +57,63 @@ func (fu *FileUploader) DoUpload() (digest.Digest, error) {
 		}
 	}()
 
+	// Fetch into a dir of its own, so a downloaded copy isn't uploaded as an
+	// extra file alongside fu.path's own entry in targetDir.
+	fetchDir := createTmpDir()
+	defer os.RemoveAll(fetchDir)
+	localPath, cleanup, err := resolveSourceFetcher(fu.path).Fetch(fu.CommonConfig.ctx, fu.path, fetchDir)
+	if err != nil {
+		return digest.Digest{}, fmt.Errorf("failed to fetch %s: %v", fu.path, err)
+	}
+	defer cleanup()
+
 	if fu.CommonConfig.chunk {
 		start := time.Now()
 		chunksDir := filepath.Join(targetDir, chunkerutil.ChunksDirName)
 		os.MkdirAll(chunksDir, 0755)
 
-		chunksIndex, err := chunkerutil.ChunkFile(fu.path, path.Base(fu.path), chunksDir, fu.CommonConfig.avgChunkSize)
-		if err != nil {
-			return digest.Digest{}, fmt.Errorf("failed to chunk the file %s: %v", fu.path, err)
+		var chunksIndex chunkerutil.ChunksIndex
+		if fu.CommonConfig.chunkSegmentSize > 0 && fu.CommonConfig.chunkFormat == chunkerutil.FormatLegacy {
+			segWriter, err := segmentstore.NewWriter(chunksDir, fu.CommonConfig.chunkSegmentSize)
+			if err != nil {
+				return digest.Digest{}, fmt.Errorf("failed to create segment writer: %w", err)
+			}
+			chunksIndex, err = chunkerutil.ChunkFileWithSegments(localPath, path.Base(fu.path), chunksDir, fu.CommonConfig.avgChunkSize, fu.CommonConfig.chunkCompression, segWriter)
+			if err != nil {
+				return digest.Digest{}, fmt.Errorf("failed to chunk the file %s: %v", fu.path, err)
+			}
+			if err := segWriter.Close(); err != nil {
+				return digest.Digest{}, fmt.Errorf("failed to close segment writer: %w", err)
+			}
+			if err := segmentstore.WriteIndex(chunksDir, segWriter.Index()); err != nil {
+				return digest.Digest{}, fmt.Errorf("failed to write segment index: %w", err)
+			}
+		} else if fu.CommonConfig.chunkCache != nil && fu.CommonConfig.chunkFormat == chunkerutil.FormatLegacy {
+			chunksIndex, err = chunkerutil.ChunkFileCached(localPath, path.Base(fu.path), chunksDir, fu.CommonConfig.avgChunkSize, fu.CommonConfig.chunkerKind, nil, fu.CommonConfig.chunkCache, fu.CommonConfig.metrics)
+			if err != nil {
+				return digest.Digest{}, fmt.Errorf("failed to chunk the file %s: %v", fu.path, err)
+			}
+		} else {
+			chunksIndex, err = chunkerutil.ChunkFileWithFormat(localPath, path.Base(fu.path), chunksDir, fu.CommonConfig.avgChunkSize, fu.CommonConfig.chunkerKind, nil, fu.CommonConfig.chunkFormat, fu.CommonConfig.chunkCompression)
+			if err != nil {
+				return digest.Digest{}, fmt.Errorf("failed to chunk the file %s: %v", fu.path, err)
+			}
 		}
 
-		if err := chunkerutil.CreateIndexFile(targetDir, []chunkerutil.ChunksIndex{chunksIndex}); err != nil {
+		if err := chunkerutil.CreateIndexFile(targetDir, []chunkerutil.ChunksIndex{chunksIndex}, fu.CommonConfig.avgChunkSize); err != nil {
 			return digest.Digest{}, fmt.Errorf("failed to create index file for file %s: %v", fu.path, err)
 		}
 		fu.CommonConfig.metrics.ChunkTimeMs = time.Since(start).Milliseconds()
 	} else {
 		// Upload as a dir with the file in it.
 		path := filepath.Join(targetDir, filepath.Base(fu.path))
-		if err := os.Symlink(fu.path, path); err != nil {
+		if err := os.Symlink(localPath, path); err != nil {
 			// Failover to copy the file.
-			fileInfo, err := os.Stat(fu.path)
+			fileInfo, err := os.Stat(localPath)
 			if err != nil {
 				return digest.Digest{}, err
 			}
-			if err := copyFile(path, fu.path, fileInfo.Mode()); err != nil {
+			if err := copyFile(path, localPath, fileInfo.Mode()); err != nil {
 				return digest.Digest{}, fmt.Errorf("failed to copy file: %w", err)
 			}
 		}
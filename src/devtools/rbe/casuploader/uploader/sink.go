@@ -0,0 +1,101 @@
+package uploader
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/xattr"
+)
+
+// FileSink abstracts the filesystem operations an archive unarchiver needs
+// to materialize its entries, so the same unarchiving logic can target a
+// real on-disk directory, a tar writer, or an in-memory destination.
+type FileSink interface {
+	// MkdirAll creates path, and any missing parents, with the given mode.
+	MkdirAll(path string, mode os.FileMode) error
+	// CreateFile creates (or truncates) a file at path with the given mode
+	// and returns a writer for its content. The caller closes it.
+	CreateFile(path string, mode os.FileMode) (io.WriteCloser, error)
+	// SetXattr sets an extended attribute on the file at path. Sinks that
+	// can't represent xattrs may no-op.
+	SetXattr(path, name string, value []byte) error
+	// SetTimes sets the modification time of the file at path. Sinks that
+	// can't represent times may no-op.
+	SetTimes(path string, mtime time.Time) error
+}
+
+// dirFileSink is a FileSink backed by a real directory on the local
+// filesystem. It's the sink unarchivers use by default.
+type dirFileSink struct{}
+
+func (dirFileSink) MkdirAll(path string, mode os.FileMode) error {
+	return os.MkdirAll(path, mode)
+}
+
+func (dirFileSink) CreateFile(path string, mode os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+}
+
+func (dirFileSink) SetXattr(path, name string, value []byte) error {
+	return xattr.Set(path, name, value)
+}
+
+func (dirFileSink) SetTimes(path string, mtime time.Time) error {
+	return os.Chtimes(path, time.Time{}, mtime)
+}
+
+// memFile is a single file held by a memFileSink.
+type memFile struct {
+	buf   bytes.Buffer
+	mode  os.FileMode
+	xattr map[string][]byte
+	mtime time.Time
+}
+
+// memFileSink is an in-memory FileSink, useful for callers that only need to
+// inspect or re-pack extracted content without ever touching disk.
+type memFileSink struct {
+	files map[string]*memFile
+}
+
+func newMemFileSink() *memFileSink {
+	return &memFileSink{files: make(map[string]*memFile)}
+}
+
+func (s *memFileSink) MkdirAll(path string, mode os.FileMode) error {
+	return nil // directories aren't modeled; files are addressed by full path.
+}
+
+func (s *memFileSink) CreateFile(path string, mode os.FileMode) (io.WriteCloser, error) {
+	f := &memFile{mode: mode, xattr: make(map[string][]byte)}
+	s.files[path] = f
+	return nopWriteCloser{&f.buf}, nil
+}
+
+func (s *memFileSink) SetXattr(path, name string, value []byte) error {
+	f, ok := s.files[path]
+	if !ok {
+		return os.ErrNotExist
+	}
+	f.xattr[name] = value
+	return nil
+}
+
+func (s *memFileSink) SetTimes(path string, mtime time.Time) error {
+	f, ok := s.files[path]
+	if !ok {
+		return os.ErrNotExist
+	}
+	f.mtime = mtime
+	return nil
+}
+
+// nopWriteCloser adapts an io.Writer with no meaningful Close into an
+// io.WriteCloser.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
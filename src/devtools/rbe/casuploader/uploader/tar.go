@@ -0,0 +1,381 @@
+package uploader
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/xattr"
+)
+
+const (
+	// XattrSrcTarPath is the xattr name for the entry name in the tar
+	// archive. It maps an extracted file back to its entry inside the
+	// original tar, the tar analogue of XattrSrcZipPath.
+	XattrSrcTarPath = "user.tar_src"
+)
+
+// DigestSource resolves a tar entry's content digest directly from its
+// header, for archive formats that embed a per-entry hash in their own
+// table of contents (e.g. some OCI layers), so TarUploader can skip
+// streaming-hashing that entry's content entirely. It's the tar analogue of
+// ZipUploader's Sha256HeaderID extra field. A nil DigestSource (the
+// default) means no such TOC is available; every entry is extracted and
+// hashed normally by DirUploader.DoUpload.
+type DigestSource interface {
+	// Digest returns hdr's entry's SHA256, or ok=false if this DigestSource
+	// has no record for it.
+	Digest(hdr *tar.Header) (sha256 string, ok bool)
+}
+
+// TarUploader is the uploader for uploading a tar archive (optionally
+// zstd-compressed, selected by a ".zst" suffix) to CAS. It mirrors
+// ZipUploader's shape: an entry digestSource already has a digest for is
+// materialized as an empty stub file carrying XattrDigestName/
+// XattrSrcTarPath xattrs, and tarFileLoader seeks back into the archive to
+// fill in content DirUploader.DoUpload reports missing.
+type TarUploader struct {
+	CommonConfig
+	tarPath string
+}
+
+// NewTarUploader creates a new tar uploader to upload a tar archive to CAS.
+func NewTarUploader(config *CommonConfig, tarPath string) Uploader {
+	return &TarUploader{
+		CommonConfig: *config,
+		tarPath:      tarPath,
+	}
+}
+
+// DoUpload uploads the unarchived tar's content to CAS, and returns the
+// digest of the root directory.
+func (tu *TarUploader) DoUpload() (digest.Digest, error) {
+	// Set the digest xattr key name to filemetadata
+	filemetadata.XattrDigestName = XattrDigestName
+
+	targetDir := createTmpDir()
+	defer func() {
+		if err := os.RemoveAll(targetDir); err != nil {
+			log.Errorf("Failed to remove tmp dir: %v\n", err)
+		}
+	}()
+
+	log.Infof("Extracting %s to %s with digests\n", tu.tarPath, targetDir)
+
+	unarchiver := newTarUnarchiver(tu.tarPath, targetDir, dirFileSink{}, tu.CommonConfig.digestSource)
+	if err := unarchiver.extractAll(true); err != nil {
+		return digest.Digest{}, fmt.Errorf("failed to extract %s to %s: %v", tu.tarPath, targetDir, err)
+	}
+
+	du := NewDirUploader(&tu.CommonConfig, targetDir, &tarFileLoader{tarPath: tu.tarPath, offsets: unarchiver.offsets})
+	rootDigest, err := du.DoUpload()
+	if err != nil {
+		return rootDigest, fmt.Errorf("failed to upload the directory %s for tar %s: %v", targetDir, tu.tarPath, err)
+	}
+	return rootDigest, nil
+}
+
+// tarEntryOffset records where an extracted tar entry's content begins (and
+// how long it is) in the (possibly decompressed) tar byte stream, so
+// tarFileLoader can seek directly back to it without re-reading every
+// earlier entry.
+type tarEntryOffset struct {
+	Offset int64
+	Size   int64
+}
+
+// tarUnarchiver extracts a (possibly zstd-compressed) tar archive, same
+// role as zipUnarchiver but for the tar format: archive/tar.Reader can only
+// be read forward once, so tarUnarchiver records each extracted file's
+// stream offset as it goes, instead of relying on the archive format's own
+// random access the way zipUnarchiver does.
+type tarUnarchiver struct {
+	tarPath string
+	dstRoot string
+	// sink is the FileSink entries are materialized into. Defaults to
+	// dirFileSink{} (a real directory), but can target any FileSink, e.g. an
+	// in-memory sink.
+	sink FileSink
+	// limits bounds how much extractAll is willing to extract.
+	limits extractLimits
+	// digestSource, if non-nil, lets extractAll skip streaming-hashing an
+	// entry whose digest it already knows from the archive's own TOC.
+	digestSource DigestSource
+	// extractedSize is the running total of uncompressed bytes extracted so
+	// far, checked against limits.MaxTotalSize.
+	extractedSize int64
+	// offsets maps each extracted regular file's tar entry name to where its
+	// content lives in the (possibly decompressed) byte stream.
+	offsets map[string]tarEntryOffset
+}
+
+func newTarUnarchiver(tarPath, dstRoot string, sink FileSink, digestSource DigestSource) *tarUnarchiver {
+	if sink == nil {
+		sink = dirFileSink{}
+	}
+	return &tarUnarchiver{
+		tarPath:      tarPath,
+		dstRoot:      dstRoot,
+		sink:         sink,
+		limits:       defaultExtractLimits,
+		digestSource: digestSource,
+		offsets:      make(map[string]tarEntryOffset),
+	}
+}
+
+// openTarStream opens path (zstd-decompressed when path ends in ".zst") as a
+// byte stream, ready to be read sequentially from the start.
+func openTarStream(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tar archive: %v", err)
+	}
+	if !strings.HasSuffix(path, ".zst") {
+		return f, nil
+	}
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open zstd stream of %s: %v", path, err)
+	}
+	return zstdReadCloser{Decoder: zr, f: f}, nil
+}
+
+// zstdReadCloser adapts a *zstd.Decoder, whose Close has no return value,
+// into an io.ReadCloser that also closes the underlying file.
+type zstdReadCloser struct {
+	*zstd.Decoder
+	f *os.File
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return z.f.Close()
+}
+
+// countingReader wraps an io.Reader, tracking how many bytes have been read
+// from it, so tarUnarchiver can record each entry's content offset within
+// the (possibly decompressed) tar byte stream.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// resolvePath joins name onto the extraction root and rejects the result if
+// it would escape the root (a "tar slip" path traversal via "../" entries
+// or an absolute path).
+func (tu *tarUnarchiver) resolvePath(name string) (string, error) {
+	filePath := filepath.Join(tu.dstRoot, name)
+	rel, err := filepath.Rel(tu.dstRoot, filePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("tar entry %q escapes the extraction root", name)
+	}
+	return filePath, nil
+}
+
+// extractAll extracts every regular file and directory from the tar
+// archive into tu.dstRoot. If skipFileWithDigest is true, an entry
+// tu.digestSource already has a digest for is materialized as an empty
+// stub file carrying XattrDigestName/XattrSrcTarPath xattrs instead of
+// having its content read, mirroring zipUnarchiver.extractAll.
+func (tu *tarUnarchiver) extractAll(skipFileWithDigest bool) error {
+	stream, err := openTarStream(tu.tarPath)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	cr := &countingReader{r: stream}
+	tr := tar.NewReader(cr)
+
+	var count int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %v", err)
+		}
+		count++
+		if count > tu.limits.MaxFiles {
+			return fmt.Errorf("tar archive %s has more than %d entries, exceeding the limit", tu.tarPath, tu.limits.MaxFiles)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := tu.extractDir(hdr); err != nil {
+				return fmt.Errorf("failed to extract directory %s: %v", hdr.Name, err)
+			}
+		case tar.TypeReg:
+			if err := tu.extractFile(hdr, tr, cr.n, skipFileWithDigest); err != nil {
+				return fmt.Errorf("failed to extract file %s: %v", hdr.Name, err)
+			}
+		default:
+			// Symlinks, hardlinks, devices, etc. carry no content of their
+			// own and aren't part of this uploader's scope; skip them.
+			log.Warningf("Skipping unsupported tar entry %s (type %v)", hdr.Name, hdr.Typeflag)
+		}
+	}
+	return nil
+}
+
+func (tu *tarUnarchiver) extractDir(hdr *tar.Header) error {
+	filePath, err := tu.resolvePath(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if err := tu.sink.MkdirAll(filePath, hdr.FileInfo().Mode()); err != nil {
+		return fmt.Errorf("failed to extract directory %s: %v", filePath, err)
+	}
+	return nil
+}
+
+// extractFile materializes hdr's content (or, if skipIfDigestExists and
+// tu.digestSource knows its digest, an empty stub with digest xattrs) at
+// its resolved destination path, and records its content offset (read
+// before any of its content is consumed) in tu.offsets.
+func (tu *tarUnarchiver) extractFile(hdr *tar.Header, tr *tar.Reader, contentOffset int64, skipIfDigestExists bool) error {
+	if hdr.Size > tu.limits.MaxFileSize {
+		return fmt.Errorf("tar entry %q is %d bytes, exceeding the per-file limit of %d", hdr.Name, hdr.Size, tu.limits.MaxFileSize)
+	}
+	if tu.extractedSize += hdr.Size; tu.extractedSize > tu.limits.MaxTotalSize {
+		return fmt.Errorf("tar archive %s exceeds the total uncompressed size limit of %d bytes", tu.tarPath, tu.limits.MaxTotalSize)
+	}
+
+	filePath, err := tu.resolvePath(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if err := tu.sink.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(filePath), err)
+	}
+
+	tu.offsets[hdr.Name] = tarEntryOffset{Offset: contentOffset, Size: hdr.Size}
+
+	if skipIfDigestExists && tu.digestSource != nil {
+		if sha256, ok := tu.digestSource.Digest(hdr); ok {
+			w, err := tu.sink.CreateFile(filePath, hdr.FileInfo().Mode())
+			if err != nil {
+				return fmt.Errorf("failed to create file %s: %v", filePath, err)
+			}
+			w.Close()
+			if err := tu.sink.SetXattr(filePath, XattrDigestName, []byte(fmt.Sprintf("%s/%d", sha256, hdr.Size))); err != nil {
+				return fmt.Errorf("failed to set xattr %s to %s: %v", XattrDigestName, filePath, err)
+			}
+			if err := tu.sink.SetXattr(filePath, XattrSrcTarPath, []byte(hdr.Name)); err != nil {
+				return fmt.Errorf("failed to set xattr %s to %s: %v", XattrSrcTarPath, filePath, err)
+			}
+			if err := tu.sink.SetTimes(filePath, hdr.ModTime); err != nil {
+				return fmt.Errorf("failed to set modified time %s to file %s: %v", hdr.ModTime, filePath, err)
+			}
+			return nil
+		}
+	}
+
+	dst, err := tu.sink.CreateFile(filePath, hdr.FileInfo().Mode())
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %v", filePath, err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, tr); err != nil {
+		return fmt.Errorf("failed to extract file %s in archive: %v", hdr.Name, err)
+	}
+	return nil
+}
+
+// tarFileLoader loads only the files DirUploader.DoUpload reports missing,
+// by re-opening the archive and seeking directly to each one's recorded
+// offset (see tarUnarchiver.offsets) instead of re-extracting everything,
+// the tar analogue of zipFileLoader (which instead relies on the zip
+// format's own random access).
+type tarFileLoader struct {
+	tarPath string
+	offsets map[string]tarEntryOffset
+}
+
+func (tfl *tarFileLoader) LoadFiles(dstPaths []string) error {
+	start := time.Now()
+
+	type target struct {
+		path string
+		tarEntryOffset
+	}
+	var targets []target
+	for _, path := range dstPaths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if stat.Size() > 0 {
+			continue
+		}
+		name, err := xattr.Get(path, XattrSrcTarPath)
+		if err != nil {
+			return err
+		}
+		entry, ok := tfl.offsets[string(name)]
+		if !ok {
+			return fmt.Errorf("no recorded tar offset for entry %q", name)
+		}
+		targets = append(targets, target{path: path, tarEntryOffset: entry})
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	// Visiting targets in ascending stream order means a single sequential
+	// pass through the (possibly zstd-decompressed) stream reaches every one
+	// of them, without ever having to re-open or re-decompress from scratch.
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Offset < targets[j].Offset })
+
+	stream, err := openTarStream(tfl.tarPath)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	var pos int64
+	var count int
+	var size int64
+	for _, t := range targets {
+		if t.Offset > pos {
+			n, err := io.CopyN(io.Discard, stream, t.Offset-pos)
+			pos += n
+			if err != nil {
+				return fmt.Errorf("failed to seek to offset %d in %s: %v", t.Offset, tfl.tarPath, err)
+			}
+		}
+
+		dst, err := os.OpenFile(t.path, os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(dst, io.LimitReader(stream, t.Size))
+		dst.Close()
+		pos += n
+		if err != nil {
+			return fmt.Errorf("failed to load file content of %s from archive: %v", t.path, err)
+		}
+		count++
+		size += n
+	}
+	log.Infof("Loaded %d files, %d bytes. Time: %v\n", count, size, time.Since(start))
+	return nil
+}
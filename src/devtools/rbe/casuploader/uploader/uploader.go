@@ -8,7 +8,10 @@ import (
 
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
 	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/filemetadata"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkercache"
 	"github.com/google/device-infra/src/devtools/rbe/casuploader/metrics"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/resumejournal"
 	"github.com/google/uuid"
 )
 
@@ -16,29 +19,119 @@ import (
 type Uploader interface {
 	// DoUpload uploads files/directories to CAS, and returns the digest of the root directory.
 	DoUpload() (digest.Digest, error)
+	// SupportsPartialBlobs reports whether this upload may contain
+	// chunkerutil.BlobManifest blobs in place of some files' own content
+	// (see DirUploader.partialBlobUpload), so a downstream consumer knows
+	// whether a digest in this upload's tree needs checking for
+	// chunkerutil.BlobManifestMagic before it's treated as literal content.
+	SupportsPartialBlobs() bool
 }
 
 // CommonConfig is the common configurations used for all kinds of uploders
 type CommonConfig struct {
-	ctx             context.Context
-	client          *client.Client
-	excludeFilters  []string
-	dumpFileDetails string
-	chunk           bool
-	avgChunkSize    int
-	metrics         *metrics.Metrics
+	ctx              context.Context
+	client           *client.Client
+	excludeFilters   []string
+	dumpFileDetails  string
+	chunk            bool
+	avgChunkSize     int
+	chunkFormat      string
+	chunkCompression string
+	chunkSegmentSize int64
+	// chunkerKind is chunker.ChunkerFastCDC or chunker.ChunkerFixed,
+	// selecting FormatLegacy's splitting algorithm (see
+	// chunker.ChunkFileWithChunker); "" behaves like ChunkerFastCDC.
+	chunkerKind string
+	chunkCache       *chunkercache.Cache
+	journal          *resumejournal.Journal
+	metrics          *metrics.Metrics
+	// compressor estimates the wire savings of compressing an upload
+	// entry's contents above compressionThreshold (see upload in dir.go).
+	// Never nil; NewCommonConfig defaults it to the identity Compressor.
+	compressor Compressor
+	// compressionThreshold is the minimum blob size, in bytes, for which
+	// upload estimates compression savings. <= 0 disables the estimate.
+	compressionThreshold int64
+	// metadataCache, when non-nil, is passed to client.ComputeMerkleTree
+	// instead of filemetadata.NewNoopCache(), so DirUploader.DoUpload (and
+	// the chunked sub-upload it recurses into) can skip restating and
+	// rehashing files unchanged since a prior invocation (see
+	// metadatacache.Cache).
+	metadataCache filemetadata.Cache
+	// partialBlobThreshold is the minimum file size, in bytes, at which
+	// DirUploader.DoUpload chunks a file on the fly and uploads a
+	// chunkerutil.BlobManifest blob in its place instead of the file's own
+	// content, so a large, mostly-unchanged file only re-transmits the
+	// chunks CAS doesn't already have (see DirUploader.partialBlobUpload).
+	// <= 0 disables this entirely.
+	partialBlobThreshold int64
+	// digestSource, when non-nil, is consulted by TarUploader to skip
+	// streaming-hashing a tar entry whose digest its archive's own TOC
+	// already records. nil means no such TOC is available.
+	digestSource DigestSource
 }
 
-// NewCommonConfig creates a common CAS uploader configuration.
-func NewCommonConfig(ctx context.Context, client *client.Client, excludeFilters []string, dumpFileDetails string, chunk bool, avgChunkSize int, metrics *metrics.Metrics) *CommonConfig {
+// SupportsPartialBlobs reports whether c.partialBlobThreshold is enabled.
+// It's promoted onto every Uploader that embeds a CommonConfig, satisfying
+// the Uploader interface's SupportsPartialBlobs method.
+func (c *CommonConfig) SupportsPartialBlobs() bool {
+	return c.partialBlobThreshold > 0
+}
+
+// NewCommonConfig creates a common CAS uploader configuration. chunkFormat
+// selects the on-disk layout used when chunk is true; see
+// chunkerutil.ChunkFileWithFormat for the supported values ("" and
+// chunkerutil.FormatLegacy are equivalent). chunkCompression selects the
+// per-chunk on-disk compression used by the legacy format (see
+// chunker.ChunkFileWithCompression). chunkSegmentSize, when > 0 and
+// chunkFormat is FormatLegacy, packs chunk payloads into segment files of
+// roughly that size instead of one file per chunk (see segmentstore).
+// chunkCache, when non-nil, skips re-chunking unchanged files across
+// invocations (see chunkerutil.ChunkFileCached); it only applies to
+// FormatLegacy with chunkSegmentSize == 0. journal, when non-nil, makes
+// DirUploader.DoUpload (and its callers, FilelistUploader/FileUploader)
+// resumable: already-confirmed blob digests from a prior attempt are
+// skipped, and newly-confirmed ones are recorded as the upload progresses
+// (see resumejournal and the `casuploader resume` command). chunkerKind
+// selects FormatLegacy's splitting algorithm (chunker.ChunkerFastCDC or
+// chunker.ChunkerFixed; "" behaves like ChunkerFastCDC). compressor and
+// compressionThreshold control upload's (see dir.go) estimate of blob
+// compression savings above compressionThreshold bytes; a nil compressor
+// is replaced with the identity Compressor. metadataCache, if non-nil, is
+// used by DirUploader.DoUpload in place of filemetadata.NewNoopCache() to
+// skip rehashing files unchanged since a prior invocation (see
+// metadatacache.Cache); a nil metadataCache keeps the noop-cache default.
+// partialBlobThreshold controls DirUploader.DoUpload's partial-blob
+// upload path (see CommonConfig.partialBlobThreshold); <= 0 disables it.
+// digestSource, if non-nil, lets a TarUploader built from this config skip
+// streaming-hashing entries its archive's own TOC already has a digest
+// for (see DigestSource); nil means every entry is hashed normally.
+func NewCommonConfig(ctx context.Context, client *client.Client, excludeFilters []string, dumpFileDetails string, chunk bool, avgChunkSize int, chunkFormat, chunkCompression string, chunkSegmentSize int64, chunkerKind string, chunkCache *chunkercache.Cache, journal *resumejournal.Journal, metrics *metrics.Metrics, compressor Compressor, compressionThreshold int64, metadataCache filemetadata.Cache, partialBlobThreshold int64, digestSource DigestSource) *CommonConfig {
+	if compressor == nil {
+		compressor = noopCompressor{}
+	}
+	if metadataCache == nil {
+		metadataCache = filemetadata.NewNoopCache()
+	}
 	return &CommonConfig{
-		ctx:             ctx,
-		client:          client,
-		excludeFilters:  excludeFilters,
-		dumpFileDetails: dumpFileDetails,
-		chunk:           chunk,
-		avgChunkSize:    avgChunkSize,
-		metrics:         metrics,
+		ctx:                  ctx,
+		client:               client,
+		excludeFilters:       excludeFilters,
+		dumpFileDetails:      dumpFileDetails,
+		chunk:                chunk,
+		avgChunkSize:         avgChunkSize,
+		chunkFormat:          chunkFormat,
+		chunkCompression:     chunkCompression,
+		chunkSegmentSize:     chunkSegmentSize,
+		chunkerKind:          chunkerKind,
+		chunkCache:           chunkCache,
+		journal:              journal,
+		metrics:              metrics,
+		compressor:           compressor,
+		compressionThreshold: compressionThreshold,
+		metadataCache:        metadataCache,
+		partialBlobThreshold: partialBlobThreshold,
+		digestSource:         digestSource,
 	}
 }
 
@@ -4,10 +4,12 @@ import (
 	"archive/zip"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	log "github.com/golang/glog"
@@ -16,6 +18,23 @@ import (
 	"github.com/pkg/xattr"
 )
 
+var (
+	// ErrTooLarge is returned, wrapped, by extractFile when a zip entry's
+	// uncompressed size exceeds extractLimits.MaxFileSize, or by extractAll
+	// when the archive's cumulative uncompressed size exceeds MaxTotalSize.
+	ErrTooLarge = errors.New("zip entry exceeds the configured size limit")
+	// ErrPathEscape is returned, wrapped, by resolvePath when a zip entry's
+	// name would extract outside the destination root.
+	ErrPathEscape = errors.New("zip entry escapes the extraction root")
+	// ErrTooManyFiles is returned, wrapped, by extractAll when a zip archive
+	// has more entries than extractLimits.MaxFiles.
+	ErrTooManyFiles = errors.New("zip archive has too many entries")
+	// ErrCaseCollision is returned, wrapped, by extractAll when two zip
+	// entries differ only in case, which would extract to the same path on
+	// a case-insensitive (but case-preserving) filesystem.
+	ErrCaseCollision = errors.New("zip entries collide case-insensitively")
+)
+
 const (
 	// Sha256HeaderID is a custom Header ID for the `extra` field in the file header to store the SHA
 	// checksum. It is defined in build/soong/zip/zip.go
@@ -34,6 +53,25 @@ const (
 	XattrSrcZipPath = "user.zip_src"
 )
 
+// extractLimits bounds the resources an unarchiver may consume, mirroring
+// the safety limits golang.org/x/mod/zip applies to module zips: a cap on
+// the number of entries, on any single entry's uncompressed size, and on
+// the total uncompressed size, so a crafted or corrupted archive can't
+// exhaust disk space or inodes.
+type extractLimits struct {
+	MaxFiles     int
+	MaxFileSize  int64
+	MaxTotalSize int64
+}
+
+// defaultExtractLimits are the limits applied when a zipUnarchiver is
+// created without an explicit extractLimits override.
+var defaultExtractLimits = extractLimits{
+	MaxFiles:     1 << 17,   // 131072 entries
+	MaxFileSize:  512 << 20, // 512 MiB per entry
+	MaxTotalSize: 1 << 30,   // 1 GiB uncompressed, in total
+}
+
 // ZipUploader is the uploader to uploader the a zip
 type ZipUploader struct {
 	CommonConfig
@@ -62,7 +100,7 @@ func (zu *ZipUploader) DoUpload() (digest.Digest, error) {
 
 	log.Infof("Extracting %s to %s with digests\n", zu.zipPath, targetDir)
 
-	unarchiver, err := newZipUnarchiver(zu.zipPath, targetDir)
+	unarchiver, err := newZipUnarchiver(zu.zipPath, targetDir, dirFileSink{})
 	if err != nil {
 		return digest.Digest{}, fmt.Errorf("failed to create zip unarchiver for %s: %v", zu.zipPath, err)
 	}
@@ -85,20 +123,98 @@ type zipUnarchiver struct {
 	zipPath string
 	dstRoot string
 	zr      *zip.ReadCloser
+	// sink is the FileSink entries are materialized into. Defaults to
+	// dirFileSink{} (a real directory), but can target any FileSink, e.g. an
+	// in-memory sink.
+	sink FileSink
+	// limits bounds how much extractAll is willing to extract.
+	limits extractLimits
+	// extractedSize is the running total of uncompressed bytes extracted so
+	// far, checked against limits.MaxTotalSize.
+	extractedSize int64
+	// seenNames maps each entry name seen so far, lowercased, to its
+	// original casing, to detect entries that would collide on a
+	// case-insensitive (but case-preserving) filesystem.
+	seenNames map[string]string
 }
 
-func newZipUnarchiver(zipPath string, dstRoot string) (*zipUnarchiver, error) {
+func newZipUnarchiver(zipPath string, dstRoot string, sink FileSink) (*zipUnarchiver, error) {
 	zipReader, err := zip.OpenReader(zipPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open zip archive: %v", err)
 	}
+	if sink == nil {
+		sink = dirFileSink{}
+	}
 	return &zipUnarchiver{
-		zipPath: zipPath,
-		dstRoot: dstRoot,
-		zr:      zipReader,
+		zipPath:   zipPath,
+		dstRoot:   dstRoot,
+		zr:        zipReader,
+		sink:      sink,
+		limits:    defaultExtractLimits,
+		seenNames: map[string]string{},
 	}, nil
 }
 
+// resolvePath joins name onto the extraction root and rejects the result if
+// it would escape the root (a "zip slip" path traversal via "../" entries
+// or an absolute path).
+func (zu *zipUnarchiver) resolvePath(name string) (string, error) {
+	filePath := filepath.Join(zu.dstRoot, name)
+	rel, err := filepath.Rel(zu.dstRoot, filePath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("zip entry %q: %w", name, ErrPathEscape)
+	}
+	return filePath, nil
+}
+
+// checkCollision records name (lowercased) as seen, and rejects it if a
+// differently-cased entry with the same lowercased name was already seen:
+// the two would extract to the same path on a case-insensitive (but
+// case-preserving) filesystem, silently clobbering one another.
+func (zu *zipUnarchiver) checkCollision(name string) error {
+	lower := strings.ToLower(name)
+	if existing, ok := zu.seenNames[lower]; ok && existing != name {
+		return fmt.Errorf("zip entry %q collides with %q: %w", name, existing, ErrCaseCollision)
+	}
+	zu.seenNames[lower] = name
+	return nil
+}
+
+// checkSymlinkTarget rejects zf if it's a symlink entry whose target, once
+// resolved relative to the symlink's own location, would point outside the
+// extraction root. zf's content (the link target) is small and trusted to
+// fit well within extractLimits.MaxFileSize, so it isn't size-checked.
+//
+// zipUnarchiver never materializes real symlinks (the FileSink abstraction
+// has no way to create one; see extractAll), so this exists purely to
+// reject a zip-slip attempt hidden inside a symlink's target, not to
+// support following links.
+func (zu *zipUnarchiver) checkSymlinkTarget(zf *zip.File) error {
+	filePath, err := zu.resolvePath(zf.Name)
+	if err != nil {
+		return err
+	}
+	rc, err := zf.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open symlink entry %s: %v", zf.Name, err)
+	}
+	defer rc.Close()
+	target, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("failed to read symlink target for %s: %v", zf.Name, err)
+	}
+	if filepath.IsAbs(string(target)) {
+		return fmt.Errorf("zip entry %q: symlink target %q is absolute: %w", zf.Name, target, ErrPathEscape)
+	}
+	resolved := filepath.Join(filepath.Dir(filePath), string(target))
+	rel, err := filepath.Rel(zu.dstRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("zip entry %q: symlink target %q escapes the extraction root: %w", zf.Name, target, ErrPathEscape)
+	}
+	return nil
+}
+
 func (zu *zipUnarchiver) Close() error {
 	return zu.zr.Close()
 }
@@ -107,31 +223,60 @@ func (zu *zipUnarchiver) Close() error {
 // is true, for files with SHA256 value stored in the zip file header, this extractor will only
 // create an empty file, and set the digest to xattr values.
 func (zu *zipUnarchiver) extractAll(skipFileWithDigest bool) error {
+	if len(zu.zr.File) > zu.limits.MaxFiles {
+		return fmt.Errorf("zip archive %s has %d entries, exceeding the limit of %d: %w", zu.zipPath, len(zu.zr.File), zu.limits.MaxFiles, ErrTooManyFiles)
+	}
 	for _, f := range zu.zr.File {
-		if f.FileHeader.Mode().IsDir() {
+		if err := zu.checkCollision(f.Name); err != nil {
+			return err
+		}
+		switch {
+		case f.FileHeader.Mode().IsDir():
 			if err := zu.extractDir(f); err != nil {
-				return fmt.Errorf("failed to extract directory %s: %v", f.Name, err)
+				return fmt.Errorf("failed to extract directory %s: %w", f.Name, err)
+			}
+		case f.FileHeader.Mode()&os.ModeSymlink != 0:
+			// Symlinks carry no content of their own and aren't part of
+			// this uploader's scope (mirroring tarUnarchiver.extractAll);
+			// still validate their target so a zip-slip attempt hidden
+			// inside one is rejected rather than silently skipped.
+			if err := zu.checkSymlinkTarget(f); err != nil {
+				return err
+			}
+			log.Warningf("Skipping unsupported zip symlink entry %s", f.Name)
+		default:
+			if zu.extractedSize += int64(f.UncompressedSize64); zu.extractedSize > zu.limits.MaxTotalSize {
+				return fmt.Errorf("zip archive %s exceeds the total uncompressed size limit of %d bytes: %w", zu.zipPath, zu.limits.MaxTotalSize, ErrTooLarge)
+			}
+			if err := zu.extractFile(f, skipFileWithDigest); err != nil {
+				return fmt.Errorf("failed to extract file %s: %w", f.Name, err)
 			}
-			continue
-		}
-		if err := zu.extractFile(f, skipFileWithDigest); err != nil {
-			return fmt.Errorf("failed to extract file %s: %v", f.Name, err)
 		}
 	}
 	return nil
 }
 
 func (zu *zipUnarchiver) extractDir(zf *zip.File) error {
-	filePath := filepath.Join(zu.dstRoot, zf.Name)
-	if err := os.MkdirAll(filePath, zf.Mode()); err != nil {
+	filePath, err := zu.resolvePath(zf.Name)
+	if err != nil {
+		return err
+	}
+	if err := zu.sink.MkdirAll(filePath, zf.Mode()); err != nil {
 		return fmt.Errorf("failed to extract directory %s: %v", filePath, err)
 	}
 	return nil
 }
 
 func (zu *zipUnarchiver) extractFile(zf *zip.File, skipIfDigestExists bool) error {
-	filePath := filepath.Join(zu.dstRoot, zf.Name)
-	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+	if size := int64(zf.UncompressedSize64); size > zu.limits.MaxFileSize {
+		return fmt.Errorf("zip entry %q is %d bytes, exceeding the per-file limit of %d: %w", zf.Name, size, zu.limits.MaxFileSize, ErrTooLarge)
+	}
+
+	filePath, err := zu.resolvePath(zf.Name)
+	if err != nil {
+		return err
+	}
+	if err := zu.sink.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
 		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(filePath), err)
 	}
 
@@ -143,20 +288,19 @@ func (zu *zipUnarchiver) extractFile(zf *zip.File, skipIfDigestExists bool) erro
 		// If the digest value exists in zip file header, only create an empty file and set xattr
 		// values.
 		if sha256 != "" {
-			if _, err = os.Create(filePath); err != nil {
+			w, err := zu.sink.CreateFile(filePath, zf.Mode())
+			if err != nil {
 				return fmt.Errorf("failed to create file %s: %v", filePath, err)
 			}
-			if err := xattr.Set(filePath, XattrDigestName, []byte(
+			w.Close()
+			if err := zu.sink.SetXattr(filePath, XattrDigestName, []byte(
 				fmt.Sprintf("%s/%d", sha256, zf.FileHeader.UncompressedSize64))); err != nil {
 				return fmt.Errorf("failed to set xattr %s to %s: %v", XattrDigestName, filePath, err)
 			}
-			if err := xattr.Set(filePath, XattrSrcZipPath, []byte(zf.Name)); err != nil {
+			if err := zu.sink.SetXattr(filePath, XattrSrcZipPath, []byte(zf.Name)); err != nil {
 				return fmt.Errorf("failed to set xattr %s to %s: %v", XattrSrcZipPath, filePath, err)
 			}
-			if err := os.Chmod(filePath, zf.Mode()); err != nil {
-				return fmt.Errorf("failed to set mode %s to file %s: %v", zf.Mode(), filePath, err)
-			}
-			if err := os.Chtimes(filePath, time.Time{}, zf.Modified); err != nil {
+			if err := zu.sink.SetTimes(filePath, zf.Modified); err != nil {
 				return fmt.Errorf("failed to set modified time %s to file %s: %v", zf.Modified, filePath, err)
 			}
 			return nil
@@ -164,7 +308,7 @@ func (zu *zipUnarchiver) extractFile(zf *zip.File, skipIfDigestExists bool) erro
 	}
 
 	// Write the file content to the destination.
-	dst, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, zf.Mode())
+	dst, err := zu.sink.CreateFile(filePath, zf.Mode())
 	if err != nil {
 		return fmt.Errorf("failed to open file %s: %v", filePath, err)
 	}
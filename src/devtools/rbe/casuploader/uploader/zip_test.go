@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -13,226 +14,95 @@ import (
 	"testing"
 )
 
-const (
-	testZip = "test_data/partial_zip.zip"
-)
-
 type fileVerification struct {
 	path     string
 	size     int64
 	checksum string
-	linkTo   string
 }
 
 func TestExtractAll(t *testing.T) {
-	testCases := []struct {
-		name           string
-		extractOptions extractOptions
-		want           []fileVerification
-	}{
-		{
-			name: "skip_no_follow",
-			extractOptions: extractOptions{
-				skipIfDigestExists: true,
-			},
-			want: []fileVerification{
-				{
-					path: "empty/empty_file",
-					size: 0,
-				},
-				{
-					path: "large_text/file.txt",
-					size: 0,
-				},
-				{
-					path: "read_only/readonly_file",
-					size: 0,
-				},
-				{
-					path:   "symlinks/large_text_derived/file.txt",
-					linkTo: "../../large_text/file.txt",
-				},
-				{
-					path:   "symlinks/large_text_derived2/file_derived_2.txt",
-					linkTo: "../large_text_derived/file.txt",
-				},
-			},
-		},
-		{
-			name: "no_skip_with_follow",
-			extractOptions: extractOptions{
-				followSymLinks: true,
-			},
-			want: []fileVerification{
-				{
-					path:     "empty/empty_file",
-					size:     0,
-					checksum: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
-				},
-				{
-					path:     "large_text/file.txt",
-					size:     802816,
-					checksum: "d8c076a86a7f2bb3cc87d6e632d9d8e8268a5bfbf68395413a5bfde19de52d1d",
-				},
-				{
-					path:     "read_only/readonly_file",
-					size:     24,
-					checksum: "7036bbbfdf466127c759c7f388b8d1283356925b83dce60296e8de378a1d4338",
-				},
-				{
-					path:     "symlinks/large_text_derived/file.txt",
-					size:     802816,
-					checksum: "d8c076a86a7f2bb3cc87d6e632d9d8e8268a5bfbf68395413a5bfde19de52d1d",
-				},
-				{
-					path:     "symlinks/large_text_derived2/file_derived_2.txt",
-					size:     802816,
-					checksum: "d8c076a86a7f2bb3cc87d6e632d9d8e8268a5bfbf68395413a5bfde19de52d1d",
-				},
-			},
-		},
-		{
-			name: "skip_with_follow",
-			extractOptions: extractOptions{
-				skipIfDigestExists: true,
-				followSymLinks:     true,
-			},
-			want: []fileVerification{
-				{ // skipped because digest exists
-					path: "large_text/file.txt",
-					size: 0,
-				},
-				{ // followed because no digest for symlinks
-					path:     "symlinks/large_text_derived2/file_derived_2.txt",
-					size:     802816,
-					checksum: "d8c076a86a7f2bb3cc87d6e632d9d8e8268a5bfbf68395413a5bfde19de52d1d",
-				},
-			},
-		},
-		{
-			name:           "no_skip_no_follow",
-			extractOptions: extractOptions{},
-			want: []fileVerification{
-				{
-					path:     "large_text/file.txt",
-					size:     802816,
-					checksum: "d8c076a86a7f2bb3cc87d6e632d9d8e8268a5bfbf68395413a5bfde19de52d1d",
-				},
-				{
-					path:   "symlinks/large_text_derived/file.txt",
-					linkTo: "../../large_text/file.txt",
-				},
-				{
-					path:   "symlinks/large_text_derived2/file_derived_2.txt",
-					linkTo: "../large_text_derived/file.txt",
-				},
-			},
-		},
+	targetDir := t.TempDir()
+	zipPath := filepath.Join(targetDir, "test.zip")
+	createZipWithFiles(t, zipPath, map[string]string{
+		"empty/empty_file":    "",
+		"large_text/file.txt": "hello, world",
+	})
+
+	unarchiver, err := newZipUnarchiver(zipPath, targetDir, dirFileSink{})
+	if err != nil {
+		t.Fatalf("newZipUnarchiver() failed: %v", err)
 	}
+	defer unarchiver.Close()
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			targetDir := t.TempDir()
-			unarchiver, err := newZipUnarchiver(testZip, targetDir)
-			if err != nil {
-				t.Fatalf("newZipUnarchiver() failed: %v", err)
-			}
-			err = unarchiver.extractAll(tc.extractOptions)
-			if err != nil {
-				t.Fatalf("extractAll() failed: %v", err)
-			}
-			for _, want := range tc.want {
-				err := verifyExtractedFile(targetDir, want)
-				if err != nil {
-					t.Errorf("verifyExtractedFile(%s) failed: %v", want.path, err)
-				}
-			}
-		})
+	if err := unarchiver.extractAll(false); err != nil {
+		t.Fatalf("extractAll() failed: %v", err)
+	}
+
+	want := []fileVerification{
+		{path: "empty/empty_file", size: 0},
+		{path: "large_text/file.txt", size: 12, checksum: sha256Hex("hello, world")},
+	}
+	for _, w := range want {
+		if err := verifyExtractedFile(targetDir, w); err != nil {
+			t.Errorf("verifyExtractedFile(%s) failed: %v", w.path, err)
+		}
 	}
 }
 
-func TestResolve(t *testing.T) {
-	testcases := []struct {
-		name           string
-		file           string
-		followSymLinks bool
-		want           []fileVerification
-	}{
-		{
-			name: "normal_file",
-			file: "large_text/file.txt",
-			want: []fileVerification{
-				{
-					path:     "large_text/file.txt",
-					size:     802816,
-					checksum: "d8c076a86a7f2bb3cc87d6e632d9d8e8268a5bfbf68395413a5bfde19de52d1d",
-				},
-			},
-		},
-		{
-			name: "link_no_follow",
-			file: "symlinks/large_text_derived/file.txt",
-			want: []fileVerification{
-				{
-					path:   "symlinks/large_text_derived/file.txt",
-					linkTo: "../../large_text/file.txt",
-				},
-			},
-		},
-		{
-			name:           "link_with_follow",
-			followSymLinks: true,
-			file:           "symlinks/large_text_derived2/file_derived_2.txt",
-			want: []fileVerification{
-				{
-					path:     "symlinks/large_text_derived2/file_derived_2.txt",
-					size:     802816,
-					checksum: "d8c076a86a7f2bb3cc87d6e632d9d8e8268a5bfbf68395413a5bfde19de52d1d",
-				},
-			},
-		},
+func TestExtractAll_TooManyFiles(t *testing.T) {
+	targetDir := t.TempDir()
+	zipPath := filepath.Join(targetDir, "test.zip")
+	createZipWithFiles(t, zipPath, map[string]string{"a": "1", "b": "2", "c": "3"})
+
+	unarchiver, err := newZipUnarchiver(zipPath, t.TempDir(), dirFileSink{})
+	if err != nil {
+		t.Fatalf("newZipUnarchiver() failed: %v", err)
 	}
+	defer unarchiver.Close()
+	unarchiver.limits.MaxFiles = 2
 
-	for _, tc := range testcases {
-		t.Run(tc.name, func(t *testing.T) {
-			targetDir := t.TempDir()
-			unarchiver, err := newZipUnarchiver(testZip, targetDir)
-			if err != nil {
-				t.Fatalf("newZipUnarchiver() failed: %v", err)
-			}
+	err = unarchiver.extractAll(false)
+	if !errors.Is(err, ErrTooManyFiles) {
+		t.Errorf("extractAll() error = %v, want wrapping ErrTooManyFiles", err)
+	}
+}
 
-			if err = unarchiver.resolve(findZipFile(unarchiver, tc.file), filepath.Join(targetDir, tc.file), tc.followSymLinks); err != nil {
-				t.Fatalf("resolve() failed: %v", err)
-			}
+func TestExtractFile_TooLarge(t *testing.T) {
+	targetDir := t.TempDir()
+	zipPath := filepath.Join(targetDir, "test.zip")
+	createZipWithFiles(t, zipPath, map[string]string{"large_text/file.txt": "hello, world"})
 
-			verified := make(map[string]bool)
-			for _, want := range tc.want {
-				err = verifyExtractedFile(targetDir, want)
-				if err != nil {
-					t.Errorf("verifyExtractedFile(%s) failed: %v", want.path, err)
-				}
-				verified[want.path] = true
-			}
-			err = filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if info.IsDir() {
-					return nil
-				}
-				rel, err := filepath.Rel(targetDir, path)
-				if err != nil {
-					return err
-				}
-				if !verified[rel] {
-					return fmt.Errorf("unexpected file extracted: %s", path)
-				}
-				return nil
-			})
-			if err != nil {
-				t.Errorf("check extracted directory failed: %v", err)
-			}
-		})
+	unarchiver, err := newZipUnarchiver(zipPath, t.TempDir(), dirFileSink{})
+	if err != nil {
+		t.Fatalf("newZipUnarchiver() failed: %v", err)
+	}
+	defer unarchiver.Close()
+	unarchiver.limits.MaxFileSize = 1
+
+	err = unarchiver.extractAll(false)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("extractAll() error = %v, want wrapping ErrTooLarge", err)
+	}
+}
+
+func TestExtractFile_TotalTooLarge(t *testing.T) {
+	targetDir := t.TempDir()
+	zipPath := filepath.Join(targetDir, "test.zip")
+	createZipWithFiles(t, zipPath, map[string]string{
+		"a.txt": "hello",
+		"b.txt": "world",
+	})
+
+	unarchiver, err := newZipUnarchiver(zipPath, t.TempDir(), dirFileSink{})
+	if err != nil {
+		t.Fatalf("newZipUnarchiver() failed: %v", err)
+	}
+	defer unarchiver.Close()
+	unarchiver.limits.MaxTotalSize = 6
+
+	err = unarchiver.extractAll(false)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("extractAll() error = %v, want wrapping ErrTooLarge", err)
 	}
 }
 
@@ -269,16 +139,21 @@ func TestZipSlip(t *testing.T) {
 
 			zipPath := filepath.Join(targetDir, "test.zip")
 			fileNameInZip := tc.fileName(t, targetDir)
-			createZipWithFiles(t, zipPath, []string{fileNameInZip})
+			createZipWithFiles(t, zipPath, map[string]string{fileNameInZip: "evil"})
 
-			unarchiver, err := newZipUnarchiver(zipPath, targetDir)
+			unarchiver, err := newZipUnarchiver(zipPath, targetDir, dirFileSink{})
 			if err != nil {
 				t.Errorf("newZipUnarchiver(%q, %q): %v", zipPath, targetDir, err)
 			}
 			defer unarchiver.Close()
 
-			if err := unarchiver.extractAll(extractOptions{}); tc.wantError && err == nil {
-				t.Errorf("extractAll succeeded with malicious zip entry %q, want error", fileNameInZip)
+			err = unarchiver.extractAll(false)
+			if tc.wantError {
+				if !errors.Is(err, ErrPathEscape) {
+					t.Errorf("extractAll() error = %v, want wrapping ErrPathEscape for malicious entry %q", err, fileNameInZip)
+				}
+			} else if err != nil {
+				t.Errorf("extractAll() failed: %v", err)
 			}
 
 			if _, err := os.Stat(outsidePath); !os.IsNotExist(err) {
@@ -288,7 +163,87 @@ func TestZipSlip(t *testing.T) {
 	}
 }
 
-func createZipWithFiles(t *testing.T, zipPath string, fileNames []string) {
+func TestExtractAll_CaseInsensitiveCollision(t *testing.T) {
+	targetDir := t.TempDir()
+	zipPath := filepath.Join(targetDir, "test.zip")
+	createZipWithFiles(t, zipPath, map[string]string{
+		"lib/Foo.so": "one",
+		"lib/foo.so": "two",
+	})
+
+	unarchiver, err := newZipUnarchiver(zipPath, t.TempDir(), dirFileSink{})
+	if err != nil {
+		t.Fatalf("newZipUnarchiver() failed: %v", err)
+	}
+	defer unarchiver.Close()
+
+	err = unarchiver.extractAll(false)
+	if !errors.Is(err, ErrCaseCollision) {
+		t.Errorf("extractAll() error = %v, want wrapping ErrCaseCollision", err)
+	}
+}
+
+func TestExtractAll_SymlinkEscape(t *testing.T) {
+	outsideDir := t.TempDir()
+
+	testCases := []struct {
+		name      string
+		target    string
+		wantError bool
+	}{
+		{name: "target inside the extraction root", target: "file.txt", wantError: false},
+		{name: "target escapes via ..", target: "../../outside.txt", wantError: true},
+		{name: "absolute target", target: filepath.Join(outsideDir, "outside.txt"), wantError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetDir := t.TempDir()
+			zipPath := filepath.Join(targetDir, "test.zip")
+			createZipWithSymlink(t, zipPath, "link", tc.target)
+
+			unarchiver, err := newZipUnarchiver(zipPath, t.TempDir(), dirFileSink{})
+			if err != nil {
+				t.Fatalf("newZipUnarchiver() failed: %v", err)
+			}
+			defer unarchiver.Close()
+
+			err = unarchiver.extractAll(false)
+			if tc.wantError {
+				if !errors.Is(err, ErrPathEscape) {
+					t.Errorf("extractAll() error = %v, want wrapping ErrPathEscape for symlink target %q", err, tc.target)
+				}
+			} else if err != nil {
+				t.Errorf("extractAll() failed: %v", err)
+			}
+		})
+	}
+}
+
+func createZipWithSymlink(t *testing.T, zipPath, name, target string) {
+	t.Helper()
+	z, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatalf("create zip: %v", err)
+	}
+	defer z.Close()
+	zw := zip.NewWriter(z)
+
+	hdr := &zip.FileHeader{Name: name}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		t.Fatalf("create symlink entry %q inside zip: %v", name, err)
+	}
+	if _, err := w.Write([]byte(target)); err != nil {
+		t.Fatalf("write symlink target for %q inside zip: %v", name, err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close writer: %v", err)
+	}
+}
+
+func createZipWithFiles(t *testing.T, zipPath string, files map[string]string) {
 	t.Helper()
 	z, err := os.Create(zipPath)
 	if err != nil {
@@ -296,10 +251,13 @@ func createZipWithFiles(t *testing.T, zipPath string, fileNames []string) {
 	}
 	defer z.Close()
 	zw := zip.NewWriter(z)
-	for _, fileName := range fileNames {
-		_, err = zw.Create(fileName)
+	for name, content := range files {
+		w, err := zw.Create(name)
 		if err != nil {
-			t.Fatalf("create file %q inside zip: %v", fileName, err)
+			t.Fatalf("create file %q inside zip: %v", name, err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatalf("write file %q inside zip: %v", name, err)
 		}
 	}
 	if err := zw.Close(); err != nil {
@@ -322,49 +280,35 @@ func fileChecksum(filePath string) (string, error) {
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func findZipFile(u *zipUnarchiver, path string) *zip.File {
-	for _, f := range u.zr.File {
-		if f.Name == path {
-			return f
-		}
-	}
-	return nil
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
 }
 
 func verifyExtractedFile(targetDir string, want fileVerification) error {
-	path := path.Join(targetDir, want.path)
-	if want.linkTo != "" {
-		linkTo, err := os.Readlink(path)
-		if err != nil {
-			return fmt.Errorf("os.Readlink(%s) failed: %v", want.path, err)
-		}
-		if linkTo != want.linkTo {
-			return fmt.Errorf("os.Readlink(%s) = %s, want %s", want.path, linkTo, want.linkTo)
-		}
-		return nil // size and checksum are irrelevant for links
-	}
+	p := path.Join(targetDir, want.path)
 
-	var errors []string
-	size, err := os.Stat(path)
+	var errs []string
+	size, err := os.Stat(p)
 	if err != nil {
 		return fmt.Errorf("os.Stat(%s) failed: %v", want.path, err)
 	}
 	if size.Size() != want.size {
-		errors = append(errors, fmt.Sprintf("actual size of %q = %d, want %d", want.path, size.Size(), want.size))
+		errs = append(errs, fmt.Sprintf("actual size of %q = %d, want %d", want.path, size.Size(), want.size))
 	}
 
 	if want.checksum != "" {
-		checksum, err := fileChecksum(path)
+		checksum, err := fileChecksum(p)
 		if err != nil {
 			return fmt.Errorf("fileChecksum(%s) failed: %v", want.path, err)
 		}
 		if checksum != want.checksum {
-			errors = append(errors, fmt.Sprintf("fileChecksum(%s) = %s, want %s", want.path, checksum, want.checksum))
+			errs = append(errs, fmt.Sprintf("fileChecksum(%s) = %s, want %s", want.path, checksum, want.checksum))
 		}
 	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf("verifyExtractedFile(%s) failed: %s", want.path, strings.Join(errors, "; "))
+	if len(errs) > 0 {
+		return fmt.Errorf("verifyExtractedFile(%s) failed: %s", want.path, strings.Join(errs, "; "))
 	}
 	return nil
 }
@@ -0,0 +1,34 @@
+package chunkstore
+
+import (
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
+)
+
+// ExpandBlobManifest decodes data (the raw bytes a FileNode's digest
+// resolved to) as a chunkerutil.BlobManifest, returning the []ChunkInfo and
+// total size a FileInfo needs to read the file through the mount one chunk
+// at a time, same as a file chunked by the -chunk upload path. ok is false
+// if data isn't a BlobManifest (see chunkerutil.IsBlobManifest), in which
+// case the caller should treat data as the file's literal content instead.
+func ExpandBlobManifest(data []byte) (chunks []ChunkInfo, size int64, ok bool, err error) {
+	if !chunkerutil.IsBlobManifest(data) {
+		return nil, 0, false, nil
+	}
+	manifest, err := chunkerutil.DecodeBlobManifest(data)
+	if err != nil {
+		return nil, 0, true, err
+	}
+
+	chunks = make([]ChunkInfo, len(manifest.Chunks))
+	var offset int64
+	for i, dg := range manifest.Chunks {
+		chunks[i] = ChunkInfo{ChunkInfo: chunker.ChunkInfo{
+			SHA256: dg.Hash,
+			Offset: offset,
+			Length: dg.Size,
+		}, Length: int(dg.Size)}
+		offset += dg.Size
+	}
+	return chunks, offset, true, nil
+}
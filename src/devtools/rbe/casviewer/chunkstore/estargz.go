@@ -0,0 +1,332 @@
+package chunkstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// IndexFormat selects how NewChunkStoreFromLayer's blob argument encodes its
+// file list and chunk boundaries.
+type IndexFormat string
+
+const (
+	// IndexFormatEStargz reads a trailer TOC in the eStargz/zstd:chunked
+	// convention embedded in the layer blob itself (see readEStargzTOC),
+	// rather than a separate chunkDir plus JSON sidecar index (see
+	// NewChunkStore).
+	IndexFormatEStargz IndexFormat = "estargz"
+)
+
+// estargzFooterSize is the size, in bytes, of the trailing empty gzip
+// stream an eStargz/zstd:chunked blob ends with. Its Header.Extra field
+// encodes the byte offset of the TOC gzip member as "%016xSTARGZ" (16 lower-
+// case hex digits followed by the literal string "STARGZ").
+const estargzFooterSize = 51
+
+const estargzFooterMarker = "STARGZ"
+
+// estargzTOC is the JSON schema of an eStargz TOC gzip member.
+type estargzTOC struct {
+	Version int               `json:"version"`
+	Entries []estargzTOCEntry `json:"entries"`
+}
+
+// estargzTOCEntry is a single file, directory, symlink, or chunk record in
+// an eStargz TOC. A regular file larger than one chunk appears as one "reg"
+// entry (its first chunk) followed by one "chunk" entry per additional
+// chunk; Offset is where that chunk's own gzip member starts in the blob.
+type estargzTOCEntry struct {
+	Name        string    `json:"name"`
+	Type        string    `json:"type"` // "reg", "dir", "symlink", or "chunk"
+	LinkName    string    `json:"linkName"`
+	Mode        int64     `json:"mode"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modtime"`
+	Offset      int64     `json:"offset"`
+	ChunkOffset int64     `json:"chunkOffset"`
+	ChunkSize   int64     `json:"chunkSize"`
+	Digest      string    `json:"digest"`      // whole-file digest, "reg" entries only
+	ChunkDigest string    `json:"chunkDigest"` // this chunk's digest, "reg"/"chunk" entries
+}
+
+// readEStargzTOC reads the trailer footer and TOC gzip member from an
+// eStargz/zstd:chunked blob.
+func readEStargzTOC(f *os.File) (*estargzTOC, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat layer blob: %v", err)
+	}
+	if info.Size() < estargzFooterSize {
+		return nil, fmt.Errorf("layer blob is too small to contain an eStargz footer")
+	}
+
+	footer := make([]byte, estargzFooterSize)
+	if _, err := f.ReadAt(footer, info.Size()-estargzFooterSize); err != nil {
+		return nil, fmt.Errorf("failed to read eStargz footer: %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse eStargz footer as gzip: %v", err)
+	}
+	extra := zr.Header.Extra
+	zr.Close()
+	if !strings.HasSuffix(string(extra), estargzFooterMarker) {
+		return nil, fmt.Errorf("blob is not an eStargz: footer is missing the %s marker", estargzFooterMarker)
+	}
+	offsetHex := string(extra[:len(extra)-len(estargzFooterMarker)])
+	tocOffset, err := strconv.ParseInt(offsetHex, 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TOC offset from eStargz footer: %v", err)
+	}
+	tocSize := info.Size() - estargzFooterSize - tocOffset
+	if tocOffset < 0 || tocSize <= 0 {
+		return nil, fmt.Errorf("eStargz footer names out-of-range TOC offset %d", tocOffset)
+	}
+
+	tocGzip := make([]byte, tocSize)
+	if _, err := f.ReadAt(tocGzip, tocOffset); err != nil {
+		return nil, fmt.Errorf("failed to read eStargz TOC: %v", err)
+	}
+	tocZr, err := gzip.NewReader(bytes.NewReader(tocGzip))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress eStargz TOC: %v", err)
+	}
+	defer tocZr.Close()
+	tocJSON, err := io.ReadAll(tocZr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decompressed eStargz TOC: %v", err)
+	}
+
+	var toc estargzTOC
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		return nil, fmt.Errorf("failed to parse eStargz TOC JSON: %v", err)
+	}
+	return &toc, nil
+}
+
+// estargzDigestToSHA256 strips the OCI "sha256:" algorithm prefix a TOC
+// entry's Digest/ChunkDigest carries, to match the bare-hex form ChunkInfo
+// and ChunkSource use elsewhere in this package.
+func estargzDigestToSHA256(digest string) string {
+	return strings.TrimPrefix(digest, "sha256:")
+}
+
+// estargzFileMode converts a TOC entry's type and permission bits into the
+// fuseMode FileInfo stores, the same way osFileModeToFuseMode does for the
+// native index format.
+func estargzFileMode(entryType string, mode int64) fuseMode {
+	perm := fuseMode(mode) & fuseMode(os.ModePerm)
+	switch entryType {
+	case "dir":
+		return fuse.S_IFDIR | perm
+	case "symlink":
+		return fuse.S_IFLNK | perm
+	default:
+		return fuse.S_IFREG | perm
+	}
+}
+
+// estargzChunkLoc locates one chunk's gzip member within the layer blob, so
+// estargzChunkSource can seek and decompress it on demand.
+type estargzChunkLoc struct {
+	offset int64 // start of the gzip member in the blob
+	size   int64 // compressed size of the gzip member
+	length int64 // uncompressed chunk length
+}
+
+// estargzToFileIndex converts an eStargz TOC into the FileInfo/ChunkInfo
+// shape the rest of ChunkStore understands (GetFile, GetFiles,
+// ChecksumWildcard, ReadFileToDest), and the chunk locations
+// estargzChunkSource needs to serve them. Every entry's Path is validated
+// against policy the same way the native JSON index format is (see
+// newFileIndex), since a layer's TOC is no more trustworthy than a
+// hand-edited sidecar index.
+func estargzToFileIndex(toc *estargzTOC, policy pathPolicy) (*fileIndex, map[string]estargzChunkLoc, error) {
+	var order []string
+	byName := map[string]*FileInfo{}
+	locs := map[string]estargzChunkLoc{}
+
+	type pending struct {
+		sha256 string
+		offset int64
+		length int64
+	}
+	var chunkOrder []pending
+
+	for _, e := range toc.Entries {
+		switch e.Type {
+		case "dir", "symlink":
+			byName[e.Name] = &FileInfo{
+				Path:    e.Name,
+				ModTime: e.ModTime,
+				Mode:    estargzFileMode(e.Type, e.Mode),
+			}
+			order = append(order, e.Name)
+		case "reg", "chunk":
+			fi, ok := byName[e.Name]
+			if !ok {
+				fi = &FileInfo{Path: e.Name, ModTime: e.ModTime, Mode: estargzFileMode(e.Type, e.Mode)}
+				byName[e.Name] = fi
+				order = append(order, e.Name)
+			}
+			digest := e.ChunkDigest
+			if digest == "" {
+				digest = e.Digest
+			}
+			sha256 := estargzDigestToSHA256(digest)
+			length := e.ChunkSize
+			if length == 0 {
+				length = e.Size
+			}
+			fi.Chunks = append(fi.Chunks, ChunkInfo{
+				ChunkInfo: chunker.ChunkInfo{SHA256: sha256, Offset: e.ChunkOffset, Length: length},
+				Length:    int(length),
+			})
+			fi.Size += length
+			chunkOrder = append(chunkOrder, pending{sha256: sha256, offset: e.Offset, length: length})
+		}
+	}
+
+	// Each chunk's gzip member runs from its own Offset to the next chunk's
+	// Offset (entries are written in blob order); the very last chunk's size
+	// is left 0, and Fetch reads it up to the end of its own gzip member.
+	sort.Slice(chunkOrder, func(i, j int) bool { return chunkOrder[i].offset < chunkOrder[j].offset })
+	for i, p := range chunkOrder {
+		loc := estargzChunkLoc{offset: p.offset, length: p.length}
+		if i+1 < len(chunkOrder) {
+			loc.size = chunkOrder[i+1].offset - p.offset
+		}
+		if existing, ok := locs[p.sha256]; ok {
+			loc.length = existing.length
+		}
+		locs[p.sha256] = loc
+	}
+
+	files := make([]FileInfo, 0, len(order))
+	for _, name := range order {
+		files = append(files, *byName[name])
+	}
+	idx, err := newFileIndex(files, policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	return idx, locs, nil
+}
+
+// estargzChunkSource is the ChunkSource for a ChunkStore opened with
+// NewChunkStoreFromLayer: every chunk's payload lives gzip-compressed in
+// its own member of a single layer blob, at the offset recorded in locs,
+// rather than as its own file under a chunkDir.
+type estargzChunkSource struct {
+	path string
+	locs map[string]estargzChunkLoc
+}
+
+// Stat implements ChunkSource.
+func (s *estargzChunkSource) Stat(sha256 string) (int64, error) {
+	loc, ok := s.locs[sha256]
+	if !ok {
+		return 0, fmt.Errorf("chunk %s not found in eStargz TOC", sha256)
+	}
+	return loc.length, nil
+}
+
+// gzipMemberReadCloser closes both the gzip.Reader and the underlying file
+// it reads from, so Fetch callers can treat it as a single io.ReadCloser.
+type gzipMemberReadCloser struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (rc *gzipMemberReadCloser) Close() error {
+	rc.Reader.Close()
+	return rc.f.Close()
+}
+
+// Fetch implements ChunkSource.
+func (s *estargzChunkSource) Fetch(sha256 string, offset, length int64) (io.ReadCloser, error) {
+	loc, ok := s.locs[sha256]
+	if !ok {
+		return nil, fmt.Errorf("chunk %s not found in eStargz TOC", sha256)
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer blob: %w", err)
+	}
+	if _, err := f.Seek(loc.offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to seek to chunk %s: %w", sha256, err)
+	}
+	var member io.Reader = f
+	if loc.size > 0 {
+		member = io.LimitReader(f, loc.size)
+	}
+	zr, err := gzip.NewReader(member)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to decompress chunk %s: %w", sha256, err)
+	}
+	zr.Multistream(false)
+	rc := &gzipMemberReadCloser{Reader: zr, f: f}
+	if offset > 0 {
+		if _, err := io.CopyN(io.Discard, rc, offset); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("failed to skip to offset %d in chunk %s: %w", offset, sha256, err)
+		}
+	}
+	if length < 0 {
+		return rc, nil
+	}
+	return limitedReadCloser{io.LimitReader(rc, length), rc}, nil
+}
+
+// NewChunkStoreFromLayer creates a ChunkStore directly from a single
+// eStargz/zstd:chunked layer blob, with no separate chunkDir or JSON
+// sidecar index: the file list and chunk boundaries come from the blob's
+// own trailer TOC (see readEStargzTOC), and chunk payloads are decompressed
+// on demand from the same blob (see estargzChunkSource). opts.Source is
+// ignored; segment packing (see segmentstore) never applies, since it's a
+// chunkDir-local optimization with no layer-blob equivalent.
+func NewChunkStoreFromLayer(layerPath string, opts Options) (*ChunkStore, error) {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer blob %s: %w", filepath.Base(layerPath), err)
+	}
+	toc, err := readEStargzTOC(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	idx, locs, err := estargzToFileIndex(toc, newPathPolicy(opts))
+	if err != nil {
+		return nil, err
+	}
+	source := &estargzChunkSource{path: layerPath, locs: locs}
+
+	var p *prefetcher
+	if opts.CacheBytes > 0 {
+		p = newPrefetcher(opts.CacheBytes, opts.PrefetchAhead, opts.PrefetchWorkers)
+	}
+
+	cs := &ChunkStore{
+		source:     source,
+		prefetcher: p,
+		verify:     opts.Verify,
+		pathPolicy: newPathPolicy(opts),
+	}
+	cs.index.Store(idx)
+	return cs, nil
+}
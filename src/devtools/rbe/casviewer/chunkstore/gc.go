@@ -0,0 +1,198 @@
+package chunkstore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
+)
+
+// sha256HexRe matches the flat chunk file names written under a chunk dir
+// (see chunker.ChunkFile), which are bare lowercase-hex SHA256 digests. This
+// is what tells GC apart chunk payloads from the index file, segment files
+// and any sidecar access log that also live under the same directory.
+var sha256HexRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// GCOptions configures a GC run (see GC).
+type GCOptions struct {
+	// RootDirs lists directories whose chunks index (see
+	// chunkerutil.FindChunksIndex) describes chunks that are still
+	// referenced and must therefore survive GC, even though they live in
+	// the same shared chunkDir as chunks from other, possibly stale,
+	// uploads.
+	RootDirs []string
+	// MaxBytes bounds the total size of unreferenced chunks left under
+	// chunkDir after GC runs: unreferenced chunks are evicted
+	// oldest-accessed-first until what remains is at or below MaxBytes.
+	// MaxBytes <= 0 evicts every unreferenced chunk.
+	MaxBytes int64
+	// AccessLogPath, if non-empty, is the sidecar log written by
+	// ChunkStore.recordAccess (see EnableAccessLog) and is consulted for
+	// last-access timestamps in preference to a chunk file's mtime, since
+	// many FUSE mounts run with noatime/relatime. Chunks with no recorded
+	// access fall back to their chunk file's mtime.
+	AccessLogPath string
+	// DryRun reports what GC would evict without deleting anything.
+	DryRun bool
+}
+
+// GCResult summarizes a GC run.
+type GCResult struct {
+	LiveChunks         int   // Chunks referenced by opts.RootDirs, left untouched.
+	UnreferencedChunks int   // Chunks under chunkDir referenced by no root dir.
+	UnreferencedBytes  int64 // Total size of UnreferencedChunks.
+	EvictedChunks      int   // Unreferenced chunks removed (or that would be, in DryRun).
+	EvictedBytes       int64 // Total size of EvictedChunks.
+}
+
+// GC treats chunkDir as a shared content-addressable chunk pool: it walks
+// every chunks index under opts.RootDirs to compute the set of SHA256s
+// still referenced by some upload, then evicts chunk files under chunkDir
+// that aren't in that set, oldest-accessed-first, until opts.MaxBytes is
+// satisfied or there's nothing left to evict (see GCOptions). Chunks
+// packed into segment files (see segmentstore) and FormatZstdChunked blobs
+// aren't individually addressable files under chunkDir, so they're outside
+// GC's eviction domain; only the legacy one-file-per-chunk layout is
+// affected.
+func GC(chunkDir string, opts GCOptions) (GCResult, error) {
+	live, err := liveChunkSHAs(opts.RootDirs)
+	if err != nil {
+		return GCResult{}, err
+	}
+
+	entries, err := os.ReadDir(chunkDir)
+	if err != nil {
+		return GCResult{}, fmt.Errorf("failed to list chunk dir %s: %w", chunkDir, err)
+	}
+	accessed := loadAccessLog(opts.AccessLogPath)
+
+	type candidate struct {
+		name       string
+		size       int64
+		lastAccess time.Time
+	}
+	var result GCResult
+	var candidates []candidate
+	for _, e := range entries {
+		if e.IsDir() || !sha256HexRe.MatchString(e.Name()) {
+			continue
+		}
+		if live[e.Name()] {
+			result.LiveChunks++
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return GCResult{}, fmt.Errorf("failed to stat chunk %s: %w", e.Name(), err)
+		}
+		result.UnreferencedChunks++
+		result.UnreferencedBytes += info.Size()
+		last, ok := accessed[e.Name()]
+		if !ok {
+			last = info.ModTime()
+		}
+		candidates = append(candidates, candidate{e.Name(), info.Size(), last})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastAccess.Before(candidates[j].lastAccess) })
+
+	remaining := result.UnreferencedBytes
+	for _, c := range candidates {
+		if opts.MaxBytes > 0 && remaining <= opts.MaxBytes {
+			break
+		}
+		if !opts.DryRun {
+			if err := os.Remove(filepath.Join(chunkDir, c.name)); err != nil && !os.IsNotExist(err) {
+				return result, fmt.Errorf("failed to remove chunk %s: %w", c.name, err)
+			}
+		}
+		result.EvictedChunks++
+		result.EvictedBytes += c.size
+		remaining -= c.size
+	}
+
+	return result, nil
+}
+
+// liveChunkSHAs returns the set of chunk SHA256s referenced by the chunks
+// index found under any of rootDirs. A root dir with no chunks index (e.g.
+// it was already restored, see chunkerutil.RestoreFiles) contributes
+// nothing rather than failing the whole run.
+func liveChunkSHAs(rootDirs []string) (map[string]bool, error) {
+	live := map[string]bool{}
+	for _, dir := range rootDirs {
+		indexes, err := chunkerutil.LoadChunksIndex(dir)
+		if err != nil {
+			continue
+		}
+		for _, index := range indexes {
+			for _, chunk := range index.Chunks {
+				live[chunk.SHA256] = true
+			}
+		}
+	}
+	return live, nil
+}
+
+// accessLogWriter appends "<sha256> <unix-nano>\n" lines to a sidecar log
+// recording when ChunkStore.ReadFileToDest last read a flat chunk file, so
+// GC can do LRU eviction without depending on the mount's atime semantics.
+type accessLogWriter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// EnableAccessLog opens (creating if needed) the sidecar access log at
+// path and starts recording reads of flat chunk files to it.
+func (cs *ChunkStore) EnableAccessLog(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log %s: %w", path, err)
+	}
+	cs.accessLog = &accessLogWriter{file: f}
+	return nil
+}
+
+// recordAccess appends sha256's access time to cs.accessLog, if enabled.
+// Errors are intentionally swallowed: the access log is advisory (GC falls
+// back to chunk file mtime), so a logging failure shouldn't fail the read
+// it's recording.
+func (cs *ChunkStore) recordAccess(sha256 string) {
+	if cs.accessLog == nil {
+		return
+	}
+	cs.accessLog.mu.Lock()
+	defer cs.accessLog.mu.Unlock()
+	fmt.Fprintf(cs.accessLog.file, "%s %d\n", sha256, time.Now().UnixNano())
+}
+
+// loadAccessLog parses the sidecar log written by recordAccess into a map
+// of the last recorded access time per SHA256. A missing or unreadable log
+// yields an empty map, so callers fall back to chunk file mtime.
+func loadAccessLog(path string) map[string]time.Time {
+	accessed := map[string]time.Time{}
+	if path == "" {
+		return accessed
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return accessed
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var sha256 string
+		var nanos int64
+		if _, err := fmt.Sscanf(scanner.Text(), "%s %d", &sha256, &nanos); err != nil {
+			continue
+		}
+		accessed[sha256] = time.Unix(0, nanos)
+	}
+	return accessed
+}
@@ -0,0 +1,105 @@
+package chunkstore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
+)
+
+// writeChunksIndex writes a minimal _chunks_index.json under dir describing
+// a single file backed by the given chunk SHA256s, so liveChunkSHAs (via
+// chunkerutil.LoadChunksIndex) treats them as referenced.
+func writeChunksIndex(t *testing.T, dir string, shas ...string) {
+	t.Helper()
+	chunks := make([]chunker.ChunkInfo, len(shas))
+	for i, sha := range shas {
+		chunks[i] = chunker.ChunkInfo{SHA256: sha, Offset: int64(i * 10), Length: 10}
+	}
+	index := []chunkerutil.ChunksIndex{{Path: "f", Chunks: chunks}}
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("Failed to marshal chunks index: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, chunkerutil.ChunksIndexFileName), data, 0644); err != nil {
+		t.Fatalf("Failed to write chunks index: %v", err)
+	}
+}
+
+func TestGC_KeepsLiveEvictsUnreferenced(t *testing.T) {
+	chunkDir := t.TempDir()
+	live := createChunkFile(t, chunkDir, []byte("live chunk"))
+	stale := createChunkFile(t, chunkDir, []byte("stale chunk"))
+
+	rootDir := t.TempDir()
+	writeChunksIndex(t, rootDir, live)
+
+	result, err := GC(chunkDir, GCOptions{RootDirs: []string{rootDir}})
+	if err != nil {
+		t.Fatalf("GC() failed: %v", err)
+	}
+	if result.LiveChunks != 1 || result.UnreferencedChunks != 1 || result.EvictedChunks != 1 {
+		t.Errorf("GC() result = %+v, want 1 live, 1 unreferenced, 1 evicted", result)
+	}
+
+	if _, err := os.Stat(filepath.Join(chunkDir, live)); err != nil {
+		t.Errorf("live chunk %s was removed: %v", live, err)
+	}
+	if _, err := os.Stat(filepath.Join(chunkDir, stale)); !os.IsNotExist(err) {
+		t.Errorf("stale chunk %s was not removed", stale)
+	}
+}
+
+func TestGC_DryRunDeletesNothing(t *testing.T) {
+	chunkDir := t.TempDir()
+	stale := createChunkFile(t, chunkDir, []byte("stale chunk"))
+	rootDir := t.TempDir()
+	writeChunksIndex(t, rootDir) // No live chunks referenced.
+
+	result, err := GC(chunkDir, GCOptions{RootDirs: []string{rootDir}, DryRun: true})
+	if err != nil {
+		t.Fatalf("GC() failed: %v", err)
+	}
+	if result.EvictedChunks != 1 || result.EvictedBytes != int64(len("stale chunk")) {
+		t.Errorf("GC() result = %+v, want 1 evicted chunk reported", result)
+	}
+	if _, err := os.Stat(filepath.Join(chunkDir, stale)); err != nil {
+		t.Errorf("DryRun removed chunk %s: %v", stale, err)
+	}
+}
+
+func TestGC_MaxBytesEvictsOldestFirst(t *testing.T) {
+	chunkDir := t.TempDir()
+	older := createChunkFile(t, chunkDir, []byte("aaaaaaaaaa")) // 10 bytes
+	newer := createChunkFile(t, chunkDir, []byte("bbbbbbbbbb")) // 10 bytes
+	rootDir := t.TempDir()
+	writeChunksIndex(t, rootDir) // Neither is referenced.
+
+	now := time.Now()
+	accessLogPath := filepath.Join(t.TempDir(), "access.log")
+	accessLog := older + " " + strconv.FormatInt(now.Add(-time.Hour).UnixNano(), 10) + "\n" +
+		newer + " " + strconv.FormatInt(now.UnixNano(), 10) + "\n"
+	if err := os.WriteFile(accessLogPath, []byte(accessLog), 0644); err != nil {
+		t.Fatalf("Failed to write access log: %v", err)
+	}
+
+	// Budget for only one 10-byte chunk to survive: the older one should go.
+	result, err := GC(chunkDir, GCOptions{RootDirs: []string{rootDir}, MaxBytes: 10, AccessLogPath: accessLogPath})
+	if err != nil {
+		t.Fatalf("GC() failed: %v", err)
+	}
+	if result.EvictedChunks != 1 {
+		t.Fatalf("GC() result = %+v, want exactly 1 evicted chunk", result)
+	}
+	if _, err := os.Stat(filepath.Join(chunkDir, older)); !os.IsNotExist(err) {
+		t.Errorf("older chunk %s was not evicted", older)
+	}
+	if _, err := os.Stat(filepath.Join(chunkDir, newer)); err != nil {
+		t.Errorf("newer chunk %s was evicted: %v", newer, err)
+	}
+}
@@ -0,0 +1,77 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore"
+)
+
+// IndexFileChecker checks that indexPath is still present and readable,
+// catching the case where it was deleted or truncated out from under a
+// running mount (e.g. by a build cleaning its output directory).
+func IndexFileChecker(indexPath string) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		f, err := os.Open(indexPath)
+		if err != nil {
+			return fmt.Errorf("index file: %w", err)
+		}
+		return f.Close()
+	})
+}
+
+// ChunkSamplingChecker checks that a spread of up to sampleSize files still
+// decode cleanly, by prefetching each one (see ChunkStore.PrefetchFile),
+// catching chunk files that went missing or corrupt out from under
+// chunkDir without anyone reading them yet.
+func ChunkSamplingChecker(store *chunkstore.ChunkStore, sampleSize int) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		files := store.GetFiles()
+		if len(files) == 0 || sampleSize <= 0 {
+			return nil
+		}
+		stride := len(files) / sampleSize
+		if stride == 0 {
+			stride = 1
+		}
+		for i, n := 0, 0; i < len(files) && n < sampleSize; i, n = i+stride, n+1 {
+			if err := store.PrefetchFile(files[i].Path); err != nil {
+				return fmt.Errorf("sampled file %s: %w", files[i].Path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// MountChecker checks that mountPoint is still a responsive directory, the
+// way an unresponsive or crashed FUSE server (go-fuse's process died, or
+// is wedged on a remote fetch) would make even a stat call hang or fail.
+// Unlike mountpoint.ValidateMountPoint, which checks a directory is empty
+// before mounting, this only checks the already-mounted point is alive.
+func MountChecker(mountPoint string) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		if _, err := os.Stat(mountPoint); err != nil {
+			return fmt.Errorf("mount point: %w", err)
+		}
+		return nil
+	})
+}
+
+// ReadErrorRateChecker checks that store's cumulative chunk verification
+// failures (see Options.Verify) across every file stay at or below
+// maxFailures. It's a count rather than a true rate, since ChunkStore
+// doesn't track total reads attempted, but it still catches a chunk
+// source or cache silently handing back corrupt data.
+func ReadErrorRateChecker(store *chunkstore.ChunkStore, maxFailures int64) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		var failures int64
+		for _, fs := range store.Stats().Files {
+			failures += fs.VerifyFailures
+		}
+		if failures > maxFailures {
+			return fmt.Errorf("%d chunk verification failures exceeds limit %d", failures, maxFailures)
+		}
+		return nil
+	})
+}
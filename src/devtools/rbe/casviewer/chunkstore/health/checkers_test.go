@@ -0,0 +1,68 @@
+package health
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore"
+)
+
+// TestChunkSamplingChecker_CorruptedChunk builds a real ChunkStore, corrupts
+// one of its chunk files on disk after load (same length, so only a
+// verifying read notices), and checks that a Registry running the checker
+// periodically flips unhealthy within one check interval.
+func TestChunkSamplingChecker_CorruptedChunk(t *testing.T) {
+	content := []byte("a sample file's content")
+	sum := sha256.Sum256(content)
+	sha := hex.EncodeToString(sum[:])
+
+	tempDir := t.TempDir()
+	chunkDir := filepath.Join(tempDir, "chunks")
+	indexPath := filepath.Join(tempDir, "_chunks_index.json")
+	if err := os.Mkdir(chunkDir, 0755); err != nil {
+		t.Fatalf("failed to create chunk dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(chunkDir, sha), content, 0644); err != nil {
+		t.Fatalf("failed to write chunk file: %v", err)
+	}
+
+	indexJSON := fmt.Sprintf(
+		`[{"path": "file.txt", "mod_time": %q, "mode": 420, "chunks": [{"sha256": %q, "offset": 0}]}]`,
+		time.Now().Format(time.RFC3339Nano), sha)
+	if err := os.WriteFile(indexPath, []byte(indexJSON), 0644); err != nil {
+		t.Fatalf("failed to write index file: %v", err)
+	}
+
+	store, err := chunkstore.NewChunkStore(chunkDir, indexPath)
+	if err != nil {
+		t.Fatalf("NewChunkStore() failed: %v", err)
+	}
+
+	// Corrupt the chunk before it's ever read, so the checker's first
+	// decode (rather than a cache hit from an earlier, clean read) is what
+	// observes it.
+	corrupted := bytes.Repeat([]byte("X"), len(content))
+	if err := os.WriteFile(filepath.Join(chunkDir, sha), corrupted, 0644); err != nil {
+		t.Fatalf("failed to corrupt chunk file: %v", err)
+	}
+
+	checker := ChunkSamplingChecker(store, 1)
+	reg := NewRegistry()
+	reg.RegisterPeriodic("chunks", 5*time.Millisecond, checker)
+	defer reg.Stop()
+
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if !reg.Results()["chunks"].OK {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Registry never reported the chunk checker unhealthy after corruption")
+}
@@ -0,0 +1,199 @@
+// Package health provides a small health-check registry for a casviewer
+// FUSE mount: long-running invariants (the index file is still readable,
+// a sample of chunks still decode, the mount point is still responsive)
+// are registered once at startup and exposed over HTTP for an external
+// watchdog to poll, the same role casmount's and casdownloader's -daemon
+// modes play for cache upkeep.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Checker reports whether some invariant still holds, returning a non-nil
+// error describing what's wrong otherwise.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts a plain function to Checker.
+type CheckerFunc func(ctx context.Context) error
+
+// Check implements Checker.
+func (f CheckerFunc) Check(ctx context.Context) error { return f(ctx) }
+
+// Result is one checker's most recent outcome.
+type Result struct {
+	OK      bool          `json:"ok"`
+	Error   string        `json:"error,omitempty"`
+	Checked time.Time     `json:"checked"`
+	Latency time.Duration `json:"latency_ns"`
+}
+
+// Registry tracks named Checkers and their most recently recorded Result.
+// It's safe for concurrent use.
+type Registry struct {
+	mu     sync.Mutex
+	checks map[string]Checker
+	last   map[string]Result
+	stop   map[string]chan struct{}
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		checks: map[string]Checker{},
+		last:   map[string]Result{},
+		stop:   map[string]chan struct{}{},
+	}
+}
+
+// Register adds c under name, replacing any existing checker (and stopping
+// its periodic goroutine, if any) with the same name. c isn't run until
+// Run, RunAll, or ServeHTTP is called; use RegisterPeriodic to have it run
+// in the background instead.
+func (r *Registry) Register(name string, c Checker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked(name)
+	r.checks[name] = c
+}
+
+// RegisterPeriodic is like Register, but also runs c immediately and then
+// every interval in the background, so Results and ServeHTTP always
+// reflect a recent check instead of blocking the request on one.
+func (r *Registry) RegisterPeriodic(name string, interval time.Duration, c Checker) {
+	r.mu.Lock()
+	r.stopLocked(name)
+	r.checks[name] = c
+	stop := make(chan struct{})
+	r.stop[name] = stop
+	r.mu.Unlock()
+
+	go func() {
+		r.run(context.Background(), name, c)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				r.run(context.Background(), name, c)
+			}
+		}
+	}()
+}
+
+// stopLocked stops name's periodic goroutine, if it has one. Callers must
+// hold r.mu.
+func (r *Registry) stopLocked(name string) {
+	if stop, ok := r.stop[name]; ok {
+		close(stop)
+		delete(r.stop, name)
+	}
+}
+
+// run executes c, records its Result under name, and returns it.
+func (r *Registry) run(ctx context.Context, name string, c Checker) Result {
+	start := time.Now()
+	err := c.Check(ctx)
+	result := Result{OK: err == nil, Checked: start, Latency: time.Since(start)}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.mu.Lock()
+	r.last[name] = result
+	r.mu.Unlock()
+	return result
+}
+
+// Run runs the named checker synchronously now and returns its Result. It
+// panics if name wasn't registered.
+func (r *Registry) Run(ctx context.Context, name string) Result {
+	r.mu.Lock()
+	c := r.checks[name]
+	r.mu.Unlock()
+	return r.run(ctx, name, c)
+}
+
+// RunAll runs every registered checker synchronously, concurrently, and
+// returns their Results keyed by name.
+func (r *Registry) RunAll(ctx context.Context) map[string]Result {
+	r.mu.Lock()
+	checks := make(map[string]Checker, len(r.checks))
+	for name, c := range r.checks {
+		checks[name] = c
+	}
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := make(map[string]Result, len(checks))
+	for name, c := range checks {
+		name, c := name, c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := r.run(ctx, name, c)
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Results returns the most recently recorded Result for every registered
+// checker, without running any of them. A checker never run reports
+// OK:false with a "not yet checked" error.
+func (r *Registry) Results() map[string]Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := make(map[string]Result, len(r.checks))
+	for name := range r.checks {
+		if result, ok := r.last[name]; ok {
+			results[name] = result
+		} else {
+			results[name] = Result{Error: "not yet checked"}
+		}
+	}
+	return results
+}
+
+// ServeHTTP implements http.Handler: it runs every registered checker (see
+// RunAll) and writes a JSON object mapping checker name to Result, with
+// HTTP 503 if any checker reports unhealthy and 200 otherwise.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	results := r.RunAll(req.Context())
+
+	healthy := true
+	for _, result := range results {
+		if !result.OK {
+			healthy = false
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// Stop stops every periodic checker's background goroutine. Registry
+// remains usable for Run/RunAll/ServeHTTP afterward; it just stops
+// refreshing results on its own.
+func (r *Registry) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name := range r.stop {
+		r.stopLocked(name)
+	}
+}
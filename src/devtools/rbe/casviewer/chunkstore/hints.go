@@ -0,0 +1,81 @@
+package chunkstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PrefetchHint is a byte range of a virtual file to eagerly decode at mount
+// time, e.g. from a --prefetch-hints landmark file listing paths known to
+// be hot for a given workload (test-runner startup, etc), analogous to
+// eStargz's prioritized-files list.
+type PrefetchHint struct {
+	Path   string
+	Offset int64
+	Length int64
+}
+
+// ParseHints parses a --prefetch-hints landmark file from r: one
+// "path\toffset\tlength" triple per line, blank lines ignored.
+func ParseHints(r io.Reader) ([]PrefetchHint, error) {
+	var hints []PrefetchHint
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid prefetch hint line %q: want \"path\\toffset\\tlength\"", line)
+		}
+		offset, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset in prefetch hint line %q: %w", line, err)
+		}
+		length, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid length in prefetch hint line %q: %w", line, err)
+		}
+		hints = append(hints, PrefetchHint{Path: fields[0], Offset: offset, Length: length})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hints, nil
+}
+
+// Prewarm eagerly decodes the chunks overlapping each hint's byte range
+// (see ParseHints), for known-hot workloads that shouldn't pay decode
+// latency on their first real read after mount. It's best-effort and
+// returns immediately: a hint whose path isn't in the index is skipped, and
+// decoding happens on cs.prefetcher's worker pool exactly like
+// prefetchAhead, so a saturated pool simply leaves the rest for a later
+// real read to decode. A no-op if the ChunkStore has no prefetcher (see
+// Options.CacheBytes).
+func (cs *ChunkStore) Prewarm(hints []PrefetchHint) {
+	if cs.prefetcher == nil {
+		return
+	}
+	for _, h := range hints {
+		file, err := cs.GetFile(h.Path)
+		if err != nil {
+			continue
+		}
+		start := cs.findChunkIndex(file.Chunks, max(0, h.Offset))
+		if start == -1 {
+			continue
+		}
+		end := h.Offset + h.Length
+		for i := start; i < len(file.Chunks); i++ {
+			chunk := file.Chunks[i]
+			if chunk.Offset >= end {
+				break
+			}
+			cs.prefetcher.prefetchAheadN(cs, file.Chunks, i, 1)
+		}
+	}
+}
@@ -7,9 +7,17 @@ import (
 
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/segmentstore"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore/internal/safepath"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -18,7 +26,11 @@ type fuseMode uint32
 // ChunkInfo represents a chunk of a file.
 type ChunkInfo struct {
 	chunker.ChunkInfo
-	Length int `json:"-"` // FastCDC chunk length is typically small, ~128KB.
+	// Length shadows chunker.ChunkInfo.Length: it's always derived at load
+	// time (see NewChunkStore), preferring the persisted value when present,
+	// otherwise taken from the next chunk's offset, or for a file's last
+	// chunk by stating its payload, so it's never itself serialized. FastCDC chunk length is typically small, ~128KB.
+	Length int `json:"-"`
 }
 
 // FileInfo represents a file in the chunk store.
@@ -30,11 +42,186 @@ type FileInfo struct {
 	Size    int64       `json:"-"`
 }
 
+// fileIndex bundles a chunk store's file list with its path lookup so
+// Reindex can swap both atomically, without any reader (GetFile, GetFiles,
+// ChecksumWildcard) ever observing one updated but not the other.
+type fileIndex struct {
+	files   []FileInfo
+	fileMap map[string]*FileInfo // Map of file path to FileInfo
+
+	// digests, digestFiles, and chunkByDigest back LookupChunk and
+	// LookupFileByDigestPrefix; see newFileIndex.
+	digests       []string             // every chunk's SHA256, sorted, for prefix binary search.
+	digestFiles   map[string][]string  // chunk SHA256 -> paths of files containing it.
+	chunkByDigest map[string]ChunkInfo // chunk SHA256 -> one ChunkInfo with that digest.
+}
+
+// pathPolicy bounds what an index entry's Path is allowed to look like, so
+// a corrupted or untrusted index (see NewChunkStoreFromLayer) can't place a
+// file where it would escape the FUSE mount's virtual root. It's derived
+// from Options by newPathPolicy.
+type pathPolicy struct {
+	allowSymlinks bool
+	maxDepth      int // 0 means unbounded.
+	maxBytes      int // 0 means unbounded.
+}
+
+func newPathPolicy(opts Options) pathPolicy {
+	return pathPolicy{allowSymlinks: opts.AllowSymlinks, maxDepth: opts.MaxPathDepth, maxBytes: opts.MaxPathBytes}
+}
+
+// newFileIndex builds a fileIndex from files, validating and canonicalizing
+// each entry's Path against policy (see safepath.SecureJoin), then deriving
+// fileMap, digests, and digestFiles. It's shared by loadFileIndex and
+// estargzToFileIndex so both index formats get the same validation and
+// expose the same lookups.
+func newFileIndex(files []FileInfo, policy pathPolicy) (*fileIndex, error) {
+	fileMap := make(map[string]*FileInfo, len(files))
+	digestFiles := map[string][]string{}
+	chunkByDigest := map[string]ChunkInfo{}
+	for i := range files {
+		clean, err := safepath.SecureJoin(files[i].Path)
+		if err != nil {
+			return nil, fmt.Errorf("index entry %q: %w", files[i].Path, err)
+		}
+		if policy.maxBytes > 0 && len(clean) > policy.maxBytes {
+			return nil, fmt.Errorf("index entry %q is %d bytes, exceeding Options.MaxPathBytes %d", clean, len(clean), policy.maxBytes)
+		}
+		if depth := strings.Count(clean, "/") + 1; policy.maxDepth > 0 && clean != "" && depth > policy.maxDepth {
+			return nil, fmt.Errorf("index entry %q is %d levels deep, exceeding Options.MaxPathDepth %d", clean, depth, policy.maxDepth)
+		}
+		if !policy.allowSymlinks && files[i].Mode&fuseMode(syscall.S_IFMT) == fuseMode(fuse.S_IFLNK) {
+			return nil, fmt.Errorf("index entry %q is a symlink, which requires Options.AllowSymlinks", clean)
+		}
+		files[i].Path = clean
+
+		fileMap[clean] = &files[i]
+		for _, chunk := range files[i].Chunks {
+			digestFiles[chunk.SHA256] = append(digestFiles[chunk.SHA256], clean)
+			if _, ok := chunkByDigest[chunk.SHA256]; !ok {
+				chunkByDigest[chunk.SHA256] = chunk
+			}
+		}
+	}
+
+	digests := make([]string, 0, len(digestFiles))
+	for sha := range digestFiles {
+		digests = append(digests, sha)
+	}
+	sort.Strings(digests)
+
+	return &fileIndex{files: files, fileMap: fileMap, digests: digests, digestFiles: digestFiles, chunkByDigest: chunkByDigest}, nil
+}
+
 // ChunkStore represents a chunk store that stores files as chunks.
 type ChunkStore struct {
-	chunkDir string
-	files    []FileInfo
-	fileMap  map[string]*FileInfo // Map of file path to FileInfo
+	// source resolves a chunk's on-disk payload by SHA256 (see
+	// decodeChunk); it's NewLocalChunkSource(chunkDir) unless
+	// Options.Source overrides it, e.g. with an RBEChunkSource or
+	// HTTPChunkSource for a mount that doesn't have every chunk locally.
+	source ChunkSource
+	// index is swapped atomically by Reindex so a long-running mount's
+	// file list can be refreshed without unmounting or pausing readers.
+	index atomic.Pointer[fileIndex]
+	// segReader resolves chunks packed into segment files (see
+	// segmentstore), or nil if chunkDir has no segment index, meaning
+	// every chunk is instead its own file under chunkDir.
+	segReader *segmentstore.Reader
+	// accessLog records reads of flat chunk files for GC's LRU eviction,
+	// or nil if EnableAccessLog was never called.
+	accessLog *accessLogWriter
+	// prefetcher decodes and caches chunk payloads for ReadFileToDest (see
+	// prefetch.go), or nil if Options.CacheBytes was <= 0.
+	prefetcher *prefetcher
+	// verify is Options.Verify, consulted by decodeChunk to decide whether
+	// (and how often) to check a chunk's decoded bytes against its recorded
+	// SHA256 before returning them to a reader.
+	verify string
+	// pathPolicy is derived from Options.AllowSymlinks/MaxPathDepth/
+	// MaxPathBytes; newFileIndex enforces it against every index entry on
+	// load and on Reindex.
+	pathPolicy pathPolicy
+	// handleStatsMu guards handleStats, the aggregate FileHandle.Close
+	// folds its own statistics into (see PrefetchStats).
+	handleStatsMu sync.Mutex
+	handleStats   HandleStats
+	// statsMu guards bytesRead and chunkStats, the per-file and per-chunk
+	// instrumentation Stats aggregates for the control-socket "stats"
+	// command (see casviewer/controlsock).
+	statsMu    sync.Mutex
+	bytesRead  map[string]int64
+	chunkStats map[string]*chunkDecodeStats
+}
+
+const (
+	defaultCacheBytes      = 64 << 20 // 64 MiB.
+	defaultPrefetchAhead   = 4
+	defaultPrefetchWorkers = 4
+)
+
+const (
+	// VerifyNone never checks a chunk's decoded bytes against its recorded
+	// SHA256; the fastest option, trusting chunkDir and the index entirely.
+	VerifyNone = "none"
+	// VerifyLazy checks a chunk's decoded bytes against its recorded SHA256
+	// the first time it's read from disk, before it enters the cache;
+	// subsequent reads of the same cached chunk aren't re-checked.
+	VerifyLazy = "lazy"
+	// VerifyStrict checks a chunk's decoded bytes against its recorded
+	// SHA256 on every read, including cache hits, at the cost of rehashing
+	// the chunk's full payload each time.
+	VerifyStrict = "strict"
+)
+
+// Options configures optional ChunkStore behavior (see NewChunkStoreWithOptions).
+type Options struct {
+	// CacheBytes bounds the size of the in-memory LRU cache of decoded
+	// chunk payloads that ReadFileToDest and its prefetcher share. <= 0
+	// disables both the cache and prefetching.
+	CacheBytes int64
+	// PrefetchAhead is how many chunks beyond the one actually being read
+	// are proactively decoded and cached, to make sequential reads over
+	// the FUSE mount (e.g. media streaming) not serialize on one chunk
+	// file at a time. ReadFileToDest always prefetches exactly this many;
+	// a FileHandle (see OpenFile) instead treats it as the ceiling its
+	// adaptive read-ahead window grows to.
+	PrefetchAhead int
+	// PrefetchWorkers bounds how many prefetch decodes run concurrently.
+	PrefetchWorkers int
+	// Verify is VerifyNone, VerifyLazy, or VerifyStrict, controlling how
+	// aggressively ReadFileToDest checks decoded chunk bytes against their
+	// recorded SHA256. The zero value behaves like VerifyNone.
+	Verify string
+	// Source, if non-nil, replaces the default local-directory ChunkSource
+	// (see NewRBEChunkSource, NewHTTPChunkSource, NewCachingChunkSource)
+	// for resolving chunk payloads instead of reading them from chunkDir.
+	// Segment-packed chunks (see segmentstore) are always read locally
+	// from chunkDir regardless of Source, since segment packing is a
+	// local on-disk optimization with no remote equivalent.
+	Source ChunkSource
+	// AllowSymlinks allows index entries whose Mode is a symlink. The zero
+	// value rejects them at load time, since this package's FUSE layer
+	// doesn't resolve a symlink's target against the virtual root, making
+	// an attacker-controlled target a mount-escape vector.
+	AllowSymlinks bool
+	// MaxPathDepth rejects an index entry whose Path has more than this
+	// many slash-separated components. <= 0 means unbounded.
+	MaxPathDepth int
+	// MaxPathBytes rejects an index entry whose Path, after cleaning, is
+	// longer than this many bytes. <= 0 means unbounded.
+	MaxPathBytes int
+}
+
+// DefaultOptions returns the Options NewChunkStore constructs a ChunkStore
+// with, for callers that want to override just one or two fields (e.g.
+// Verify) without repeating the rest.
+func DefaultOptions() Options {
+	return Options{
+		CacheBytes:      defaultCacheBytes,
+		PrefetchAhead:   defaultPrefetchAhead,
+		PrefetchWorkers: defaultPrefetchWorkers,
+		Verify:          VerifyLazy,
+	}
 }
 
 func getFileSize(filePath string) (int64, error) {
@@ -46,50 +233,130 @@ func getFileSize(filePath string) (int64, error) {
 	return stat.Size(), nil
 }
 
-// NewChunkStore creates a new ChunkStore from the given index path.
+// NewChunkStore creates a new ChunkStore from the given index path, with
+// prefetching and a chunk cache enabled using default settings (see
+// NewChunkStoreWithOptions to tune or disable them).
 func NewChunkStore(chunkDir, indexPath string) (*ChunkStore, error) {
+	return NewChunkStoreWithOptions(chunkDir, indexPath, DefaultOptions())
+}
+
+// NewChunkStoreWithOptions is like NewChunkStore, but lets callers tune or
+// disable the chunk cache and prefetching (see Options).
+func NewChunkStoreWithOptions(chunkDir, indexPath string, opts Options) (*ChunkStore, error) {
+	source := opts.Source
+	if source == nil {
+		source = NewLocalChunkSource(chunkDir)
+	}
+
+	policy := newPathPolicy(opts)
+	idx, err := loadFileIndex(indexPath, source, opts.Verify, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Segment packing (see segmentstore) is a local on-disk optimization:
+	// segment-packed chunks are always read from chunkDir, whether or not
+	// opts.Source overrides where the other chunks come from.
+	var segReader *segmentstore.Reader
+	if chunkDir != "" {
+		segIndex, err := segmentstore.LoadIndex(chunkDir)
+		if err != nil {
+			return nil, err
+		}
+		if segIndex != nil {
+			segReader = segmentstore.NewReader(chunkDir, segIndex)
+		}
+	}
+
+	var p *prefetcher
+	if opts.CacheBytes > 0 {
+		p = newPrefetcher(opts.CacheBytes, opts.PrefetchAhead, opts.PrefetchWorkers)
+	}
+
+	cs := &ChunkStore{
+		source:     source,
+		segReader:  segReader,
+		prefetcher: p,
+		verify:     opts.Verify,
+		pathPolicy: policy,
+	}
+	cs.index.Store(idx)
+	return cs, nil
+}
+
+// loadFileIndex reads and parses indexPath into a fileIndex, resolving each
+// file's size and each chunk's length against source and validating every
+// entry's Path against policy (see newFileIndex). It's shared by
+// NewChunkStoreWithOptions and Reindex so a mount's file list can be
+// recomputed identically whether at startup or while already running.
+func loadFileIndex(indexPath string, source ChunkSource, verify string, policy pathPolicy) (*fileIndex, error) {
 	data, err := os.ReadFile(indexPath)
 	if err != nil {
 		return nil, err
 	}
 
+	if verify != "" && verify != VerifyNone {
+		manifest, err := chunkerutil.LoadManifest(filepath.Dir(indexPath))
+		if err != nil {
+			return nil, err
+		}
+		if err := chunkerutil.VerifyManifest(manifest, data); err != nil {
+			return nil, err
+		}
+	}
+
 	var files []FileInfo
 	if err := json.Unmarshal(data, &files); err != nil {
 		return nil, err
 	}
 
 	// Calculate file sizes -
-	fileMap := map[string]*FileInfo{}
 	for i, file := range files {
-		fileMap[file.Path] = &files[i]
-
 		fileSize := int64(0)
 		chunkCount := len(file.Chunks)
 		for c, chunk := range file.Chunks {
-			if c < chunkCount-1 {
+			if chunk.ChunkInfo.Length > 0 {
+				// The chunk index already persisted the uncompressed length
+				// (see chunker.ChunkInfo.Length), so there's no need to stat
+				// the chunk file on disk, which may be compressed.
+				file.Chunks[c].Length = int(chunk.ChunkInfo.Length)
+			} else if c < chunkCount-1 {
 				file.Chunks[c].Length = int(file.Chunks[c+1].Offset - chunk.Offset)
-				continue
-			}
-
-			// Last chunk, get chunk size
-			path := filepath.Join(chunkDir, chunk.SHA256)
-			length, err := getFileSize(path)
-			if err != nil {
-				return nil, err
+			} else {
+				// Last chunk of an index written before chunker.ChunkInfo.Length
+				// existed: fall back to stating the (uncompressed) chunk's payload.
+				length, err := source.Stat(chunk.SHA256)
+				if err != nil {
+					return nil, err
+				}
+				file.Chunks[c].Length = int(length)
 			}
-			file.Chunks[c].Length = int(length)
 
 			// file.chunks are perfectly contiguous and sorted by offset.
-			fileSize = chunk.Offset + int64(length)
+			if c == chunkCount-1 {
+				fileSize = chunk.Offset + int64(file.Chunks[c].Length)
+			}
 		}
 		files[i].Size = fileSize
 	}
 
-	return &ChunkStore{
-		chunkDir: chunkDir,
-		files:    files,
-		fileMap:  fileMap,
-	}, nil
+	return newFileIndex(files, policy)
+}
+
+// Reindex reloads indexPath and atomically replaces the file list seen by
+// GetFile, GetFiles, ChecksumWildcard, and reads already in flight, so a
+// long-running mount can pick up upstream CAS content changes (new or
+// modified files) without unmounting or restarting the FUSE server (see the
+// "reindex" control-socket command in casviewer/controlsock). Segment
+// packing and prefetcher settings are unaffected; only the file list itself
+// is swapped.
+func (cs *ChunkStore) Reindex(indexPath string) error {
+	idx, err := loadFileIndex(indexPath, cs.source, cs.verify, cs.pathPolicy)
+	if err != nil {
+		return err
+	}
+	cs.index.Store(idx)
+	return nil
 }
 
 // UnmarshalJSON is a custom unmarshal to convert os.FileMode → fuseMode.
@@ -128,12 +395,12 @@ func osFileModeToFuseMode(m os.FileMode) fuseMode {
 
 // GetFiles returns all files in the chunk store.
 func (cs *ChunkStore) GetFiles() []FileInfo {
-	return cs.files
+	return cs.index.Load().files
 }
 
 // GetFile returns the FileInfo for the given file path.
 func (cs *ChunkStore) GetFile(path string) (*FileInfo, error) {
-	if fileInfo, ok := cs.fileMap[path]; ok {
+	if fileInfo, ok := cs.index.Load().fileMap[path]; ok {
 		return fileInfo, nil
 	}
 	return nil, os.ErrNotExist
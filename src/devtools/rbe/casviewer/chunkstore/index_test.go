@@ -5,11 +5,14 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
 	"google3/third_party/golang/gofuse/fuse/fuse" // For fuseMode constants
 )
 
@@ -164,8 +167,33 @@ func TestNewChunkStore_MalformedJSON(t *testing.T) {
 	}
 }
 
+func TestNewChunkStoreWithOptions_ManifestDigestMismatch(t *testing.T) {
+	tempDir := t.TempDir()
+	chunkDir := filepath.Join(tempDir, "chunks")
+	indexPath := filepath.Join(tempDir, "_chunks_index.json")
+	_ = os.Mkdir(chunkDir, 0755)
+
+	indexJSON := []byte(`[{"path": "file.txt"}]`)
+	if err := os.WriteFile(indexPath, indexJSON, 0644); err != nil {
+		t.Fatalf("Failed to write index file: %v", err)
+	}
+	if err := chunkerutil.WriteManifest(tempDir, []byte(`[{"path": "different"}]`), chunkerutil.ChunkerParams{}); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+
+	if _, err := NewChunkStoreWithOptions(chunkDir, indexPath, Options{Verify: VerifyLazy}); err == nil {
+		t.Fatal("Expected error for manifest digest mismatch, got nil")
+	}
+
+	// VerifyNone skips the manifest check entirely.
+	if _, err := NewChunkStoreWithOptions(chunkDir, indexPath, Options{Verify: VerifyNone}); err != nil {
+		t.Errorf("NewChunkStoreWithOptions() with VerifyNone = %v, want nil", err)
+	}
+}
+
 func TestNewChunkStore_MissingChunkFile(t *testing.T) {
-	// sha1 represents a chunk that will NOT be created on disk
+	// sha1 represents a chunk that will NOT be created on disk (or served
+	// by the HTTP/fake backend below).
 	sha1Missing := "0000000000000000000000000000000000000000000000000000000000000000"
 	filesData := []TestFileEntry{
 		{
@@ -175,30 +203,59 @@ func TestNewChunkStore_MissingChunkFile(t *testing.T) {
 			Chunks:  []TestChunkInfo{{SHA256: sha1Missing, Offset: 0}},
 		},
 	}
-	// allChunkContents := map[string][]byte{} // Empty, so sha1Missing won't exist
-
-	tempDir := t.TempDir()
-	chunkDir := filepath.Join(tempDir, "chunks")
-	indexPath := filepath.Join(tempDir, "_chunks_index.json")
-	_ = os.Mkdir(chunkDir, 0755)
 
 	indexJSON, err := json.MarshalIndent(filesData, "", "  ")
 	if err != nil {
 		t.Fatalf("Failed to marshal index data: %v", err)
 	}
-	err = os.WriteFile(indexPath, indexJSON, 0644)
-	if err != nil {
-		t.Fatalf("Failed to write index file: %v", err)
-	}
 
-	_, err = NewChunkStore(chunkDir, indexPath)
-	if err == nil {
-		t.Fatal("Expected error for missing chunk file, got nil")
-	}
-	// The error from getFileSize is wrapped, so check for os.ErrNotExist within the chain
-	if !errors.Is(err, os.ErrNotExist) {
-		t.Logf("Note: Expected error chain to contain os.ErrNotExist for missing chunk, got: %v", err)
-	}
+	t.Run("local", func(t *testing.T) {
+		tempDir := t.TempDir()
+		chunkDir := filepath.Join(tempDir, "chunks")
+		indexPath := filepath.Join(tempDir, "_chunks_index.json")
+		_ = os.Mkdir(chunkDir, 0755)
+		if err := os.WriteFile(indexPath, indexJSON, 0644); err != nil {
+			t.Fatalf("Failed to write index file: %v", err)
+		}
+
+		_, err := NewChunkStore(chunkDir, indexPath)
+		if err == nil {
+			t.Fatal("Expected error for missing chunk file, got nil")
+		}
+		// The error from getFileSize is wrapped, so check for os.ErrNotExist within the chain
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Logf("Note: Expected error chain to contain os.ErrNotExist for missing chunk, got: %v", err)
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+
+		tempDir := t.TempDir()
+		indexPath := filepath.Join(tempDir, "_chunks_index.json")
+		if err := os.WriteFile(indexPath, indexJSON, 0644); err != nil {
+			t.Fatalf("Failed to write index file: %v", err)
+		}
+
+		opts := Options{Source: NewHTTPChunkSource(srv.URL, nil), Verify: VerifyNone}
+		if _, err := NewChunkStoreWithOptions(tempDir, indexPath, opts); err == nil {
+			t.Fatal("Expected error for missing chunk file served over HTTP, got nil")
+		}
+	})
+
+	t.Run("fake", func(t *testing.T) {
+		tempDir := t.TempDir()
+		indexPath := filepath.Join(tempDir, "_chunks_index.json")
+		if err := os.WriteFile(indexPath, indexJSON, 0644); err != nil {
+			t.Fatalf("Failed to write index file: %v", err)
+		}
+
+		opts := Options{Source: newFakeChunkSource(map[string][]byte{}), Verify: VerifyNone}
+		if _, err := NewChunkStoreWithOptions(tempDir, indexPath, opts); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("NewChunkStoreWithOptions() with a missing chunk = %v, want an error wrapping os.ErrNotExist", err)
+		}
+	})
 }
 
 func TestChunkStore_GetFile(t *testing.T) {
@@ -229,6 +286,64 @@ func TestChunkStore_GetFile(t *testing.T) {
 	}
 }
 
+// TestNewChunkStore_PathEscape covers the two classic escape shapes the
+// pathPolicy (via internal/safepath) must reject at load time: a relative
+// ".." climb above the chunkDir root, and an absolute path.
+func TestNewChunkStore_PathEscape(t *testing.T) {
+	for _, path := range []string{"../../etc/passwd", "/etc/passwd"} {
+		t.Run(path, func(t *testing.T) {
+			filesData := []TestFileEntry{
+				{Path: path, ModTime: time.Now().Format(time.RFC3339Nano), Mode: 0644, Chunks: []TestChunkInfo{}},
+			}
+
+			tempDir := t.TempDir()
+			chunkDir := filepath.Join(tempDir, "chunks")
+			indexPath := filepath.Join(tempDir, "_chunks_index.json")
+			_ = os.Mkdir(chunkDir, 0755)
+
+			indexJSON, err := json.MarshalIndent(filesData, "", "  ")
+			if err != nil {
+				t.Fatalf("Failed to marshal index data: %v", err)
+			}
+			if err := os.WriteFile(indexPath, indexJSON, 0644); err != nil {
+				t.Fatalf("Failed to write index file: %v", err)
+			}
+
+			if _, err := NewChunkStore(chunkDir, indexPath); err == nil {
+				t.Fatalf("NewChunkStore() with escaping path %q = nil error, want error", path)
+			}
+		})
+	}
+}
+
+// TestNewChunkStore_SymlinkCycle loads an index with two symlink entries
+// that "point" at each other. FileInfo carries no symlink-target field at
+// all (see Options.AllowSymlinks), so nothing in this package ever
+// dereferences one: loading must simply succeed, not hang or loop.
+func TestNewChunkStore_SymlinkCycle(t *testing.T) {
+	filesData := []TestFileEntry{
+		{Path: "a", ModTime: time.Now().Format(time.RFC3339Nano), Mode: int(os.ModeSymlink | 0777), Chunks: []TestChunkInfo{}},
+		{Path: "b", ModTime: time.Now().Format(time.RFC3339Nano), Mode: int(os.ModeSymlink | 0777), Chunks: []TestChunkInfo{}},
+	}
+
+	tempDir := t.TempDir()
+	chunkDir := filepath.Join(tempDir, "chunks")
+	indexPath := filepath.Join(tempDir, "_chunks_index.json")
+	_ = os.Mkdir(chunkDir, 0755)
+
+	indexJSON, err := json.MarshalIndent(filesData, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal index data: %v", err)
+	}
+	if err := os.WriteFile(indexPath, indexJSON, 0644); err != nil {
+		t.Fatalf("Failed to write index file: %v", err)
+	}
+
+	if _, err := NewChunkStoreWithOptions(chunkDir, indexPath, Options{AllowSymlinks: true}); err != nil {
+		t.Fatalf("NewChunkStoreWithOptions() with a symlink cycle = %v, want nil", err)
+	}
+}
+
 func TestOsFileModeToFuseMode(t *testing.T) {
 	tests := []struct {
 		name     string
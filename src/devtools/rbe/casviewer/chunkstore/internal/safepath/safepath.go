@@ -0,0 +1,51 @@
+// Package safepath validates the virtual, slash-separated paths a
+// chunkstore index entry carries, so a corrupted or maliciously crafted
+// index (or, via NewChunkStoreFromLayer, an untrusted OCI layer's TOC)
+// can't place a file where it would escape the FUSE mount's virtual root.
+package safepath
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrUnsafePath is returned by SecureJoin when a path is absolute, or its
+// ".." components climb back past the virtual root.
+var ErrUnsafePath = errors.New("safepath: unsafe path")
+
+// SecureJoin validates rel, a slash-separated virtual path as stored in a
+// chunkstore index entry, and returns its cleaned, root-relative form.
+// Unlike path.Clean alone, it rejects any path that would resolve outside
+// the virtual root: an absolute path, a Windows-style path carrying a
+// backslash component, or one whose ".." components outnumber the real
+// directory components that precede them.
+func SecureJoin(rel string) (string, error) {
+	if rel == "" {
+		return "", nil
+	}
+	if path.IsAbs(rel) {
+		return "", fmt.Errorf("%w: %q is an absolute path", ErrUnsafePath, rel)
+	}
+	if strings.ContainsRune(rel, '\\') {
+		return "", fmt.Errorf("%w: %q contains a backslash, which this package never treats as a path separator", ErrUnsafePath, rel)
+	}
+
+	clean := path.Clean(rel)
+	depth := 0
+	for _, part := range strings.Split(clean, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", fmt.Errorf("%w: %q climbs above the virtual root", ErrUnsafePath, rel)
+			}
+		default:
+			depth++
+		}
+	}
+	return clean, nil
+}
@@ -0,0 +1,41 @@
+package safepath
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSecureJoin(t *testing.T) {
+	testCases := []struct {
+		name       string
+		rel        string
+		want       string
+		wantUnsafe bool
+	}{
+		{name: "empty", rel: "", want: ""},
+		{name: "simple", rel: "a/b/c.txt", want: "a/b/c.txt"},
+		{name: "dot_dot_within_root", rel: "a/b/../c.txt", want: "a/c.txt"},
+		{name: "relative_traversal_above_root", rel: "../../etc/passwd", wantUnsafe: true},
+		{name: "absolute_path", rel: "/etc/passwd", wantUnsafe: true},
+		{name: "backslash_components", rel: "..\\..\\etc\\passwd", wantUnsafe: true},
+		{name: "backslash_in_otherwise_safe_path", rel: "a\\b", wantUnsafe: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := SecureJoin(tc.rel)
+			if tc.wantUnsafe {
+				if !errors.Is(err, ErrUnsafePath) {
+					t.Fatalf("SecureJoin(%q) error = %v, want ErrUnsafePath", tc.rel, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SecureJoin(%q) failed: %v", tc.rel, err)
+			}
+			if got != tc.want {
+				t.Errorf("SecureJoin(%q) = %q, want %q", tc.rel, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package chunkstore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// minDigestPrefixLen is the shortest hex prefix LookupChunk and
+	// LookupFileByDigestPrefix accept; anything shorter is too likely to
+	// match many chunks to be a useful lookup key.
+	minDigestPrefixLen = 4
+	// maxAmbiguousCandidates bounds how many matching digests an
+	// AmbiguousDigestError carries, so a very short prefix against a huge
+	// index doesn't blow up the error message.
+	maxAmbiguousCandidates = 10
+)
+
+// ErrDigestNotFound is returned by LookupChunk and LookupFileByDigestPrefix
+// when no chunk's SHA256 starts with the given prefix.
+var ErrDigestNotFound = errors.New("chunkstore: digest prefix not found")
+
+// ErrDigestAmbiguous is the sentinel AmbiguousDigestError wraps; match
+// against it with errors.Is, or errors.As for the candidate list.
+var ErrDigestAmbiguous = errors.New("chunkstore: digest prefix is ambiguous")
+
+// ErrPrefixTooShort is returned by LookupChunk and LookupFileByDigestPrefix
+// when prefix is shorter than minDigestPrefixLen.
+var ErrPrefixTooShort = fmt.Errorf("chunkstore: digest prefix must be at least %d hex characters", minDigestPrefixLen)
+
+// AmbiguousDigestError is the concrete error LookupChunk and
+// LookupFileByDigestPrefix return, wrapped, when more than one chunk's
+// SHA256 starts with the looked-up prefix: Candidates holds the first
+// maxAmbiguousCandidates matching digests, sorted, so a caller (or an
+// operator reading a control-socket response) can narrow the prefix.
+type AmbiguousDigestError struct {
+	Prefix     string
+	Candidates []string
+}
+
+func (e *AmbiguousDigestError) Error() string {
+	return fmt.Sprintf("chunkstore: digest prefix %q is ambiguous, matches %v", e.Prefix, e.Candidates)
+}
+
+// Is reports whether target is ErrDigestAmbiguous, so errors.Is(err,
+// ErrDigestAmbiguous) matches an *AmbiguousDigestError without needing
+// errors.As.
+func (e *AmbiguousDigestError) Is(target error) bool {
+	return target == ErrDigestAmbiguous
+}
+
+// LookupChunk resolves prefix, a hex prefix (at least minDigestPrefixLen
+// characters) of a chunk's SHA256, to the one full digest and ChunkInfo it
+// names, via binary search over the index's sorted digest list (see
+// newFileIndex). It returns ErrPrefixTooShort if prefix is too short,
+// ErrDigestNotFound if no chunk's digest starts with prefix, or an
+// *AmbiguousDigestError (matching ErrDigestAmbiguous) if more than one does.
+func (cs *ChunkStore) LookupChunk(prefix string) (sha string, info ChunkInfo, err error) {
+	if len(prefix) < minDigestPrefixLen {
+		return "", ChunkInfo{}, ErrPrefixTooShort
+	}
+
+	idx := cs.index.Load()
+	digests := idx.digests
+	i := sort.SearchStrings(digests, prefix)
+	if i >= len(digests) || !strings.HasPrefix(digests[i], prefix) {
+		return "", ChunkInfo{}, ErrDigestNotFound
+	}
+	if i+1 < len(digests) && strings.HasPrefix(digests[i+1], prefix) {
+		candidates := []string{digests[i]}
+		for j := i + 1; j < len(digests) && strings.HasPrefix(digests[j], prefix) && len(candidates) < maxAmbiguousCandidates; j++ {
+			candidates = append(candidates, digests[j])
+		}
+		return "", ChunkInfo{}, &AmbiguousDigestError{Prefix: prefix, Candidates: candidates}
+	}
+	return digests[i], idx.chunkByDigest[digests[i]], nil
+}
+
+// LookupFileByDigestPrefix resolves prefix to the paths of every file
+// containing a chunk whose SHA256 starts with it (see LookupChunk). It
+// returns ErrPrefixTooShort, ErrDigestNotFound, or an *AmbiguousDigestError
+// under the same conditions as LookupChunk.
+func (cs *ChunkStore) LookupFileByDigestPrefix(prefix string) ([]string, error) {
+	sha256, _, err := cs.LookupChunk(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return cs.index.Load().digestFiles[sha256], nil
+}
@@ -0,0 +1,118 @@
+package chunkstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLookupChunk(t *testing.T) {
+	chunkA := []byte("chunk A content")
+	chunkB := []byte("chunk B content")
+	hasherA := sha256.Sum256(chunkA)
+	shaA := hex.EncodeToString(hasherA[:])
+	hasherB := sha256.Sum256(chunkB)
+	shaB := hex.EncodeToString(hasherB[:])
+
+	// Two digests that deliberately share a prefix, to exercise the
+	// ambiguous case without depending on a real hash collision. Their
+	// backing chunk files below only need to exist, not match the digest
+	// content: loadFileIndex only stats a single-chunk file's size, it
+	// doesn't rehash it against the index.
+	const sharedPrefix = "abcdef12"
+	shaC := sharedPrefix + "0000000000000000000000000000000000000000000000000000000000"
+	shaD := sharedPrefix + "1111111111111111111111111111111111111111111111111111111111"
+
+	allChunkContents := map[string][]byte{
+		shaA: chunkA,
+		shaB: chunkB,
+		shaC: []byte("chunk C content"),
+		shaD: []byte("chunk D content"),
+	}
+
+	filesData := []TestFileEntry{
+		{
+			Path:    "a.txt",
+			ModTime: time.Now().Format(time.RFC3339Nano),
+			Mode:    0644,
+			Chunks:  []TestChunkInfo{{SHA256: shaA, Offset: 0}},
+		},
+		{
+			Path:    "b.txt",
+			ModTime: time.Now().Format(time.RFC3339Nano),
+			Mode:    0644,
+			Chunks:  []TestChunkInfo{{SHA256: shaB, Offset: 0}},
+		},
+		{
+			Path:    "c.txt",
+			ModTime: time.Now().Format(time.RFC3339Nano),
+			Mode:    0644,
+			Chunks:  []TestChunkInfo{{SHA256: shaC, Offset: 0}},
+		},
+		{
+			Path:    "d.txt",
+			ModTime: time.Now().Format(time.RFC3339Nano),
+			Mode:    0644,
+			Chunks:  []TestChunkInfo{{SHA256: shaD, Offset: 0}},
+		},
+	}
+
+	store, _ := setupTestChunkStore(t, filesData, allChunkContents)
+
+	t.Run("unambiguous", func(t *testing.T) {
+		prefix := shaA[:8]
+		sha, info, err := store.LookupChunk(prefix)
+		if err != nil {
+			t.Fatalf("LookupChunk(%q) failed: %v", prefix, err)
+		}
+		if sha != shaA {
+			t.Errorf("LookupChunk(%q) sha = %q, want %q", prefix, sha, shaA)
+		}
+		if info.SHA256 != shaA {
+			t.Errorf("LookupChunk(%q) info.SHA256 = %q, want %q", prefix, info.SHA256, shaA)
+		}
+
+		files, err := store.LookupFileByDigestPrefix(prefix)
+		if err != nil {
+			t.Fatalf("LookupFileByDigestPrefix(%q) failed: %v", prefix, err)
+		}
+		if len(files) != 1 || files[0] != "a.txt" {
+			t.Errorf("LookupFileByDigestPrefix(%q) = %v, want [a.txt]", prefix, files)
+		}
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		_, _, err := store.LookupChunk("deadbeef")
+		if !errors.Is(err, ErrDigestNotFound) {
+			t.Errorf("LookupChunk(deadbeef) error = %v, want ErrDigestNotFound", err)
+		}
+	})
+
+	t.Run("too_short", func(t *testing.T) {
+		_, _, err := store.LookupChunk("abc")
+		if !errors.Is(err, ErrPrefixTooShort) {
+			t.Errorf("LookupChunk(abc) error = %v, want ErrPrefixTooShort", err)
+		}
+	})
+
+	t.Run("ambiguous", func(t *testing.T) {
+		_, _, err := store.LookupChunk(sharedPrefix)
+		var ambiguous *AmbiguousDigestError
+		if !errors.As(err, &ambiguous) {
+			t.Fatalf("LookupChunk(%q) error = %v, want *AmbiguousDigestError", sharedPrefix, err)
+		}
+		if !errors.Is(err, ErrDigestAmbiguous) {
+			t.Errorf("LookupChunk(%q) error does not match ErrDigestAmbiguous via errors.Is", sharedPrefix)
+		}
+		if len(ambiguous.Candidates) != 2 {
+			t.Errorf("AmbiguousDigestError.Candidates = %v, want 2 entries", ambiguous.Candidates)
+		}
+
+		_, err = store.LookupFileByDigestPrefix(sharedPrefix)
+		if !errors.Is(err, ErrDigestAmbiguous) {
+			t.Errorf("LookupFileByDigestPrefix(%q) error = %v, want ErrDigestAmbiguous", sharedPrefix, err)
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package chunkstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sync/singleflight"
+)
+
+// zstdDecoderPool holds reusable *zstd.Decoder instances for decodeChunk, so
+// decoding many chunks doesn't allocate a fresh decoder (and its internal
+// buffers) per call. A *zstd.Decoder is safe to reuse across DecodeAll calls
+// once its previous result is no longer needed.
+var zstdDecoderPool = sync.Pool{
+	New: func() any {
+		d, err := zstd.NewReader(nil)
+		if err != nil {
+			// zstd.NewReader(nil) only fails on invalid options, which this
+			// call site never passes, so this is unreachable in practice.
+			panic(fmt.Sprintf("failed to create zstd decoder: %v", err))
+		}
+		return d
+	},
+}
+
+// chunkCache is a size-bounded LRU cache of decoded chunk payloads, shared
+// by ReadFileToDest and prefetcher.prefetchAhead below so a chunk decoded
+// once (by a real read or a prefetch) doesn't need to be re-opened and
+// re-decompressed by a later read of the same chunk. It always keeps at
+// least the most recently put entry, even if that alone exceeds maxBytes.
+type chunkCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	curBytes int64
+	entries  map[string]*list.Element
+	order    *list.List // Front = most recently used.
+}
+
+type chunkCacheEntry struct {
+	sha  string
+	data []byte
+}
+
+func newChunkCache(maxBytes int64) *chunkCache {
+	return &chunkCache{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (c *chunkCache) get(sha string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[sha]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*chunkCacheEntry).data, true
+}
+
+func (c *chunkCache) put(sha string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[sha]; ok {
+		c.order.MoveToFront(e)
+		e.Value.(*chunkCacheEntry).data = data
+		return
+	}
+	e := c.order.PushFront(&chunkCacheEntry{sha: sha, data: data})
+	c.entries[sha] = e
+	c.curBytes += int64(len(data))
+
+	for c.curBytes > c.maxBytes && c.order.Len() > 1 {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*chunkCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.sha)
+		c.curBytes -= int64(len(entry.data))
+	}
+}
+
+// clear drops every entry, for the control-socket "flush" command (see
+// ChunkStore.FlushCache). Chunks already in flight through
+// prefetcher.group are unaffected and will repopulate the now-empty cache
+// when they finish.
+func (c *chunkCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*list.Element{}
+	c.order = list.New()
+	c.curBytes = 0
+}
+
+// prefetcher decodes chunk payloads on demand, caches them in a bounded
+// LRU (see chunkCache), coalesces concurrent loads of the same chunk with
+// singleflight, and asynchronously loads the next few chunks of a file
+// being read so a streaming read over the FUSE mount (the mountutil/
+// casviewer use case) doesn't serialize on opening one chunk file at a
+// time. A nil *prefetcher (see Options.CacheBytes) makes load() decode
+// directly with no caching or prefetching.
+type prefetcher struct {
+	cache *chunkCache
+	group singleflight.Group
+	sem   chan struct{} // Bounds concurrent prefetch loads; cap 0 disables prefetching.
+	ahead int
+}
+
+func newPrefetcher(cacheBytes int64, ahead, workers int) *prefetcher {
+	if workers < 0 {
+		workers = 0
+	}
+	return &prefetcher{
+		cache: newChunkCache(cacheBytes),
+		sem:   make(chan struct{}, workers),
+		ahead: ahead,
+	}
+}
+
+// load returns chunk's decoded payload, from the cache if present,
+// otherwise decoding it via decodeChunk and populating the cache.
+// Concurrent loads of the same chunk are coalesced into a single decode.
+func (p *prefetcher) load(cs *ChunkStore, chunk ChunkInfo) ([]byte, error) {
+	if p == nil {
+		return decodeChunk(cs, chunk)
+	}
+	if data, ok := p.cache.get(chunk.SHA256); ok {
+		if cs.verify == VerifyStrict {
+			if err := verifyChunk(chunk.SHA256, data); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+	v, err, _ := p.group.Do(chunk.SHA256, func() (any, error) {
+		if data, ok := p.cache.get(chunk.SHA256); ok {
+			return data, nil
+		}
+		data, err := decodeChunk(cs, chunk)
+		if err != nil {
+			return nil, err
+		}
+		p.cache.put(chunk.SHA256, data)
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// cached reports whether chunk's decoded payload is already in p's cache,
+// without decoding it if not. A nil prefetcher (no caching configured)
+// never counts as cached.
+func (p *prefetcher) cached(sha string) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.cache.get(sha)
+	return ok
+}
+
+// prefetchAhead asynchronously decodes chunks[from : from+p.ahead] into
+// the cache; see prefetchAheadN.
+func (p *prefetcher) prefetchAhead(cs *ChunkStore, chunks []ChunkInfo, from int) {
+	if p == nil {
+		return
+	}
+	p.prefetchAheadN(cs, chunks, from, p.ahead)
+}
+
+// prefetchAheadN asynchronously decodes chunks[from : from+n] into the
+// cache. It's best-effort and never blocks the caller: a chunk already
+// cached is skipped, and if the prefetch worker pool (p.sem) is saturated
+// the remaining chunks are simply left for a later real read to decode.
+func (p *prefetcher) prefetchAheadN(cs *ChunkStore, chunks []ChunkInfo, from, n int) {
+	if p == nil {
+		return
+	}
+	end := from + n
+	if end > len(chunks) {
+		end = len(chunks)
+	}
+	for i := from; i < end; i++ {
+		chunk := chunks[i]
+		if _, ok := p.cache.get(chunk.SHA256); ok {
+			continue
+		}
+		select {
+		case p.sem <- struct{}{}:
+			go func(chunk ChunkInfo) {
+				defer func() { <-p.sem }()
+				p.load(cs, chunk)
+			}(chunk)
+		default:
+		}
+	}
+}
+
+// decodeChunk reads and fully decodes chunk's on-disk payload, whether
+// it's packed into a segment file (see segmentstore), individually
+// zstd-compressed, or stored raw. Chunks are decoded whole rather than
+// streamed since FastCDC chunks are small (~128KB); with prefetcher's
+// cache in front of it, a chunk is decoded at most once regardless of how
+// many overlapping reads or prefetches ask for it, which is the main
+// payoff a per-chunk os.File handle pool would otherwise be chasing, so
+// this doesn't also keep one open.
+func decodeChunk(cs *ChunkStore, chunk ChunkInfo) ([]byte, error) {
+	var raw []byte
+	if chunk.ChunkInfo.SegmentID != nil {
+		var err error
+		raw, err = cs.segReader.ReadChunk(chunk.SHA256)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segmented chunk %s: %w", chunk.SHA256, err)
+		}
+	} else {
+		rc, err := cs.source.Fetch(chunk.SHA256, 0, chunkOnDiskLength(chunk))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk %s: %w", chunk.SHA256, err)
+		}
+		raw, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk %s: %w", chunk.SHA256, err)
+		}
+		cs.recordAccess(chunk.SHA256)
+	}
+
+	decodeStart := time.Now()
+	var decoded []byte
+	switch chunk.ChunkInfo.Compression {
+	case chunker.CompressionZstd:
+		decoder := zstdDecoderPool.Get().(*zstd.Decoder)
+		defer zstdDecoderPool.Put(decoder)
+		var err error
+		decoded, err = decoder.DecodeAll(raw, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress chunk %s: %w", chunk.SHA256, err)
+		}
+	case chunker.CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip decoder for chunk %s: %w", chunk.SHA256, err)
+		}
+		defer r.Close()
+		decoded, err = io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress chunk %s: %w", chunk.SHA256, err)
+		}
+	default:
+		decoded = raw
+	}
+	cs.recordDecompress(chunk.SHA256, time.Since(decodeStart))
+
+	if cs.verify == VerifyLazy || cs.verify == VerifyStrict {
+		if err := verifyChunk(chunk.SHA256, decoded); err != nil {
+			cs.recordVerifyFailure(chunk.SHA256)
+			return nil, err
+		}
+	}
+	return decoded, nil
+}
+
+// verifyChunk checks that decoded's SHA256 matches wantSHA256, the digest
+// recorded for it in the chunks index.
+func verifyChunk(wantSHA256 string, decoded []byte) error {
+	sum := sha256.Sum256(decoded)
+	if got := hex.EncodeToString(sum[:]); got != wantSHA256 {
+		return fmt.Errorf("chunk %s failed verification: decoded content hashes to %s", wantSHA256, got)
+	}
+	return nil
+}
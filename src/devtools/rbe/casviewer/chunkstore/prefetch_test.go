@@ -0,0 +1,155 @@
+package chunkstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+)
+
+func TestChunkCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newChunkCache(15)
+	c.put("a", []byte("aaaaa"))  // 5 bytes, total 5
+	c.put("b", []byte("bbbbb"))  // 5 bytes, total 10
+	c.get("a")                   // "a" is now more recently used than "b"
+	c.put("c", []byte("ccccccccc")) // 9 bytes, pushes total over budget: evict "b" first
+
+	if _, ok := c.get("b"); ok {
+		t.Error("chunkCache kept least-recently-used entry \"b\" over budget")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("chunkCache evicted recently-used entry \"a\"")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Error("chunkCache didn't keep just-inserted entry \"c\"")
+	}
+}
+
+func TestChunkStore_ReadFileToDest_PrefetchesAndCaches(t *testing.T) {
+	chunkAContent := []byte("AAAAAAAAAA")
+	chunkBContent := []byte("BBBBBBBBBB")
+	chunkCContent := []byte("CCCCCCCCCC")
+
+	chunkDir := t.TempDir()
+	shaA := createChunkFile(t, chunkDir, chunkAContent)
+	shaB := createChunkFile(t, chunkDir, chunkBContent)
+	shaC := createChunkFile(t, chunkDir, chunkCContent)
+
+	filesData := []TestFileEntry{
+		{
+			Path:    "testfile.txt",
+			ModTime: time.Now().Format(time.RFC3339Nano),
+			Mode:    0644,
+			Chunks: []TestChunkInfo{
+				{SHA256: shaA, Offset: 0},
+				{SHA256: shaB, Offset: 10},
+				{SHA256: shaC, Offset: 20},
+			},
+		},
+	}
+	indexPath := filepath.Join(t.TempDir(), "_chunks_index.json")
+	indexJSON, err := json.MarshalIndent(filesData, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal index data: %v", err)
+	}
+	if err := os.WriteFile(indexPath, indexJSON, 0644); err != nil {
+		t.Fatalf("Failed to write index file: %v", err)
+	}
+
+	store, err := NewChunkStoreWithOptions(chunkDir, indexPath, Options{CacheBytes: 1 << 20, PrefetchAhead: 2, PrefetchWorkers: 2})
+	if err != nil {
+		t.Fatalf("NewChunkStoreWithOptions() failed: %v", err)
+	}
+
+	dest := make([]byte, 5)
+	if _, err := store.ReadFileToDest("testfile.txt", dest, 0); err != nil {
+		t.Fatalf("ReadFileToDest() failed: %v", err)
+	}
+
+	// Reading the first chunk should have kicked off a prefetch of chunk B
+	// (and, budget permitting, C); wait for it to land in the cache.
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := store.prefetcher.cache.get(shaB); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := store.prefetcher.cache.get(shaB); !ok {
+		t.Error("prefetchAhead did not populate the cache for the next chunk")
+	}
+
+	// Deleting the now-cached chunk's file on disk shouldn't break a
+	// subsequent read of it, since it should be served from cache.
+	if err := os.Remove(filepath.Join(chunkDir, shaB)); err != nil {
+		t.Fatalf("Failed to remove chunk file: %v", err)
+	}
+	dest2 := make([]byte, 10)
+	n, err := store.ReadFileToDest("testfile.txt", dest2, 10)
+	if err != nil {
+		t.Fatalf("ReadFileToDest() on cached chunk failed: %v", err)
+	}
+	if n != 10 || string(dest2) != string(chunkBContent) {
+		t.Errorf("ReadFileToDest() on cached chunk = %q, %d, want %q, 10", dest2, n, chunkBContent)
+	}
+}
+
+func TestDecodeChunk_Gzip(t *testing.T) {
+	content := []byte("gzip-compressed chunk content")
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		t.Fatalf("Failed to gzip-compress test content: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to gzip-compress test content: %v", err)
+	}
+
+	chunkDir := t.TempDir()
+	sha := createChunkFile(t, chunkDir, buf.Bytes())
+	cs := &ChunkStore{source: NewLocalChunkSource(chunkDir)}
+	chunk := ChunkInfo{ChunkInfo: chunker.ChunkInfo{SHA256: sha, Compression: chunker.CompressionGzip}}
+
+	decoded, err := decodeChunk(cs, chunk)
+	if err != nil {
+		t.Fatalf("decodeChunk() failed: %v", err)
+	}
+	if string(decoded) != string(content) {
+		t.Errorf("decodeChunk() = %q, want %q", decoded, content)
+	}
+}
+
+func TestPrefetcher_LoadCoalescesConcurrentDecodes(t *testing.T) {
+	chunkDir := t.TempDir()
+	sha := createChunkFile(t, chunkDir, []byte("shared content"))
+	cs := &ChunkStore{source: NewLocalChunkSource(chunkDir)}
+	p := newPrefetcher(1<<20, 0, 0)
+
+	var decodes int32
+	chunk := ChunkInfo{ChunkInfo: chunker.ChunkInfo{SHA256: sha}}
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			if _, err := p.load(cs, chunk); err != nil {
+				t.Errorf("load() failed: %v", err)
+			}
+			atomic.AddInt32(&decodes, 1)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	if decodes != 10 {
+		t.Errorf("got %d completed loads, want 10", decodes)
+	}
+	if _, ok := p.cache.get(sha); !ok {
+		t.Error("load() did not populate the cache")
+	}
+}
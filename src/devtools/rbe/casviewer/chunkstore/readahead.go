@@ -0,0 +1,114 @@
+package chunkstore
+
+import "sync"
+
+// HandleStats summarizes read-ahead effectiveness for one open file handle
+// (see FileHandle), aggregated by ChunkStore.PrefetchStats for callers
+// (e.g. casviewer) to log at unmount.
+type HandleStats struct {
+	Hits   int64 // Reads where every chunk touched was already decoded and cached.
+	Misses int64 // Reads that had to decode at least one chunk synchronously.
+}
+
+// FileHandle tracks one open file's read pattern across repeated ReadAt
+// calls, growing or shrinking its read-ahead window (see
+// ChunkStore.readFileToDest's ahead parameter) based on whether recent
+// reads have been sequential, strided, or random, instead of always
+// prefetching a fixed number of chunks ahead like ReadFileToDest does.
+type FileHandle struct {
+	cs   *ChunkStore
+	file *FileInfo
+
+	mu      sync.Mutex
+	lastEnd int64 // End offset (exclusive) of the previous ReadAt, or -1 before the first read.
+	stride  int64 // Offset delta between the two most recent reads, 0 until a second read arrives.
+	window  int   // Current read-ahead window in chunks, grown on sequential/strided hits and reset on misses.
+	stats   HandleStats
+}
+
+// OpenFile returns a FileHandle for tracking path's read pattern across
+// repeated ReadAt calls. Call Close when the handle is no longer in use to
+// fold its statistics into ChunkStore.PrefetchStats.
+func (cs *ChunkStore) OpenFile(path string) (*FileHandle, error) {
+	file, err := cs.GetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileHandle{cs: cs, file: file, lastEnd: -1, window: 1}, nil
+}
+
+// ReadAt is like ChunkStore.ReadFileToDest for h's file, but widens h's
+// read-ahead window while reads through h keep being sequential or
+// strided, and resets it to 1 chunk as soon as a read breaks that pattern.
+func (h *FileHandle) ReadAt(dest []byte, offset int64) (int, error) {
+	h.mu.Lock()
+	delta := offset - h.lastEnd
+	sequential := h.lastEnd >= 0 && delta == 0
+	strided := h.lastEnd >= 0 && h.stride != 0 && delta == h.stride
+	if h.lastEnd >= 0 {
+		h.stride = delta
+	}
+
+	maxWindow := h.cs.maxPrefetchWindow()
+	switch {
+	case sequential || strided:
+		if h.window == 0 {
+			h.window = 1
+		}
+		h.window *= 2
+		if h.window > maxWindow {
+			h.window = maxWindow
+		}
+	default:
+		h.window = 1 // Random access: don't bother prefetching ahead.
+	}
+	window := h.window
+	h.mu.Unlock()
+
+	n, hit, err := h.cs.readFileToDest(h.file, dest, offset, window)
+
+	h.mu.Lock()
+	h.lastEnd = offset + int64(n)
+	if hit {
+		h.stats.Hits++
+	} else {
+		h.stats.Misses++
+	}
+	h.mu.Unlock()
+
+	return n, err
+}
+
+// Close releases h and folds its final access-pattern statistics into
+// ChunkStore.PrefetchStats.
+func (h *FileHandle) Close() HandleStats {
+	h.mu.Lock()
+	stats := h.stats
+	h.mu.Unlock()
+
+	h.cs.handleStatsMu.Lock()
+	h.cs.handleStats.Hits += stats.Hits
+	h.cs.handleStats.Misses += stats.Misses
+	h.cs.handleStatsMu.Unlock()
+
+	return stats
+}
+
+// maxPrefetchWindow is the largest read-ahead window, in chunks, a
+// FileHandle will grow to, taken from Options.PrefetchAhead; 0 if
+// prefetching is disabled (Options.CacheBytes <= 0).
+func (cs *ChunkStore) maxPrefetchWindow() int {
+	if cs.prefetcher == nil {
+		return 0
+	}
+	return cs.prefetcher.ahead
+}
+
+// PrefetchStats returns the read-ahead hit/miss counts aggregated across
+// every FileHandle opened against cs and since closed (see
+// FileHandle.Close), for callers (e.g. casviewer) to log at unmount.
+func (cs *ChunkStore) PrefetchStats() HandleStats {
+	cs.handleStatsMu.Lock()
+	defer cs.handleStatsMu.Unlock()
+	return cs.handleStats
+}
@@ -0,0 +1,154 @@
+package chunkstore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForCached polls store's decoded-chunk cache for sha, for tests
+// asserting on Prewarm's asynchronous decodes.
+func waitForCached(t *testing.T, store *ChunkStore, sha string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if store.prefetcher.cached(sha) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("Prewarm did not cache chunk %s in time", sha)
+}
+
+func newReadaheadTestStore(t *testing.T) (*ChunkStore, string, string) {
+	t.Helper()
+	chunkAContent := []byte("AAAAAAAAAA")
+	chunkBContent := []byte("BBBBBBBBBB")
+	chunkCContent := []byte("CCCCCCCCCC")
+
+	chunkDir := t.TempDir()
+	shaA := createChunkFile(t, chunkDir, chunkAContent)
+	shaB := createChunkFile(t, chunkDir, chunkBContent)
+	shaC := createChunkFile(t, chunkDir, chunkCContent)
+
+	filesData := []TestFileEntry{
+		{
+			Path:    "testfile.txt",
+			ModTime: time.Now().Format(time.RFC3339Nano),
+			Mode:    0644,
+			Chunks: []TestChunkInfo{
+				{SHA256: shaA, Offset: 0},
+				{SHA256: shaB, Offset: 10},
+				{SHA256: shaC, Offset: 20},
+			},
+		},
+	}
+	indexPath := filepath.Join(t.TempDir(), "_chunks_index.json")
+	indexJSON, err := json.MarshalIndent(filesData, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal index data: %v", err)
+	}
+	if err := os.WriteFile(indexPath, indexJSON, 0644); err != nil {
+		t.Fatalf("Failed to write index file: %v", err)
+	}
+
+	store, err := NewChunkStoreWithOptions(chunkDir, indexPath, Options{CacheBytes: 1 << 20, PrefetchAhead: 4, PrefetchWorkers: 2})
+	if err != nil {
+		t.Fatalf("NewChunkStoreWithOptions() failed: %v", err)
+	}
+	return store, chunkDir, indexPath
+}
+
+func TestFileHandle_SequentialReadsGrowWindowAndReportHits(t *testing.T) {
+	store, _, _ := newReadaheadTestStore(t)
+
+	file, err := store.GetFile("testfile.txt")
+	if err != nil {
+		t.Fatalf("GetFile() failed: %v", err)
+	}
+	h, err := store.OpenFile("testfile.txt")
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+
+	dest := make([]byte, 10)
+	// The first read is necessarily a miss; wait for each read's
+	// read-ahead to land in the cache before the next read, so later
+	// reads deterministically hit instead of racing the prefetch goroutine.
+	for i, off := 0, int64(0); off < 30; i, off = i+1, off+10 {
+		if _, err := h.ReadAt(dest, off); err != nil {
+			t.Fatalf("ReadAt(%d) failed: %v", off, err)
+		}
+		if i+1 < len(file.Chunks) {
+			waitForCached(t, store, file.Chunks[i+1].SHA256)
+		}
+	}
+
+	if h.window <= 1 {
+		t.Errorf("window after sequential reads = %d, want > 1", h.window)
+	}
+
+	stats := h.Close()
+	if stats.Hits == 0 {
+		t.Error("sequential reads following an earlier read's prefetch reported no cache hits")
+	}
+
+	total := store.PrefetchStats()
+	if total != stats {
+		t.Errorf("PrefetchStats() = %+v, want %+v", total, stats)
+	}
+}
+
+func TestFileHandle_RandomReadsResetWindow(t *testing.T) {
+	store, _, _ := newReadaheadTestStore(t)
+
+	h, err := store.OpenFile("testfile.txt")
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	defer h.Close()
+
+	dest := make([]byte, 10)
+	if _, err := h.ReadAt(dest, 0); err != nil {
+		t.Fatalf("ReadAt(0) failed: %v", err)
+	}
+	if _, err := h.ReadAt(dest, 10); err != nil {
+		t.Fatalf("ReadAt(10) failed: %v", err)
+	}
+	if h.window <= 1 {
+		t.Fatalf("window after two sequential reads = %d, want > 1", h.window)
+	}
+
+	// Jump backwards: breaks the sequential/strided pattern.
+	if _, err := h.ReadAt(dest, 0); err != nil {
+		t.Fatalf("ReadAt(0) failed: %v", err)
+	}
+	if h.window != 1 {
+		t.Errorf("window after a non-sequential read = %d, want 1", h.window)
+	}
+}
+
+func TestParseHintsAndPrewarm(t *testing.T) {
+	store, _, _ := newReadaheadTestStore(t)
+
+	hints, err := ParseHints(strings.NewReader("testfile.txt\t0\t10\n\ntestfile.txt\t20\t10\n"))
+	if err != nil {
+		t.Fatalf("ParseHints() failed: %v", err)
+	}
+	if len(hints) != 2 {
+		t.Fatalf("ParseHints() returned %d hints, want 2", len(hints))
+	}
+
+	file, err := store.GetFile("testfile.txt")
+	if err != nil {
+		t.Fatalf("GetFile() failed: %v", err)
+	}
+	store.Prewarm(hints)
+
+	for _, sha := range []string{file.Chunks[0].SHA256, file.Chunks[2].SHA256} {
+		waitForCached(t, store, sha)
+	}
+}
@@ -0,0 +1,178 @@
+package chunkstore
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CachingChunkSource wraps another ChunkSource with a size-bounded,
+// on-disk LRU cache of whole chunk payloads, named by SHA256 under dir
+// exactly like LocalChunkSource, so repeated or prefetched reads of the
+// same chunk from a remote source (RBEChunkSource, HTTPChunkSource) don't
+// re-fetch it over the network. Concurrent fetches of a chunk not yet
+// cached are coalesced into a single request via singleflight, the same
+// approach prefetcher uses for decoded payloads (see prefetch.go).
+type CachingChunkSource struct {
+	source   ChunkSource
+	dir      string
+	maxBytes int64
+	group    singleflight.Group
+
+	mu       sync.Mutex
+	curBytes int64
+	entries  map[string]*list.Element
+	order    *list.List // Front = most recently used.
+}
+
+type cacheEntry struct {
+	sha  string
+	size int64
+}
+
+// NewCachingChunkSource creates a CachingChunkSource caching fetches from
+// source under dir (created if needed), evicting least-recently-used
+// chunks once the cache exceeds maxBytes. Any chunk files already under
+// dir (e.g. from a prior run) are adopted into the cache.
+func NewCachingChunkSource(source ChunkSource, dir string, maxBytes int64) (*CachingChunkSource, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create chunk cache dir: %w", err)
+	}
+	c := &CachingChunkSource{
+		source:   source,
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+
+	existing, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunk cache dir: %w", err)
+	}
+	for _, f := range existing {
+		if f.IsDir() {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		e := c.order.PushBack(&cacheEntry{sha: f.Name(), size: info.Size()})
+		c.entries[f.Name()] = e
+		c.curBytes += info.Size()
+	}
+	return c, nil
+}
+
+func (c *CachingChunkSource) path(sha256 string) string {
+	return filepath.Join(c.dir, sha256)
+}
+
+// Stat implements ChunkSource, preferring the cached copy's size.
+func (c *CachingChunkSource) Stat(sha256 string) (int64, error) {
+	if size, err := getFileSize(c.path(sha256)); err == nil {
+		return size, nil
+	}
+	return c.source.Stat(sha256)
+}
+
+// Fetch implements ChunkSource: it serves sha256 from the on-disk cache
+// when present, otherwise fetches it whole from source (even if only a
+// range was requested, since caching a partial chunk isn't worth the
+// bookkeeping), writes it to the cache, and evicts least-recently-used
+// entries if that pushes the cache over maxBytes. When offset is 0, length
+// is passed on to source as the chunk's whole size, as sources that need a
+// size up front (e.g. RBEChunkSource) require; otherwise source gets -1.
+func (c *CachingChunkSource) Fetch(sha256 string, offset, length int64) (io.ReadCloser, error) {
+	c.mu.Lock()
+	e, cached := c.entries[sha256]
+	if cached {
+		c.order.MoveToFront(e)
+	}
+	c.mu.Unlock()
+
+	if cached {
+		if rc, err := NewLocalChunkSource(c.dir).Fetch(sha256, offset, length); err == nil {
+			return rc, nil
+		}
+		// The cached file vanished or is corrupt (e.g. concurrent eviction
+		// raced this read); fall through and re-fetch it from source.
+	}
+
+	v, err, _ := c.group.Do(sha256, func() (any, error) {
+		if rc, err := NewLocalChunkSource(c.dir).Fetch(sha256, 0, -1); err == nil {
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}
+
+		wholeLen := int64(-1)
+		if offset == 0 {
+			wholeLen = length
+		}
+		rc, err := c.source.Fetch(sha256, 0, wholeLen)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk %s from source: %w", sha256, err)
+		}
+		c.put(sha256, data)
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data := v.([]byte)
+	end := int64(len(data))
+	if length >= 0 && offset+length < end {
+		end = offset + length
+	}
+	if offset > end {
+		offset = end
+	}
+	return io.NopCloser(bytes.NewReader(data[offset:end])), nil
+}
+
+// put writes data to dir under sha256 and records it in the LRU,
+// evicting the least-recently-used entries if that pushes curBytes over
+// maxBytes. It always keeps at least the entry just added, even if that
+// alone exceeds maxBytes.
+func (c *CachingChunkSource) put(sha256 string, data []byte) {
+	tmp := c.path(sha256) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, c.path(sha256)); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[sha256]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	e := c.order.PushFront(&cacheEntry{sha: sha256, size: int64(len(data))})
+	c.entries[sha256] = e
+	c.curBytes += int64(len(data))
+
+	for c.maxBytes > 0 && c.curBytes > c.maxBytes && c.order.Len() > 1 {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*cacheEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.sha)
+		c.curBytes -= entry.size
+		os.Remove(c.path(entry.sha))
+	}
+}
@@ -0,0 +1,73 @@
+package chunkstore
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// HTTPChunkSource fetches chunk payloads as HTTP(S) GET requests under
+// baseURL, one request per chunk, using the Range header for partial
+// reads. It addresses a chunk at baseURL + "/" + sha256, mirroring
+// LocalChunkSource's filename convention.
+type HTTPChunkSource struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// NewHTTPChunkSource creates an HTTPChunkSource serving chunks from
+// baseURL. httpClient, if nil, defaults to http.DefaultClient.
+func NewHTTPChunkSource(baseURL string, httpClient *http.Client) *HTTPChunkSource {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPChunkSource{baseURL: baseURL, httpClient: httpClient}
+}
+
+func (s *HTTPChunkSource) url(sha256 string) string {
+	return s.baseURL + "/" + sha256
+}
+
+// Stat implements ChunkSource via a HEAD request.
+func (s *HTTPChunkSource) Stat(sha256 string) (int64, error) {
+	req, err := http.NewRequest(http.MethodHead, s.url(sha256), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to build HEAD request for chunk %s: %w", sha256, err)
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to HEAD chunk %s: %w", sha256, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HEAD chunk %s: unexpected status %s", sha256, resp.Status)
+	}
+	return resp.ContentLength, nil
+}
+
+// Fetch implements ChunkSource via a GET request, with a Range header
+// when offset or length is set.
+func (s *HTTPChunkSource) Fetch(sha256 string, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url(sha256), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request for chunk %s: %w", sha256, err)
+	}
+	if offset > 0 || length >= 0 {
+		rangeEnd := ""
+		if length >= 0 {
+			rangeEnd = strconv.FormatInt(offset+length-1, 10)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", offset, rangeEnd))
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch chunk %s: %w", sha256, err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetch chunk %s: unexpected status %s", sha256, resp.Status)
+	}
+	return resp.Body, nil
+}
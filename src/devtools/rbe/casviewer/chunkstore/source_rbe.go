@@ -0,0 +1,52 @@
+package chunkstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+)
+
+// RBEChunkSource fetches chunk payloads from a remote CAS over gRPC,
+// addressing each chunk by the (SHA256, size) digest CAS itself uses to
+// address blobs (client.Client picks BatchReadBlobs or ByteStream.Read
+// internally depending on blob size), so a FastCDC index can be mounted
+// without every chunk having been downloaded first.
+//
+// Only chunker.CompressionNone chunks are supported: CAS holds canonical
+// uncompressed bytes addressed by their own SHA256, so there's no remote
+// equivalent of a locally zstd/gzip-compressed chunk file.
+type RBEChunkSource struct {
+	ctx    context.Context
+	client *client.Client
+}
+
+// NewRBEChunkSource creates an RBEChunkSource that fetches blobs through c.
+func NewRBEChunkSource(ctx context.Context, c *client.Client) *RBEChunkSource {
+	return &RBEChunkSource{ctx: ctx, client: c}
+}
+
+// Stat isn't meaningful on its own for RBEChunkSource: CAS digests are
+// (hash, size) pairs, so there's no way to look up a blob's size from its
+// hash alone. Callers should instead get a chunk's size from the chunks
+// index (see chunkOnDiskLength) and pass it to Fetch.
+func (s *RBEChunkSource) Stat(sha256 string) (int64, error) {
+	return 0, fmt.Errorf("RBEChunkSource: size of chunk %s must come from the chunks index, not a remote Stat", sha256)
+}
+
+// Fetch implements ChunkSource. length must be >= 0, since CAS digests
+// require a size alongside the hash.
+func (s *RBEChunkSource) Fetch(sha256 string, offset, length int64) (io.ReadCloser, error) {
+	if length < 0 {
+		return nil, fmt.Errorf("RBEChunkSource.Fetch(%s): length must be known, since CAS digests are (hash, size) pairs", sha256)
+	}
+	d := digest.Digest{Hash: sha256, Size: length}
+	data, _, err := s.client.ReadBlobRange(s.ctx, d, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s from CAS: %w", sha256, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
@@ -0,0 +1,124 @@
+package chunkstore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLocalChunkSource_FetchRange(t *testing.T) {
+	dir := t.TempDir()
+	sha := createChunkFile(t, dir, []byte("0123456789"))
+
+	src := NewLocalChunkSource(dir)
+
+	if size, err := src.Stat(sha); err != nil || size != 10 {
+		t.Fatalf("Stat() = (%d, %v), want (10, nil)", size, err)
+	}
+
+	rc, err := src.Fetch(sha, 3, 4)
+	if err != nil {
+		t.Fatalf("Fetch() failed: %v", err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll() failed: %v", err)
+	}
+	if string(got) != "3456" {
+		t.Errorf("Fetch(offset=3, length=4) = %q, want %q", got, "3456")
+	}
+}
+
+// countingSource wraps a ChunkSource and counts calls to Fetch, so tests can
+// assert that CachingChunkSource actually avoids re-fetching cached chunks.
+type countingSource struct {
+	ChunkSource
+	fetches atomic.Int32
+}
+
+func (s *countingSource) Fetch(sha256 string, offset, length int64) (io.ReadCloser, error) {
+	s.fetches.Add(1)
+	return s.ChunkSource.Fetch(sha256, offset, length)
+}
+
+func TestCachingChunkSource_CachesAndEvicts(t *testing.T) {
+	backingDir := t.TempDir()
+	shaA := createChunkFile(t, backingDir, []byte("aaaaa")) // 5 bytes
+	shaB := createChunkFile(t, backingDir, []byte("bbbbb")) // 5 bytes
+	shaC := createChunkFile(t, backingDir, []byte("ccccc")) // 5 bytes
+
+	backing := &countingSource{ChunkSource: NewLocalChunkSource(backingDir)}
+	cache, err := NewCachingChunkSource(backing, t.TempDir(), 12)
+	if err != nil {
+		t.Fatalf("NewCachingChunkSource() failed: %v", err)
+	}
+
+	read := func(sha string) string {
+		t.Helper()
+		rc, err := cache.Fetch(sha, 0, -1)
+		if err != nil {
+			t.Fatalf("Fetch(%s) failed: %v", sha, err)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("ReadAll(%s) failed: %v", sha, err)
+		}
+		return string(data)
+	}
+
+	if got := read(shaA); got != "aaaaa" {
+		t.Errorf("Fetch(shaA) = %q, want %q", got, "aaaaa")
+	}
+	if got := read(shaA); got != "aaaaa" {
+		t.Errorf("Fetch(shaA) (cached) = %q, want %q", got, "aaaaa")
+	}
+	if n := backing.fetches.Load(); n != 1 {
+		t.Errorf("backing source fetched %d times for a repeated read of the same chunk, want 1", n)
+	}
+
+	// Pull shaB and shaC in, which (12-byte budget) evicts the
+	// least-recently-used entry, shaA.
+	read(shaB)
+	read(shaC)
+
+	if _, err := os.Stat(filepath.Join(cache.dir, shaA)); err == nil {
+		t.Error("CachingChunkSource kept least-recently-used chunk shaA past its byte budget")
+	}
+	for _, sha := range []string{shaB, shaC} {
+		if _, err := os.Stat(filepath.Join(cache.dir, sha)); err != nil {
+			t.Errorf("CachingChunkSource evicted recently-used chunk %s: %v", sha, err)
+		}
+	}
+
+	// Re-reading shaA should transparently re-fetch it from backing.
+	if got := read(shaA); got != "aaaaa" {
+		t.Errorf("Fetch(shaA) after eviction = %q, want %q", got, "aaaaa")
+	}
+}
+
+func TestCachingChunkSource_AdoptsExistingCacheDir(t *testing.T) {
+	backingDir := t.TempDir()
+	sha := createChunkFile(t, backingDir, []byte("hello"))
+	backing := &countingSource{ChunkSource: NewLocalChunkSource(backingDir)}
+
+	cacheDir := t.TempDir()
+	createChunkFile(t, cacheDir, []byte("hello")) // Pre-populate, as if from a prior run.
+
+	cache, err := NewCachingChunkSource(backing, cacheDir, 1<<20)
+	if err != nil {
+		t.Fatalf("NewCachingChunkSource() failed: %v", err)
+	}
+
+	rc, err := cache.Fetch(sha, 0, -1)
+	if err != nil {
+		t.Fatalf("Fetch() failed: %v", err)
+	}
+	rc.Close()
+	if n := backing.fetches.Load(); n != 0 {
+		t.Errorf("backing source was fetched %d times for a chunk already present in the adopted cache dir, want 0", n)
+	}
+}
@@ -0,0 +1,139 @@
+package chunkstore
+
+import "time"
+
+// chunkDecodeStats accumulates decodeChunk instrumentation for one chunk,
+// keyed by SHA256 rather than file path since content-defined chunking can
+// dedup the same chunk across multiple files (see Stats, which attributes a
+// shared chunk's stats to every file referencing it).
+type chunkDecodeStats struct {
+	decompressNanos int64
+	verifyFailures  int64
+}
+
+// FileStats is one file's entry in Stats.Files: how much of it has been
+// read, and how expensive decoding its chunks has been.
+type FileStats struct {
+	// BytesRead is the total bytes ReadFileToDest/FileHandle.ReadAt have
+	// copied out of this file, across every open and read.
+	BytesRead int64
+	// DecompressNanos is the total time spent decompressing this file's
+	// chunks, summed across every chunk (shared chunks are counted once
+	// per file that references them, not once overall).
+	DecompressNanos int64
+	// VerifyFailures is how many times one of this file's chunks failed
+	// its recorded SHA256 check (see Options.Verify).
+	VerifyFailures int64
+}
+
+// Stats is the control-socket "stats" command's response (see
+// casviewer/controlsock): chunk-cache effectiveness aggregated across every
+// FileHandle, plus per-file read/decode activity.
+type Stats struct {
+	CacheHits   int64
+	CacheMisses int64
+	Files       map[string]FileStats
+}
+
+// recordBytesRead attributes n bytes copied out of path to Stats.
+func (cs *ChunkStore) recordBytesRead(path string, n int64) {
+	if n == 0 {
+		return
+	}
+	cs.statsMu.Lock()
+	defer cs.statsMu.Unlock()
+	if cs.bytesRead == nil {
+		cs.bytesRead = map[string]int64{}
+	}
+	cs.bytesRead[path] += n
+}
+
+// decodeStatsLocked returns chunk sha's chunkDecodeStats, allocating it if
+// this is the first time sha has been decoded. Callers must hold statsMu.
+func (cs *ChunkStore) decodeStatsLocked(sha string) *chunkDecodeStats {
+	if cs.chunkStats == nil {
+		cs.chunkStats = map[string]*chunkDecodeStats{}
+	}
+	s := cs.chunkStats[sha]
+	if s == nil {
+		s = &chunkDecodeStats{}
+		cs.chunkStats[sha] = s
+	}
+	return s
+}
+
+// recordDecompress attributes a chunk decode's duration to Stats.
+func (cs *ChunkStore) recordDecompress(sha string, d time.Duration) {
+	cs.statsMu.Lock()
+	defer cs.statsMu.Unlock()
+	cs.decodeStatsLocked(sha).decompressNanos += d.Nanoseconds()
+}
+
+// recordVerifyFailure attributes a failed SHA256 check to Stats.
+func (cs *ChunkStore) recordVerifyFailure(sha string) {
+	cs.statsMu.Lock()
+	defer cs.statsMu.Unlock()
+	cs.decodeStatsLocked(sha).verifyFailures++
+}
+
+// Stats returns chunk-cache effectiveness aggregated across every
+// FileHandle (see PrefetchStats) plus per-file bytes-read, decompression
+// time, and verification-failure counters, for the control-socket "stats"
+// command (see casviewer/controlsock). Only files with at least one
+// recorded byte read, decode, or verification failure are included.
+func (cs *ChunkStore) Stats() Stats {
+	handleStats := cs.PrefetchStats()
+
+	cs.statsMu.Lock()
+	defer cs.statsMu.Unlock()
+
+	files := map[string]FileStats{}
+	for _, f := range cs.GetFiles() {
+		fs := FileStats{BytesRead: cs.bytesRead[f.Path]}
+		for _, c := range f.Chunks {
+			if s, ok := cs.chunkStats[c.SHA256]; ok {
+				fs.DecompressNanos += s.decompressNanos
+				fs.VerifyFailures += s.verifyFailures
+			}
+		}
+		if fs != (FileStats{}) {
+			files[f.Path] = fs
+		}
+	}
+
+	return Stats{CacheHits: handleStats.Hits, CacheMisses: handleStats.Misses, Files: files}
+}
+
+// FlushCache drops every decoded chunk payload from the in-memory cache
+// ReadFileToDest, FileHandle.ReadAt, and the prefetcher share, for the
+// control-socket "flush" command (see casviewer/controlsock). It's a no-op
+// if Options.CacheBytes was <= 0. Subsequent reads simply re-decode,
+// exactly as if the chunks had never been read before.
+func (cs *ChunkStore) FlushCache() {
+	if cs.prefetcher == nil {
+		return
+	}
+	cs.prefetcher.cache.clear()
+}
+
+// PrefetchFile eagerly decodes every chunk of path into the cache, for the
+// control-socket "prefetch" command (see casviewer/controlsock). Unlike the
+// read-path's best-effort prefetchAhead, this blocks until every chunk has
+// either been decoded or failed, so a caller driving it from the control
+// socket gets a definitive answer before moving on. A no-op if
+// Options.CacheBytes was <= 0.
+func (cs *ChunkStore) PrefetchFile(path string) error {
+	if cs.prefetcher == nil {
+		return nil
+	}
+	file, err := cs.GetFile(path)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range file.Chunks {
+		if _, err := cs.prefetcher.load(cs, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package chunkstore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStats_TracksBytesReadAndCacheHits(t *testing.T) {
+	store, _, _ := newReadaheadTestStore(t)
+
+	// Cache hits and misses are counted per FileHandle and folded into
+	// Stats on Close, so read through a handle rather than ReadFileToDest.
+	h, err := store.OpenFile("testfile.txt")
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	dest := make([]byte, 10)
+	if _, err := h.ReadAt(dest, 0); err != nil {
+		t.Fatalf("ReadAt(0) failed: %v", err)
+	}
+	if _, err := h.ReadAt(dest, 0); err != nil {
+		t.Fatalf("ReadAt(0) (second read) failed: %v", err)
+	}
+	h.Close()
+
+	stats := store.Stats()
+	fs, ok := stats.Files["testfile.txt"]
+	if !ok {
+		t.Fatalf("Stats().Files has no entry for testfile.txt; got %+v", stats.Files)
+	}
+	if fs.BytesRead != 20 {
+		t.Errorf("BytesRead = %d, want 20", fs.BytesRead)
+	}
+	if stats.CacheHits+stats.CacheMisses == 0 {
+		t.Error("Stats() reported no cache hits or misses after two reads")
+	}
+}
+
+func TestFlushCache_DropsCachedChunks(t *testing.T) {
+	store, _, _ := newReadaheadTestStore(t)
+
+	file, err := store.GetFile("testfile.txt")
+	if err != nil {
+		t.Fatalf("GetFile() failed: %v", err)
+	}
+	if err := store.PrefetchFile("testfile.txt"); err != nil {
+		t.Fatalf("PrefetchFile() failed: %v", err)
+	}
+	for _, c := range file.Chunks {
+		if !store.prefetcher.cached(c.SHA256) {
+			t.Fatalf("chunk %s not cached after PrefetchFile()", c.SHA256)
+		}
+	}
+
+	store.FlushCache()
+
+	for _, c := range file.Chunks {
+		if store.prefetcher.cached(c.SHA256) {
+			t.Errorf("chunk %s still cached after FlushCache()", c.SHA256)
+		}
+	}
+}
+
+func TestReindex_PicksUpNewFile(t *testing.T) {
+	store, chunkDir, indexPath := newReadaheadTestStore(t)
+
+	if _, err := store.GetFile("newfile.txt"); err == nil {
+		t.Fatalf("GetFile(newfile.txt) unexpectedly succeeded before Reindex")
+	}
+
+	sha := createChunkFile(t, chunkDir, []byte("NEWFILENEW"))
+	filesData := []TestFileEntry{
+		{
+			Path:    "newfile.txt",
+			ModTime: time.Now().Format(time.RFC3339Nano),
+			Mode:    0644,
+			Chunks: []TestChunkInfo{
+				{SHA256: sha, Offset: 0},
+			},
+		},
+	}
+	indexJSON, err := json.MarshalIndent(filesData, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to marshal updated index data: %v", err)
+	}
+	if err := os.WriteFile(indexPath, indexJSON, 0644); err != nil {
+		t.Fatalf("Failed to write updated index file: %v", err)
+	}
+
+	if err := store.Reindex(indexPath); err != nil {
+		t.Fatalf("Reindex() failed: %v", err)
+	}
+
+	file, err := store.GetFile("newfile.txt")
+	if err != nil {
+		t.Fatalf("GetFile(newfile.txt) failed after Reindex: %v", err)
+	}
+	if file.Size != 10 {
+		t.Errorf("newfile.txt Size = %d, want 10", file.Size)
+	}
+	if _, err := store.GetFile("testfile.txt"); err == nil {
+		t.Error("testfile.txt still present after Reindex replaced the index")
+	}
+}
+
+func TestReindex_NonexistentIndexPathFailsWithoutClearingCurrentIndex(t *testing.T) {
+	store, _, _ := newReadaheadTestStore(t)
+
+	if err := store.Reindex(filepath.Join(t.TempDir(), "missing_index.json")); err == nil {
+		t.Fatal("Reindex() with a nonexistent index path unexpectedly succeeded")
+	}
+
+	if _, err := store.GetFile("testfile.txt"); err != nil {
+		t.Errorf("GetFile(testfile.txt) failed after a failed Reindex: %v", err)
+	}
+}
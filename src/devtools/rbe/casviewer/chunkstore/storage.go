@@ -3,8 +3,6 @@ package chunkstore
 import (
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 )
 
 // ReadFileToDest reads content from the virtual file specified by path, at a given offset,
@@ -14,33 +12,45 @@ func (cs *ChunkStore) ReadFileToDest(path string, dest []byte, offset int64) (in
 	if err != nil {
 		return 0, err
 	}
+	n, _, err := cs.readFileToDest(file, dest, offset, -1)
+	return n, err
+}
 
+// readFileToDest is ReadFileToDest's implementation, parameterized by how
+// many chunks beyond the read to prefetch (ahead < 0 means use
+// cs.prefetcher's configured default; see FileHandle.ReadAt, which instead
+// grows or shrinks ahead based on file's detected access pattern). It also
+// reports whether every chunk the read touched was already decoded and
+// cached, for FileHandle to track hit/miss statistics.
+func (cs *ChunkStore) readFileToDest(file *FileInfo, dest []byte, offset int64, ahead int) (int, bool, error) {
 	if offset < 0 {
-		return 0, fmt.Errorf("negative offset not allowed")
+		return 0, false, fmt.Errorf("negative offset not allowed")
 	}
 	if offset >= file.Size {
-		return 0, io.EOF // Reading at or past EOF
+		return 0, false, io.EOF // Reading at or past EOF
 	}
 
 	destLen := int64(len(dest))
 	bytesToReadOverall := min(destLen, file.Size-offset) // Don't read past EOF of virtual file.
 	if bytesToReadOverall <= 0 {
-		return 0, nil // Nothing to read (e.g. offset is exactly at EOF, or len(dest) is 0)
+		return 0, true, nil // Nothing to read (e.g. offset is exactly at EOF, or len(dest) is 0)
 	}
 
 	bytesActuallyCopiedToDest := 0
+	allCached := true
 	// Virtual read window in the file: [offset, offset + bytesToReadOverall)
 	virtualReadStart := offset
 	virtualReadEnd := offset + bytesToReadOverall
 
 	startIndex := cs.findChunkIndex(file.Chunks, virtualReadStart)
 	if startIndex == -1 {
-		return 0, fmt.Errorf("could not find chunk for offset: %v", virtualReadStart)
+		return 0, false, fmt.Errorf("could not find chunk for offset: %v", virtualReadStart)
 	}
 
 	// file.chunks are perfectly contiguous, without any gaps.
 	// offset is verified to be in the range of [0, file.Size), so startIndex can't be negative.
-	for i := startIndex; i < len(file.Chunks); i++ {
+	i := startIndex
+	for ; i < len(file.Chunks); i++ {
 		chunk := file.Chunks[i]
 		chunkVirtualStart := chunk.Offset
 		chunkVirtualEnd := chunk.Offset + int64(chunk.Length)
@@ -59,34 +69,43 @@ func (cs *ChunkStore) ReadFileToDest(path string, dest []byte, offset int64) (in
 		}
 
 		readPosInChunkFile := overlapStart - chunkVirtualStart
-		chunkFilePath := filepath.Join(cs.chunkDir, chunk.SHA256)
-		f, err := os.Open(chunkFilePath)
-		if err != nil {
-			return bytesActuallyCopiedToDest, fmt.Errorf("failed to open chunk %s: %w", chunk.SHA256, err)
-		}
 
-		_, err = f.Seek(readPosInChunkFile, io.SeekStart)
+		if !cs.prefetcher.cached(chunk.SHA256) {
+			allCached = false
+		}
+		// decoded is the chunk's full uncompressed payload, from
+		// cs.prefetcher's cache when a prior read or prefetch already
+		// decoded it, otherwise decoded fresh and cached for next time
+		// (see prefetcher.load).
+		decoded, err := cs.prefetcher.load(cs, chunk)
 		if err != nil {
-			f.Close()
-			return bytesActuallyCopiedToDest, fmt.Errorf("failed to seek in chunk %s to %d: %w", chunk.SHA256, readPosInChunkFile, err)
+			return bytesActuallyCopiedToDest, false, fmt.Errorf("failed to read chunk %s: %w", chunk.SHA256, err)
 		}
-
-		n, readErr := io.ReadFull(f, dest[bytesActuallyCopiedToDest:bytesActuallyCopiedToDest+int(lengthOfOverlap)])
-		f.Close()
-
-		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
-			// For io.ReadFull, an error means not all bytes were read.
-			return bytesActuallyCopiedToDest + n, fmt.Errorf("failed to read %d bytes from chunk %s: %w", lengthOfOverlap, chunk.SHA256, readErr)
+		if readPosInChunkFile > int64(len(decoded)) {
+			return bytesActuallyCopiedToDest, false, fmt.Errorf("read position %d beyond decoded chunk size %d for chunk %s", readPosInChunkFile, len(decoded), chunk.SHA256)
 		}
 
+		destSlice := dest[bytesActuallyCopiedToDest : bytesActuallyCopiedToDest+int(lengthOfOverlap)]
+		n := copy(destSlice, decoded[readPosInChunkFile:])
 		bytesActuallyCopiedToDest += n
 
 		if int64(bytesActuallyCopiedToDest) >= bytesToReadOverall {
+			i++ // So the prefetch below starts after the chunk we just read.
 			break
 		}
 	}
 
-	return bytesActuallyCopiedToDest, nil
+	// Proactively decode the chunks likely to be read next, for streaming
+	// reads over the FUSE mount; a no-op if cs.prefetcher is nil. ahead < 0
+	// uses cs.prefetcher's own configured default instead of an explicit count.
+	if ahead < 0 {
+		cs.prefetcher.prefetchAhead(cs, file.Chunks, i)
+	} else {
+		cs.prefetcher.prefetchAheadN(cs, file.Chunks, i, ahead)
+	}
+
+	cs.recordBytesRead(file.Path, int64(bytesActuallyCopiedToDest))
+	return bytesActuallyCopiedToDest, allCached, nil
 }
 
 func (cs *ChunkStore) findChunkIndex(chunks []ChunkInfo, offset int64) int {
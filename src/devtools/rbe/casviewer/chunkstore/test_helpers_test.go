@@ -1,15 +1,54 @@
 package chunkstore
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
 	// "time"
 )
 
+// fakeChunkSource is an in-memory ChunkSource, so tests can exercise
+// ChunkSource consumers (e.g. loadFileIndex, decodeChunk) without a real
+// chunkDir or network round trip.
+type fakeChunkSource struct {
+	chunks map[string][]byte
+}
+
+func newFakeChunkSource(chunks map[string][]byte) *fakeChunkSource {
+	return &fakeChunkSource{chunks: chunks}
+}
+
+// Stat implements ChunkSource.
+func (s *fakeChunkSource) Stat(sha256 string) (int64, error) {
+	data, ok := s.chunks[sha256]
+	if !ok {
+		return 0, fmt.Errorf("fake chunk source: chunk %s not found: %w", sha256, os.ErrNotExist)
+	}
+	return int64(len(data)), nil
+}
+
+// Fetch implements ChunkSource.
+func (s *fakeChunkSource) Fetch(sha256 string, offset, length int64) (io.ReadCloser, error) {
+	data, ok := s.chunks[sha256]
+	if !ok {
+		return nil, fmt.Errorf("fake chunk source: chunk %s not found: %w", sha256, os.ErrNotExist)
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
 // Helper to create a chunk file and return its SHA256 hash.
 func createChunkFile(t *testing.T, chunkDir string, content []byte) string {
 	t.Helper()
@@ -0,0 +1,90 @@
+package chunkstore
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ChecksumWildcard returns a single stable digest covering every file in the
+// store whose path matches the doublestar-style glob pattern (e.g.
+// "**/*.so"). Files are visited in sorted path order and fed into the digest
+// as "path\x00mode\x00size\x00chunkDigest\n", so the result is deterministic
+// across runs and independent of how chunks happen to be laid out on disk.
+// This lets a build system cheaply ask "did any .so under lib/ change?"
+// against a mounted CAS tree without reading file contents.
+//
+// followLinks is accepted so this mirrors the shape of
+// chunkerutil.ChunksIndexReader.ChecksumWildcard, but the store doesn't
+// currently record a symlink's target (see FileInfo), so a symlink entry is
+// always hashed as "path\x00LINK\x00\n" regardless of followLinks.
+func (cs *ChunkStore) ChecksumWildcard(pattern string, followLinks bool) (digest.Digest, error) {
+	matcher, err := globToRegexp(pattern)
+	if err != nil {
+		return digest.Digest{}, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+
+	var matched []FileInfo
+	for _, f := range cs.GetFiles() {
+		if matcher.MatchString(f.Path) {
+			matched = append(matched, f)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Path < matched[j].Path })
+
+	var buf bytes.Buffer
+	for _, f := range matched {
+		if f.Mode&fuseMode(syscall.S_IFMT) == fuseMode(fuse.S_IFLNK) {
+			fmt.Fprintf(&buf, "%s\x00LINK\x00\n", f.Path)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s\x00%d\x00%d\x00%s\n", f.Path, uint32(f.Mode), f.Size, chunkDigest(f.Chunks))
+	}
+	return digest.NewFromBlob(buf.Bytes()), nil
+}
+
+// chunkDigest returns a string that changes iff the chunks backing a file
+// change, regardless of where those chunks happen to live on disk.
+func chunkDigest(chunks []ChunkInfo) string {
+	parts := make([]string, len(chunks))
+	for i, c := range chunks {
+		parts[i] = c.SHA256
+	}
+	return strings.Join(parts, ",")
+}
+
+// globToRegexp compiles a doublestar-style glob pattern ("*" matches within a
+// path segment, "**" matches zero or more segments, "?" matches a single
+// character) into a regexp anchored to the whole string. This is a minimal
+// subset sufficient for ChecksumWildcard.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteByte('^')
+	for i := 0; i < len(pattern); {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString(`(?:.*/)?`)
+			i += 3
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(`.*`)
+			i += 2
+		case pattern[i] == '*':
+			b.WriteString(`[^/]*`)
+			i++
+		case pattern[i] == '?':
+			b.WriteString(`[^/]`)
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			i++
+		}
+	}
+	b.WriteByte('$')
+	return regexp.Compile(b.String())
+}
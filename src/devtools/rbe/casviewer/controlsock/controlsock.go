@@ -0,0 +1,174 @@
+// Package controlsock serves casviewer's --control-socket JSON-line
+// protocol: "stats", "flush", "prefetch", "reindex", "lookup", "commit",
+// and "snapshot", for introspecting and managing a mounted ChunkStore's
+// chunk cache, or pushing a --rw mount's edits to CAS or to a local
+// chunkDir, without unmounting it. This mirrors the runtime control
+// surfaces rclone's mount and stargz-snapshotter expose for long-running
+// test infrastructure.
+package controlsock
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/fuse"
+)
+
+// Request is one JSON-line command read from a control-socket connection:
+// {"cmd":"stats"}, {"cmd":"flush"}, {"cmd":"prefetch","path":"a/b"},
+// {"cmd":"reindex"} / {"cmd":"reindex","path":"/new/index.json"} (path
+// defaults to the index file the mount was started with),
+// {"cmd":"lookup","digest":"abcd"} (see chunkstore.LookupFileByDigestPrefix),
+// {"cmd":"commit"} (see fuse.FastCDCFS.Commit; only valid on a --rw mount
+// started with -cas-instance), or {"cmd":"snapshot","path":"/new/dir"} (see
+// fuse.FastCDCFS.Snapshot; only valid on a --rw mount).
+type Request struct {
+	Cmd    string `json:"cmd"`
+	Path   string `json:"path,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// Response is one JSON-line reply to a Request.
+type Response struct {
+	OK     bool              `json:"ok"`
+	Error  string            `json:"error,omitempty"`
+	Stats  *chunkstore.Stats `json:"stats,omitempty"`
+	Digest string            `json:"digest,omitempty"` // "hash/size", for "commit".
+	Files  []string          `json:"files,omitempty"`  // matching file paths, for "lookup".
+}
+
+// Server serves the --control-socket protocol against a single mounted
+// ChunkStore.
+type Server struct {
+	store        *chunkstore.ChunkStore
+	defaultIndex string
+	// fs and client are both nil unless the mount was started with --rw
+	// and -cas-instance, in which case they serve the "commit" command.
+	fs     *fuse.FastCDCFS
+	client *client.Client
+	ln     net.Listener
+}
+
+// Listen creates a Server listening on a Unix domain socket at socketPath,
+// removing any stale socket file a prior crash left behind. defaultIndex is
+// the index JSON file a "reindex" command without its own "path" falls
+// back to. fs and c enable the "commit" command; either may be nil, in
+// which case "commit" reports an error instead of running.
+func Listen(socketPath string, store *chunkstore.ChunkStore, defaultIndex string, fs *fuse.FastCDCFS, c *client.Client) (*Server, error) {
+	if err := os.RemoveAll(socketPath); err != nil {
+		return nil, fmt.Errorf("failed to remove stale control socket %s: %w", socketPath, err)
+	}
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket %s: %w", socketPath, err)
+	}
+	return &Server{store: store, defaultIndex: defaultIndex, fs: fs, client: c, ln: ln}, nil
+}
+
+// Serve accepts connections until Close is called, handling each on its own
+// goroutine. It always returns a non-nil error (net.ErrClosed after Close).
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting new connections and unblocks Serve.
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+// handle serves every request on one connection, one JSON line in and one
+// JSON line out, until the client disconnects or sends invalid JSON.
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			enc.Encode(Response{OK: false, Error: fmt.Sprintf("invalid request: %v", err)})
+			continue
+		}
+		if err := enc.Encode(s.dispatch(req)); err != nil {
+			return
+		}
+	}
+}
+
+// dispatch runs one Request against s.store and returns its Response.
+func (s *Server) dispatch(req Request) Response {
+	switch req.Cmd {
+	case "stats":
+		stats := s.store.Stats()
+		return Response{OK: true, Stats: &stats}
+
+	case "flush":
+		s.store.FlushCache()
+		return Response{OK: true}
+
+	case "prefetch":
+		if req.Path == "" {
+			return Response{OK: false, Error: `"prefetch" requires "path"`}
+		}
+		if err := s.store.PrefetchFile(req.Path); err != nil {
+			return Response{OK: false, Error: err.Error()}
+		}
+		return Response{OK: true}
+
+	case "reindex":
+		path := req.Path
+		if path == "" {
+			path = s.defaultIndex
+		}
+		if err := s.store.Reindex(path); err != nil {
+			return Response{OK: false, Error: err.Error()}
+		}
+		return Response{OK: true}
+
+	case "lookup":
+		if req.Digest == "" {
+			return Response{OK: false, Error: `"lookup" requires "digest"`}
+		}
+		files, err := s.store.LookupFileByDigestPrefix(req.Digest)
+		if err != nil {
+			return Response{OK: false, Error: err.Error()}
+		}
+		return Response{OK: true, Files: files}
+
+	case "commit":
+		if s.fs == nil || s.client == nil {
+			return Response{OK: false, Error: `"commit" requires the mount to have been started with --rw and -cas-instance`}
+		}
+		root, err := s.fs.Commit(context.Background(), s.client)
+		if err != nil {
+			return Response{OK: false, Error: err.Error()}
+		}
+		return Response{OK: true, Digest: fmt.Sprintf("%s/%d", root.Hash, root.Size)}
+
+	case "snapshot":
+		if s.fs == nil {
+			return Response{OK: false, Error: `"snapshot" requires the mount to have been started with --rw`}
+		}
+		if req.Path == "" {
+			return Response{OK: false, Error: `"snapshot" requires "path"`}
+		}
+		if err := s.fs.Snapshot(req.Path); err != nil {
+			return Response{OK: false, Error: err.Error()}
+		}
+		return Response{OK: true}
+
+	default:
+		return Response{OK: false, Error: fmt.Sprintf("unknown cmd %q", req.Cmd)}
+	}
+}
@@ -0,0 +1,168 @@
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/uploadinfo"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/overlay"
+	"google.golang.org/protobuf/proto"
+)
+
+// Commit uploads the mount's current state — the base ChunkStore layered
+// with every add, modification, and deletion the overlay has recorded
+// since the mount — as a new CAS directory tree, and returns its root
+// digest. Unlike the FastCDC chunking overlay.Write uses to keep reads
+// through the mount efficient, Commit uploads each file as a single
+// whole-file blob: CAS already dedups at the blob level, so there's no
+// benefit to re-chunking a file here, only the cost of reassembling
+// chunks Write already wrote out as a contiguous scratch file. Commit
+// requires a writable mount (see NewFastCDCFSWithOverlay).
+func (f *FastCDCFS) Commit(ctx context.Context, c *client.Client) (digest.Digest, error) {
+	if f.overlay == nil {
+		return digest.Digest{}, fmt.Errorf("FastCDCFS.Commit: mount is read-only")
+	}
+
+	delta := f.overlay.DeltaIndex()
+	deleted := make(map[string]bool, len(delta.Deleted))
+	for _, path := range delta.Deleted {
+		deleted[path] = true
+	}
+	live := make(map[string]bool)
+	for _, file := range f.store.GetFiles() {
+		if !deleted[file.Path] {
+			live[file.Path] = true
+		}
+	}
+	for _, e := range delta.Added {
+		live[e.Path] = true
+	}
+	for _, e := range delta.Modified {
+		live[e.Path] = true
+	}
+
+	dirs := map[string]*repb.Directory{"": {}}
+	nodes := map[string]*repb.DirectoryNode{}
+	var ensureDir func(path string) *repb.Directory
+	ensureDir = func(path string) *repb.Directory {
+		if d, ok := dirs[path]; ok {
+			return d
+		}
+		d := &repb.Directory{}
+		dirs[path] = d
+		parentPath, name := splitVirtualPath(path)
+		parent := ensureDir(parentPath)
+		node := &repb.DirectoryNode{Name: name}
+		parent.Directories = append(parent.Directories, node)
+		nodes[path] = node
+		return d
+	}
+
+	paths := make([]string, 0, len(live))
+	for path := range live {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var blobs []*uploadinfo.Entry
+	for _, path := range paths {
+		entry, err := f.overlay.Stat(path)
+		if err != nil {
+			return digest.Digest{}, fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		data, err := readFullFile(f.overlay, path, entry.Size)
+		if err != nil {
+			return digest.Digest{}, err
+		}
+		dg := digest.NewFromBlob(data)
+		dirPath, name := splitVirtualPath(path)
+		d := ensureDir(dirPath)
+		d.Files = append(d.Files, &repb.FileNode{
+			Name:         name,
+			Digest:       dg.ToProto(),
+			IsExecutable: entry.Mode.Perm()&0100 != 0,
+		})
+		blobs = append(blobs, &uploadinfo.Entry{Digest: dg, Contents: data})
+	}
+
+	dirPaths := make([]string, 0, len(dirs))
+	for path := range dirs {
+		dirPaths = append(dirPaths, path)
+	}
+	// Deepest directories first, so every DirectoryNode's Digest is known
+	// by the time its parent is marshaled.
+	sort.Slice(dirPaths, func(i, j int) bool { return virtualDepth(dirPaths[i]) > virtualDepth(dirPaths[j]) })
+
+	var root digest.Digest
+	for _, path := range dirPaths {
+		data, err := proto.Marshal(dirs[path])
+		if err != nil {
+			return digest.Digest{}, fmt.Errorf("failed to marshal directory %q: %w", path, err)
+		}
+		dg := digest.NewFromBlob(data)
+		blobs = append(blobs, &uploadinfo.Entry{Digest: dg, Contents: data})
+		if path == "" {
+			root = dg
+		} else {
+			nodes[path].Digest = dg.ToProto()
+		}
+	}
+
+	if _, _, err := c.UploadIfMissing(ctx, blobs...); err != nil {
+		return digest.Digest{}, fmt.Errorf("failed to upload committed tree: %w", err)
+	}
+	return root, nil
+}
+
+// Snapshot merges the mount's current state into a fresh, self-contained
+// chunkDir at dir (see overlay.Overlay.Snapshot), so it can be remounted
+// standalone with no dependency on this mount's base ChunkStore or overlay
+// dir. Unlike Commit, it needs no CAS client: the result is a local
+// directory, not an uploaded tree. Snapshot requires a writable mount (see
+// NewFastCDCFSWithOverlay).
+func (f *FastCDCFS) Snapshot(dir string) error {
+	if f.overlay == nil {
+		return fmt.Errorf("FastCDCFS.Snapshot: mount is read-only")
+	}
+	return f.overlay.Snapshot(dir)
+}
+
+// readFullFile reads path's entire content (size bytes) through ov, which
+// falls back to the base ChunkStore for paths the overlay hasn't touched
+// (see overlay.Overlay.Read).
+func readFullFile(ov *overlay.Overlay, path string, size int64) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	n, err := ov.Read(path, buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return buf[:n], nil
+}
+
+// splitVirtualPath splits a virtual path into its parent directory ("" for
+// a root-level path) and base name; the inverse of joinVirtualPath.
+func splitVirtualPath(path string) (dir, name string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+// virtualDepth returns how many path components deep a virtual directory
+// path is, with the mount root ("") at depth 0.
+func virtualDepth(path string) int {
+	if path == "" {
+		return 0
+	}
+	return strings.Count(path, "/") + 1
+}
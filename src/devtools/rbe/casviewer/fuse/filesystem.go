@@ -14,22 +14,39 @@ import (
 	"google3/third_party/golang/gofuse/fuse/fuse"
 
 	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/overlay"
 )
 
 // FastCDCFS represents a FUSE filesystem for FastCDC.
 type FastCDCFS struct {
 	fs.Inode
-	store     *chunkstore.ChunkStore
+	store *chunkstore.ChunkStore
+	// overlay captures writes, creates, truncates, and deletes when the
+	// filesystem is mounted with NewFastCDCFSWithOverlay; nil means the
+	// mount is read-only (see NewFastCDCFS).
+	overlay   *overlay.Overlay
 	mountTime time.Time // Store the mount time for consistent timestamps
 }
 
 // Ensure FastCDCFS itself implements NodeGetattrer for the root directory attributes
 var _ = (fs.NodeGetattrer)((*FastCDCFS)(nil))
+var _ = (fs.NodeCreater)((*FastCDCFS)(nil))
+var _ = (fs.NodeUnlinker)((*FastCDCFS)(nil))
+var _ = (fs.NodeRenamer)((*FastCDCFS)(nil))
 
-// NewFastCDCFS creates a new FastCDCFS.
+// NewFastCDCFS creates a new, read-only FastCDCFS: writes are rejected
+// with EROFS (see NewFastCDCFSWithOverlay for a writable mount).
 func NewFastCDCFS(store *chunkstore.ChunkStore) *FastCDCFS {
+	return NewFastCDCFSWithOverlay(store, nil)
+}
+
+// NewFastCDCFSWithOverlay is like NewFastCDCFS, but makes the mount
+// writable: writes, creates, truncates, and deletes against it are
+// captured by ov (see overlay.Overlay) instead of being rejected.
+func NewFastCDCFSWithOverlay(store *chunkstore.ChunkStore, ov *overlay.Overlay) *FastCDCFS {
 	return &FastCDCFS{
 		store:     store,
+		overlay:   ov,
 		mountTime: time.Now(), // Set mount time when the FS is created
 	}
 }
@@ -50,6 +67,33 @@ func (f *FastCDCFS) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.Att
 	return 0
 }
 
+// Create adds a new, empty file called name to the mount's root directory;
+// see overlayCreate.
+func (f *FastCDCFS) Create(ctx context.Context, name string, flags, mode uint32) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	return overlayCreate(ctx, &f.Inode, f.overlay, f.store, "", name, mode)
+}
+
+// Unlink removes name from the mount's root directory; see overlayUnlink.
+func (f *FastCDCFS) Unlink(ctx context.Context, name string) syscall.Errno {
+	return overlayUnlink(f.overlay, "", name)
+}
+
+// Rename moves name out of the mount's root directory; see overlayRename.
+func (f *FastCDCFS) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	return overlayRename(&f.Inode, f.overlay, "", name, newParent, newName)
+}
+
+// WriteDeltaIndex writes the overlay's delta index (see
+// overlay.Overlay.WriteDeltaIndex), describing files added, modified, or
+// deleted since the mount, meant to be called on unmount. It's a no-op for
+// a read-only mount (see NewFastCDCFS).
+func (f *FastCDCFS) WriteDeltaIndex() error {
+	if f.overlay == nil {
+		return nil
+	}
+	return f.overlay.WriteDeltaIndex()
+}
+
 // Mount creates a new FUSE server for the FastCDCFS filesystem.
 func (f *FastCDCFS) Mount(mountPoint string) (*fuse.Server, error) {
 	attrTimeout := time.Second
@@ -77,6 +121,16 @@ func splitPath(path string) []string {
 	return strings.Split(cleaned, string(filepath.Separator))
 }
 
+// joinVirtualPath joins a virtual directory path (as stored in
+// chunkstore.FileInfo.Path and overlay.Entry.Path, "" for the mount root)
+// with a single path component.
+func joinVirtualPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
 // OnAdd is called when the filesystem is mounted.
 func (f *FastCDCFS) OnAdd(ctx context.Context) {
 	// Build the directory structure from the store
@@ -84,6 +138,7 @@ func (f *FastCDCFS) OnAdd(ctx context.Context) {
 		// The `file.Path` from store is the full path within the virtual FS.
 		components := splitPath(file.Path)
 		parent := &f.Inode // This is the root Inode of FastCDCFS.
+		dirPath := ""
 		name := ""
 
 		// Traverse or create parent directories
@@ -97,17 +152,20 @@ func (f *FastCDCFS) OnAdd(ctx context.Context) {
 				break // Parent is found
 			}
 
+			childDirPath := joinVirtualPath(dirPath, component)
 			child := parent.GetChild(component)
 			if child == nil {
+				dirNode := &FastCDCDir{store: f.store, overlay: f.overlay, path: childDirPath}
 				childInode := parent.NewPersistentInode(
 					ctx,
-					&fs.Inode{}, // Generic inode for a directory
+					dirNode,
 					fs.StableAttr{Mode: fuse.S_IFDIR},
 				)
 				parent.AddChild(component, childInode, false)
 				child = childInode
 			}
 			parent = child
+			dirPath = childDirPath
 		}
 
 		// Skip root-like paths
@@ -122,8 +180,9 @@ func (f *FastCDCFS) OnAdd(ctx context.Context) {
 
 		// Create file inode
 		fileNode := &FastCDCFile{
-			store: f.store,
-			path:  file.Path,
+			store:   f.store,
+			overlay: f.overlay,
+			path:    file.Path,
 		}
 
 		// The StableAttr here is for the *file node*, its Getattr will provide full details.
@@ -136,19 +195,132 @@ func (f *FastCDCFS) OnAdd(ctx context.Context) {
 	}
 }
 
+// FastCDCDir represents a directory other than the mount root. Read-only
+// mounts could use a bare *fs.Inode here (as OnAdd once did), but a
+// writable mount (see overlay.Overlay) needs Create and Unlink to reach
+// the store and overlay, so every directory is one of these.
+type FastCDCDir struct {
+	fs.Inode
+	store   *chunkstore.ChunkStore
+	overlay *overlay.Overlay
+	path    string // This directory's virtual path, e.g. "a/b".
+}
+
+var _ = (fs.NodeCreater)((*FastCDCDir)(nil))
+var _ = (fs.NodeUnlinker)((*FastCDCDir)(nil))
+var _ = (fs.NodeRenamer)((*FastCDCDir)(nil))
+
+// Create adds a new, empty file called name to this directory; see overlayCreate.
+func (d *FastCDCDir) Create(ctx context.Context, name string, flags, mode uint32) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	return overlayCreate(ctx, &d.Inode, d.overlay, d.store, d.path, name, mode)
+}
+
+// Unlink removes name from this directory; see overlayUnlink.
+func (d *FastCDCDir) Unlink(ctx context.Context, name string) syscall.Errno {
+	return overlayUnlink(d.overlay, d.path, name)
+}
+
+// Rename moves name out of this directory; see overlayRename.
+func (d *FastCDCDir) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	return overlayRename(&d.Inode, d.overlay, d.path, name, newParent, newName)
+}
+
+// overlayCreate implements NodeCreater for a directory at dirPath (see
+// FastCDCFS.Create and FastCDCDir.Create): it adds name to ov as an empty
+// file and gives it a FastCDCFile inode under parent. It fails with EROFS
+// when ov is nil, i.e. the mount isn't writable.
+func overlayCreate(ctx context.Context, parent *fs.Inode, ov *overlay.Overlay, store *chunkstore.ChunkStore, dirPath, name string, mode uint32) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if ov == nil {
+		return nil, nil, 0, syscall.EROFS
+	}
+	path := joinVirtualPath(dirPath, name)
+	if err := ov.Create(path, os.FileMode(mode)&os.ModePerm); err != nil {
+		return nil, nil, 0, syscall.EIO
+	}
+
+	fileNode := &FastCDCFile{store: store, overlay: ov, path: path}
+	childInode := parent.NewPersistentInode(ctx, fileNode, fs.StableAttr{Mode: fuse.S_IFREG})
+	parent.AddChild(name, childInode, true)
+	return childInode, nil, 0, 0
+}
+
+// overlayUnlink implements NodeUnlinker for a directory at dirPath (see
+// FastCDCFS.Unlink and FastCDCDir.Unlink): it marks name as deleted in ov.
+// It fails with EROFS when ov is nil, i.e. the mount isn't writable.
+func overlayUnlink(ov *overlay.Overlay, dirPath, name string) syscall.Errno {
+	if ov == nil {
+		return syscall.EROFS
+	}
+	ov.Delete(joinVirtualPath(dirPath, name))
+	return 0
+}
+
+// dirPathOf returns the virtual directory path of a Rename's newParent,
+// i.e. what FastCDCDir.path or FastCDCFS's "" would be for that node.
+func dirPathOf(parent fs.InodeEmbedder) string {
+	switch p := parent.(type) {
+	case *FastCDCDir:
+		return p.path
+	default:
+		return ""
+	}
+}
+
+// overlayRename implements NodeRenamer for a directory at dirPath (see
+// FastCDCFS.Rename and FastCDCDir.Rename): it moves name to newName under
+// newParent in ov, then moves the cached child Inode to match. It fails
+// with EROFS when ov is nil, i.e. the mount isn't writable.
+func overlayRename(parentInode *fs.Inode, ov *overlay.Overlay, dirPath, name string, newParent fs.InodeEmbedder, newName string) syscall.Errno {
+	if ov == nil {
+		return syscall.EROFS
+	}
+	oldPath := joinVirtualPath(dirPath, name)
+	newPath := joinVirtualPath(dirPathOf(newParent), newName)
+	if err := ov.Rename(oldPath, newPath); err != nil {
+		return syscall.EIO
+	}
+	if !parentInode.MvChild(name, newParent.EmbeddedInode(), newName, true) {
+		return syscall.EIO
+	}
+	return 0
+}
+
 // FastCDCFile represents a file in the FastCDCFS filesystem.
 type FastCDCFile struct {
 	fs.Inode
 	store *chunkstore.ChunkStore
-	path  string
+	// overlay, if non-nil, makes this file writable (see
+	// NewFastCDCFSWithOverlay); reads and attributes are then served
+	// through it instead of store directly, since it may have a
+	// copy-on-write view of this file's content.
+	overlay *overlay.Overlay
+	path    string
 }
 
 var _ = (fs.NodeOpener)((*FastCDCFile)(nil))
 var _ = (fs.NodeGetattrer)((*FastCDCFile)(nil))
 var _ = (fs.NodeReader)((*FastCDCFile)(nil))
+var _ = (fs.NodeWriter)((*FastCDCFile)(nil))
+var _ = (fs.NodeSetattrer)((*FastCDCFile)(nil))
+var _ = (fs.NodeFsyncer)((*FastCDCFile)(nil))
 
 // Getattr for a file node
 func (f *FastCDCFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if f.overlay != nil {
+		entry, err := f.overlay.Stat(f.path)
+		if err != nil {
+			return syscall.ENOENT
+		}
+		out.Mode = uint32(entry.Mode) | fuse.S_IFREG
+		out.Size = uint64(entry.Size)
+		out.Mtime = uint64(entry.ModTime.Unix())
+		out.Atime = out.Mtime
+		out.Ctime = out.Mtime
+		out.Uid = uint32(os.Getuid())
+		out.Gid = uint32(os.Getgid())
+		return 0
+	}
+
 	file, err := f.store.GetFile(f.path)
 	if err != nil {
 		return syscall.ENOENT
@@ -164,13 +336,43 @@ func (f *FastCDCFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.A
 	return 0
 }
 
-// Open for a file node
+// Setattr handles truncation (the only attribute change this filesystem
+// supports setting); other requested changes (e.g. chmod) are silently
+// accepted without being applied, matching Open/Write's EROFS-on-read-only
+// behavior of rejecting only what it can't honor.
+func (f *FastCDCFile) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if in.Valid&fuse.FATTR_SIZE != 0 {
+		if f.overlay == nil {
+			return syscall.EROFS
+		}
+		if err := f.overlay.Truncate(f.path, int64(in.Size)); err != nil {
+			return syscall.EIO
+		}
+	}
+	return f.Getattr(ctx, fh, out)
+}
+
+var _ = (fs.NodeReleaser)((*FastCDCFile)(nil))
+
+// Open for a file node. A read-only open returns a *chunkstore.FileHandle
+// as its FileHandle so Read can track this open's access pattern (see
+// chunkstore.FileHandle.ReadAt) instead of always prefetching the store's
+// fixed default window; Release folds its statistics into the store.
 func (f *FastCDCFile) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	// Only allow read access
 	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC) != 0 {
-		return nil, 0, syscall.EROFS
+		if f.overlay == nil {
+			return nil, 0, syscall.EROFS
+		}
+		return nil, 0, 0
 	}
-	return nil, fuse.FOPEN_KEEP_CACHE, 0 // Beneficial for read-only.
+	if f.overlay != nil {
+		return nil, fuse.FOPEN_KEEP_CACHE, 0
+	}
+	h, err := f.store.OpenFile(f.path)
+	if err != nil {
+		return nil, 0, syscall.ENOENT
+	}
+	return h, fuse.FOPEN_KEEP_CACHE, 0 // Beneficial for read-only.
 }
 
 // Read for a file node
@@ -178,9 +380,50 @@ func (f *FastCDCFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, o
 	if len(dest) == 0 {
 		return fuse.ReadResultData(nil), 0
 	}
-	n, err := f.store.ReadFileToDest(f.path, dest, off)
+	var n int
+	var err error
+	if f.overlay != nil {
+		n, err = f.overlay.Read(f.path, dest, off)
+	} else if h, ok := fh.(*chunkstore.FileHandle); ok {
+		n, err = h.ReadAt(dest, off)
+	} else {
+		n, err = f.store.ReadFileToDest(f.path, dest, off)
+	}
 	if err != nil && err != io.EOF {
 		return nil, syscall.EIO
 	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
+
+// Release closes the chunkstore.FileHandle Open created for a read-only
+// open, folding its access-pattern statistics into the store (see
+// chunkstore.ChunkStore.PrefetchStats).
+func (f *FastCDCFile) Release(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	if h, ok := fh.(*chunkstore.FileHandle); ok {
+		h.Close()
+	}
+	return 0
+}
+
+// Write for a file node; only reachable when overlay is non-nil, since
+// Open already rejects write flags with EROFS otherwise.
+func (f *FastCDCFile) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	if f.overlay == nil {
+		return 0, syscall.EROFS
+	}
+	n, err := f.overlay.Write(f.path, data, off)
+	if err != nil {
+		return uint32(n), syscall.EIO
+	}
+	return uint32(n), 0
+}
+
+// Fsync is a no-op: overlay.Write and overlay.Truncate already write
+// through to the overlay's scratch file synchronously on every call, so
+// there's nothing buffered here for Fsync to flush.
+func (f *FastCDCFile) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) syscall.Errno {
+	if f.overlay == nil {
+		return syscall.EROFS
+	}
+	return 0
+}
@@ -2,18 +2,30 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"flag"
-	
+
+	"net/http"
+
 	log "github.com/golang/glog"
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/client"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/metrics"
 	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore/health"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/controlsock"
 	"github.com/google/device-infra/src/devtools/rbe/casviewer/fuse"
 	"github.com/google/device-infra/src/devtools/rbe/casviewer/mountutil"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/overlay"
+	"github.com/google/device-infra/src/devtools/rbe/rbeclient"
 )
 
 const (
@@ -21,19 +33,145 @@ const (
 )
 
 var (
-	printVersion = flag.Bool("version", false, "Print version information")
-	indexPath    = flag.String("index", "", "Path to index JSON file (required)")
-	chunkDir     = flag.String("chunks", "", "Directory containing chunk files")
-	mountPoint   = flag.String("mount", "", "Mount point (required)")
-	logDir       = flag.String("log-dir", "", "Log directory path")
+	printVersion       = flag.Bool("version", false, "Print version information")
+	indexPath          = flag.String("index", "", "Path to index JSON file (required)")
+	chunkDir           = flag.String("chunks", "", "Directory containing chunk files")
+	mountPoint         = flag.String("mount", "", "Mount point (required)")
+	logDir             = flag.String("log-dir", "", "Log directory path")
+	verify             = flag.String("verify", chunkstore.VerifyLazy, "How aggressively to check chunk content against its recorded SHA256: \"none\", \"lazy\" (once per chunk), or \"strict\" (every read)")
+	rw                 = flag.Bool("rw", false, "Mount writable instead of read-only; requires --overlay")
+	overlayDir         = flag.String("overlay", "", "Scratch directory for writes when --rw is set; see overlay.Overlay")
+	overlayChunkSizeKb = flag.Int("overlay-chunk-size", 1024, "Average chunk size in KiB used to re-chunk files written through --overlay")
+
+	remoteSource   = flag.String("remote-source", "", "Fetch chunks not present under --chunks from a remote source instead of requiring every chunk locally: \"rbe\" (see -cas-instance/-cas-addr), an http(s):// base URL (see chunkstore.HTTPChunkSource), or another local directory (see chunkstore.LocalChunkSource), e.g. a second --chunks-style tree mounted read-only from elsewhere")
+	casInstance    = flag.String("cas-instance", "", "RBE instance; required when -remote-source=rbe, and enables the control socket's \"commit\" command when --rw is also set")
+	casAddr        = flag.String("cas-addr", "remotebuildexecution.googleapis.com:443", "RBE server address, when -remote-source=rbe or -cas-instance is set")
+	serviceAccount = flag.String("service-account-json", "", "Path to JSON file with service account credentials to use, when -remote-source=rbe or -cas-instance is set")
+	useADC         = flag.Bool("use-adc", false, "True to use Application Default Credentials (ADC), when -remote-source=rbe or -cas-instance is set")
+	cacheSize      = flag.String("cache-size", "0", "Size budget for the on-disk cache of chunks fetched via -remote-source, e.g. \"10GiB\"; 0 disables the on-disk cache, re-fetching remotely on every read")
+	cacheDir       = flag.String("cache-dir", "", "Directory for the on-disk chunk cache; required when -remote-source and -cache-size > 0 are both set")
+
+	prefetchWindow      = flag.Int("prefetch-window", chunkstore.DefaultOptions().PrefetchAhead, "Largest read-ahead window, in chunks, a sequential or strided read pattern on one open file handle can grow to")
+	prefetchMaxInflight = flag.Int("prefetch-max-inflight", chunkstore.DefaultOptions().PrefetchWorkers, "Maximum number of chunk prefetches running concurrently")
+	prefetchHints       = flag.String("prefetch-hints", "", "Path to a landmark file of \"path\\toffset\\tlength\" triples to eagerly prefetch at mount time (see chunkstore.ParseHints)")
+
+	controlSocket = flag.String("control-socket", "", "Path to a Unix domain socket serving a JSON-line runtime control protocol (stats, flush, prefetch, reindex); disabled if unset (see controlsock.Server)")
+
+	allowSymlinks = flag.Bool("allow-symlinks", false, "Allow index entries that are symlinks; rejected by default since this package's FUSE layer doesn't resolve a symlink's target against the virtual root (see chunkstore.Options.AllowSymlinks)")
+	maxPathDepth  = flag.Int("max-path-depth", 0, "Reject index entries whose path has more than this many slash-separated components; 0 means unbounded (see chunkstore.Options.MaxPathDepth)")
+	maxPathBytes  = flag.Int("max-path-bytes", 0, "Reject index entries whose cleaned path is longer than this many bytes; 0 means unbounded (see chunkstore.Options.MaxPathBytes)")
+
+	healthAddr           = flag.String("health-addr", "", "Address (e.g. \":8080\") to serve a JSON health-check report on, for an external watchdog to poll; disabled if unset (see chunkstore/health.Registry)")
+	healthSampleSize     = flag.Int("health-sample-size", 16, "Number of files to sample-read per health check (see health.ChunkSamplingChecker)")
+	healthCheckInterval  = flag.Duration("health-check-interval", 30*time.Second, "How often background health checks re-run between requests to -health-addr (see health.Registry.RegisterPeriodic)")
+	healthMaxVerifyFails = flag.Int64("health-max-verify-failures", 0, "Chunk verification failures allowed before the health check reports unhealthy (see health.ReadErrorRateChecker)")
 )
 
+// multiStringFlag is a slice of strings for parsing command flags into a string list.
+type multiStringFlag []string
+
+func (f *multiStringFlag) String() string {
+	return fmt.Sprintf("%v", *f)
+}
+
+func (f *multiStringFlag) Set(val string) error {
+	*f = append(*f, val)
+	return nil
+}
+
+func (f *multiStringFlag) Get() any {
+	return []string(*f)
+}
+
+// parseSize parses a human-readable byte size such as "50GiB" or "100MB"
+// (binary units take precedence when both a binary and decimal unit could
+// apply, e.g. plain "GB" is treated as GiB) or a bare number of bytes.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"GiB", 1 << 30}, {"GB", 1 << 30},
+		{"MiB", 1 << 20}, {"MB", 1 << 20},
+		{"KiB", 1 << 10}, {"KB", 1 << 10},
+		{"B", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, u.suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid size %q: %v", s, err)
+			}
+			return int64(n * float64(u.factor)), nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	return n, nil
+}
+
+// runGC parses the "gc" subcommand's own flags from args and runs
+// chunkstore.GC against them (see GCOptions). It's a separate flag.FlagSet
+// from the top-level mount flags since the two subcommands have
+// essentially disjoint flag sets.
+func runGC(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	gcChunkDir := fs.String("chunks", "", "Directory containing chunk files (required)")
+	maxBytes := fs.String("chunkstore-max-bytes", "0", "Size budget for unreferenced chunks left under --chunks, e.g. \"50GiB\"; 0 evicts every unreferenced chunk")
+	dryRun := fs.Bool("dry-run", false, "Report reclaimable bytes without deleting anything")
+	accessLog := fs.String("access-log", "", "Path to the sidecar access log written by ChunkStore.EnableAccessLog, used for LRU ordering instead of chunk file mtimes")
+	dumpMetrics := fs.String("dump-metrics", "", "If set, dump GC metrics (EvictedEntries/EvictedBytes) as JSON to this path")
+	var roots multiStringFlag
+	fs.Var(&roots, "root", "Directory whose chunks index marks chunks as still referenced (repeatable); at least one is required")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *gcChunkDir == "" {
+		return errors.New("gc: --chunks must be specified")
+	}
+	if len(roots) == 0 {
+		return errors.New("gc: at least one --root must be specified")
+	}
+	maxBytesVal, err := parseSize(*maxBytes)
+	if err != nil {
+		return fmt.Errorf("gc: %v", err)
+	}
+
+	result, err := chunkstore.GC(*gcChunkDir, chunkstore.GCOptions{
+		RootDirs:      roots,
+		MaxBytes:      maxBytesVal,
+		AccessLogPath: *accessLog,
+		DryRun:        *dryRun,
+	})
+	if err != nil {
+		return fmt.Errorf("gc: %v", err)
+	}
+
+	verb := "Evicted"
+	if *dryRun {
+		verb = "Would evict"
+	}
+	log.Infof("%s %d of %d unreferenced chunks (%d bytes of %d); %d live chunks left untouched",
+		verb, result.EvictedChunks, result.UnreferencedChunks, result.EvictedBytes, result.UnreferencedBytes, result.LiveChunks)
+
+	if *dumpMetrics != "" {
+		m := &metrics.Metrics{EvictedEntries: result.EvictedChunks, EvictedBytes: result.EvictedBytes}
+		if err := m.Dump(*dumpMetrics); err != nil {
+			return fmt.Errorf("gc: failed to dump metrics: %v", err)
+		}
+	}
+	return nil
+}
+
 func checkFlags() error {
-	if *chunkDir == "" {
-		return errors.New("Chunk dir must be specified with --chunks")
+	if *chunkDir == "" && *remoteSource == "" {
+		return errors.New("Chunk dir must be specified with --chunks, unless --remote-source is set")
 	}
 
-	if *indexPath == "" {
+	if *indexPath == "" && *chunkDir != "" {
 		defaultIndexPath, err := mountutil.DefaultIndexFile(*chunkDir)
 		if err != nil {
 			return err
@@ -44,11 +182,91 @@ func checkFlags() error {
 		*indexPath = defaultIndexPath
 		log.Infof("Use default index file: %v", *indexPath)
 	}
+	if *indexPath == "" {
+		return errors.New("Index file must be specified with --index")
+	}
 
 	if err := mountutil.ValidateMountPoint(*mountPoint); err != nil {
 		return err
 	}
 
+	if *verify != chunkstore.VerifyNone && *verify != chunkstore.VerifyLazy && *verify != chunkstore.VerifyStrict {
+		return fmt.Errorf("-verify must be %q, %q, or %q", chunkstore.VerifyNone, chunkstore.VerifyLazy, chunkstore.VerifyStrict)
+	}
+
+	if *rw && *overlayDir == "" {
+		return errors.New("-rw requires -overlay to be specified")
+	}
+
+	if *remoteSource == "rbe" && *casInstance == "" {
+		return errors.New("-remote-source=rbe requires -cas-instance to be specified")
+	}
+	cacheBytes, err := parseSize(*cacheSize)
+	if err != nil {
+		return fmt.Errorf("-cache-size: %v", err)
+	}
+	if cacheBytes > 0 {
+		if *remoteSource == "" {
+			return errors.New("-cache-size > 0 requires -remote-source to be specified")
+		}
+		if *cacheDir == "" {
+			return errors.New("-cache-size > 0 requires -cache-dir to be specified")
+		}
+	}
+
+	return nil
+}
+
+// newRemoteChunkSource builds the chunkstore.ChunkSource *remoteSource
+// selects ("rbe", an http(s):// base URL, or another local directory; see
+// the -remote-source flag), wrapped in a CachingChunkSource when
+// -cache-size > 0.
+func newRemoteChunkSource(ctx context.Context) (chunkstore.ChunkSource, error) {
+	var source chunkstore.ChunkSource
+	switch {
+	case *remoteSource == "rbe":
+		log.Infof("Connecting to RBE instance %q at %s...", *casInstance, *casAddr)
+		rbeClient, err := rbeclient.New(ctx, rbeclient.Opts{
+			Instance:              *casInstance,
+			ServiceAddress:        *casAddr,
+			ServiceAccountJSON:    *serviceAccount,
+			UseApplicationDefault: *useADC,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create RBE client: %w", err)
+		}
+		source = chunkstore.NewRBEChunkSource(ctx, rbeClient)
+	case strings.HasPrefix(*remoteSource, "http://") || strings.HasPrefix(*remoteSource, "https://"):
+		source = chunkstore.NewHTTPChunkSource(*remoteSource, nil)
+	default:
+		source = chunkstore.NewLocalChunkSource(*remoteSource)
+	}
+
+	cacheBytes, err := parseSize(*cacheSize)
+	if err != nil {
+		return nil, err
+	}
+	if cacheBytes <= 0 {
+		return source, nil
+	}
+	log.Infof("Caching chunks fetched from %s under %s (up to %s)...", *remoteSource, *cacheDir, *cacheSize)
+	return chunkstore.NewCachingChunkSource(source, *cacheDir, cacheBytes)
+}
+
+// prewarmFromHintsFile parses hintsPath as a --prefetch-hints landmark
+// file (see chunkstore.ParseHints) and kicks off store.Prewarm for it.
+func prewarmFromHintsFile(store *chunkstore.ChunkStore, hintsPath string) error {
+	f, err := os.Open(hintsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open -prefetch-hints file: %w", err)
+	}
+	defer f.Close()
+	hints, err := chunkstore.ParseHints(f)
+	if err != nil {
+		return fmt.Errorf("failed to parse -prefetch-hints file: %w", err)
+	}
+	log.Infof("Prewarming %d prefetch hint(s) from %s...", len(hints), hintsPath)
+	store.Prewarm(hints)
 	return nil
 }
 
@@ -65,6 +283,13 @@ func logToDir(dir string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		if err := runGC(os.Args[2:]); err != nil {
+			log.Exit(err)
+		}
+		return
+	}
+
 	// Parse command line arguments
 	flag.Set("silent_init", "true")
 	flag.Set("logalsotostderr", "true")
@@ -90,13 +315,88 @@ func main() {
 	}
 
 	log.Info("Creating new ChunkStore...")
-	store, err := chunkstore.NewChunkStore(*chunkDir, *indexPath)
+	opts := chunkstore.DefaultOptions()
+	opts.Verify = *verify
+	opts.PrefetchAhead = *prefetchWindow
+	opts.PrefetchWorkers = *prefetchMaxInflight
+	opts.AllowSymlinks = *allowSymlinks
+	opts.MaxPathDepth = *maxPathDepth
+	opts.MaxPathBytes = *maxPathBytes
+	if *remoteSource != "" {
+		source, err := newRemoteChunkSource(context.Background())
+		if err != nil {
+			log.Exit(err)
+		}
+		opts.Source = source
+	}
+	store, err := chunkstore.NewChunkStoreWithOptions(*chunkDir, *indexPath, opts)
 	if err != nil {
 		log.Exit(err)
 	}
 
-	log.Info("Creating new FastCDCFS...")
-	fs := fuse.NewFastCDCFS(store)
+	if *prefetchHints != "" {
+		if err := prewarmFromHintsFile(store, *prefetchHints); err != nil {
+			log.Exit(err)
+		}
+	}
+
+	var fs *fuse.FastCDCFS
+	var commitClient *client.Client
+	if *rw {
+		log.Infof("Creating overlay at %s...", *overlayDir)
+		ov, err := overlay.New(store, *overlayDir, *overlayChunkSizeKb)
+		if err != nil {
+			log.Exit(err)
+		}
+		log.Info("Creating new writable FastCDCFS...")
+		fs = fuse.NewFastCDCFSWithOverlay(store, ov)
+
+		if *casInstance != "" {
+			log.Infof("Connecting to RBE instance %q at %s for commits...", *casInstance, *casAddr)
+			commitClient, err = rbeclient.New(context.Background(), rbeclient.Opts{
+				Instance:              *casInstance,
+				ServiceAddress:        *casAddr,
+				ServiceAccountJSON:    *serviceAccount,
+				UseApplicationDefault: *useADC,
+			})
+			if err != nil {
+				log.Exit(fmt.Errorf("failed to create RBE client for commits: %w", err))
+			}
+		}
+	} else {
+		log.Info("Creating new FastCDCFS...")
+		fs = fuse.NewFastCDCFS(store)
+	}
+
+	var ctrlServer *controlsock.Server
+	if *controlSocket != "" {
+		var err error
+		ctrlServer, err = controlsock.Listen(*controlSocket, store, *indexPath, fs, commitClient)
+		if err != nil {
+			log.Exit(err)
+		}
+		go func() {
+			if err := ctrlServer.Serve(); err != nil {
+				log.Infof("Control socket stopped serving: %v", err)
+			}
+		}()
+		log.Infof("Serving runtime control protocol on %s", *controlSocket)
+	}
+
+	if *healthAddr != "" {
+		registry := health.NewRegistry()
+		registry.RegisterPeriodic("index_file", *healthCheckInterval, health.IndexFileChecker(*indexPath))
+		registry.RegisterPeriodic("chunk_sampling", *healthCheckInterval, health.ChunkSamplingChecker(store, *healthSampleSize))
+		registry.RegisterPeriodic("mount", *healthCheckInterval, health.MountChecker(*mountPoint))
+		registry.RegisterPeriodic("read_error_rate", *healthCheckInterval, health.ReadErrorRateChecker(store, *healthMaxVerifyFails))
+		healthServer := &http.Server{Addr: *healthAddr, Handler: registry}
+		go func() {
+			if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Warningf("Health check server stopped: %v", err)
+			}
+		}()
+		log.Infof("Serving health checks on %s", *healthAddr)
+	}
 
 	log.Infof("Mounting filesystem at %s...", *mountPoint)
 	server, err := fs.Mount(*mountPoint)
@@ -128,5 +428,15 @@ func main() {
 
 	// Wait for unmount
 	server.Wait()
+	if ctrlServer != nil {
+		ctrlServer.Close()
+	}
+	if *rw {
+		if err := fs.WriteDeltaIndex(); err != nil {
+			log.Infof("Failed to write overlay delta index: %v", err)
+		}
+	}
+	stats := store.PrefetchStats()
+	log.Infof("Prefetch stats: %d hits, %d misses", stats.Hits, stats.Misses)
 	log.Infof("Successfully unmounted FastCDC-FUSE at: %s", *mountPoint)
 }
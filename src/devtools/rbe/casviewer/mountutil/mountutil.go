@@ -9,7 +9,9 @@ import (
 
 	"path/filepath"
 
+	"github.com/bazelbuild/remote-apis-sdks/go/pkg/digest"
 	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore"
 )
 
 // ValidateMountPoint validates the mount point directory exists and is empty.
@@ -61,3 +63,16 @@ func DefaultIndexFile(chunkDir string) (string, error) {
 
 	return "", nil // No default index file found in any location.
 }
+
+// ChecksumWildcard opens the chunk store described by chunkDir and indexPath
+// and returns the digest covering every mounted file whose path matches the
+// doublestar-style glob pattern (see chunkstore.ChunkStore.ChecksumWildcard).
+// It's a thin passthrough so callers that only have the store's on-disk
+// location (e.g. a CLI flag) don't need to construct a ChunkStore themselves.
+func ChecksumWildcard(chunkDir, indexPath, pattern string, followLinks bool) (digest.Digest, error) {
+	store, err := chunkstore.NewChunkStore(chunkDir, indexPath)
+	if err != nil {
+		return digest.Digest{}, fmt.Errorf("failed to open chunk store at %s: %v", indexPath, err)
+	}
+	return store.ChecksumWildcard(pattern, followLinks)
+}
@@ -0,0 +1,360 @@
+// Package overlay implements a writable copy-on-write layer on top of a
+// read-only chunkstore.ChunkStore, for the FUSE filesystem's --rw mode (see
+// fuse.NewFastCDCFSWithOverlay). A write to a file re-chunks its whole
+// current content with FastCDC into the overlay's own chunk directory:
+// since FastCDC's chunk boundaries are content-defined, the byte ranges a
+// write didn't touch still hash to, and are stored as, the same chunks the
+// base ChunkStore already has — only the genuinely modified or appended
+// ranges end up as new chunk files. This keeps Overlay simple (every
+// written-to file's current chunk list lives entirely in the overlay, with
+// no need to track which physical directory each ChunkInfo came from) while
+// still getting FastCDC's normal dedup benefit for the unmodified parts.
+package overlay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/google/device-infra/src/devtools/rbe/casviewer/chunkstore"
+)
+
+// ChunksDirName is the subdirectory of an Overlay's dir holding chunk
+// files freshly written by re-chunking, mirroring chunkerutil.ChunksDirName
+// for the base store.
+const ChunksDirName = "chunks"
+
+// scratchDirName is the subdirectory of an Overlay's dir holding, per
+// file, a full materialized copy of its current content, used to apply a
+// write and then re-chunk.
+const scratchDirName = "scratch"
+
+// DeltaIndexFileName is the file Write writes, describing how the overlay
+// differs from the base ChunkStore it sits on top of.
+const DeltaIndexFileName = "_overlay_delta.json"
+
+// Entry is one file's current state in the overlay, and also the shape an
+// added or modified file takes in a DeltaIndex.
+type Entry struct {
+	Path    string              `json:"path"`
+	ModTime time.Time           `json:"mod_time"`
+	Mode    os.FileMode         `json:"mode"`
+	Size    int64               `json:"size"`
+	Chunks  []chunker.ChunkInfo `json:"chunks"`
+}
+
+// DeltaIndex describes how an Overlay's writes differ from the base
+// chunkstore.ChunkStore it was created over, so they can be promoted into a
+// new snapshot (e.g. via chunkerutil.CreateIndexFile).
+type DeltaIndex struct {
+	Added    []Entry  `json:"added"`
+	Modified []Entry  `json:"modified"`
+	Deleted  []string `json:"deleted"`
+}
+
+// Overlay is a copy-on-write writable layer over a base ChunkStore. It's
+// safe for concurrent use.
+type Overlay struct {
+	base           *chunkstore.ChunkStore
+	dir            string
+	chunksDir      string
+	avgChunkSizeKB int
+
+	mu      sync.Mutex
+	entries map[string]*Entry // path -> current overlay state, once first touched.
+	deleted map[string]bool
+}
+
+// New creates an Overlay rooted at dir (created if it doesn't exist yet)
+// capturing writes against base. avgChunkSizeKB is passed through to
+// chunker.ChunkFileWithCompression when re-chunking a written-to file.
+func New(base *chunkstore.ChunkStore, dir string, avgChunkSizeKB int) (*Overlay, error) {
+	chunksDir := filepath.Join(dir, ChunksDirName)
+	if err := os.MkdirAll(chunksDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create overlay chunks dir: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, scratchDirName), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create overlay scratch dir: %w", err)
+	}
+	return &Overlay{
+		base:           base,
+		dir:            dir,
+		chunksDir:      chunksDir,
+		avgChunkSizeKB: avgChunkSizeKB,
+		entries:        map[string]*Entry{},
+		deleted:        map[string]bool{},
+	}, nil
+}
+
+// scratchPath returns where path's full-content scratch copy lives, used
+// to apply a write and then re-chunk.
+func (o *Overlay) scratchPath(path string) string {
+	return filepath.Join(o.dir, scratchDirName, filepath.FromSlash(path))
+}
+
+// Stat returns path's current Entry: the overlay's own copy-on-write state
+// if path has been touched, or a freshly-constructed one from the base
+// ChunkStore otherwise. It reports os.ErrNotExist if path doesn't exist in
+// either the overlay or the base store, or has been deleted in the overlay.
+func (o *Overlay) Stat(path string) (*Entry, error) {
+	o.mu.Lock()
+	if e, ok := o.entries[path]; ok {
+		o.mu.Unlock()
+		return e, nil
+	}
+	deleted := o.deleted[path]
+	o.mu.Unlock()
+	if deleted {
+		return nil, os.ErrNotExist
+	}
+
+	file, err := o.base.GetFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Path: path, ModTime: file.ModTime, Mode: baseMode(file), Size: file.Size, Chunks: chunkerChunks(file.Chunks)}, nil
+}
+
+// Read reads path's content at offset into dest, returning the number of
+// bytes read, like chunkstore.ChunkStore.ReadFileToDest. Files untouched in
+// the overlay are simply read through to the base store; touched files are
+// read from the overlay's own re-chunked copy of their content.
+func (o *Overlay) Read(path string, dest []byte, offset int64) (int, error) {
+	o.mu.Lock()
+	_, touched := o.entries[path]
+	o.mu.Unlock()
+	if !touched {
+		return o.base.ReadFileToDest(path, dest, offset)
+	}
+
+	f, err := os.Open(o.scratchPath(path))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(dest, offset)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Write applies data at offset to path, materializing its current content
+// into the overlay's scratch dir on first write, then re-chunking the
+// result and updating path's Entry. It creates path if it doesn't already
+// exist in the overlay or the base store.
+func (o *Overlay) Write(path string, data []byte, offset int64) (int, error) {
+	if err := o.materialize(path); err != nil {
+		return 0, err
+	}
+
+	scratch := o.scratchPath(path)
+	f, err := os.OpenFile(scratch, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open overlay scratch file for %s: %w", path, err)
+	}
+	defer f.Close()
+	n, err := f.WriteAt(data, offset)
+	if err != nil {
+		return n, fmt.Errorf("failed to write overlay scratch file for %s: %w", path, err)
+	}
+
+	return n, o.rechunk(path, scratch)
+}
+
+// Truncate resizes path to size, materializing it into the overlay first
+// if needed, and updates its Entry.
+func (o *Overlay) Truncate(path string, size int64) error {
+	if err := o.materialize(path); err != nil {
+		return err
+	}
+	scratch := o.scratchPath(path)
+	if err := os.Truncate(scratch, size); err != nil {
+		return fmt.Errorf("failed to truncate overlay scratch file for %s: %w", path, err)
+	}
+	return o.rechunk(path, scratch)
+}
+
+// Create adds an empty file at path with the given mode, overriding any
+// prior deletion of path.
+func (o *Overlay) Create(path string, mode os.FileMode) error {
+	scratch := o.scratchPath(path)
+	if err := os.MkdirAll(filepath.Dir(scratch), 0755); err != nil {
+		return fmt.Errorf("failed to create overlay scratch dir for %s: %w", path, err)
+	}
+	if err := os.WriteFile(scratch, nil, 0644); err != nil {
+		return fmt.Errorf("failed to create overlay scratch file for %s: %w", path, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.deleted, path)
+	o.entries[path] = &Entry{Path: path, ModTime: time.Now(), Mode: mode, Chunks: []chunker.ChunkInfo{}}
+	return nil
+}
+
+// Delete marks path as removed, so Stat and the eventual DeltaIndex report
+// it as deleted even if it still exists in the base ChunkStore.
+func (o *Overlay) Delete(path string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.entries, path)
+	o.deleted[path] = true
+}
+
+// Rename moves oldPath to newPath, materializing oldPath first if it
+// hasn't been touched yet. oldPath is left marked deleted; newPath is
+// re-chunked so its Entry (and the eventual DeltaIndex) reflect its
+// content under its new name.
+func (o *Overlay) Rename(oldPath, newPath string) error {
+	if err := o.materialize(oldPath); err != nil {
+		return err
+	}
+
+	oldScratch := o.scratchPath(oldPath)
+	newScratch := o.scratchPath(newPath)
+	if err := os.MkdirAll(filepath.Dir(newScratch), 0755); err != nil {
+		return fmt.Errorf("failed to create overlay scratch dir for %s: %w", newPath, err)
+	}
+	if err := os.Rename(oldScratch, newScratch); err != nil {
+		return fmt.Errorf("failed to rename overlay scratch file %s to %s: %w", oldPath, newPath, err)
+	}
+
+	o.mu.Lock()
+	delete(o.entries, oldPath)
+	o.deleted[oldPath] = true
+	o.mu.Unlock()
+
+	return o.rechunk(newPath, newScratch)
+}
+
+// materialize copies path's current content (from the overlay if already
+// touched, otherwise read through the base store) into its scratch file,
+// if that hasn't already happened.
+func (o *Overlay) materialize(path string) error {
+	scratch := o.scratchPath(path)
+	if _, err := os.Stat(scratch); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to stat overlay scratch file for %s: %w", path, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(scratch), 0755); err != nil {
+		return fmt.Errorf("failed to create overlay scratch dir for %s: %w", path, err)
+	}
+
+	file, err := o.base.GetFile(path)
+	if err != nil {
+		if err == os.ErrNotExist {
+			return os.WriteFile(scratch, nil, 0644)
+		}
+		return err
+	}
+
+	out, err := os.Create(scratch)
+	if err != nil {
+		return fmt.Errorf("failed to create overlay scratch file for %s: %w", path, err)
+	}
+	defer out.Close()
+
+	buf := make([]byte, 1<<20)
+	for off := int64(0); off < file.Size; {
+		n, err := o.base.ReadFileToDest(path, buf, off)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to materialize %s into overlay: %w", path, err)
+		}
+		if n == 0 {
+			break
+		}
+		if _, err := out.Write(buf[:n]); err != nil {
+			return fmt.Errorf("failed to materialize %s into overlay: %w", path, err)
+		}
+		off += int64(n)
+	}
+
+	o.mu.Lock()
+	delete(o.deleted, path)
+	o.entries[path] = &Entry{Path: path, ModTime: file.ModTime, Mode: baseMode(file)}
+	o.mu.Unlock()
+	return nil
+}
+
+// rechunk re-splits scratch with FastCDC into o.chunksDir and updates
+// path's Entry with the resulting chunk list, size, and mod time.
+func (o *Overlay) rechunk(path, scratch string) error {
+	chunks, err := chunker.ChunkFile(scratch, o.chunksDir, o.avgChunkSizeKB)
+	if err != nil {
+		return fmt.Errorf("failed to re-chunk %s: %w", path, err)
+	}
+	stat, err := os.Stat(scratch)
+	if err != nil {
+		return fmt.Errorf("failed to stat overlay scratch file for %s: %w", path, err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e, ok := o.entries[path]
+	if !ok {
+		e = &Entry{Path: path, Mode: 0644}
+		o.entries[path] = e
+	}
+	e.Chunks = chunks
+	e.Size = stat.Size()
+	e.ModTime = time.Now()
+	delete(o.deleted, path)
+	return nil
+}
+
+// DeltaIndex returns how the overlay currently differs from the base
+// ChunkStore it was created over: files touched since New that have no
+// base entry are Added, files touched that do have a base entry are
+// Modified, and paths passed to Delete are Deleted.
+func (o *Overlay) DeltaIndex() DeltaIndex {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var delta DeltaIndex
+	for path, e := range o.entries {
+		if _, err := o.base.GetFile(path); err == nil {
+			delta.Modified = append(delta.Modified, *e)
+		} else {
+			delta.Added = append(delta.Added, *e)
+		}
+	}
+	for path := range o.deleted {
+		delta.Deleted = append(delta.Deleted, path)
+	}
+	return delta
+}
+
+// WriteDeltaIndex writes the overlay's current DeltaIndex as JSON to
+// DeltaIndexFileName under its dir, meant to be called on unmount.
+func (o *Overlay) WriteDeltaIndex() error {
+	data, err := json.MarshalIndent(o.DeltaIndex(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal overlay delta index: %w", err)
+	}
+	return os.WriteFile(filepath.Join(o.dir, DeltaIndexFileName), data, 0644)
+}
+
+// baseMode extracts the os.FileMode permission bits from a base ChunkStore
+// file's fuse mode; the overlay only tracks plain files, so file-type bits
+// (which fuseMode also carries) aren't needed here.
+func baseMode(file *chunkstore.FileInfo) os.FileMode {
+	return os.FileMode(file.Mode) & os.ModePerm
+}
+
+// chunkerChunks strips a ChunkStore's chunkstore.ChunkInfo wrapper down to
+// the underlying chunker.ChunkInfo, for Stat's synthesized Entry.
+func chunkerChunks(chunks []chunkstore.ChunkInfo) []chunker.ChunkInfo {
+	out := make([]chunker.ChunkInfo, len(chunks))
+	for i, c := range chunks {
+		out[i] = c.ChunkInfo
+	}
+	return out
+}
@@ -0,0 +1,120 @@
+package overlay
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunker"
+	"github.com/google/device-infra/src/devtools/rbe/casuploader/chunkerutil"
+)
+
+// Snapshot merges the base ChunkStore with every add, modification, and
+// deletion this Overlay has recorded since New into a fresh, self-contained
+// chunkDir under dir (created if it doesn't exist): every live file is
+// chunked into dir, and chunkerutil.CreateIndexFile writes dir's
+// _chunks_index.json describing them. The result can be mounted standalone
+// via chunkstore.NewChunkStore(dir, ...), with no dependency on the
+// original base ChunkStore, chunkDir, or this Overlay's own scratch and
+// chunks dirs.
+//
+// Unlike FastCDCFS.Commit, which uploads each live file as a single
+// whole-file CAS blob (CAS already dedups, so re-chunking would only cost
+// time), Snapshot re-chunks every live file with FastCDC: a remountable
+// chunkDir has to be one self-contained directory, and there's no single
+// existing directory to copy the base store's untouched chunk files from,
+// since chunkstore.ChunkStore doesn't expose its ChunkSource's backing
+// path.
+func (o *Overlay) Snapshot(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+
+	delta := o.DeltaIndex()
+	deleted := make(map[string]bool, len(delta.Deleted))
+	for _, path := range delta.Deleted {
+		deleted[path] = true
+	}
+	touched := make(map[string]bool, len(delta.Added)+len(delta.Modified))
+	for _, e := range delta.Added {
+		touched[e.Path] = true
+	}
+	for _, e := range delta.Modified {
+		touched[e.Path] = true
+	}
+
+	var index []chunkerutil.ChunksIndex
+	for _, file := range o.base.GetFiles() {
+		if deleted[file.Path] || touched[file.Path] {
+			continue
+		}
+		idx, err := o.snapshotBaseFile(dir, file.Path)
+		if err != nil {
+			return err
+		}
+		index = append(index, idx)
+	}
+	for _, e := range append(append([]Entry{}, delta.Added...), delta.Modified...) {
+		idx, err := o.snapshotOverlayFile(dir, e)
+		if err != nil {
+			return err
+		}
+		index = append(index, idx)
+	}
+
+	return chunkerutil.CreateIndexFile(dir, index, o.avgChunkSizeKB)
+}
+
+// snapshotBaseFile re-chunks path's content, read through to the base
+// ChunkStore since it was never touched in the overlay, into dir.
+func (o *Overlay) snapshotBaseFile(dir, path string) (chunkerutil.ChunksIndex, error) {
+	file, err := o.base.GetFile(path)
+	if err != nil {
+		return chunkerutil.ChunksIndex{}, fmt.Errorf("failed to stat base file %s: %w", path, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "snapshot-*")
+	if err != nil {
+		return chunkerutil.ChunksIndex{}, fmt.Errorf("failed to create snapshot temp file for %s: %w", path, err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	buf := make([]byte, 1<<20)
+	for off := int64(0); off < file.Size; {
+		n, err := o.base.ReadFileToDest(path, buf, off)
+		if err != nil && err != io.EOF {
+			tmp.Close()
+			return chunkerutil.ChunksIndex{}, fmt.Errorf("failed to read base file %s: %w", path, err)
+		}
+		if n == 0 {
+			break
+		}
+		if _, err := tmp.Write(buf[:n]); err != nil {
+			tmp.Close()
+			return chunkerutil.ChunksIndex{}, fmt.Errorf("failed to materialize base file %s: %w", path, err)
+		}
+		off += int64(n)
+	}
+	if err := tmp.Close(); err != nil {
+		return chunkerutil.ChunksIndex{}, fmt.Errorf("failed to materialize base file %s: %w", path, err)
+	}
+
+	chunks, err := chunker.ChunkFile(tmpPath, dir, o.avgChunkSizeKB)
+	if err != nil {
+		return chunkerutil.ChunksIndex{}, fmt.Errorf("failed to chunk base file %s into snapshot: %w", path, err)
+	}
+	return chunkerutil.ChunksIndex{Path: path, ModTime: file.ModTime, Mode: baseMode(file), Chunks: chunks}, nil
+}
+
+// snapshotOverlayFile re-chunks e's content, already materialized at its
+// overlay scratch path by a prior Write, Truncate, Create, or Rename, into
+// dir.
+func (o *Overlay) snapshotOverlayFile(dir string, e Entry) (chunkerutil.ChunksIndex, error) {
+	chunks, err := chunker.ChunkFile(o.scratchPath(e.Path), dir, o.avgChunkSizeKB)
+	if err != nil {
+		return chunkerutil.ChunksIndex{}, fmt.Errorf("failed to chunk overlay file %s into snapshot: %w", e.Path, err)
+	}
+	return chunkerutil.ChunksIndex{Path: e.Path, ModTime: e.ModTime, Mode: e.Mode, Chunks: chunks}, nil
+}
+